@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// queueAckTimeout bounds the wait for Loki to store the entries of one queue receive
+// Messages that are not acknowledged in time stay in their queue and are redelivered
+const queueAckTimeout = time.Minute
+
+// deliverAndWait queues entries for the batchers, blocking while a shard is full, and
+// waits until Loki stored all of them; queue consumers remove messages only after that
+func deliverAndWait(ctx context.Context, entryQueue *batch.EntryQueue, deliveries *DeliveryTracker, entries []LogEntry, timeout time.Duration) error {
+	ack := batch.NewDeliveryAck()
+	for _, entry := range entries {
+		entry.Ack = ack
+		ack.Add()
+		select {
+		case entryQueue.For(entry) <- entry:
+			deliveries.Track(entry, entry.Labels["tenant_name"], deliveryQueued)
+		case <-ctx.Done():
+			ack.Done(ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return ack.Wait(waitCtx)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenantActivity is when a tenant delivered and whether it went silent
+type tenantActivity struct {
+	firstSeen  time.Time
+	lastSeen   time.Time
+	deliveries int64
+	stale      bool
+}
+
+// TenantActivity records when each tenant last delivered logs and reports tenants that went
+// silent, the most common sign of an Auth0 stream that broke without anyone noticing
+type TenantActivity struct {
+	staleAfter time.Duration // Silence after which a tenant is stale (0 disables the check)
+	metrics    *Metrics
+	logger     *slog.Logger
+	now        func() time.Time
+
+	mu      sync.Mutex
+	tenants map[string]*tenantActivity
+}
+
+// NewTenantActivity creates a tracker; staleAfter 0 records activity without staleness checks
+func NewTenantActivity(staleAfter time.Duration, metrics *Metrics, logger *slog.Logger) *TenantActivity {
+	return &TenantActivity{
+		staleAfter: staleAfter,
+		metrics:    metrics,
+		logger:     logger,
+		now:        time.Now,
+		tenants:    make(map[string]*tenantActivity),
+	}
+}
+
+// Seen records an authenticated delivery of a tenant
+func (a *TenantActivity) Seen(tenant string) {
+	if a == nil {
+		return
+	}
+	now := a.now()
+
+	a.mu.Lock()
+	activity, ok := a.tenants[tenant]
+	if !ok {
+		activity = &tenantActivity{firstSeen: now}
+		a.tenants[tenant] = activity
+	}
+	silence := now.Sub(activity.lastSeen)
+	resumed := activity.stale
+	activity.lastSeen = now
+	activity.deliveries++
+	activity.stale = false
+	a.mu.Unlock()
+
+	a.metrics.tenantLastSeen.Set(float64(now.Unix()), tenant)
+	if resumed {
+		a.logger.Info("Tenant resumed streaming",
+			"tenant", tenant,
+			"silent_for", silence.Round(time.Second).String(),
+		)
+	}
+}
+
+// Stale returns the number of tenants that are currently silent
+func (a *TenantActivity) Stale() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stale := 0
+	for _, activity := range a.tenants {
+		if activity.stale {
+			stale++
+		}
+	}
+	return stale
+}
+
+// check marks tenants that were streaming but stayed silent for staleAfter, logging each once
+func (a *TenantActivity) check() {
+	now := a.now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for tenant, activity := range a.tenants {
+		if activity.stale || now.Sub(activity.lastSeen) < a.staleAfter {
+			continue
+		}
+		activity.stale = true
+		a.metrics.tenantsGoneStale.Inc(tenant)
+		a.logger.Warn("Tenant stopped streaming",
+			"tenant", tenant,
+			"last_seen", activity.lastSeen.UTC().Format(time.RFC3339),
+			"silent_for", now.Sub(activity.lastSeen).Round(time.Second).String(),
+		)
+	}
+}
+
+// RunStalenessCheck periodically looks for silent tenants until the context is cancelled
+func (a *TenantActivity) RunStalenessCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.check()
+		}
+	}
+}
+
+// ServeHTTP serves GET /stats, the last delivery of every tenant
+func (a *TenantActivity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := a.now()
+
+	a.mu.Lock()
+	tenants := make([]TenantStats, 0, len(a.tenants))
+	for tenant, activity := range a.tenants {
+		tenants = append(tenants, TenantStats{
+			Tenant:        tenant,
+			FirstSeen:     activity.firstSeen.UTC(),
+			LastSeen:      activity.lastSeen.UTC(),
+			SecondsSilent: int64(now.Sub(activity.lastSeen).Seconds()),
+			Deliveries:    activity.deliveries,
+			Stale:         activity.stale,
+		})
+	}
+	a.mu.Unlock()
+	slices.SortFunc(tenants, func(x, y TenantStats) int {
+		return strings.Compare(x.Tenant, y.Tenant)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatsResponse{
+		StaleAfterSeconds: int64(a.staleAfter.Seconds()),
+		Tenants:           tenants,
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// requireAdminToken guards the admin listener: requests that change state (any method but GET,
+// HEAD and OPTIONS), such as purging the dead-letter queue or draining, need ADMIN_TOKEN as a
+// bearer token, and are refused while none is configured
+// Reads are left alone, since /admin/tail and /admin/recent carry the tenant's token
+func requireAdminToken(next http.Handler, token string, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			writeJSONErrorDetail(w, http.StatusForbidden, "admin_token_not_configured",
+				"set ADMIN_TOKEN to enable admin requests that change state")
+			return
+		}
+		presented, err := bearerToken(r)
+		if err != nil || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			logger.Warn("Rejected admin request without a valid admin token",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"remote_addr", r.RemoteAddr,
+			)
+			writeJSONError(w, http.StatusUnauthorized, "invalid_admin_token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logLookupTimeout bounds the Loki query made by a log lookup
+const logLookupTimeout = 15 * time.Second
+
+// LogLookupHandler serves GET /admin/logs/{log_id}, answering whether a given
+// Auth0 event was received and delivered
+type LogLookupHandler struct {
+	deliveries  *DeliveryTracker
+	lokiClient  *loki.Client
+	serviceName string
+	lookback    time.Duration // How far back Loki is searched (0 disables the Loki search)
+	orgIDs      *OrgIDMap     // Loki tenant searched for the entry's tenant
+	logger      *slog.Logger
+}
+
+// NewLogLookupHandler creates a log lookup handler
+func NewLogLookupHandler(deliveries *DeliveryTracker, lokiClient *loki.Client, serviceName string, lookback time.Duration, orgIDs *OrgIDMap, logger *slog.Logger) *LogLookupHandler {
+	return &LogLookupHandler{
+		deliveries:  deliveries,
+		lokiClient:  lokiClient,
+		serviceName: serviceName,
+		lookback:    lookback,
+		orgIDs:      orgIDs,
+		logger:      logger,
+	}
+}
+
+// ServeHTTP looks up the log entry in memory and in Loki
+func (h *LogLookupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logID := r.PathValue("log_id")
+	if logID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_log_id")
+		return
+	}
+
+	resp := LogLookupResponse{LogID: logID}
+
+	if record, ok := h.deliveries.Lookup(logID); ok {
+		resp.Recent = &record
+		resp.Found = true
+	}
+
+	// Search Loki unless memory already shows the entry as delivered
+	if h.lookback > 0 && (resp.Recent == nil || resp.Recent.Status != deliveryDelivered) {
+		// The tenant selects the Loki tenant to search; memory knows it for recent entries
+		tenant := r.URL.Query().Get("tenant")
+		if tenant == "" && resp.Recent != nil {
+			tenant = resp.Recent.Tenant
+		}
+		resp.Loki = h.searchLoki(r.Context(), h.orgIDs.For(tenant), logID)
+		if resp.Loki.Found {
+			resp.Found = true
+		}
+	}
+
+	h.logger.Debug("Log lookup",
+		"log_id", logID,
+		"found", resp.Found,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Found {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// searchLoki queries the service's streams for a line containing the log ID
+func (h *LogLookupHandler) searchLoki(ctx context.Context, orgID, logID string) *LokiLookupState {
+	state := &LokiLookupState{Searched: h.lookback.String()}
+
+	ctx, cancel := context.WithTimeout(ctx, logLookupTimeout)
+	defer cancel()
+
+	end := time.Now()
+	selector := "{service_name=" + strconv.Quote(h.serviceName) + "}"
+	match, err := h.lokiClient.FindLine(ctx, orgID, selector, `"`+logID+`"`, end.Add(-h.lookback), end)
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	if match != nil {
+		state.Found = true
+		state.Timestamp = &match.Timestamp
+		state.Labels = match.Labels
+	}
+	return state
+}
+
+// maxDeadLetterSelectionBytes bounds the body of a replay or purge request
+const maxDeadLetterSelectionBytes = 1 << 20
+
+// DeadLetterHandler serves the /admin/dlq endpoints, listing, previewing, replaying and purging
+// the batches Loki did not accept
+type DeadLetterHandler struct {
+	deadLetter *DeadLetterQueue
+	entryQueue *batch.EntryQueue
+	logger     *slog.Logger
+}
+
+// NewDeadLetterHandler creates a dead-letter handler replaying into entryQueue
+func NewDeadLetterHandler(deadLetter *DeadLetterQueue, entryQueue *batch.EntryQueue, logger *slog.Logger) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		deadLetter: deadLetter,
+		entryQueue: entryQueue,
+		logger:     logger,
+	}
+}
+
+// List serves GET /admin/dlq
+func (h *DeadLetterHandler) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.deadLetter.List())
+}
+
+// Get serves GET /admin/dlq/{id}
+func (h *DeadLetterHandler) Get(w http.ResponseWriter, r *http.Request) {
+	batch, err := h.deadLetter.Entries(r.PathValue("id"))
+	if errors.Is(err, errDeadLetterNotFound) {
+		writeJSONError(w, http.StatusNotFound, "batch_not_found")
+		return
+	}
+	if err != nil {
+		writeJSONErrorDetail(w, http.StatusInternalServerError, "read_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// Replay serves POST /admin/dlq/replay
+func (h *DeadLetterHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	selection, ok := h.readSelection(w, r)
+	if !ok {
+		return
+	}
+	result, err := h.deadLetter.Replay(r.Context(), selection, h.entryQueue)
+	h.logger.Info("Replayed dead-lettered batches",
+		"batches", result.Batches,
+		"entries", result.Entries,
+		"not_found", len(result.NotFound),
+		"error", err,
+	)
+	if err != nil {
+		if errors.Is(err, errDeadLetterClosed) || errors.Is(err, context.Canceled) {
+			writeJSONErrorDetail(w, http.StatusServiceUnavailable, "replay_interrupted", err.Error())
+			return
+		}
+		writeJSONErrorDetail(w, http.StatusInternalServerError, "replay_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Purge serves POST /admin/dlq/purge
+func (h *DeadLetterHandler) Purge(w http.ResponseWriter, r *http.Request) {
+	selection, ok := h.readSelection(w, r)
+	if !ok {
+		return
+	}
+	result, err := h.deadLetter.Purge(selection)
+	h.logger.Info("Purged dead-lettered batches",
+		"batches", result.Batches,
+		"entries", result.Entries,
+		"not_found", len(result.NotFound),
+		"error", err,
+	)
+	if err != nil {
+		writeJSONErrorDetail(w, http.StatusInternalServerError, "purge_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// readSelection decodes the batches and entries a request selects, answering 400 if there are none
+func (h *DeadLetterHandler) readSelection(w http.ResponseWriter, r *http.Request) (DeadLetterSelection, bool) {
+	var selection DeadLetterSelection
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDeadLetterSelectionBytes)).Decode(&selection); err != nil {
+		writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_selection", err.Error())
+		return selection, false
+	}
+	if !selection.All && len(selection.IDs) == 0 && len(selection.Entries) == 0 {
+		writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_selection", `select batches with "ids" or "all": true, or entries with "entries"`)
+		return selection, false
+	}
+	for _, selected := range selection.Entries {
+		if selected.ID == "" || len(selected.Indexes) == 0 {
+			writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_selection", `each of "entries" needs an "id" and "indexes"`)
+			return selection, false
+		}
+	}
+	return selection, true
+}
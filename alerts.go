@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert target kinds
+const (
+	alertSlack     = "slack"
+	alertPagerDuty = "pagerduty"
+	alertWebhook   = "webhook"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint, used when a pagerduty target has no URL
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// alertQueueSize bounds the alerts waiting to be sent; further alerts are dropped
+const alertQueueSize = 1000
+
+// alertSendTimeout bounds one notification
+const alertSendTimeout = 10 * time.Second
+
+// AlertRule fires a notification for Auth0 events matching all of its conditions
+type AlertRule struct {
+	Name            string            `json:"name"`             // Used in notifications, logs and metrics
+	Types           []string          `json:"types"`            // Auth0 event types (empty matches any)
+	Tenants         []string          `json:"tenants"`          // Tenants (empty matches any)
+	Fields          map[string]string `json:"fields"`           // Event paths and the values they must have
+	Target          AlertTarget       `json:"target"`           // Where the notification goes
+	CooldownSeconds *int              `json:"cooldown_seconds"` // Per dedup key, suppresses repeats (default 300, 0 sends every match)
+	DedupPath       string            `json:"dedup_path"`       // Event path added to the dedup key (tenant and type by default)
+	MaxPerHour      int               `json:"max_per_hour"`     // Notifications per hour of the rule (0 = unlimited)
+	Severity        string            `json:"severity"`         // PagerDuty severity (critical, error, warning or info; default warning)
+}
+
+// AlertTarget is a Slack incoming webhook, a PagerDuty Events API v2 integration or a generic HTTP endpoint
+type AlertTarget struct {
+	Kind       string `json:"kind"`        // slack, pagerduty or webhook
+	URL        string `json:"url"`         // Webhook URL (optional for pagerduty)
+	RoutingKey string `json:"routing_key"` // PagerDuty integration key
+}
+
+// alertRulesFile is the file configured by ALERT_RULES_FILE
+type alertRulesFile struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+// LoadAlertRules reads and validates the rules of an alert rules file
+func LoadAlertRules(path string) ([]AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules file: %w", err)
+	}
+	var file alertRulesFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules file: %w", err)
+	}
+
+	names := make(map[string]bool, len(file.Rules))
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %q: %w", rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("alert rule %q is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("alert rules file defines no rules")
+	}
+	return file.Rules, nil
+}
+
+// validate checks the rule's target and limits and fills in defaults
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Target.Kind {
+	case alertSlack, alertWebhook:
+		if r.Target.URL == "" {
+			return fmt.Errorf("target url is required for %s", r.Target.Kind)
+		}
+	case alertPagerDuty:
+		if r.Target.RoutingKey == "" {
+			return fmt.Errorf("target routing_key is required for pagerduty")
+		}
+		if r.Target.URL == "" {
+			r.Target.URL = pagerDutyEventsURL
+		}
+	default:
+		return fmt.Errorf("unknown target kind %q (expected slack, pagerduty or webhook)", r.Target.Kind)
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = "warning"
+	case "critical", "error", "warning", "info":
+	default:
+		return fmt.Errorf("unknown severity %q (expected critical, error, warning or info)", r.Severity)
+	}
+	if r.CooldownSeconds == nil {
+		cooldown := 300
+		r.CooldownSeconds = &cooldown
+	}
+	if *r.CooldownSeconds < 0 || r.MaxPerHour < 0 {
+		return fmt.Errorf("cooldown_seconds and max_per_hour must not be negative")
+	}
+	return nil
+}
+
+// matches reports whether an event of the tenant matches the rule's type and tenant conditions,
+// which are checked before the event is decoded for its field conditions
+func (r *AlertRule) matches(tenant, eventType string) bool {
+	return (len(r.Types) == 0 || slices.Contains(r.Types, eventType)) &&
+		(len(r.Tenants) == 0 || slices.Contains(r.Tenants, tenant))
+}
+
+// alert is one matched event waiting to be sent
+type alert struct {
+	rule   *AlertRule
+	tenant string
+	entry  LogEntry
+	event  map[string]any
+}
+
+// Alerter matches Auth0 events against alert rules and sends notifications in the background,
+// at most one per rule and dedup key every cooldown and at most max_per_hour per rule
+type Alerter struct {
+	rules   []AlertRule
+	client  *http.Client
+	queue   chan alert
+	metrics *Metrics
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time // Rule name and dedup key to the last notification
+	hour     time.Time            // Start of the current max_per_hour window
+	sent     map[string]int       // Notifications per rule in the current window
+}
+
+// NewAlerter creates an alerter for the rules; Run must be started to send notifications
+func NewAlerter(rules []AlertRule, metrics *Metrics, logger *slog.Logger) *Alerter {
+	return &Alerter{
+		rules:    rules,
+		client:   newOutboundClient(alertSendTimeout),
+		queue:    make(chan alert, alertQueueSize),
+		metrics:  metrics,
+		logger:   logger,
+		lastSent: make(map[string]time.Time),
+		sent:     make(map[string]int),
+	}
+}
+
+// Observe checks an accepted entry against the rules and queues a notification for each match
+// It never blocks; alerts that find the queue full are dropped
+func (a *Alerter) Observe(tenant string, entry LogEntry) {
+	if a == nil || entry.Source != sourceAuth0 {
+		return
+	}
+
+	var event map[string]any
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(tenant, entry.Labels["type"]) {
+			continue
+		}
+		if event == nil {
+			if err := json.Unmarshal([]byte(entry.Line), &event); err != nil {
+				return
+			}
+		}
+		if !fieldsMatch(event, rule.Fields) || !a.admit(rule, tenant, entry, event) {
+			continue
+		}
+
+		select {
+		case a.queue <- alert{rule: rule, tenant: tenant, entry: entry, event: event}:
+		default:
+			a.metrics.alerts.Inc(rule.Name, "dropped")
+			a.logger.Warn("Alert queue is full, dropping alert", "rule", rule.Name, "tenant", tenant)
+		}
+	}
+}
+
+// fieldsMatch reports whether every path of fields has the given value in the event
+func fieldsMatch(event map[string]any, fields map[string]string) bool {
+	for path, want := range fields {
+		if value, ok := lookupPath(event, path); !ok || value != want {
+			return false
+		}
+	}
+	return true
+}
+
+// admit applies the rule's cooldown and hourly limit, counting suppressed matches
+func (a *Alerter) admit(rule *AlertRule, tenant string, entry LogEntry, event map[string]any) bool {
+	key := rule.Name + "\xff" + tenant + "\xff" + entry.Labels["type"]
+	if rule.DedupPath != "" {
+		value, _ := lookupPath(event, rule.DedupPath)
+		key += "\xff" + value
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cooldown := time.Duration(*rule.CooldownSeconds) * time.Second
+	if last, ok := a.lastSent[key]; ok && now.Sub(last) < cooldown {
+		a.metrics.alerts.Inc(rule.Name, "suppressed")
+		return false
+	}
+	if now.Sub(a.hour) >= time.Hour {
+		a.hour = now.Truncate(time.Hour)
+		clear(a.sent)
+	}
+	if rule.MaxPerHour > 0 && a.sent[rule.Name] >= rule.MaxPerHour {
+		a.metrics.alerts.Inc(rule.Name, "rate_limited")
+		return false
+	}
+	a.sent[rule.Name]++
+	if cooldown > 0 {
+		a.lastSent[key] = now
+	}
+	return true
+}
+
+// Run sends queued alerts until ctx is canceled and forgets expired cooldowns once a minute
+func (a *Alerter) Run(ctx context.Context) {
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			a.prune()
+		case al := <-a.queue:
+			a.send(ctx, al)
+		}
+	}
+}
+
+// prune removes dedup keys whose cooldown has passed, bounding the memory of high-cardinality keys
+func (a *Alerter) prune() {
+	longest := time.Duration(0)
+	for _, rule := range a.rules {
+		longest = max(longest, time.Duration(*rule.CooldownSeconds)*time.Second)
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, last := range a.lastSent {
+		if now.Sub(last) >= longest {
+			delete(a.lastSent, key)
+		}
+	}
+}
+
+// send delivers one alert to its target
+func (a *Alerter) send(ctx context.Context, al alert) {
+	body, err := json.Marshal(alertPayload(al))
+	if err != nil {
+		a.logger.Error("Failed to encode alert", "rule", al.rule.Name, "error", err)
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, alertSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(sendCtx, http.MethodPost, al.rule.Target.URL, bytes.NewReader(body))
+	if err != nil {
+		a.logger.Error("Failed to create alert request", "rule", al.rule.Name, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+			err = fmt.Errorf("alert target returned status %d: %s", resp.StatusCode, string(respBody))
+		}
+	}
+	if err != nil {
+		a.metrics.alerts.Inc(al.rule.Name, "failed")
+		a.logger.Warn("Failed to send alert",
+			"rule", al.rule.Name,
+			"tenant", al.tenant,
+			"target", al.rule.Target.Kind,
+			"url", redactedURL(al.rule.Target.URL),
+			"error", err,
+		)
+		return
+	}
+	a.metrics.alerts.Inc(al.rule.Name, "sent")
+	a.logger.Info("Sent alert",
+		"rule", al.rule.Name,
+		"tenant", al.tenant,
+		"type", al.entry.Labels["type"],
+		"log_id", al.entry.LogID,
+	)
+}
+
+// alertPayload builds the request body of the alert's target kind
+func alertPayload(al alert) any {
+	eventType := al.entry.Labels["type"]
+	summary := fmt.Sprintf("Auth0 alert %q: %s event in tenant %s", al.rule.Name, eventType, al.tenant)
+	if description, ok := lookupPath(al.event, "data.description"); ok && description != "" {
+		summary += ": " + description
+	}
+	if al.entry.LogID != "" {
+		summary += " (log_id " + al.entry.LogID + ")"
+	}
+
+	switch al.rule.Target.Kind {
+	case alertSlack:
+		return map[string]any{"text": summary}
+	case alertPagerDuty:
+		return map[string]any{
+			"routing_key":  al.rule.Target.RoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    strings.Join([]string{al.rule.Name, al.tenant, eventType, al.entry.LogID}, "/"),
+			"payload": map[string]any{
+				"summary":        summary,
+				"source":         al.tenant,
+				"severity":       al.rule.Severity,
+				"component":      "auth0",
+				"class":          eventType,
+				"custom_details": al.event,
+			},
+		}
+	default:
+		return map[string]any{
+			"rule":    al.rule.Name,
+			"tenant":  al.tenant,
+			"type":    eventType,
+			"log_id":  al.entry.LogID,
+			"summary": summary,
+			"event":   json.RawMessage(al.entry.Line),
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DiskProtection encrypts the records that on-disk buffers write and deletes their files
+// Records are sealed one by one with AES-GCM under a random nonce and stored base64-encoded,
+// so files stay line-oriented and a record torn by a crash only loses itself
+// A nil DiskProtection writes plaintext and deletes files normally
+type DiskProtection struct {
+	aead         cipher.AEAD // nil keeps records in plaintext
+	secureDelete bool        // Overwrite files with zeros before deleting them
+}
+
+// NewDiskProtection resolves DISK_ENCRYPTION_KEY or DISK_ENCRYPTION_KMS_CIPHERTEXT, or returns
+// nil when neither encryption nor secure deletion is configured
+func NewDiskProtection(ctx context.Context, cfg *Config) (*DiskProtection, error) {
+	if cfg.DiskEncryptionKey == "" && cfg.DiskEncryptionKMSCiphertext == "" && !cfg.DiskSecureDelete {
+		return nil, nil
+	}
+	p := &DiskProtection{secureDelete: cfg.DiskSecureDelete}
+
+	var key []byte
+	switch {
+	case cfg.DiskEncryptionKey != "":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cfg.DiskEncryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("DISK_ENCRYPTION_KEY is not valid base64: %w", err)
+		}
+		key = decoded
+	case cfg.DiskEncryptionKMSCiphertext != "":
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cfg.DiskEncryptionKMSCiphertext))
+		if err != nil {
+			return nil, fmt.Errorf("DISK_ENCRYPTION_KMS_CIPHERTEXT is not valid base64: %w", err)
+		}
+		client := newOutboundClient(10 * time.Second)
+		key, err = kmsDecrypt(ctx, client, NewAWSCredentialsChain(client, awsRegion()), awsRegion(), ciphertext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("disk encryption key must be 16, 24 or 32 bytes: %w", err)
+		}
+		if p.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("failed to set up AES-GCM: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Encrypted reports whether records are encrypted
+func (p *DiskProtection) Encrypted() bool {
+	return p != nil && p.aead != nil
+}
+
+// Seal returns the line to store for a record
+func (p *DiskProtection) Seal(record []byte) ([]byte, error) {
+	if !p.Encrypted() {
+		return record, nil
+	}
+	sealed := make([]byte, p.aead.NonceSize(), p.aead.NonceSize()+len(record)+p.aead.Overhead())
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed = p.aead.Seal(sealed, sealed, record, nil)
+	return base64.StdEncoding.AppendEncode(nil, sealed), nil
+}
+
+// Open returns the record of a stored line
+// Plaintext records (JSON objects) are returned as they are, so files written before
+// encryption was enabled can still be read
+func (p *DiskProtection) Open(line []byte) ([]byte, error) {
+	if len(line) > 0 && line[0] == '{' {
+		return line, nil
+	}
+	if !p.Encrypted() {
+		return nil, errors.New("record is encrypted and no disk encryption key is configured")
+	}
+	sealed, err := base64.StdEncoding.AppendDecode(nil, line)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted record: %w", err)
+	}
+	if len(sealed) < p.aead.NonceSize() {
+		return nil, errors.New("encrypted record is too short")
+	}
+	record, err := p.aead.Open(nil, sealed[:p.aead.NonceSize()], sealed[p.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record (wrong key?): %w", err)
+	}
+	return record, nil
+}
+
+// Remove deletes a file, overwriting its contents with zeros first when secure deletion is on
+// Overwriting does not reach copies that SSD wear leveling or copy-on-write filesystems keep
+func (p *DiskProtection) Remove(path string) error {
+	if p != nil && p.secureDelete {
+		if err := overwriteFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// overwriteFile replaces the contents of a file with zeros and syncs it
+func overwriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file for secure deletion: %w", err)
+	}
+	zeros := make([]byte, 64<<10)
+	for remaining := info.Size(); remaining > 0; {
+		n, err := f.Write(zeros[:min(remaining, int64(len(zeros)))])
+		if err != nil {
+			return fmt.Errorf("failed to overwrite file for secure deletion: %w", err)
+		}
+		remaining -= int64(n)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync overwritten file: %w", err)
+	}
+	return nil
+}
+
+// kmsDecrypt decrypts a data key with AWS KMS, as produced by `aws kms generate-data-key`
+func kmsDecrypt(ctx context.Context, client *http.Client, creds *AWSCredentialsChain, region string, ciphertext []byte) ([]byte, error) {
+	if region == "" {
+		return nil, fmt.Errorf("DISK_ENCRYPTION_KMS_CIPHERTEXT requires AWS_REGION")
+	}
+	credentials, err := creds.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string][]byte{"CiphertextBlob": ciphertext})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	endpoint := "https://kms." + region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	signAWSRequestV4(req, body, credentials, region, "kms", time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to KMS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("KMS Decrypt returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse KMS response: %w", err)
+	}
+	return result.Plaintext, nil
+}
@@ -1,109 +1,239 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
+
+	"github.com/amba/a0-logstream2loki/pkg/auth"
+)
+
+// Authentication schemes of AUTH_METHODS
+const (
+	authHMAC  = "hmac"  // Bearer token: hex HMAC-SHA256 of the tenant under HMAC_SECRET
+	authToken = "token" // Bearer token: one of CUSTOM_AUTH_TOKEN
+	authJWT   = "jwt"   // Bearer token: JWT signed by a key of JWT_JWKS_URL or JWT_PUBLIC_KEY_FILE
+	authMTLS  = "mtls"  // Client certificate issued by TLS_CLIENT_CA_FILE for the tenant
 )
 
-// ErrorResponse represents a JSON error response
-type ErrorResponse struct {
-	Error string `json:"error"`
+// errNoCredentials is returned by an authenticator when the request carries none of the
+// credentials it checks, so the next one is tried
+var errNoCredentials = errors.New("no credentials for this scheme")
+
+// authFailure rejects a request: the error code answered and counted, and the logged reason
+type authFailure struct {
+	status int
+	code   string
+	reason string
+	level  slog.Level // Warn for bad credentials, Error for a configuration problem
+}
+
+func (f *authFailure) Error() string { return f.reason }
+
+// invalidToken rejects a bearer token that does not verify
+func invalidToken(reason string) *authFailure {
+	return &authFailure{status: http.StatusUnauthorized, code: "invalid_token", reason: reason, level: slog.LevelWarn}
+}
+
+// Authenticator checks one kind of credentials of a request for a tenant
+type Authenticator interface {
+	// Authenticate returns nil when r carries valid credentials for tenant, errNoCredentials
+	// when it carries none of this scheme, or an *authFailure
+	Authenticate(r *http.Request, tenant string) error
 }
 
-// authenticateRequest validates the bearer token
-// If customAuthToken is set, it uses exact token matching (takes precedence)
-// Otherwise, it validates using HMAC-SHA256 of the tenant
-// Returns the tenant string if authentication succeeds, otherwise writes an error response and returns empty string
-func authenticateRequest(w http.ResponseWriter, r *http.Request, hmacSecret, customAuthToken string, logger *slog.Logger) (string, bool) {
-	// Extract tenant query parameter
-	tenant := r.URL.Query().Get("tenant")
+// AuthChain authenticates the requests of the ingestion endpoints, /admin/tail and
+// /admin/recent with the schemes of AUTH_METHODS, tried in order: the first that accepts
+// the credentials authenticates the request
+type AuthChain struct {
+	names          []string
+	authenticators []Authenticator
+}
+
+// NewAuthChain creates the authenticators of cfg.AuthMethods; without AUTH_METHODS,
+// CUSTOM_AUTH_TOKEN takes precedence over HMAC_SECRET as before the schemes could be stacked
+func NewAuthChain(ctx context.Context, cfg *Config, secrets *SecretStore, logger *slog.Logger) (*AuthChain, error) {
+	chain := &AuthChain{names: cfg.authMethods()}
+	for _, name := range chain.names {
+		var authenticator Authenticator
+		switch name {
+		case authHMAC:
+			authenticator = &hmacAuthenticator{secrets: secrets}
+		case authToken:
+			authenticator = &tokenAuthenticator{secrets: secrets}
+		case authJWT:
+			jwt, err := NewJWTAuthenticator(ctx, cfg, logger)
+			if err != nil {
+				return nil, err
+			}
+			authenticator = jwt
+		case authMTLS:
+			authenticator = mtlsAuthenticator{}
+		}
+		chain.authenticators = append(chain.authenticators, authenticator)
+	}
+	return chain, nil
+}
+
+// authMethods returns the schemes requests are authenticated with
+func (cfg *Config) authMethods() []string {
+	if len(cfg.AuthMethods) > 0 {
+		return cfg.AuthMethods
+	}
+	if len(cfg.CustomAuthTokens) > 0 || cfg.CustomAuthTokenFile != "" {
+		return []string{authToken}
+	}
+	return []string{authHMAC}
+}
+
+// authenticateRequest validates the credentials of the request for the tenant it names
+// The first failing scheme gives the error when no scheme accepts the request
+// Returns the tenant string if authentication succeeds, otherwise writes an error response
+// and returns the error code that was sent as the failure reason
+func (c *AuthChain) authenticateRequest(w http.ResponseWriter, r *http.Request, logger *slog.Logger) (tenant string, failure string) {
+	// The tenant is named in the path (/logs/{tenant}) or the tenant query parameter
+	tenant = r.PathValue("tenant")
+	if query := r.URL.Query().Get("tenant"); query != "" {
+		if tenant != "" && query != tenant {
+			logger.Warn("Authentication failed: tenant in path and query differ",
+				"tenant", tenant,
+				"query_tenant", query,
+				"remote_addr", r.RemoteAddr,
+			)
+			writeJSONError(w, http.StatusBadRequest, "conflicting_tenant")
+			return "", "conflicting_tenant"
+		}
+		tenant = query
+	}
 	if tenant == "" {
 		logger.Warn("Authentication failed: missing tenant parameter",
 			"remote_addr", r.RemoteAddr,
 		)
 		writeJSONError(w, http.StatusBadRequest, "missing_tenant")
-		return "", false
+		return "", "missing_tenant"
+	}
+
+	var rejected *authFailure
+	for i, authenticator := range c.authenticators {
+		err := authenticator.Authenticate(r, tenant)
+		if err == nil {
+			return tenant, ""
+		}
+		var f *authFailure
+		if errors.As(err, &f) && rejected == nil {
+			rejected = f
+			logger = logger.With("auth_method", c.names[i])
+		}
+	}
+	if rejected == nil {
+		// No scheme found its credentials in the request
+		rejected = &authFailure{
+			status: http.StatusUnauthorized,
+			code:   "missing_authorization",
+			reason: "missing authorization header",
+			level:  slog.LevelWarn,
+		}
+		if slices.Equal(c.names, []string{authMTLS}) {
+			rejected.reason = "missing client certificate"
+		}
 	}
 
-	// Extract bearer token from Authorization header
+	logger.Log(r.Context(), rejected.level, "Authentication failed: "+rejected.reason,
+		"tenant", tenant,
+		"remote_addr", r.RemoteAddr,
+	)
+	writeJSONError(w, rejected.status, rejected.code)
+	return "", rejected.code
+}
+
+// bearerToken returns the token of the Authorization header
+// Parse "Bearer <token>" format (case-insensitive for "Bearer")
+func bearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		logger.Warn("Authentication failed: missing authorization header",
-			"tenant", tenant,
-			"remote_addr", r.RemoteAddr,
-		)
-		writeJSONError(w, http.StatusUnauthorized, "missing_authorization")
-		return "", false
+		return "", errNoCredentials
 	}
-
-	// Parse "Bearer <token>" format (case-insensitive for "Bearer")
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
-		logger.Warn("Authentication failed: invalid authorization format",
-			"tenant", tenant,
-			"remote_addr", r.RemoteAddr,
-		)
-		writeJSONError(w, http.StatusUnauthorized, "invalid_authorization_format")
-		return "", false
+		return "", &authFailure{
+			status: http.StatusUnauthorized,
+			code:   "invalid_authorization_format",
+			reason: "invalid authorization format",
+			level:  slog.LevelWarn,
+		}
 	}
-	token := parts[1]
+	return parts[1], nil
+}
 
-	// If custom auth token is configured, use exact matching (takes precedence)
-	if customAuthToken != "" {
-		// Timing-safe comparison of custom token
-		if !hmac.Equal([]byte(token), []byte(customAuthToken)) {
-			logger.Warn("Authentication failed: invalid custom token",
-				"tenant", tenant,
-				"remote_addr", r.RemoteAddr,
-			)
-			writeJSONError(w, http.StatusUnauthorized, "invalid_token")
-			return "", false
+// hmacAuthenticator accepts the hex HMAC-SHA256 of the tenant under one of the active secrets
+type hmacAuthenticator struct {
+	secrets *SecretStore
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request, tenant string) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	secrets := a.secrets.Load().HMACSecrets
+	if len(secrets) == 0 {
+		return &authFailure{
+			status: http.StatusUnauthorized,
+			code:   "authentication_not_configured",
+			reason: "no HMAC secret configured",
+			level:  slog.LevelError,
 		}
-		return tenant, true
 	}
 
-	// Otherwise, use HMAC-SHA256 validation
-	if hmacSecret == "" {
-		logger.Error("Authentication failed: no HMAC secret or custom token configured",
-			"tenant", tenant,
-			"remote_addr", r.RemoteAddr,
-		)
-		writeJSONError(w, http.StatusUnauthorized, "authentication_not_configured")
-		return "", false
+	// Timing-safe comparison against the HMAC of every active secret
+	switch err := auth.VerifyHMAC(tenant, token, secrets); {
+	case errors.Is(err, auth.ErrMalformedToken):
+		return invalidToken("token not valid hex")
+	case err != nil:
+		return invalidToken("HMAC mismatch")
 	}
+	return nil
+}
 
-	// Compute HMAC-SHA256 of the tenant string using the configured secret
-	mac := hmac.New(sha256.New, []byte(hmacSecret))
-	mac.Write([]byte(tenant))
-	expectedMAC := mac.Sum(nil)
+// tokenAuthenticator accepts one of the active static tokens, whatever the tenant
+type tokenAuthenticator struct {
+	secrets *SecretStore
+}
 
-	// Decode the provided token from hex
-	providedMAC, err := hex.DecodeString(token)
+func (a *tokenAuthenticator) Authenticate(r *http.Request, tenant string) error {
+	token, err := bearerToken(r)
 	if err != nil {
-		logger.Warn("Authentication failed: token not valid hex",
-			"tenant", tenant,
-			"remote_addr", r.RemoteAddr,
-		)
-		writeJSONError(w, http.StatusUnauthorized, "invalid_token")
-		return "", false
+		return err
 	}
-
-	// Timing-safe comparison
-	if !hmac.Equal(expectedMAC, providedMAC) {
-		logger.Warn("Authentication failed: HMAC mismatch",
-			"tenant", tenant,
-			"remote_addr", r.RemoteAddr,
-		)
-		writeJSONError(w, http.StatusUnauthorized, "invalid_token")
-		return "", false
+	// Timing-safe comparison against every active custom token
+	if !auth.MatchToken(token, a.secrets.Load().CustomAuthTokens) {
+		return invalidToken("invalid custom token")
 	}
+	return nil
+}
 
-	return tenant, true
+// mtlsAuthenticator accepts a client certificate, verified against TLS_CLIENT_CA_FILE during
+// the handshake, whose common name or one of whose DNS names is the tenant
+type mtlsAuthenticator struct{}
+
+func (mtlsAuthenticator) Authenticate(r *http.Request, tenant string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == tenant || slices.Contains(cert.DNSNames, tenant) {
+		return nil
+	}
+	return &authFailure{
+		status: http.StatusUnauthorized,
+		code:   "invalid_client_certificate",
+		reason: "client certificate not issued for the tenant (subject " + cert.Subject.String() + ")",
+		level:  slog.LevelWarn,
+	}
 }
 
 // writeJSONError writes a JSON error response
@@ -112,3 +242,12 @@ func writeJSONError(w http.ResponseWriter, statusCode int, errorMsg string) {
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(ErrorResponse{Error: errorMsg})
 }
+
+// writeJSONErrorDetail writes a JSON error response explaining the error
+func writeJSONErrorDetail(w http.ResponseWriter, statusCode int, errorMsg, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false) // Details often quote the offending input, e.g. '<'
+	encoder.Encode(ErrorResponse{Error: errorMsg, Detail: detail})
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials holds a set of AWS credentials
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time // Zero for static credentials
+}
+
+// expired reports whether the credentials should be refreshed
+// Temporary credentials are refreshed five minutes before they expire
+func (c *awsCredentials) expired() bool {
+	return !c.Expires.IsZero() && time.Now().Add(5*time.Minute).After(c.Expires)
+}
+
+// AWSCredentialsChain resolves credentials the way the AWS SDKs do, without depending on them:
+// environment variables, web identity (IRSA), shared credentials file,
+// ECS container credentials, and finally EC2 instance metadata (IMDSv2)
+// Temporary credentials are cached and refreshed automatically before they expire
+type AWSCredentialsChain struct {
+	client *http.Client
+	region string
+
+	mu     sync.Mutex
+	cached *awsCredentials
+}
+
+// NewAWSCredentialsChain creates a credentials chain for the given region
+func NewAWSCredentialsChain(client *http.Client, region string) *AWSCredentialsChain {
+	return &AWSCredentialsChain{
+		client: client,
+		region: region,
+	}
+}
+
+// awsRegion returns the region configured through the standard AWS environment variables
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// Retrieve returns valid credentials, refreshing them if necessary
+func (c *AWSCredentialsChain) Retrieve(ctx context.Context) (*awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil && !c.cached.expired() {
+		return c.cached, nil
+	}
+
+	creds, err := c.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.cached = creds
+	return creds, nil
+}
+
+// resolve walks the credential sources in order and returns the first that yields credentials
+func (c *AWSCredentialsChain) resolve(ctx context.Context) (*awsCredentials, error) {
+	// 1. Static credentials from the environment
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	// 2. Web identity token (EKS IRSA, GKE/Azure workload identity federation)
+	if tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && roleARN != "" {
+		return c.assumeRoleWithWebIdentity(ctx, tokenFile, roleARN)
+	}
+
+	// 3. Shared credentials file
+	if creds, err := readSharedCredentials(); err == nil && creds != nil {
+		return creds, nil
+	}
+
+	// 4. ECS / EKS Pod Identity container credentials
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return c.containerCredentials(ctx)
+	}
+
+	// 5. EC2 instance metadata
+	creds, err := c.instanceCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials found (environment, web identity, shared file, container or instance metadata): %w", err)
+	}
+	return creds, nil
+}
+
+// assumeRoleWithWebIdentity exchanges a projected service account token for temporary credentials
+func (c *AWSCredentialsChain) assumeRoleWithWebIdentity(ctx context.Context, tokenFile, roleARN string) (*awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("a0-logstream2loki-%d", time.Now().Unix())
+	}
+
+	endpoint := "https://sts.amazonaws.com/"
+	if c.region != "" {
+		endpoint = "https://sts." + c.region + ".amazonaws.com/"
+	}
+
+	query := url.Values{}
+	query.Set("Action", "AssumeRoleWithWebIdentity")
+	query.Set("Version", "2011-06-15")
+	query.Set("RoleArn", roleARN)
+	query.Set("RoleSessionName", sessionName)
+	query.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(query.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call STS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("STS AssumeRoleWithWebIdentity returned status %d: %s", resp.StatusCode, truncate(string(body), 500))
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse STS response: %w", err)
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// readSharedCredentials reads the profile from ~/.aws/credentials (or AWS_SHARED_CREDENTIALS_FILE)
+// Returns nil without error when the file or profile does not exist
+func readSharedCredentials() (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	creds := &awsCredentials{}
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// containerCredentials fetches credentials from the ECS (or EKS Pod Identity) credentials endpoint
+func (c *AWSCredentialsChain) containerCredentials(ctx context.Context) (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = "http://169.254.170.2" + relative
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container credentials request: %w", err)
+	}
+
+	authToken := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read container authorization token: %w", err)
+		}
+		authToken = strings.TrimSpace(string(data))
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+
+	return c.fetchJSONCredentials(req)
+}
+
+// instanceCredentials fetches the instance profile credentials using IMDSv2
+func (c *AWSCredentialsChain) instanceCredentials(ctx context.Context) (*awsCredentials, error) {
+	const imdsURL = "http://169.254.169.254"
+
+	// IMDS is link-local; fail fast when not running on EC2
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	tokenResp, err := c.client.Do(tokenReq)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata unavailable: %w", err)
+	}
+	token, _ := io.ReadAll(io.LimitReader(tokenResp.Body, 4096))
+	tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata token request returned status %d", tokenResp.StatusCode)
+	}
+
+	roleReq, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsURL+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return nil, err
+	}
+	roleReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	roleResp, err := c.client.Do(roleReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instance role: %w", err)
+	}
+	role, _ := io.ReadAll(io.LimitReader(roleResp.Body, 4096))
+	roleResp.Body.Close()
+	if roleResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance has no IAM role (status %d)", roleResp.StatusCode)
+	}
+
+	credsReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		imdsURL+"/latest/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), nil)
+	if err != nil {
+		return nil, err
+	}
+	credsReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return c.fetchJSONCredentials(credsReq)
+}
+
+// fetchJSONCredentials performs a request returning credentials in the ECS/IMDS JSON format
+func (c *AWSCredentialsChain) fetchJSONCredentials(req *http.Request) (*awsCredentials, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("credentials endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials response: %w", err)
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.AccessKeyID,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.Token,
+		Expires:         result.Expiration,
+	}, nil
+}
+
+// signAWSRequestV4 signs the request with AWS Signature Version 4
+// body must be the exact bytes that will be sent as the request body
+func signAWSRequestV4(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Sign host, content-type and every x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name)
+		canonicalHeaders.WriteByte(':')
+		canonicalHeaders.WriteString(headers[name])
+		canonicalHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsCanonicalURI(req.URL),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalURI returns the URI-encoded path as required by SigV4
+func awsCanonicalURI(u *url.URL) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery returns the sorted, URI-encoded query string as required by SigV4
+func awsCanonicalQuery(values url.Values) string {
+	pairs := make([]string, 0, len(values))
+	for key, vals := range values {
+		for _, val := range vals {
+			pairs = append(pairs, awsURIEncode(key)+"="+awsURIEncode(val))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything except RFC 3986 unreserved characters
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns HMAC-SHA256(key, data)
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// truncate shortens s to at most n bytes for logging
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// Storage Queue polling: each receive takes up to azureQueueMaxMessages messages and hides
+// them for azureQueueVisibility; an empty queue is polled again after azureQueueIdleDelay
+const (
+	azureQueueMaxMessages = 32
+	azureQueueVisibility  = 2 * queueAckTimeout
+	azureQueueIdleDelay   = 2 * time.Second
+	azureStorageVersion   = "2021-12-02"
+)
+
+// azureQueueMessage is a message returned by Get Messages
+type azureQueueMessage struct {
+	MessageID   string `xml:"MessageId"`
+	PopReceipt  string `xml:"PopReceipt"`
+	MessageText string `xml:"MessageText"`
+}
+
+// AzureQueueConsumer polls an Azure Storage Queue that an Event Grid subscription delivers to
+// Auth0's Azure Event Grid partner topic thus needs no inbound HTTP endpoint; messages are
+// deleted only once Loki stored their entries, which checkpoints the queue
+type AzureQueueConsumer struct {
+	client      *http.Client
+	queueURL    *url.URL // Queue URL carrying a SAS token with read and process permissions
+	concurrency int
+
+	parser     *LogsHandler // Turns Auth0 events into entries with the configured labels
+	entryQueue *batch.EntryQueue
+	metrics    *Metrics
+	logger     *slog.Logger
+}
+
+// NewAzureQueueConsumer creates a consumer for the queue at a SAS URL
+func NewAzureQueueConsumer(queueURL string, concurrency int, parser *LogsHandler, entryQueue *batch.EntryQueue, metrics *Metrics, logger *slog.Logger) (*AzureQueueConsumer, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid AZURE_QUEUE_URL")
+	}
+	if u.Query().Get("sig") == "" {
+		return nil, fmt.Errorf("AZURE_QUEUE_URL must carry a SAS token (sig parameter missing)")
+	}
+
+	return &AzureQueueConsumer{
+		client:      newOutboundClient(30 * time.Second),
+		queueURL:    u,
+		concurrency: concurrency,
+		parser:      parser,
+		entryQueue:  entryQueue,
+		metrics:     metrics,
+		// The SAS token is a secret, only the queue itself is logged
+		logger: logger.With("queue", u.Host+u.Path),
+	}, nil
+}
+
+// Run polls the queue with concurrency pollers until ctx is canceled
+func (c *AzureQueueConsumer) Run(ctx context.Context) {
+	c.logger.Info("Consuming Auth0 events from Azure Storage Queue", "concurrency", c.concurrency)
+
+	var wg sync.WaitGroup
+	for range c.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.poll(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// poll receives and processes messages, waiting while the queue is empty or after errors
+func (c *AzureQueueConsumer) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		c.parser.memory.Wait(ctx)
+		c.parser.maintenance.Wait(ctx)
+		messages, err := c.receive(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.logger.Error("Failed to receive Azure queue messages", "error", err)
+		}
+		if len(messages) > 0 {
+			c.process(ctx, messages)
+			continue
+		}
+
+		delay := azureQueueIdleDelay
+		if err != nil {
+			delay = 5 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// process queues the events of the messages and deletes the messages once Loki stored them
+func (c *AzureQueueConsumer) process(ctx context.Context, messages []azureQueueMessage) {
+	var entries []LogEntry
+	var queued []azureQueueMessage
+	for _, message := range messages {
+		entry, err := c.parseMessage(message.MessageText)
+		if errors.Is(err, errHookDropped) {
+			// Dropped by a processing hook, so done with
+			c.metrics.azureQueueMessages.Inc("filtered")
+			if err := c.delete(ctx, message); err != nil {
+				c.logger.Error("Failed to delete filtered Azure queue message, it will be delivered again",
+					"message_id", message.MessageID,
+					"error", err,
+				)
+			}
+			continue
+		}
+		if err != nil {
+			// Becomes visible again and expires with the queue's message time-to-live
+			c.metrics.azureQueueMessages.Inc("invalid")
+			c.logger.Warn("Failed to parse Azure queue message",
+				"message_id", message.MessageID,
+				"error", err,
+			)
+			continue
+		}
+		entries = append(entries, entry)
+		queued = append(queued, message)
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	if err := deliverAndWait(ctx, c.entryQueue, c.parser.deliveries, entries, queueAckTimeout); err != nil {
+		c.metrics.azureQueueMessages.Add(float64(len(queued)), "failed")
+		c.logger.Warn("Azure queue messages not delivered to Loki, leaving them for redelivery",
+			"messages", len(queued),
+			"error", err,
+		)
+		return
+	}
+
+	c.metrics.azureQueueMessages.Add(float64(len(queued)), "delivered")
+	for _, message := range queued {
+		if err := c.delete(ctx, message); err != nil {
+			c.logger.Error("Failed to delete delivered Azure queue message, it will be delivered again",
+				"message_id", message.MessageID,
+				"error", err,
+			)
+		}
+	}
+}
+
+// parseMessage extracts the Auth0 event from an Event Grid event
+// Event Grid writes the event base64-encoded; both the Event Grid and the CloudEvents schema carry it in data
+func (c *AzureQueueConsumer) parseMessage(text string) (LogEntry, error) {
+	body := []byte(text)
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil {
+		body = decoded
+	}
+
+	var event struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return LogEntry{}, err
+	}
+	if len(event.Data) == 0 {
+		return LogEntry{}, fmt.Errorf("not an Event Grid event (no data)")
+	}
+
+	// The data is the event Auth0 would deliver to a webhook
+	var line bytes.Buffer
+	if err := json.Compact(&line, event.Data); err != nil {
+		return LogEntry{}, err
+	}
+	return c.parser.parseQueuedLine(line.Bytes())
+}
+
+// receive gets the next messages of the queue, hiding them while they are processed
+func (c *AzureQueueConsumer) receive(ctx context.Context) ([]azureQueueMessage, error) {
+	query := c.queueURL.Query()
+	query.Set("numofmessages", fmt.Sprint(azureQueueMaxMessages))
+	query.Set("visibilitytimeout", fmt.Sprint(int(azureQueueVisibility.Seconds())))
+
+	resp, err := c.do(ctx, http.MethodGet, "/messages", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Messages []azureQueueMessage `xml:"QueueMessage"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse Azure queue response: %w", err)
+	}
+	return result.Messages, nil
+}
+
+// delete removes a processed message
+func (c *AzureQueueConsumer) delete(ctx context.Context, message azureQueueMessage) error {
+	query := c.queueURL.Query()
+	query.Set("popreceipt", message.PopReceipt)
+
+	resp, err := c.do(ctx, http.MethodDelete, "/messages/"+url.PathEscape(message.MessageID), query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request below the queue URL, returning an error for non-2xx answers
+func (c *AzureQueueConsumer) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := *c.queueURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("x-ms-version", azureStorageVersion)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// The URL carries the SAS token, keep it out of the error
+		return nil, fmt.Errorf("failed to send request to Azure Storage: %w", redactURLError(err))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("Azure Storage returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// redactURLError strips the URL, and with it any credentials in the query, from an HTTP client error
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
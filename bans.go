@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the memory used for failure tracking
+// When full, new clients are not tracked until stale entries are pruned
+const maxTrackedClients = 100000
+
+// BanTracker counts authentication failures per client IP and temporarily bans
+// clients that exceed the threshold within the window, to slow down token brute-forcing
+// Each repeated ban doubles in length up to maxBan
+type BanTracker struct {
+	threshold int
+	window    time.Duration
+	baseBan   time.Duration
+	maxBan    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*banState
+}
+
+// banState tracks the failures and ban history of a single client IP
+type banState struct {
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+	bans        int // Number of bans issued, drives the exponential duration
+	lastSeen    time.Time
+}
+
+// NewBanTracker creates a ban tracker
+func NewBanTracker(threshold int, window, baseBan, maxBan time.Duration) *BanTracker {
+	return &BanTracker{
+		threshold: threshold,
+		window:    window,
+		baseBan:   baseBan,
+		maxBan:    maxBan,
+		clients:   make(map[string]*banState),
+	}
+}
+
+// Banned reports whether the IP is currently banned and for how much longer
+func (t *BanTracker) Banned(ip string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.clients[ip]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := time.Until(state.bannedUntil)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// RecordFailure records an authentication failure for the IP
+// Returns the ban duration if this failure triggered a new ban
+func (t *BanTracker) RecordFailure(ip string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	state, ok := t.clients[ip]
+	if !ok {
+		if len(t.clients) >= maxTrackedClients {
+			return 0, false
+		}
+		state = &banState{windowStart: now}
+		t.clients[ip] = state
+	}
+	state.lastSeen = now
+
+	// Start a new counting window once the previous one has elapsed
+	if now.Sub(state.windowStart) > t.window {
+		state.failures = 0
+		state.windowStart = now
+	}
+
+	state.failures++
+	if state.failures < t.threshold {
+		return 0, false
+	}
+
+	// Exponential ban duration: base, 2*base, 4*base, ... capped at maxBan
+	duration := t.baseBan
+	for i := 0; i < state.bans && duration < t.maxBan; i++ {
+		duration *= 2
+	}
+	if duration > t.maxBan {
+		duration = t.maxBan
+	}
+
+	state.bans++
+	state.failures = 0
+	state.windowStart = now
+	state.bannedUntil = now.Add(duration)
+	return duration, true
+}
+
+// RecordSuccess clears the failure count of an IP after a successful authentication
+// The ban history is kept so a client alternating between valid and invalid tokens still escalates
+func (t *BanTracker) RecordSuccess(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state, ok := t.clients[ip]; ok {
+		state.failures = 0
+	}
+}
+
+// Active returns the number of currently banned IPs
+func (t *BanTracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	active := 0
+	for _, state := range t.clients {
+		if state.bannedUntil.After(now) {
+			active++
+		}
+	}
+	return active
+}
+
+// prune forgets clients that are not banned and have been quiet for longer than the maximum ban
+// Forgetting a client also resets its ban history
+func (t *BanTracker) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for ip, state := range t.clients {
+		if state.bannedUntil.Before(now) && now.Sub(state.lastSeen) > t.maxBan+t.window {
+			delete(t.clients, ip)
+		}
+	}
+}
+
+// RunPruner periodically prunes stale entries until the context is cancelled
+func (t *BanTracker) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.prune()
+		}
+	}
+}
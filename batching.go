@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBatchingBody bounds the body of PUT /admin/batching
+const maxBatchingBody = 4096
+
+// BatchTuning holds the batch size, flush timeout and per-stream limit shared by the batchers,
+// adjustable on /admin/batching so operators can react to Loki pressure without a restart
+// Changes live in memory; the response lists the settings that persist them
+type BatchTuning struct {
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	size      int
+	flush     time.Duration
+	streamMax int           // Entries of one stream that trigger a push (0 = no limit)
+	changed   chan struct{} // Closed and replaced by every change
+}
+
+// NewBatchTuning creates the settings the batchers start with
+func NewBatchTuning(size int, flush time.Duration, streamMax int, logger *slog.Logger) *BatchTuning {
+	return &BatchTuning{
+		logger:    logger,
+		size:      size,
+		flush:     flush,
+		streamMax: streamMax,
+		changed:   make(chan struct{}),
+	}
+}
+
+// Load returns the current settings and a channel closed when they change
+func (t *BatchTuning) Load() (size int, flush time.Duration, streamMax int, changed <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size, t.flush, t.streamMax, t.changed
+}
+
+// Set validates and applies new settings, waking the batchers
+func (t *BatchTuning) Set(size int, flush time.Duration, streamMax int) error {
+	if size < 1 {
+		return fmt.Errorf("batch_size must be at least 1")
+	}
+	if flush < time.Millisecond {
+		return fmt.Errorf("flush_ms must be at least 1")
+	}
+	if streamMax < 0 {
+		return fmt.Errorf("stream_max_entries must not be negative")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if size == t.size && flush == t.flush && streamMax == t.streamMax {
+		return nil
+	}
+	t.logger.Info("Batching changed at runtime",
+		"batch_size", size,
+		"flush_ms", flush.Milliseconds(),
+		"stream_max_entries", streamMax,
+		"previous_batch_size", t.size,
+		"previous_flush_ms", t.flush.Milliseconds(),
+		"previous_stream_max_entries", t.streamMax,
+	)
+	t.size, t.flush, t.streamMax = size, flush, streamMax
+	close(t.changed)
+	t.changed = make(chan struct{})
+	return nil
+}
+
+// Status returns the current settings for the admin endpoint
+func (t *BatchTuning) Status() BatchingSettings {
+	size, flush, streamMax, _ := t.Load()
+	return BatchingSettings{
+		BatchSize:        int64(size),
+		FlushMs:          flush.Milliseconds(),
+		StreamMaxEntries: int64(streamMax),
+		Config: map[string]string{
+			"BATCH_SIZE":       strconv.Itoa(size),
+			"BATCH_FLUSH_MS":   strconv.FormatInt(flush.Milliseconds(), 10),
+			"BATCH_STREAM_MAX": strconv.Itoa(streamMax),
+		},
+	}
+}
+
+// ServeHTTP serves /admin/batching: GET reports the settings, PUT changes the fields it sets
+func (t *BatchTuning) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// Fields missing from the body keep their current value
+		settings := t.Status()
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchingBody))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_batching", err.Error())
+			return
+		}
+		if err := t.Set(int(settings.BatchSize), time.Duration(settings.FlushMs)*time.Millisecond, int(settings.StreamMaxEntries)); err != nil {
+			writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_batching", err.Error())
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Status())
+}
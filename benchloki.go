@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// benchStep is the result of pushing at one concurrency level
+type benchStep struct {
+	concurrency int
+	stats       batch.PushStats
+	elapsed     time.Duration
+}
+
+// entriesPerSecond returns the rate of successfully pushed entries
+func (s *benchStep) entriesPerSecond() float64 {
+	return float64(s.stats.Entries) / s.elapsed.Seconds()
+}
+
+// runBenchLoki pushes synthetic batches at the configured Loki with increasing concurrency
+// and reports throughput and latency per level, to size batching for a given backend
+func runBenchLoki(args []string) int {
+	duration := flag.Duration("duration", 10*time.Second, "How long to push at each concurrency level")
+	maxConcurrency := flag.Int("max-concurrency", 32, "Highest number of concurrent pushes (levels double from 1)")
+	streams := flag.Int("streams", 10, "Streams per batch")
+	lineSize := flag.Int("line-size", 1024, "Approximate size of each synthetic line in bytes")
+
+	cfg, err := loadConfig(args, requireLoki)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench-loki: %v\n", err)
+		return 1
+	}
+	// Entries per push come from BATCH_SIZE (or -batch-size), as for the service
+	batchSize := cfg.BatchSize
+	if *duration <= 0 || *maxConcurrency <= 0 || *streams <= 0 || *lineSize <= 0 {
+		fmt.Fprintln(os.Stderr, "bench-loki: -duration, -max-concurrency, -streams and -line-size must be positive")
+		return 2
+	}
+
+	// Push errors are counted per level, keep the client's own logging quiet
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	cfg.LokiMaxIdleConnsPerHost = *maxConcurrency
+	lokiClient := newLokiClientFromConfig(cfg, NewSecretStore(cfg.secrets()), logger)
+
+	fmt.Printf("Benchmarking %s: %d entries per push across %d streams, ~%d byte lines, %s per level\n",
+		redactedURL(cfg.LokiURL), batchSize, *streams, *lineSize, *duration)
+	fmt.Printf("%-12s %10s %10s %12s %8s %8s %8s\n", "concurrency", "pushes", "failures", "entries/s", "p50", "p99", "max")
+
+	var best *benchStep
+	for concurrency := 1; concurrency <= *maxConcurrency; concurrency *= 2 {
+		step := benchLokiStep(lokiClient, cfg.ServiceName, concurrency, *duration, batchSize, *streams, *lineSize)
+		fmt.Printf("%-12d %10d %10d %12.0f %8s %8s %8s\n",
+			concurrency,
+			step.stats.Pushes,
+			step.stats.Failures,
+			step.entriesPerSecond(),
+			step.stats.Percentile(50).Round(time.Millisecond),
+			step.stats.Percentile(99).Round(time.Millisecond),
+			step.stats.Percentile(100).Round(time.Millisecond),
+		)
+
+		// Failures or falling throughput mean Loki is past what it can sustain
+		if step.stats.Failures > 0 {
+			fmt.Printf("Stopping: %d pushes failed at concurrency %d\n", step.stats.Failures, concurrency)
+			break
+		}
+		// Small dips are noise, only a clear drop ends the run
+		if best != nil && step.entriesPerSecond() < best.entriesPerSecond()*0.9 {
+			fmt.Printf("Stopping: throughput fell at concurrency %d\n", concurrency)
+			break
+		}
+		if best == nil || step.entriesPerSecond() > best.entriesPerSecond() {
+			best = step
+		}
+	}
+
+	if best == nil {
+		fmt.Println("No concurrency level completed without failures")
+		return 1
+	}
+	fmt.Printf("Sustainable: %.0f entries/s at concurrency %d (p99 %s)\n",
+		best.entriesPerSecond(), best.concurrency, best.stats.Percentile(99).Round(time.Millisecond))
+	return 0
+}
+
+// benchLokiStep keeps concurrency pushes in flight for duration and collects their results
+func benchLokiStep(lokiClient *loki.Client, serviceName string, concurrency int, duration time.Duration, batchSize, streams, lineSize int) *benchStep {
+	step := &benchStep{concurrency: concurrency}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	deadline := start.Add(duration)
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				batches := benchBatches(serviceName, worker, batchSize, streams, lineSize)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				pushStart := time.Now()
+				err := lokiClient.Push(ctx, batches)
+				elapsed := time.Since(pushStart)
+				cancel()
+
+				mu.Lock()
+				step.stats.Record(batchSize, elapsed, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	step.elapsed = time.Since(start)
+	return step
+}
+
+// benchBatches builds one push of synthetic Auth0-like entries spread over streams
+// Each worker writes its own streams so concurrent pushes never interleave within a stream
+func benchBatches(serviceName string, worker, batchSize, streams, lineSize int) map[string]*Batch {
+	now := time.Now()
+	padding := strings.Repeat("x", max(lineSize-200, 0))
+	batches := make(map[string]*Batch, streams)
+
+	for i := 0; i < batchSize; i++ {
+		labels := map[string]string{
+			"service_name": serviceName,
+			"type":         "bench_loki",
+			"bench_stream": strconv.Itoa(worker*streams + i%streams),
+		}
+		key := batch.LabelKey(labels)
+		batch, ok := batches[key]
+		if !ok {
+			batch = &Batch{Labels: labels, FirstEntry: now}
+			batches[key] = batch
+		}
+
+		timestamp := now.Add(time.Duration(i) * time.Nanosecond)
+		batch.Entries = append(batch.Entries, LogEntry{
+			Timestamp: timestamp.UnixNano(),
+			Labels:    labels,
+			Line: fmt.Sprintf(`{"log_id":"bench-%d-%d-%d","data":{"date":%q,"type":"bench_loki","description":"bench-loki synthetic entry","details":%q}}`,
+				worker, now.UnixNano(), i, timestamp.UTC().Format(time.RFC3339Nano), padding),
+		})
+	}
+	return batches
+}
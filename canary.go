@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// canaryPollInterval is how often Loki is queried for a canary entry until it shows up
+const canaryPollInterval = time.Second
+
+// Canary periodically sends a synthetic entry through the entry queue, batchers and Loki and
+// queries Loki until it can be read back, measuring end-to-end delivery
+type Canary struct {
+	entryQueue  *batch.EntryQueue
+	loki        *loki.Client
+	serviceName string
+	slo         time.Duration
+	metrics     *Metrics
+	logger      *slog.Logger
+}
+
+// canaryLine is the line of a canary entry
+type canaryLine struct {
+	Canary string    `json:"canary"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// NewCanary creates a canary whose entries must be readable from Loki within slo
+// Canary entries go to the Loki client's default tenant
+func NewCanary(entryQueue *batch.EntryQueue, loki *loki.Client, serviceName string, slo time.Duration, metrics *Metrics, logger *slog.Logger) *Canary {
+	return &Canary{
+		entryQueue:  entryQueue,
+		loki:        loki,
+		serviceName: serviceName,
+		slo:         slo,
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+// Run sends a canary every interval until ctx is canceled
+// A check waits up to the SLO for its entry, so checks never overlap
+func (c *Canary) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.check(ctx)
+	}
+}
+
+// check sends one canary entry and waits for it to arrive in Loki
+func (c *Canary) check(ctx context.Context) {
+	id := newRequestID()
+	sent := time.Now()
+	line, _ := json.Marshal(canaryLine{Canary: id, SentAt: sent.UTC()})
+	entry := LogEntry{
+		Timestamp: sent.UnixNano(),
+		Labels:    map[string]string{"service_name": c.serviceName},
+		Line:      string(line),
+		Source:    sourceCanary,
+	}
+	if !c.entryQueue.Offer(entry) {
+		c.metrics.canaryChecks.Inc("dropped")
+		c.logger.Error("Canary entry dropped, the entry queue is full", "canary", id)
+		return
+	}
+
+	selector := "{service_name=" + strconv.Quote(c.serviceName) + "," + batch.SourceLabel + "=" + strconv.Quote(sourceCanary) + "}"
+	deadline := sent.Add(c.slo)
+	ticker := time.NewTicker(canaryPollInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		queryCtx, cancel := context.WithDeadline(ctx, deadline)
+		match, err := c.loki.FindLine(queryCtx, "", selector, id, sent.Add(-time.Minute), time.Now().Add(time.Minute))
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && match != nil {
+			latency := time.Since(sent)
+			c.metrics.canaryChecks.Inc("ok")
+			c.metrics.canaryLatency.Observe(latency.Seconds())
+			c.metrics.canaryLastSuccess.Set(float64(time.Now().Unix()))
+			c.logger.Debug("Canary arrived in Loki", "canary", id, "latency_ms", latency.Milliseconds())
+			return
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		if !time.Now().Before(deadline) {
+			c.metrics.canaryChecks.Inc("missing")
+			logger := c.logger.With("canary", id, "slo_seconds", c.slo.Seconds())
+			if lastErr != nil {
+				logger.Error("Canary not found in Loki within the SLO", "error", lastErr)
+			} else {
+				logger.Error("Canary not found in Loki within the SLO")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const cloudflareIPRangesURL = "https://api.cloudflare.com/client/v4/ips"
+
+// CloudflareIPRanges represents the response of Cloudflare's IP ranges API
+type CloudflareIPRanges struct {
+	Success bool `json:"success"`
+	Result  struct {
+		IPv4CIDRs []string `json:"ipv4_cidrs"`
+		IPv6CIDRs []string `json:"ipv6_cidrs"`
+		Etag      string   `json:"etag"`
+	} `json:"result"`
+}
+
+// fetchCloudflareIPRanges fetches the address ranges Cloudflare connects to origins from
+func fetchCloudflareIPRanges(logger *slog.Logger) ([]string, error) {
+	client := newOutboundClient(10 * time.Second)
+
+	resp, err := client.Get(cloudflareIPRangesURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Cloudflare IP ranges: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cloudflare IP ranges endpoint returned status %d", resp.StatusCode)
+	}
+
+	var ipRanges CloudflareIPRanges
+	if err := json.NewDecoder(resp.Body).Decode(&ipRanges); err != nil {
+		return nil, fmt.Errorf("failed to parse Cloudflare IP ranges JSON: %w", err)
+	}
+
+	if !ipRanges.Success {
+		return nil, fmt.Errorf("Cloudflare IP ranges endpoint reported failure")
+	}
+
+	allIPs := append(ipRanges.Result.IPv4CIDRs, ipRanges.Result.IPv6CIDRs...)
+	if len(allIPs) == 0 {
+		return nil, fmt.Errorf("Cloudflare IP ranges response is empty")
+	}
+
+	logger.Info("Fetched Cloudflare IP ranges",
+		"ipv4_count", len(ipRanges.Result.IPv4CIDRs),
+		"ipv6_count", len(ipRanges.Result.IPv6CIDRs),
+		"etag", ipRanges.Result.Etag,
+		"source", cloudflareIPRangesURL,
+	)
+
+	return allIPs, nil
+}
+
+// refreshCloudflareIPRanges periodically re-fetches Cloudflare's ranges, keeping the current ones on failure
+func refreshCloudflareIPRanges(ctx context.Context, interval time.Duration, ranges *IPAllowlist, logger *slog.Logger) {
+	for {
+		timer := time.NewTimer(jitteredInterval(interval))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		entries, err := fetchCloudflareIPRanges(logger)
+		if err != nil {
+			logger.Warn("Keeping current Cloudflare IP ranges after failed refresh",
+				"error", err,
+				"current_count", ranges.Len(),
+			)
+			continue
+		}
+
+		ranges.Update(entries)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/amba/a0-logstream2loki/pkg/auth"
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// subcommand is a command-line tool run instead of the service
+// It receives the arguments after its name and returns the process exit code
+type subcommand struct {
+	usage string
+	run   func(args []string) int
+}
+
+// subcommands are selected by the first command-line argument
+var subcommands = map[string]subcommand{
+	"gen-token":  {"Print the HMAC bearer token for a tenant", runGenToken},
+	"replay":     {"Push an exported JSONL log file to Loki", runReplay},
+	"test-loki":  {"Check connectivity and credentials of the configured Loki", runTestLoki},
+	"bench-loki": {"Measure the push throughput of the configured Loki", runBenchLoki},
+	"version":    {"Print version and build information", runVersion},
+	"generate":   {"Generate synthetic Auth0 events for load testing", runGenerate},
+	"mock-loki":  {"Run a local Loki stand-in that records pushes to a file", runMockLoki},
+}
+
+// runSubcommand runs the subcommand named by args[0], if there is one
+func runSubcommand(args []string) (exitCode int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "help", "-help", "--help", "-h":
+		printSubcommands()
+		return 0, true
+	case "-version", "--version":
+		return runVersion(args[1:]), true
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return 0, false
+	}
+	return cmd.run(args[1:]), true
+}
+
+// printSubcommands lists the available subcommands on stderr
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags]\t\t\tRun the service\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <command> [flags]\tRun a command\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, subcommands[name].usage)
+	}
+}
+
+// runGenToken prints hex(HMAC-SHA256(secret, tenant)), the bearer token the Auth0 log stream must send
+func runGenToken(args []string) int {
+	fs := flag.NewFlagSet("gen-token", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "Tenant name, as passed in the tenant query parameter (required)")
+	secret := fs.String("secret", "", "HMAC secret (default: the first secret in HMAC_SECRET or HMAC_SECRET_FILE)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *tenant == "" {
+		fmt.Fprintln(os.Stderr, "gen-token: -tenant is required")
+		fs.Usage()
+		return 2
+	}
+
+	key := *secret
+	if key == "" {
+		secrets, err := configuredHMACSecrets()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gen-token: %v\n", err)
+			return 1
+		}
+		if len(secrets) == 0 {
+			fmt.Fprintln(os.Stderr, "gen-token: no HMAC secret configured, set HMAC_SECRET or HMAC_SECRET_FILE or pass -secret")
+			return 1
+		}
+		// During rotation the new secret is listed first
+		key = secrets[0]
+	}
+
+	fmt.Println(auth.Token(key, *tenant))
+	return 0
+}
+
+// configuredHMACSecrets reads the HMAC secrets the service would use from the environment
+func configuredHMACSecrets() ([]string, error) {
+	if path := os.Getenv("HMAC_SECRET_FILE"); path != "" {
+		value, err := readSecretFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return config.SplitList(value), nil
+	}
+	return config.SplitList(strings.TrimSpace(os.Getenv("HMAC_SECRET"))), nil
+}
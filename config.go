@@ -1,73 +1,611 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/config"
 )
 
+// defaultMaxLineSize is the largest log line accepted when no size is configured for a source
+const defaultMaxLineSize = 1024 * 1024
+
 // Config holds all configuration for the service
 type Config struct {
-	LokiURL         string
-	LokiUsername    string   // Optional: Loki basic auth username
-	LokiPassword    string   // Optional: Loki basic auth password
-	ListenAddr      string
-	HMACSecret      string
-	CustomAuthToken string   // Optional: Custom authorization token (takes precedence over HMAC)
-	BatchSize       int
-	BatchFlush      int      // milliseconds
-	ServiceName     string   // Service name label for Loki logs (default: auth0_logs)
-	LogLevel        string   // Log level: DEBUG, INFO, WARN, ERROR (default: INFO)
-	VerboseLogging  bool     // Enable verbose logging and bypass IP allowlist
-	AllowLocalIPs   bool     // Allow requests from local/private network IPs
-	IgnoreAuth0IPs  bool     // Ignore Auth0's official IP ranges
-	CustomIPs       []string // Custom IPs to add to allowlist
-	IPAllowlist     []string // Final computed allowlist (not configured directly)
+	LokiURL                     string
+	LokiUsername                string            // Optional: Loki basic auth username
+	LokiPassword                string            // Optional: Loki basic auth password
+	LokiOrgID                   string            // X-Scope-OrgID of pushes for unmapped tenants (empty sends none)
+	LokiOrgIDs                  map[string]string // Per-tenant X-Scope-OrgID, overriding LokiOrgID
+	LokiGzip                    bool              // gzip-compress push bodies (Content-Encoding: gzip)
+	LokiHTTP2                   string            // auto (HTTP/2 when negotiated over TLS), off or h2c (HTTP/2 without TLS)
+	LokiMaxConnsPerHost         int               // Connections to Loki at once (0 = unlimited)
+	LokiMaxIdleConnsPerHost     int               // Idle connections to Loki kept for reuse
+	LokiSigV4                   bool              // Sign Loki requests with AWS SigV4 instead of basic auth
+	LokiSigV4Region             string            // AWS region of the signature (defaults to AWS_REGION)
+	LokiSigV4Service            string            // AWS service name of the signature
+	LokiOAuth2TokenURL          string            // OAuth2 token endpoint; enables client credentials auth to Loki
+	LokiOAuth2ClientID          string            // OAuth2 client ID
+	LokiOAuth2ClientSecret      string            // OAuth2 client secret
+	LokiOAuth2Scopes            []string          // OAuth2 scopes requested with the token
+	ListenAddr                  string
+	AdminAddr                   string   // Optional separate listener for /health, /metrics and admin endpoints
+	AdminToken                  string   // Bearer token of admin requests that change state (none are served without it)
+	EnablePprof                 bool     // Serve net/http/pprof on the admin listener
+	HMACSecrets                 []string // HMAC secrets; several may be active during rotation
+	CustomAuthTokens            []string // Optional: Custom authorization tokens (take precedence over HMAC)
+	AuthMethods                 []string // Authentication schemes tried in order: hmac, token, jwt, mtls (empty: token with CUSTOM_AUTH_TOKEN, else hmac)
+	JWTJWKSURL                  string   // JWKS URL of the keys JWT bearer tokens are signed with
+	JWTPublicKeyFile            string   // PEM public keys or certificates JWT bearer tokens are signed with
+	JWTIssuer                   string   // Required iss claim of JWT bearer tokens (empty accepts any)
+	JWTAudience                 string   // Required aud claim of JWT bearer tokens (empty accepts any)
+	JWTTenantClaim              string   // Claim of JWT bearer tokens naming the tenant(s) they are valid for
+	TLSCertFile                 string   // Certificate of the HTTP listener (empty serves plain HTTP)
+	TLSKeyFile                  string   // Private key of TLSCertFile
+	TLSClientCAFile             string   // CA bundle client certificates are verified against, for mtls
+	BatchSize                   int
+	BatchFlush                  int                    // milliseconds
+	BatchStreamMax              int                    // Entries of one stream that trigger a push (0 = no per-stream limit)
+	BatcherShards               int                    // Batcher goroutines, each owning a share of the streams
+	AdaptiveBatching            bool                   // Grow BatchSize and BatchFlush while Loki pushes are slow
+	BatchSizeMax                int                    // Upper bound of the adaptive batch size
+	BatchFlushMax               int                    // Upper bound of the adaptive flush timeout in milliseconds
+	AdaptiveLatencyTarget       int                    // Smoothed push latency in milliseconds above which batches grow
+	PushSummaryInterval         int                    // seconds between INFO push summaries (0 logs every push at INFO)
+	ServiceName                 string                 // Service name label for Loki logs (default: auth0_logs)
+	LogLevel                    string                 // Log level: DEBUG, INFO, WARN, ERROR (default: INFO)
+	VerboseLogging              bool                   // Enable verbose logging and bypass IP allowlist
+	AllowLocalIPs               bool                   // Allow requests from local/private network IPs
+	IgnoreAuth0IPs              bool                   // Ignore Auth0's official IP ranges
+	CustomIPs                   []string               // Custom IPs to add to allowlist
+	IPAllowlist                 []string               // Final computed allowlist (not configured directly)
+	TrustedProxies              []string               // CIDRs of proxies whose forwarding headers are trusted
+	StrictClientIP              bool                   // Ignore forwarding headers and always use the connection's remote address
+	TrustAnyForwardedFor        bool                   // Legacy: trust the first X-Forwarded-For entry from any source when no proxies are configured
+	CloudflareMode              bool                   // Trust CF-Connecting-IP from Cloudflare's ranges and reject it from anywhere else
+	ProxyProtocol               bool                   // Parse PROXY protocol v1/v2 headers on accepted connections (from TRUSTED_PROXIES when set)
+	IPRangesRefreshInterval     int                    // seconds between IP range refreshes (0 = fetch at startup only)
+	IPRangesStartupJitterMs     int                    // random delay before the startup fetch, spreads out fleet restarts
+	IPRangesCacheFile           string                 // Optional cache file for the Auth0 IP ranges (may be on a shared volume)
+	IPRangesMaxChangePct        float64                // Refreshes changing more of the allowlist than this are refused (0 = no limit)
+	EgressProxy                 string                 // Proxy for all outbound HTTP (socks5://, socks5h://, http://)
+	MaxEntryAgeHours            int                    // Do not push entries older than this (match Loki's reject_old_samples_max_age, 0 disables)
+	ExactlyOnceMode             bool                   // Keep entries byte-identical and deterministically timestamped so Loki dedups webhook retries
+	CanonicalizeJSON            bool                   // Forward lines with sorted keys and compact formatting
+	SchemaDriftDetection        bool                   // Report new fields and type changes in each tenant's events
+	DryRun                      bool                   // Write Loki payloads to DryRunOutput instead of pushing them
+	DryRunOutput                string                 // File receiving dry-run payloads (empty = stdout)
+	PrintConfig                 bool                   // Print the effective configuration, secrets redacted, and exit (flag only)
+	SyncDelivery                bool                   // Answer /logs only after Loki acknowledged the entries (at-least-once)
+	SyncDeliveryTimeout         int                    // seconds to wait for that acknowledgement before answering 504
+	OutOfOrderAction            string                 // restamp or divert entries Loki rejects as out of order (empty fails the push)
+	LokiPushProxy               bool                   // Forward native Loki pushes received on /loki/api/v1/push
+	LokiPushProxyTenants        []string               // Trusted tenants allowed to use the push proxy, which bypasses quotas and label checks
+	OktaEventHooks              bool                   // Accept Okta event hooks on /okta/events
+	WebhooksFile                string                 // JSON file mapping generic webhook endpoints to Loki streams (empty disables)
+	Webhooks                    WebhookEndpoints       // Endpoints loaded from WebhooksFile
+	AlertRulesFile              string                 // JSON file of rules sending matched Auth0 events to Slack, PagerDuty or a webhook (empty disables)
+	AlertRules                  []AlertRule            // Rules loaded from AlertRulesFile
+	HooksFile                   string                 // JSON file of processing hooks dropping, relabeling or annotating entries (empty disables)
+	Hooks                       []ProcessingHook       // Hooks loaded from HooksFile
+	SQSQueueURL                 string                 // SQS queue receiving Auth0 events from EventBridge (empty disables)
+	SQSConcurrency              int                    // Parallel SQS pollers
+	AzureQueueURL               string                 // SAS URL of a Storage Queue receiving Auth0 events from Event Grid (empty disables)
+	AzureQueueConcurrency       int                    // Parallel Storage Queue pollers
+	KafkaRESTURL                string                 // Kafka REST Proxy consuming Auth0 events from Kafka (empty disables)
+	KafkaTopics                 []string               // Kafka topics holding Auth0 events
+	KafkaGroup                  string                 // Kafka consumer group whose offsets track delivery
+	TenantQuotaLinesPerDay      int                    // Default lines a tenant may send per UTC day (0 = unlimited)
+	TenantQuotaBytesPerDay      int                    // Default bytes a tenant may send per UTC day (0 = unlimited)
+	TenantQuotaLinesPerSec      float64                // Default lines a tenant may send per second (0 = unlimited)
+	QuotasFile                  string                 // JSON file with per-tenant quotas replacing the defaults (empty uses the defaults)
+	TenantQuotas                map[string]TenantQuota // Per-tenant quotas loaded from QuotasFile
+	TenantStaleMinutes          int                    // Warn when a streaming tenant is silent for this long (0 disables)
+	FaultRejectPct              float64                // Chaos testing: percentage of requests rejected with 503
+	FaultDelayMs                int                    // Chaos testing: delay added to delayed requests
+	FaultDelayPct               float64                // Chaos testing: percentage of requests delayed by FaultDelayMs
+	FaultChannelFullPct         float64                // Chaos testing: percentage of lines dropped as if the entry channel were full
+	LogLookupCapacity           int                    // Recent log_ids whose delivery status is kept for /admin/logs lookups (0 disables)
+	LogLookupLokiHours          int                    // Hours of Loki searched by /admin/logs lookups (0 disables the Loki search)
+	RecentEntries               int                    // Last accepted entries kept in memory for /admin/recent (0 disables)
+	MaxLineSize                 int                    // Default maximum log line size in bytes
+	MaxLineSizes                map[string]int         // Per-source maximum line sizes, overriding MaxLineSize
+	OversizedLineAction         string                 // reject (skip and count) or truncate lines above the maximum line size
+	MaxLinesPerRequest          int                    // Lines accepted per /logs request (0 = unlimited)
+	MaxLinesAction              string                 // reject (413) or truncate requests with more lines
+	ParseWorkers                int                    // Goroutines parsing the lines of large deliveries in parallel (0 parses on the request goroutine)
+	MaxConcurrentRequests       int                    // Ingestion requests handled at once, above which 503 is returned (0 = unlimited)
+	MaxInflightBytes            int                    // Body bytes of the ingestion requests handled at once (0 = unlimited)
+	MemoryLimitBytes            int                    // Memory limit watched for pressure, also set as the runtime's limit (0 uses GOMEMLIMIT)
+	MemoryPressurePercent       int                    // Percent of the memory limit above which deliveries are shed (0 disables)
+	MaintenanceRetryAfter       int                    // Retry-After in seconds of deliveries answered 503 in maintenance mode
+	ShutdownTimeout             int                    // Seconds a graceful shutdown may take before the service exits regardless
+	ShutdownPolicy              string                 // drain (push buffered entries to Loki) or persist (spill them to SPILL_DIR) at shutdown
+	Serverless                  string                 // off, http (push each request's entries before answering) or lambda (serve AWS Lambda invocations)
+	SpillDir                    string                 // Directory entries spill to while the entry queue is full (empty drops them)
+	SpillMaxBytes               int                    // Disk space the spilled entries may use
+	DLQDir                      string                 // Directory the entries of failed pushes are dead-lettered to (empty drops them)
+	DLQMaxBytes                 int                    // Disk space the dead-lettered batches may use
+	DLQReplayInterval           int                    // Seconds between automatic replays of dead-lettered batches (0 disables)
+	DLQExportURL                string                 // s3:// or gs:// URL dead-lettered batches are exported to (optional)
+	DLQExportAfterAttempts      int                    // Failed automatic replays after which a batch is exported
+	DiskEncryptionKey           string                 // Base64 AES key encrypting on-disk buffers (optional)
+	DiskEncryptionKeyFile       string                 // File containing DiskEncryptionKey
+	DiskEncryptionKMSCiphertext string                 // Base64 data key encrypted with AWS KMS, used instead of DiskEncryptionKey
+	DiskSecureDelete            bool                   // Overwrite on-disk buffer files with zeros before deleting them
+	LabelQueryParams            []string               // Query parameters added as stream labels
+	LabelHeader                 string                 // Request header carrying key=value stream labels
+	LabelHeaderKeys             []string               // Labels accepted from LabelHeader (empty ignores the header)
+	AuthBanThreshold            int                    // auth failures within the window that trigger a temporary ban (0 disables)
+	AuthBanWindow               int                    // seconds over which failures are counted
+	AuthBanDuration             int                    // seconds of the first ban, doubled for each repeat
+	AuthBanMaxDuration          int                    // seconds, upper bound for repeated bans
+	MetricsBackend              string                 // prometheus (scraped on /metrics), statsd or dogstatsd
+	StatsDAddr                  string                 // UDP address of the StatsD/DogStatsD agent
+	StatsDPrefix                string                 // Prefix for StatsD metric names
+	StatsDFlushInterval         int                    // seconds between StatsD flushes
+	MetricsMaxSeries            int                    // Label combinations per per-tenant metric before folding into "other"
+	OTLPEndpoint                string                 // OTLP/HTTP collector base URL for traces (empty disables tracing)
+	OTLPHeaders                 []string               // Extra headers for the collector as key=value pairs (env only)
+	OTelServiceName             string                 // service.name resource attribute of exported spans
+	TraceSampleRatio            float64                // Fraction of new traces recorded (requests with a traceparent follow the caller)
+	RemoteWriteURL              string                 // Prometheus remote-write endpoint receiving the derived Auth0 metrics (empty disables)
+	RemoteWriteInterval         int                    // Seconds between remote-write pushes
+	RemoteWriteExternalLabels   []string               // Labels added to every remote-written series as name=value pairs
+	RemoteWriteHeaders          []string               // Extra headers for the remote-write endpoint as key=value pairs (env only)
+	CanaryInterval              int                    // Seconds between end-to-end canary entries (0 disables the canary)
+	CanarySLO                   int                    // Seconds within which a canary entry must be readable from Loki
+
+	// Secret files (Docker/Kubernetes secrets convention, mutually exclusive with the direct values)
+	HMACSecretFile             string
+	CustomAuthTokenFile        string
+	LokiUsernameFile           string
+	LokiPasswordFile           string
+	LokiOAuth2ClientSecretFile string
+	SecretsWatchInterval       int // seconds between secret file reloads (0 disables watching)
+
+	// External secrets backend (vault or aws), overrides the values above for keys it defines
+	SecretsProvider        string
+	SecretsRefreshInterval int // seconds between secret refreshes from the provider (0 disables refreshing)
+	VaultAddr              string
+	VaultToken             string
+	VaultNamespace         string
+	VaultSecretPath        string // e.g. secret/data/a0-logstream2loki (KV v2)
+	AWSSecretID            string // Secrets Manager secret name or ARN
+
+	// Remote configuration (consul or etcd), a document of variables read before the environment
+	RemoteConfigBackend string
+	RemoteConfigAddr    string // e.g. http://consul:8500 or http://etcd:2379
+	RemoteConfigKey     string
+	RemoteConfigToken   string // Consul ACL token
+	RemoteConfigRestart bool   // Restart gracefully when a watched change needs it
+
+	secretsProvider SecretsProvider // Resolved from SecretsProvider (not configured directly)
+	remoteConfig    *RemoteConfig   // Loaded from RemoteConfigBackend (not configured directly)
+
+	// Preset of derived settings (grafana-cloud), filling in what is not configured otherwise
+	Preset             string
+	GrafanaCloudZone   string // e.g. prod-eu-west-0
+	GrafanaCloudAPIKey string // <user>:<token> of the stack's Loki details page
 }
 
 // LoadConfig loads configuration from environment variables and command-line flags
 // Command-line flags take precedence over environment variables
 func LoadConfig() (*Config, error) {
+	return loadConfig(os.Args[1:], requireLoki|requireAuth)
+}
+
+// configRequirement is a setting loadConfig insists on; subcommands only require what they use
+type configRequirement int
+
+const (
+	requireLoki configRequirement = 1 << iota // LOKI_URL, unless in dry-run mode
+	requireAuth                               // Credentials of the authentication schemes, e.g. HMAC_SECRET
+)
+
+// loadConfig parses args with the service flags plus any a subcommand defined on flag.CommandLine
+func loadConfig(args []string, required configRequirement) (*Config, error) {
 	cfg := &Config{}
 
 	// Define flags
 	lokiURL := flag.String("loki-url", "", "Loki base URL (e.g. http://loki:3100)")
 	lokiUsername := flag.String("loki-username", "", "Loki basic auth username (optional)")
 	lokiPassword := flag.String("loki-password", "", "Loki basic auth password (optional)")
+	lokiOrgID := flag.String("loki-org-id", "", "X-Scope-OrgID sent to Loki for tenants without a mapping (optional)")
+	lokiOrgIDs := flag.String("loki-org-ids", "", "Per-tenant X-Scope-OrgID as tenant=org_id pairs (comma-separated)")
+	lokiGzip := flag.Bool("loki-gzip", false, "gzip-compress the JSON push payload sent to Loki")
+	lokiHTTP2 := flag.String("loki-http2", "", "HTTP/2 to Loki: auto (negotiated over TLS), off or h2c (unencrypted, for http:// URLs) (default: auto)")
+	lokiMaxConnsPerHost := flag.Int("loki-max-conns-per-host", 0, "Connections to Loki at once, including those in use (0 = unlimited)")
+	lokiMaxIdleConnsPerHost := flag.Int("loki-max-idle-conns-per-host", 0, "Idle connections to Loki kept for reuse (default: 10)")
+	lokiSigV4 := flag.Bool("loki-sigv4", false, "Sign Loki requests with AWS SigV4, using credentials from the default AWS chain")
+	lokiSigV4Region := flag.String("loki-sigv4-region", "", "AWS region of the Loki SigV4 signature (default: AWS_REGION)")
+	lokiSigV4Service := flag.String("loki-sigv4-service", "aps", "AWS service name of the Loki SigV4 signature")
+	lokiOAuth2TokenURL := flag.String("loki-oauth2-token-url", "", "OAuth2 token endpoint for client credentials auth to Loki")
+	lokiOAuth2ClientID := flag.String("loki-oauth2-client-id", "", "OAuth2 client ID for Loki")
+	lokiOAuth2ClientSecret := flag.String("loki-oauth2-client-secret", "", "OAuth2 client secret for Loki")
+	lokiOAuth2Scopes := flag.String("loki-oauth2-scopes", "", "Comma-separated OAuth2 scopes requested for Loki")
 	listenAddr := flag.String("listen-addr", "", "HTTP listen address (e.g. :8080)")
-	hmacSecret := flag.String("hmac-secret", "", "HMAC secret key for bearer token validation")
-	customAuthToken := flag.String("custom-auth-token", "", "Custom authorization token (takes precedence over HMAC)")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve pprof profiling endpoints on the admin listener (requires -admin-addr)")
+	adminAddr := flag.String("admin-addr", "", "Separate listen address for /health, /metrics and admin endpoints (e.g. 127.0.0.1:9090)")
+	hmacSecret := flag.String("hmac-secret", "", "HMAC secret key(s) for bearer token validation (comma-separated for rotation)")
+	customAuthToken := flag.String("custom-auth-token", "", "Custom authorization token(s) (comma-separated, take precedence over HMAC)")
+	authMethods := flag.String("auth-methods", "", "Comma-separated authentication schemes tried in order: hmac, token, jwt, mtls (default: token with -custom-auth-token, else hmac)")
+	jwtJWKSURL := flag.String("jwt-jwks-url", "", "JWKS URL of the keys JWT bearer tokens are signed with")
+	jwtPublicKeyFile := flag.String("jwt-public-key-file", "", "PEM file of public keys or certificates JWT bearer tokens are signed with")
+	jwtIssuer := flag.String("jwt-issuer", "", "Required iss claim of JWT bearer tokens (optional)")
+	jwtAudience := flag.String("jwt-audience", "", "Required aud claim of JWT bearer tokens (optional)")
+	jwtTenantClaim := flag.String("jwt-tenant-claim", "", "Claim of JWT bearer tokens naming the tenant (default: tenant)")
+	tlsCertFile := flag.String("tls-cert-file", "", "Certificate of the HTTP listener, which then serves HTTPS (optional)")
+	tlsKeyFile := flag.String("tls-key-file", "", "Private key of -tls-cert-file")
+	tlsClientCAFile := flag.String("tls-client-ca-file", "", "CA bundle client certificates are verified against, for -auth-methods mtls")
 	batchSize := flag.Int("batch-size", 500, "Maximum number of entries per batch")
 	batchFlush := flag.Int("batch-flush-ms", 200, "Maximum milliseconds before flushing a batch")
+	batchStreamMax := flag.Int("batch-stream-max", 0, "Entries of one stream that trigger a push (0 = no per-stream limit)")
+	batcherShards := flag.Int("batcher-shards", 1, "Batcher goroutines, each batching and pushing a share of the streams")
+	adaptiveBatching := flag.Bool("adaptive-batching", false, "Grow batch size and flush timeout while Loki pushes are slow, shrink them when it recovers")
+	batchSizeMax := flag.Int("batch-size-max", 5000, "Largest batch size adaptive batching grows to")
+	batchFlushMax := flag.Int("batch-flush-max-ms", 2000, "Longest flush timeout in milliseconds adaptive batching grows to")
+	adaptiveLatencyTarget := flag.Int("adaptive-batching-target-ms", 1000, "Smoothed push latency in milliseconds above which adaptive batching grows batches")
+	pushSummaryInterval := flag.Int("push-summary-interval", 60, "Seconds between INFO push summaries; per-push logs become DEBUG (0 logs every push at INFO)")
 	serviceName := flag.String("service-name", "", "Service name label for Loki logs (default: auth0_logs)")
 	logLevel := flag.String("log-level", "", "Log level: DEBUG, INFO, WARN, ERROR (default: INFO)")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging and bypass IP allowlist")
 	allowLocalIPs := flag.Bool("allow-local-ips", false, "Allow requests from local/private network IPs")
 	ignoreAuth0IPs := flag.Bool("ignore-auth0-ips", false, "Ignore Auth0's official IP ranges")
 	customIPs := flag.String("custom-ips", "", "Comma-separated list of custom IPs to add to allowlist")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For headers are trusted")
+	strictClientIP := flag.Bool("strict-client-ip", false, "Ignore X-Forwarded-For/X-Real-IP and always use the connection's remote address")
+	trustAnyForwardedFor := flag.Bool("trust-any-forwarded-for", false, "Trust X-Forwarded-For from any source when no trusted proxies are set (legacy, spoofable)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Parse PROXY protocol v1/v2 headers on incoming connections (HAProxy/NLB in TCP mode)")
+	cloudflareMode := flag.Bool("cloudflare-mode", false, "Resolve client IPs from CF-Connecting-IP for requests coming from Cloudflare's IP ranges")
+	ipRangesRefreshInterval := flag.Int("ip-ranges-refresh-interval", 0, "Seconds between Auth0 IP range refreshes (0 = fetch at startup only)")
+	ipRangesStartupJitterMs := flag.Int("ip-ranges-startup-jitter-ms", 0, "Maximum random delay in milliseconds before the startup IP range fetch")
+	egressProxy := flag.String("egress-proxy", "", "Proxy URL for all outbound HTTP, e.g. socks5://bastion:1080 (optional)")
+	ipRangesCacheFile := flag.String("ip-ranges-cache-file", "", "Cache file for the Auth0 IP ranges (optional, may be shared between replicas)")
+	ipRangesMaxChangePercent := flag.Float64("ip-ranges-max-change-percent", 50, "Refuse IP range refreshes that change more than this percentage of the allowlist (0 for no limit)")
+	maxEntryAgeHours := flag.Int("max-entry-age-hours", 0, "Do not push entries older than this many hours; dead-lettered with -dlq-dir (match Loki's reject_old_samples_max_age, 0 disables)")
+	exactlyOnceMode := flag.Bool("exactly-once-mode", false, "Guarantee stable timestamps and unmodified lines so Loki dedups redelivered entries")
+	maxLineSize := flag.Int("max-line-size", defaultMaxLineSize, "Maximum log line size in bytes")
+	maxLinesPerRequest := flag.Int("max-lines-per-request", 0, "Lines accepted per /logs request (0 = unlimited)")
+	parseWorkers := flag.Int("parse-workers", 0, "Goroutines parsing large deliveries in parallel (0 = parse on the request goroutine)")
+	maxConcurrentRequests := flag.Int("max-concurrent-requests", 0, "Ingestion requests handled at once, above which 503 is returned (0 = unlimited)")
+	maxInflightBytes := flag.Int("max-inflight-bytes", 0, "Body bytes of the ingestion requests handled at once (0 = unlimited)")
+	spillDir := flag.String("spill-dir", "", "Directory entries spill to while the entry queue is full, instead of being dropped (optional)")
+	diskEncryptionKey := flag.String("disk-encryption-key", "", "Base64 AES-128/192/256 key encrypting on-disk buffers such as the spill queue (optional)")
+	diskEncryptionKMSCiphertext := flag.String("disk-encryption-kms-ciphertext", "", "Base64 data key encrypted with AWS KMS that encrypts on-disk buffers (optional)")
+	diskSecureDelete := flag.Bool("disk-secure-delete", false, "Overwrite on-disk buffer files with zeros before deleting them")
+	spillMaxBytes := flag.Int("spill-max-bytes", 0, "Disk space the spilled entries may use (default: 1073741824)")
+	dlqDir := flag.String("dlq-dir", "", "Directory the entries of pushes Loki did not accept are dead-lettered to, instead of being dropped (optional)")
+	dlqMaxBytes := flag.Int("dlq-max-bytes", 0, "Disk space the dead-lettered batches may use (default: 1073741824)")
+	dlqReplayInterval := flag.Int("dlq-replay-interval", 0, "Seconds between automatic replays of dead-lettered batches to Loki (0 disables)")
+	dlqExportURL := flag.String("dlq-export-url", "", "s3://bucket/prefix or gs://bucket/prefix dead-lettered batches are exported to after failed replays (optional)")
+	dlqExportAfterAttempts := flag.Int("dlq-export-after-attempts", 0, "Failed automatic replays after which a dead-lettered batch is exported (default: 3)")
+	memoryLimitBytes := flag.Int("memory-limit-bytes", 0, "Memory limit watched for memory pressure, also applied as the Go memory limit (0 = GOMEMLIMIT)")
+	memoryPressurePercent := flag.Int("memory-pressure-percent", 90, "Percent of the memory limit above which deliveries are shed with 503 (0 disables)")
+	maintenanceRetryAfter := flag.Int("maintenance-retry-after", 0, "Retry-After in seconds of deliveries answered 503 in maintenance mode (default: 300)")
+	shutdownTimeout := flag.Int("shutdown-timeout", 0, "Seconds a graceful shutdown may take before the service exits regardless (default: 30)")
+	shutdownPolicy := flag.String("shutdown-policy", "", "What happens to buffered entries at shutdown: drain (push them to Loki) or persist (spill them to -spill-dir) (default: drain)")
+	serverless := flag.String("serverless", "", "Serverless mode: auto (detect), off, http (push each request's entries before answering) or lambda (default: auto)")
+	maxLinesAction := flag.String("max-lines-action", "", "What to do with requests above -max-lines-per-request: reject (413) or truncate (default: reject)")
+	oversizedLineAction := flag.String("oversized-line-action", "", "What to do with lines above the maximum line size: reject (skip) or truncate (default: reject)")
+	labelQueryParams := flag.String("label-query-params", "", "Comma-separated query parameters added as stream labels, e.g. env,region")
+	labelHeader := flag.String("label-header", "X-Loki-Labels", "Request header carrying comma-separated key=value stream labels")
+	labelHeaderKeys := flag.String("label-header-keys", "", "Comma-separated labels accepted from -label-header (empty ignores the header)")
+	maxLineSizes := flag.String("max-line-sizes", "", "Per-source maximum line sizes as source=bytes pairs, e.g. auth0=4194304 (comma-separated)")
+	logLookupCapacity := flag.Int("log-lookup-capacity", 50000, "Recent log_ids whose delivery status is kept for /admin/logs lookups (0 disables)")
+	logLookupLokiHours := flag.Int("log-lookup-loki-hours", 24, "Hours of Loki searched by /admin/logs lookups (0 disables the Loki search)")
+	recentEntries := flag.Int("recent-entries", 0, "Last accepted entries kept in memory for /admin/recent (0 disables)")
+	canonicalizeJSON := flag.Bool("canonicalize-json", false, "Forward lines with sorted keys and compact formatting")
+	syncDelivery := flag.Bool("sync-delivery", false, "Answer /logs only after Loki acknowledged the entries, with 5xx on failure")
+	syncDeliveryTimeout := flag.Int("sync-delivery-timeout", 20, "Seconds to wait for Loki's acknowledgement in synchronous delivery mode")
+	lokiPushProxy := flag.Bool("loki-push-proxy", false, "Forward native Loki pushes from other agents received on /loki/api/v1/push")
+	lokiPushProxyTenants := flag.String("loki-push-proxy-tenants", "", "Comma-separated trusted tenants allowed to use the push proxy")
+	oktaEventHooks := flag.Bool("okta-event-hooks", false, "Accept Okta System Log events from Okta event hooks on /okta/events")
+	webhooksFile := flag.String("webhooks-file", "", "JSON file mapping generic webhook endpoints (/webhooks/{name}) to Loki streams")
+	alertRulesFile := flag.String("alert-rules-file", "", "JSON file of rules sending matched Auth0 events to Slack, PagerDuty or a webhook")
+	hooksFile := flag.String("hooks-file", "", "JSON file of processing hooks dropping, relabeling or annotating entries")
+	sqsQueueURL := flag.String("sqs-queue-url", "", "SQS queue receiving Auth0 events from EventBridge")
+	sqsConcurrency := flag.Int("sqs-concurrency", 4, "Parallel SQS pollers")
+	azureQueueURL := flag.String("azure-queue-url", "", "SAS URL of an Azure Storage Queue receiving Auth0 events from Event Grid")
+	azureQueueConcurrency := flag.Int("azure-queue-concurrency", 4, "Parallel Azure Storage Queue pollers")
+	kafkaRESTURL := flag.String("kafka-rest-url", "", "Kafka REST Proxy (v2 API) to consume Auth0 events from Kafka through")
+	kafkaTopics := flag.String("kafka-topics", "", "Comma-separated Kafka topics holding Auth0 events")
+	kafkaGroup := flag.String("kafka-group", "a0-logstream2loki", "Kafka consumer group")
+	quotaLinesPerDay := flag.Int("tenant-quota-lines-per-day", 0, "Lines each tenant may send per UTC day before getting 429 (0 = unlimited)")
+	quotaBytesPerDay := flag.Int("tenant-quota-bytes-per-day", 0, "Bytes each tenant may send per UTC day before getting 429 (0 = unlimited)")
+	quotaLinesPerSec := flag.Float64("tenant-quota-lines-per-second", 0, "Lines each tenant may send per second before getting 429 (0 = unlimited)")
+	quotasFile := flag.String("quotas-file", "", "JSON file with per-tenant quotas replacing the default quotas")
+	tenantStaleMinutes := flag.Int("tenant-stale-minutes", 0, "Warn when a tenant that was streaming sends nothing for this many minutes (0 disables)")
+	outOfOrderAction := flag.String("out-of-order-action", "", "Handling of entries Loki rejects as out of order: restamp or divert (default: fail the push)")
+	dryRun := flag.Bool("dry-run", false, "Write Loki payloads to stdout (or -dry-run-output) instead of pushing them")
+	dryRunOutput := flag.String("dry-run-output", "", "File receiving dry-run payloads (default: stdout)")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration with secrets redacted, then exit")
+	faultRejectPct := flag.Float64("fault-reject-percent", 0, "Chaos testing: reject this percentage of requests with 503")
+	faultDelayMs := flag.Int("fault-delay-ms", 0, "Chaos testing: delay requests by this many milliseconds")
+	faultDelayPct := flag.Float64("fault-delay-percent", 100, "Chaos testing: percentage of requests delayed by -fault-delay-ms")
+	faultChannelFullPct := flag.Float64("fault-channel-full-percent", 0, "Chaos testing: drop this percentage of lines as if the entry channel were full")
+	schemaDriftDetection := flag.Bool("schema-drift-detection", false, "Report new fields and type changes in each tenant's events")
+	authBanThreshold := flag.Int("auth-ban-threshold", 0, "Authentication failures within the window that trigger a temporary IP ban (0 disables)")
+	authBanWindow := flag.Int("auth-ban-window", 60, "Seconds over which authentication failures are counted")
+	authBanDuration := flag.Int("auth-ban-duration", 60, "Seconds of the first ban, doubled for each repeated ban")
+	authBanMaxDuration := flag.Int("auth-ban-max-duration", 3600, "Maximum ban duration in seconds")
+	metricsBackend := flag.String("metrics-backend", "", "Metrics backend: prometheus, statsd or dogstatsd (default: prometheus)")
+	statsdAddr := flag.String("statsd-addr", "", "StatsD/DogStatsD agent address (default: 127.0.0.1:8125)")
+	statsdPrefix := flag.String("statsd-prefix", "", "Prefix for StatsD metric names (default: a0_logstream2loki.)")
+	statsdFlushInterval := flag.Int("statsd-flush-interval", 10, "Seconds between StatsD flushes")
+	metricsMaxSeries := flag.Int("metrics-max-series", 1000, "Maximum label combinations per per-tenant metric (0 for unlimited)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector URL for traces, e.g. http://otel-collector:4318 (empty disables tracing)")
+	otelServiceName := flag.String("otel-service-name", "", "Service name of exported spans (default: a0-logstream2loki)")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", 1, "Fraction of new traces recorded (0-1)")
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote-write endpoint receiving the derived Auth0 metrics (basic auth as URL user info)")
+	remoteWriteInterval := flag.Int("remote-write-interval", 0, "Seconds between remote-write pushes (default: 30)")
+	remoteWriteExternalLabels := flag.String("remote-write-external-labels", "", "Comma-separated name=value labels added to every remote-written series")
+	canaryInterval := flag.Int("canary-interval", 0, "Seconds between synthetic canary entries that are read back from Loki (0 disables)")
+	canarySLO := flag.Int("canary-slo", 0, "Seconds within which a canary entry must be readable from Loki (default: 60)")
+	hmacSecretFile := flag.String("hmac-secret-file", "", "File containing the HMAC secret(s)")
+	customAuthTokenFile := flag.String("custom-auth-token-file", "", "File containing the custom authorization token(s)")
+	lokiUsernameFile := flag.String("loki-username-file", "", "File containing the Loki basic auth username")
+	lokiPasswordFile := flag.String("loki-password-file", "", "File containing the Loki basic auth password")
+	lokiOAuth2ClientSecretFile := flag.String("loki-oauth2-client-secret-file", "", "File containing the OAuth2 client secret for Loki")
+	diskEncryptionKeyFile := flag.String("disk-encryption-key-file", "", "File containing the disk encryption key")
+	secretsWatchInterval := flag.Int("secrets-watch-interval", 0, "Seconds between secret file reloads (0 disables watching)")
+	secretsProvider := flag.String("secrets-provider", "", "External secrets backend: vault or aws (optional)")
+	secretsRefreshInterval := flag.Int("secrets-refresh-interval", 300, "Seconds between secret refreshes from the provider (0 disables refreshing)")
+	vaultAddr := flag.String("vault-addr", "", "Vault address (e.g. https://vault:8200)")
+	vaultNamespace := flag.String("vault-namespace", "", "Vault namespace (optional)")
+	vaultSecretPath := flag.String("vault-secret-path", "", "Vault secret path (e.g. secret/data/a0-logstream2loki)")
+	awsSecretID := flag.String("aws-secret-id", "", "AWS Secrets Manager secret name or ARN")
+	envFile := flag.String("env-file", "", "File of KEY=VALUE environment variables loaded before the configuration is read (optional)")
+	remoteConfigBackend := flag.String("remote-config-backend", "", "Remote configuration backend: consul or etcd (optional)")
+	remoteConfigAddr := flag.String("remote-config-addr", "", "Address of the remote configuration backend (e.g. http://consul:8500)")
+	remoteConfigKey := flag.String("remote-config-key", "", "Key holding the remote configuration document")
+	preset := flag.String("preset", "", "Preset deriving the Loki settings: grafana-cloud (optional)")
+	grafanaCloudZone := flag.String("grafana-cloud-zone", "", "Grafana Cloud zone of the stack for -preset=grafana-cloud (e.g. prod-eu-west-0)")
+	remoteConfigRestart := flag.Bool("remote-config-restart", false, "Restart gracefully when the remote configuration changes settings that need a restart")
+
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// The env file only fills in variables the environment does not set
+	var fromEnvFile map[string]bool
+	if *envFile != "" {
+		var err error
+		if fromEnvFile, err = config.LoadEnvFile(*envFile); err != nil {
+			return nil, err
+		}
+	}
 
-	flag.Parse()
+	// So does the remote configuration, which takes precedence over the env file
+	cfg.RemoteConfigBackend = cmp.Or(*remoteConfigBackend, config.Getenv("REMOTE_CONFIG_BACKEND", ""))
+	cfg.RemoteConfigAddr = cmp.Or(*remoteConfigAddr, config.Getenv("REMOTE_CONFIG_ADDR", ""))
+	cfg.RemoteConfigKey = cmp.Or(*remoteConfigKey, config.Getenv("REMOTE_CONFIG_KEY", ""))
+	cfg.RemoteConfigToken = config.Getenv("REMOTE_CONFIG_TOKEN", "")
+	cfg.RemoteConfigRestart = *remoteConfigRestart || config.GetenvBool("REMOTE_CONFIG_RESTART", false)
+	source, err := newRemoteConfigSource(cfg.RemoteConfigBackend, cfg.RemoteConfigAddr, cfg.RemoteConfigKey, cfg.RemoteConfigToken)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if cfg.remoteConfig, err = loadRemoteConfig(ctx, source, fromEnvFile, cfg.RemoteConfigRestart); err != nil {
+			return nil, err
+		}
+	}
+
+	// The preset fills in what neither the environment, the remote configuration nor the env file set
+	cfg.Preset = cmp.Or(*preset, config.Getenv("PRESET", ""))
+	cfg.GrafanaCloudZone = cmp.Or(*grafanaCloudZone, config.Getenv("GRAFANA_CLOUD_ZONE", ""))
+	cfg.GrafanaCloudAPIKey = config.Getenv("GRAFANA_CLOUD_API_KEY", "")
+	if err := applyPreset(cfg.Preset, cfg.GrafanaCloudZone, cfg.GrafanaCloudAPIKey); err != nil {
+		return nil, err
+	}
 
 	// Load from environment variables first
-	cfg.LokiURL = getEnv("LOKI_URL", "")
-	cfg.LokiUsername = getEnv("LOKI_USERNAME", "")
-	cfg.LokiPassword = getEnv("LOKI_PASSWORD", "")
-	cfg.ListenAddr = getEnv("LISTEN_ADDR", ":8080")
-	cfg.HMACSecret = getEnv("HMAC_SECRET", "")
-	cfg.CustomAuthToken = getEnv("CUSTOM_AUTH_TOKEN", "")
-	cfg.BatchSize = getEnvInt("BATCH_SIZE", 500)
-	cfg.BatchFlush = getEnvInt("BATCH_FLUSH_MS", 200)
-	cfg.ServiceName = getEnv("SERVICE_NAME", "auth0_logs")
-	cfg.LogLevel = getEnv("LOG_LEVEL", "INFO")
-	cfg.VerboseLogging = getEnvBool("VERBOSE_LOGGING", false)
-	cfg.AllowLocalIPs = getEnvBool("ALLOW_LOCAL_IPS", false)
-	cfg.IgnoreAuth0IPs = getEnvBool("IGNORE_AUTH0_IPS", false)
-	cfg.CustomIPs = getEnvSlice("CUSTOM_IPS", []string{})
+	cfg.LokiURL = config.Getenv("LOKI_URL", "")
+	cfg.LokiUsername = config.Getenv("LOKI_USERNAME", "")
+	cfg.LokiPassword = config.Getenv("LOKI_PASSWORD", "")
+	cfg.LokiOrgID = config.Getenv("LOKI_ORG_ID", "")
+	orgIDs := config.GetenvList("LOKI_ORG_IDS", []string{})
+	cfg.LokiGzip = config.GetenvBool("LOKI_GZIP", false)
+	cfg.LokiHTTP2 = config.Getenv("LOKI_HTTP2", lokiHTTP2Auto)
+	cfg.LokiMaxConnsPerHost = config.GetenvInt("LOKI_MAX_CONNS_PER_HOST", 0)
+	cfg.LokiMaxIdleConnsPerHost = config.GetenvInt("LOKI_MAX_IDLE_CONNS_PER_HOST", 10)
+	cfg.LokiSigV4 = config.GetenvBool("LOKI_SIGV4", false)
+	cfg.LokiSigV4Region = config.Getenv("LOKI_SIGV4_REGION", awsRegion())
+	cfg.LokiSigV4Service = config.Getenv("LOKI_SIGV4_SERVICE", "aps")
+	cfg.LokiOAuth2TokenURL = config.Getenv("LOKI_OAUTH2_TOKEN_URL", "")
+	cfg.LokiOAuth2ClientID = config.Getenv("LOKI_OAUTH2_CLIENT_ID", "")
+	cfg.LokiOAuth2ClientSecret = config.Getenv("LOKI_OAUTH2_CLIENT_SECRET", "")
+	cfg.LokiOAuth2Scopes = config.GetenvList("LOKI_OAUTH2_SCOPES", []string{})
+	// Cloud Run and similar platforms name the port to listen on in PORT
+	cfg.ListenAddr = config.Getenv("LISTEN_ADDR", ":"+config.Getenv("PORT", "8080"))
+	cfg.AdminAddr = config.Getenv("ADMIN_ADDR", "")
+	cfg.AdminToken = config.Getenv("ADMIN_TOKEN", "")
+	cfg.EnablePprof = config.GetenvBool("ENABLE_PPROF", false)
+	cfg.HMACSecrets = config.GetenvList("HMAC_SECRET", []string{})
+	cfg.CustomAuthTokens = config.GetenvList("CUSTOM_AUTH_TOKEN", []string{})
+	cfg.AuthMethods = config.GetenvList("AUTH_METHODS", []string{})
+	cfg.JWTJWKSURL = config.Getenv("JWT_JWKS_URL", "")
+	cfg.JWTPublicKeyFile = config.Getenv("JWT_PUBLIC_KEY_FILE", "")
+	cfg.JWTIssuer = config.Getenv("JWT_ISSUER", "")
+	cfg.JWTAudience = config.Getenv("JWT_AUDIENCE", "")
+	cfg.JWTTenantClaim = config.Getenv("JWT_TENANT_CLAIM", "tenant")
+	cfg.TLSCertFile = config.Getenv("TLS_CERT_FILE", "")
+	cfg.TLSKeyFile = config.Getenv("TLS_KEY_FILE", "")
+	cfg.TLSClientCAFile = config.Getenv("TLS_CLIENT_CA_FILE", "")
+	cfg.BatchSize = config.GetenvInt("BATCH_SIZE", 500)
+	cfg.BatchFlush = config.GetenvInt("BATCH_FLUSH_MS", 200)
+	cfg.BatchStreamMax = config.GetenvInt("BATCH_STREAM_MAX", 0)
+	cfg.BatcherShards = config.GetenvInt("BATCHER_SHARDS", 1)
+	cfg.AdaptiveBatching = config.GetenvBool("ADAPTIVE_BATCHING", false)
+	cfg.BatchSizeMax = config.GetenvInt("BATCH_SIZE_MAX", 5000)
+	cfg.BatchFlushMax = config.GetenvInt("BATCH_FLUSH_MAX_MS", 2000)
+	cfg.AdaptiveLatencyTarget = config.GetenvInt("ADAPTIVE_BATCHING_TARGET_MS", 1000)
+	cfg.PushSummaryInterval = config.GetenvInt("PUSH_SUMMARY_INTERVAL", 60)
+	cfg.ServiceName = config.Getenv("SERVICE_NAME", "auth0_logs")
+	cfg.LogLevel = config.Getenv("LOG_LEVEL", "INFO")
+	cfg.VerboseLogging = config.GetenvBool("VERBOSE_LOGGING", false)
+	cfg.AllowLocalIPs = config.GetenvBool("ALLOW_LOCAL_IPS", false)
+	cfg.IgnoreAuth0IPs = config.GetenvBool("IGNORE_AUTH0_IPS", false)
+	cfg.CustomIPs = config.GetenvList("CUSTOM_IPS", []string{})
+	cfg.TrustedProxies = config.GetenvList("TRUSTED_PROXIES", []string{})
+	cfg.StrictClientIP = config.GetenvBool("STRICT_CLIENT_IP", false)
+	cfg.TrustAnyForwardedFor = config.GetenvBool("TRUST_ANY_FORWARDED_FOR", false)
+	cfg.CloudflareMode = config.GetenvBool("CLOUDFLARE_MODE", false)
+	cfg.ProxyProtocol = config.GetenvBool("PROXY_PROTOCOL", false)
+	cfg.IPRangesRefreshInterval = config.GetenvInt("IP_RANGES_REFRESH_INTERVAL", 0)
+	cfg.IPRangesStartupJitterMs = config.GetenvInt("IP_RANGES_STARTUP_JITTER_MS", 0)
+	cfg.IPRangesCacheFile = config.Getenv("IP_RANGES_CACHE_FILE", "")
+	cfg.IPRangesMaxChangePct = config.GetenvFloat("IP_RANGES_MAX_CHANGE_PERCENT", 50)
+	cfg.EgressProxy = config.Getenv("EGRESS_PROXY", "")
+	cfg.MaxEntryAgeHours = config.GetenvInt("MAX_ENTRY_AGE_HOURS", 0)
+	cfg.ExactlyOnceMode = config.GetenvBool("EXACTLY_ONCE_MODE", false)
+	cfg.CanonicalizeJSON = config.GetenvBool("CANONICALIZE_JSON", false)
+	cfg.SchemaDriftDetection = config.GetenvBool("SCHEMA_DRIFT_DETECTION", false)
+	cfg.SyncDelivery = config.GetenvBool("SYNC_DELIVERY", false)
+	cfg.SyncDeliveryTimeout = config.GetenvInt("SYNC_DELIVERY_TIMEOUT", 20)
+	cfg.OutOfOrderAction = config.Getenv("OUT_OF_ORDER_ACTION", "")
+	cfg.LokiPushProxy = config.GetenvBool("LOKI_PUSH_PROXY", false)
+	cfg.LokiPushProxyTenants = config.GetenvList("LOKI_PUSH_PROXY_TENANTS", []string{})
+	cfg.OktaEventHooks = config.GetenvBool("OKTA_EVENT_HOOKS", false)
+	cfg.WebhooksFile = config.Getenv("WEBHOOKS_FILE", "")
+	cfg.AlertRulesFile = config.Getenv("ALERT_RULES_FILE", "")
+	cfg.HooksFile = config.Getenv("HOOKS_FILE", "")
+	cfg.SQSQueueURL = config.Getenv("SQS_QUEUE_URL", "")
+	cfg.SQSConcurrency = config.GetenvInt("SQS_CONCURRENCY", 4)
+	cfg.AzureQueueURL = config.Getenv("AZURE_QUEUE_URL", "")
+	cfg.AzureQueueConcurrency = config.GetenvInt("AZURE_QUEUE_CONCURRENCY", 4)
+	cfg.KafkaRESTURL = config.Getenv("KAFKA_REST_URL", "")
+	cfg.KafkaTopics = config.GetenvList("KAFKA_TOPICS", []string{})
+	cfg.KafkaGroup = config.Getenv("KAFKA_GROUP", "a0-logstream2loki")
+	cfg.TenantQuotaLinesPerDay = config.GetenvInt("TENANT_QUOTA_LINES_PER_DAY", 0)
+	cfg.TenantQuotaBytesPerDay = config.GetenvInt("TENANT_QUOTA_BYTES_PER_DAY", 0)
+	cfg.TenantQuotaLinesPerSec = config.GetenvFloat("TENANT_QUOTA_LINES_PER_SECOND", 0)
+	cfg.QuotasFile = config.Getenv("QUOTAS_FILE", "")
+	cfg.TenantStaleMinutes = config.GetenvInt("TENANT_STALE_MINUTES", 0)
+	cfg.DryRun = config.GetenvBool("DRY_RUN", false)
+	cfg.DryRunOutput = config.Getenv("DRY_RUN_OUTPUT", "")
+	cfg.FaultRejectPct = config.GetenvFloat("FAULT_REJECT_PERCENT", 0)
+	cfg.FaultDelayMs = config.GetenvInt("FAULT_DELAY_MS", 0)
+	cfg.FaultDelayPct = config.GetenvFloat("FAULT_DELAY_PERCENT", 100)
+	cfg.FaultChannelFullPct = config.GetenvFloat("FAULT_CHANNEL_FULL_PERCENT", 0)
+	cfg.AuthBanThreshold = config.GetenvInt("AUTH_BAN_THRESHOLD", 0)
+	cfg.AuthBanWindow = config.GetenvInt("AUTH_BAN_WINDOW", 60)
+	cfg.AuthBanDuration = config.GetenvInt("AUTH_BAN_DURATION", 60)
+	cfg.AuthBanMaxDuration = config.GetenvInt("AUTH_BAN_MAX_DURATION", 3600)
+	cfg.MaxLineSize = config.GetenvInt("MAX_LINE_SIZE", defaultMaxLineSize)
+	cfg.LogLookupCapacity = config.GetenvInt("LOG_LOOKUP_CAPACITY", 50000)
+	cfg.LogLookupLokiHours = config.GetenvInt("LOG_LOOKUP_LOKI_HOURS", 24)
+	cfg.RecentEntries = config.GetenvInt("RECENT_ENTRIES", 0)
+	lineSizes := config.GetenvList("MAX_LINE_SIZES", []string{})
+	cfg.MaxLinesPerRequest = config.GetenvInt("MAX_LINES_PER_REQUEST", 0)
+	cfg.MaxLinesAction = config.Getenv("MAX_LINES_ACTION", maxLinesReject)
+	cfg.OversizedLineAction = config.Getenv("OVERSIZED_LINE_ACTION", oversizedReject)
+	cfg.ParseWorkers = config.GetenvInt("PARSE_WORKERS", 0)
+	cfg.MaxConcurrentRequests = config.GetenvInt("MAX_CONCURRENT_REQUESTS", 0)
+	cfg.MaxInflightBytes = config.GetenvInt("MAX_INFLIGHT_BYTES", 0)
+	cfg.MemoryLimitBytes = config.GetenvInt("MEMORY_LIMIT_BYTES", 0)
+	cfg.SpillDir = config.Getenv("SPILL_DIR", "")
+	cfg.SpillMaxBytes = config.GetenvInt("SPILL_MAX_BYTES", 1<<30)
+	cfg.DLQDir = config.Getenv("DLQ_DIR", "")
+	cfg.DLQMaxBytes = config.GetenvInt("DLQ_MAX_BYTES", 1<<30)
+	cfg.DLQReplayInterval = config.GetenvInt("DLQ_REPLAY_INTERVAL", 0)
+	cfg.DLQExportURL = config.Getenv("DLQ_EXPORT_URL", "")
+	cfg.DLQExportAfterAttempts = config.GetenvInt("DLQ_EXPORT_AFTER_ATTEMPTS", 3)
+	cfg.DiskEncryptionKey = config.Getenv("DISK_ENCRYPTION_KEY", "")
+	cfg.DiskEncryptionKeyFile = config.Getenv("DISK_ENCRYPTION_KEY_FILE", "")
+	cfg.DiskEncryptionKMSCiphertext = config.Getenv("DISK_ENCRYPTION_KMS_CIPHERTEXT", "")
+	cfg.DiskSecureDelete = config.GetenvBool("DISK_SECURE_DELETE", false)
+	cfg.MemoryPressurePercent = config.GetenvInt("MEMORY_PRESSURE_PERCENT", 90)
+	cfg.MaintenanceRetryAfter = config.GetenvInt("MAINTENANCE_RETRY_AFTER", 300)
+	cfg.ShutdownTimeout = config.GetenvInt("SHUTDOWN_TIMEOUT", 30)
+	cfg.ShutdownPolicy = config.Getenv("SHUTDOWN_POLICY", shutdownDrain)
+	cfg.Serverless = config.Getenv("SERVERLESS", serverlessAuto)
+	cfg.LabelQueryParams = config.GetenvList("LABEL_QUERY_PARAMS", []string{})
+	cfg.LabelHeader = config.Getenv("LABEL_HEADER", "X-Loki-Labels")
+	cfg.LabelHeaderKeys = config.GetenvList("LABEL_HEADER_KEYS", []string{})
+	cfg.MetricsBackend = config.Getenv("METRICS_BACKEND", "prometheus")
+	cfg.StatsDAddr = config.Getenv("STATSD_ADDR", "127.0.0.1:8125")
+	cfg.StatsDPrefix = config.Getenv("STATSD_PREFIX", "a0_logstream2loki.")
+	cfg.StatsDFlushInterval = config.GetenvInt("STATSD_FLUSH_INTERVAL", 10)
+	cfg.MetricsMaxSeries = config.GetenvInt("METRICS_MAX_SERIES", 1000)
+	cfg.OTLPEndpoint = config.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	cfg.OTLPHeaders = config.GetenvList("OTEL_EXPORTER_OTLP_HEADERS", []string{})
+	cfg.OTelServiceName = config.Getenv("OTEL_SERVICE_NAME", "a0-logstream2loki")
+	cfg.TraceSampleRatio = config.GetenvFloat("TRACE_SAMPLE_RATIO", 1)
+	cfg.RemoteWriteURL = config.Getenv("REMOTE_WRITE_URL", "")
+	cfg.RemoteWriteInterval = config.GetenvInt("REMOTE_WRITE_INTERVAL", 30)
+	cfg.RemoteWriteExternalLabels = config.GetenvList("REMOTE_WRITE_EXTERNAL_LABELS", []string{})
+	cfg.RemoteWriteHeaders = config.GetenvList("REMOTE_WRITE_HEADERS", []string{})
+	cfg.CanaryInterval = config.GetenvInt("CANARY_INTERVAL", 0)
+	cfg.CanarySLO = config.GetenvInt("CANARY_SLO", 60)
+	cfg.HMACSecretFile = config.Getenv("HMAC_SECRET_FILE", "")
+	cfg.CustomAuthTokenFile = config.Getenv("CUSTOM_AUTH_TOKEN_FILE", "")
+	cfg.LokiUsernameFile = config.Getenv("LOKI_USERNAME_FILE", "")
+	cfg.LokiPasswordFile = config.Getenv("LOKI_PASSWORD_FILE", "")
+	cfg.LokiOAuth2ClientSecretFile = config.Getenv("LOKI_OAUTH2_CLIENT_SECRET_FILE", "")
+	cfg.SecretsWatchInterval = config.GetenvInt("SECRETS_WATCH_INTERVAL", 0)
+	cfg.SecretsProvider = config.Getenv("SECRETS_PROVIDER", "")
+	cfg.SecretsRefreshInterval = config.GetenvInt("SECRETS_REFRESH_INTERVAL", 300)
+	cfg.VaultAddr = config.Getenv("VAULT_ADDR", "")
+	cfg.VaultToken = config.Getenv("VAULT_TOKEN", "")
+	cfg.VaultNamespace = config.Getenv("VAULT_NAMESPACE", "")
+	cfg.VaultSecretPath = config.Getenv("VAULT_SECRET_PATH", "")
+	cfg.AWSSecretID = config.Getenv("AWS_SECRET_ID", "")
 
 	// Override with flags if provided
 	if *lokiURL != "" {
 		cfg.LokiURL = *lokiURL
 	}
+	if *lokiOrgID != "" {
+		cfg.LokiOrgID = *lokiOrgID
+	}
+	if *lokiOrgIDs != "" {
+		orgIDs = config.SplitList(*lokiOrgIDs)
+	}
+	if *lokiGzip {
+		cfg.LokiGzip = true
+	}
+	if *lokiHTTP2 != "" {
+		cfg.LokiHTTP2 = *lokiHTTP2
+	}
+	if *lokiMaxConnsPerHost != 0 {
+		cfg.LokiMaxConnsPerHost = *lokiMaxConnsPerHost
+	}
+	if *lokiMaxIdleConnsPerHost != 0 {
+		cfg.LokiMaxIdleConnsPerHost = *lokiMaxIdleConnsPerHost
+	}
+	if *lokiSigV4 {
+		cfg.LokiSigV4 = true
+	}
+	if *lokiSigV4Region != "" {
+		cfg.LokiSigV4Region = *lokiSigV4Region
+	}
+	if flag.Lookup("loki-sigv4-service").Value.String() != "aps" {
+		cfg.LokiSigV4Service = *lokiSigV4Service
+	}
+	if *lokiOAuth2TokenURL != "" {
+		cfg.LokiOAuth2TokenURL = *lokiOAuth2TokenURL
+	}
+	if *lokiOAuth2ClientID != "" {
+		cfg.LokiOAuth2ClientID = *lokiOAuth2ClientID
+	}
+	if *lokiOAuth2ClientSecret != "" {
+		cfg.LokiOAuth2ClientSecret = *lokiOAuth2ClientSecret
+	}
+	if *lokiOAuth2Scopes != "" {
+		cfg.LokiOAuth2Scopes = config.SplitList(*lokiOAuth2Scopes)
+	}
 	if *lokiUsername != "" {
 		cfg.LokiUsername = *lokiUsername
 	}
@@ -77,11 +615,44 @@ func LoadConfig() (*Config, error) {
 	if *listenAddr != "" {
 		cfg.ListenAddr = *listenAddr
 	}
+	if *adminAddr != "" {
+		cfg.AdminAddr = *adminAddr
+	}
+	if *enablePprof {
+		cfg.EnablePprof = true
+	}
 	if *hmacSecret != "" {
-		cfg.HMACSecret = *hmacSecret
+		cfg.HMACSecrets = config.SplitList(*hmacSecret)
 	}
 	if *customAuthToken != "" {
-		cfg.CustomAuthToken = *customAuthToken
+		cfg.CustomAuthTokens = config.SplitList(*customAuthToken)
+	}
+	if *authMethods != "" {
+		cfg.AuthMethods = config.SplitList(*authMethods)
+	}
+	if *jwtJWKSURL != "" {
+		cfg.JWTJWKSURL = *jwtJWKSURL
+	}
+	if *jwtPublicKeyFile != "" {
+		cfg.JWTPublicKeyFile = *jwtPublicKeyFile
+	}
+	if *jwtIssuer != "" {
+		cfg.JWTIssuer = *jwtIssuer
+	}
+	if *jwtAudience != "" {
+		cfg.JWTAudience = *jwtAudience
+	}
+	if *jwtTenantClaim != "" {
+		cfg.JWTTenantClaim = *jwtTenantClaim
+	}
+	if *tlsCertFile != "" {
+		cfg.TLSCertFile = *tlsCertFile
+	}
+	if *tlsKeyFile != "" {
+		cfg.TLSKeyFile = *tlsKeyFile
+	}
+	if *tlsClientCAFile != "" {
+		cfg.TLSClientCAFile = *tlsClientCAFile
 	}
 	if flag.Lookup("batch-size").Value.String() != "500" {
 		cfg.BatchSize = *batchSize
@@ -89,6 +660,27 @@ func LoadConfig() (*Config, error) {
 	if flag.Lookup("batch-flush-ms").Value.String() != "200" {
 		cfg.BatchFlush = *batchFlush
 	}
+	if *batchStreamMax != 0 {
+		cfg.BatchStreamMax = *batchStreamMax
+	}
+	if flag.Lookup("batcher-shards").Value.String() != "1" {
+		cfg.BatcherShards = *batcherShards
+	}
+	if *adaptiveBatching {
+		cfg.AdaptiveBatching = true
+	}
+	if flag.Lookup("batch-size-max").Value.String() != "5000" {
+		cfg.BatchSizeMax = *batchSizeMax
+	}
+	if flag.Lookup("batch-flush-max-ms").Value.String() != "2000" {
+		cfg.BatchFlushMax = *batchFlushMax
+	}
+	if flag.Lookup("adaptive-batching-target-ms").Value.String() != "1000" {
+		cfg.AdaptiveLatencyTarget = *adaptiveLatencyTarget
+	}
+	if flag.Lookup("push-summary-interval").Value.String() != "60" {
+		cfg.PushSummaryInterval = *pushSummaryInterval
+	}
 	if *serviceName != "" {
 		cfg.ServiceName = *serviceName
 	}
@@ -105,121 +697,715 @@ func LoadConfig() (*Config, error) {
 		cfg.IgnoreAuth0IPs = true
 	}
 	if *customIPs != "" {
-		cfg.CustomIPs = parseCommaSeparated(*customIPs)
+		cfg.CustomIPs = config.SplitList(*customIPs)
+	}
+	if *trustedProxies != "" {
+		cfg.TrustedProxies = config.SplitList(*trustedProxies)
+	}
+	if *strictClientIP {
+		cfg.StrictClientIP = true
+	}
+	if *trustAnyForwardedFor {
+		cfg.TrustAnyForwardedFor = true
+	}
+	if *cloudflareMode {
+		cfg.CloudflareMode = true
+	}
+	if *proxyProtocol {
+		cfg.ProxyProtocol = true
+	}
+	if *ipRangesRefreshInterval != 0 {
+		cfg.IPRangesRefreshInterval = *ipRangesRefreshInterval
+	}
+	if *ipRangesStartupJitterMs != 0 {
+		cfg.IPRangesStartupJitterMs = *ipRangesStartupJitterMs
+	}
+	if *ipRangesCacheFile != "" {
+		cfg.IPRangesCacheFile = *ipRangesCacheFile
+	}
+	if flag.Lookup("ip-ranges-max-change-percent").Value.String() != "50" {
+		cfg.IPRangesMaxChangePct = *ipRangesMaxChangePercent
+	}
+	if *egressProxy != "" {
+		cfg.EgressProxy = *egressProxy
+	}
+	if *maxEntryAgeHours != 0 {
+		cfg.MaxEntryAgeHours = *maxEntryAgeHours
+	}
+	if *exactlyOnceMode {
+		cfg.ExactlyOnceMode = true
+	}
+	if *canonicalizeJSON {
+		cfg.CanonicalizeJSON = true
+	}
+	if *schemaDriftDetection {
+		cfg.SchemaDriftDetection = true
+	}
+	if *syncDelivery {
+		cfg.SyncDelivery = true
+	}
+	if flag.Lookup("sync-delivery-timeout").Value.String() != "20" {
+		cfg.SyncDeliveryTimeout = *syncDeliveryTimeout
+	}
+	if *lokiPushProxy {
+		cfg.LokiPushProxy = true
+	}
+	if *lokiPushProxyTenants != "" {
+		cfg.LokiPushProxyTenants = config.SplitList(*lokiPushProxyTenants)
+	}
+	if *oktaEventHooks {
+		cfg.OktaEventHooks = true
+	}
+	if *webhooksFile != "" {
+		cfg.WebhooksFile = *webhooksFile
+	}
+	if *alertRulesFile != "" {
+		cfg.AlertRulesFile = *alertRulesFile
+	}
+	if *hooksFile != "" {
+		cfg.HooksFile = *hooksFile
+	}
+	if *sqsQueueURL != "" {
+		cfg.SQSQueueURL = *sqsQueueURL
+	}
+	if flag.Lookup("sqs-concurrency").Value.String() != "4" {
+		cfg.SQSConcurrency = *sqsConcurrency
+	}
+	if *azureQueueURL != "" {
+		cfg.AzureQueueURL = *azureQueueURL
+	}
+	if flag.Lookup("azure-queue-concurrency").Value.String() != "4" {
+		cfg.AzureQueueConcurrency = *azureQueueConcurrency
+	}
+	if *kafkaRESTURL != "" {
+		cfg.KafkaRESTURL = *kafkaRESTURL
+	}
+	if *kafkaTopics != "" {
+		cfg.KafkaTopics = config.SplitList(*kafkaTopics)
+	}
+	if flag.Lookup("kafka-group").Value.String() != "a0-logstream2loki" {
+		cfg.KafkaGroup = *kafkaGroup
+	}
+	if flag.Lookup("tenant-quota-lines-per-day").Value.String() != "0" {
+		cfg.TenantQuotaLinesPerDay = *quotaLinesPerDay
+	}
+	if flag.Lookup("tenant-quota-bytes-per-day").Value.String() != "0" {
+		cfg.TenantQuotaBytesPerDay = *quotaBytesPerDay
+	}
+	if flag.Lookup("tenant-quota-lines-per-second").Value.String() != "0" {
+		cfg.TenantQuotaLinesPerSec = *quotaLinesPerSec
+	}
+	if *quotasFile != "" {
+		cfg.QuotasFile = *quotasFile
+	}
+	if flag.Lookup("tenant-stale-minutes").Value.String() != "0" {
+		cfg.TenantStaleMinutes = *tenantStaleMinutes
+	}
+	if *outOfOrderAction != "" {
+		cfg.OutOfOrderAction = *outOfOrderAction
+	}
+	if *dryRun {
+		cfg.DryRun = true
+	}
+	if *dryRunOutput != "" {
+		cfg.DryRunOutput = *dryRunOutput
+	}
+	if *printConfig {
+		cfg.PrintConfig = true
+	}
+	if flag.Lookup("fault-reject-percent").Value.String() != "0" {
+		cfg.FaultRejectPct = *faultRejectPct
+	}
+	if *faultDelayMs != 0 {
+		cfg.FaultDelayMs = *faultDelayMs
+	}
+	if flag.Lookup("fault-delay-percent").Value.String() != "100" {
+		cfg.FaultDelayPct = *faultDelayPct
+	}
+	if flag.Lookup("fault-channel-full-percent").Value.String() != "0" {
+		cfg.FaultChannelFullPct = *faultChannelFullPct
+	}
+	if *authBanThreshold != 0 {
+		cfg.AuthBanThreshold = *authBanThreshold
+	}
+	if flag.Lookup("auth-ban-window").Value.String() != "60" {
+		cfg.AuthBanWindow = *authBanWindow
+	}
+	if flag.Lookup("auth-ban-duration").Value.String() != "60" {
+		cfg.AuthBanDuration = *authBanDuration
+	}
+	if flag.Lookup("auth-ban-max-duration").Value.String() != "3600" {
+		cfg.AuthBanMaxDuration = *authBanMaxDuration
+	}
+	if flag.Lookup("max-line-size").Value.String() != strconv.Itoa(defaultMaxLineSize) {
+		cfg.MaxLineSize = *maxLineSize
+	}
+	if *maxLinesPerRequest != 0 {
+		cfg.MaxLinesPerRequest = *maxLinesPerRequest
+	}
+	if *maxLinesAction != "" {
+		cfg.MaxLinesAction = *maxLinesAction
+	}
+	if *oversizedLineAction != "" {
+		cfg.OversizedLineAction = *oversizedLineAction
+	}
+	if *parseWorkers != 0 {
+		cfg.ParseWorkers = *parseWorkers
+	}
+	if *maxConcurrentRequests != 0 {
+		cfg.MaxConcurrentRequests = *maxConcurrentRequests
+	}
+	if *maxInflightBytes != 0 {
+		cfg.MaxInflightBytes = *maxInflightBytes
+	}
+	if *spillDir != "" {
+		cfg.SpillDir = *spillDir
+	}
+	if *spillMaxBytes != 0 {
+		cfg.SpillMaxBytes = *spillMaxBytes
+	}
+	if *dlqDir != "" {
+		cfg.DLQDir = *dlqDir
+	}
+	if *dlqMaxBytes != 0 {
+		cfg.DLQMaxBytes = *dlqMaxBytes
+	}
+	if *dlqReplayInterval != 0 {
+		cfg.DLQReplayInterval = *dlqReplayInterval
+	}
+	if *dlqExportURL != "" {
+		cfg.DLQExportURL = *dlqExportURL
+	}
+	if *dlqExportAfterAttempts != 0 {
+		cfg.DLQExportAfterAttempts = *dlqExportAfterAttempts
+	}
+	if *diskEncryptionKey != "" {
+		cfg.DiskEncryptionKey = *diskEncryptionKey
+	}
+	if *diskEncryptionKMSCiphertext != "" {
+		cfg.DiskEncryptionKMSCiphertext = *diskEncryptionKMSCiphertext
+	}
+	if *diskSecureDelete {
+		cfg.DiskSecureDelete = true
+	}
+	if *memoryLimitBytes != 0 {
+		cfg.MemoryLimitBytes = *memoryLimitBytes
+	}
+	if flag.Lookup("memory-pressure-percent").Value.String() != "90" {
+		cfg.MemoryPressurePercent = *memoryPressurePercent
+	}
+	if *maintenanceRetryAfter != 0 {
+		cfg.MaintenanceRetryAfter = *maintenanceRetryAfter
+	}
+	if *shutdownTimeout != 0 {
+		cfg.ShutdownTimeout = *shutdownTimeout
+	}
+	if *shutdownPolicy != "" {
+		cfg.ShutdownPolicy = *shutdownPolicy
+	}
+	if *serverless != "" {
+		cfg.Serverless = *serverless
+	}
+	if *labelQueryParams != "" {
+		cfg.LabelQueryParams = config.SplitList(*labelQueryParams)
+	}
+	if flag.Lookup("label-header").Value.String() != "X-Loki-Labels" {
+		cfg.LabelHeader = *labelHeader
+	}
+	if *labelHeaderKeys != "" {
+		cfg.LabelHeaderKeys = config.SplitList(*labelHeaderKeys)
+	}
+	if flag.Lookup("log-lookup-capacity").Value.String() != "50000" {
+		cfg.LogLookupCapacity = *logLookupCapacity
+	}
+	if flag.Lookup("log-lookup-loki-hours").Value.String() != "24" {
+		cfg.LogLookupLokiHours = *logLookupLokiHours
+	}
+	if *recentEntries != 0 {
+		cfg.RecentEntries = *recentEntries
+	}
+	if *maxLineSizes != "" {
+		lineSizes = config.SplitList(*maxLineSizes)
+	}
+	if *metricsBackend != "" {
+		cfg.MetricsBackend = *metricsBackend
+	}
+	if *statsdAddr != "" {
+		cfg.StatsDAddr = *statsdAddr
+	}
+	if *statsdPrefix != "" {
+		cfg.StatsDPrefix = *statsdPrefix
+	}
+	if flag.Lookup("statsd-flush-interval").Value.String() != "10" {
+		cfg.StatsDFlushInterval = *statsdFlushInterval
+	}
+	if flag.Lookup("metrics-max-series").Value.String() != "1000" {
+		cfg.MetricsMaxSeries = *metricsMaxSeries
+	}
+	if *otlpEndpoint != "" {
+		cfg.OTLPEndpoint = *otlpEndpoint
+	}
+	if *otelServiceName != "" {
+		cfg.OTelServiceName = *otelServiceName
+	}
+	if flag.Lookup("trace-sample-ratio").Value.String() != "1" {
+		cfg.TraceSampleRatio = *traceSampleRatio
+	}
+	if *remoteWriteURL != "" {
+		cfg.RemoteWriteURL = *remoteWriteURL
+	}
+	if *remoteWriteInterval != 0 {
+		cfg.RemoteWriteInterval = *remoteWriteInterval
+	}
+	if *remoteWriteExternalLabels != "" {
+		cfg.RemoteWriteExternalLabels = config.SplitList(*remoteWriteExternalLabels)
+	}
+	if *canaryInterval != 0 {
+		cfg.CanaryInterval = *canaryInterval
+	}
+	if *canarySLO != 0 {
+		cfg.CanarySLO = *canarySLO
+	}
+	if *hmacSecretFile != "" {
+		cfg.HMACSecretFile = *hmacSecretFile
+	}
+	if *customAuthTokenFile != "" {
+		cfg.CustomAuthTokenFile = *customAuthTokenFile
+	}
+	if *lokiUsernameFile != "" {
+		cfg.LokiUsernameFile = *lokiUsernameFile
+	}
+	if *lokiPasswordFile != "" {
+		cfg.LokiPasswordFile = *lokiPasswordFile
+	}
+	if *lokiOAuth2ClientSecretFile != "" {
+		cfg.LokiOAuth2ClientSecretFile = *lokiOAuth2ClientSecretFile
+	}
+	if *diskEncryptionKeyFile != "" {
+		cfg.DiskEncryptionKeyFile = *diskEncryptionKeyFile
+	}
+	if *secretsWatchInterval != 0 {
+		cfg.SecretsWatchInterval = *secretsWatchInterval
+	}
+
+	if *secretsProvider != "" {
+		cfg.SecretsProvider = *secretsProvider
+	}
+	if flag.Lookup("secrets-refresh-interval").Value.String() != "300" {
+		cfg.SecretsRefreshInterval = *secretsRefreshInterval
+	}
+	if *vaultAddr != "" {
+		cfg.VaultAddr = *vaultAddr
+	}
+	if *vaultNamespace != "" {
+		cfg.VaultNamespace = *vaultNamespace
+	}
+	if *vaultSecretPath != "" {
+		cfg.VaultSecretPath = *vaultSecretPath
+	}
+	if *awsSecretID != "" {
+		cfg.AWSSecretID = *awsSecretID
+	}
+
+	// Route outbound HTTP through the proxy before anything is fetched
+	if err := setEgressProxy(cfg.EgressProxy); err != nil {
+		return nil, err
+	}
+
+	// Resolve secrets provided as files
+	if err := cfg.loadSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	// Fetch secrets from the external backend, if configured
+	provider, err := newSecretsProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := cfg.loadProviderSecrets(ctx, provider); err != nil {
+			return nil, err
+		}
+		cfg.secretsProvider = provider
 	}
 
 	// Validate required configuration
-	if cfg.LokiURL == "" {
+	if required&requireLoki != 0 && cfg.LokiURL == "" && !cfg.DryRun {
 		return nil, fmt.Errorf("LOKI_URL is required (set via environment variable or -loki-url flag)")
 	}
 
-	// Either HMAC_SECRET or CUSTOM_AUTH_TOKEN must be set
-	if cfg.HMACSecret == "" && cfg.CustomAuthToken == "" {
-		return nil, fmt.Errorf("either HMAC_SECRET or CUSTOM_AUTH_TOKEN is required")
+	if cfg.BatcherShards < 1 {
+		return nil, fmt.Errorf("BATCHER_SHARDS must be at least 1")
+	}
+	if cfg.BatchStreamMax < 0 {
+		return nil, fmt.Errorf("BATCH_STREAM_MAX must not be negative")
 	}
 
-	return cfg, nil
-}
+	// Adaptive batching never goes below the configured batch size and flush timeout
+	if cfg.AdaptiveBatching {
+		if cfg.BatchSizeMax < cfg.BatchSize {
+			return nil, fmt.Errorf("BATCH_SIZE_MAX (%d) must not be below BATCH_SIZE (%d)", cfg.BatchSizeMax, cfg.BatchSize)
+		}
+		if cfg.BatchFlushMax < cfg.BatchFlush {
+			return nil, fmt.Errorf("BATCH_FLUSH_MAX_MS (%d) must not be below BATCH_FLUSH_MS (%d)", cfg.BatchFlushMax, cfg.BatchFlush)
+		}
+		if cfg.AdaptiveLatencyTarget <= 0 {
+			return nil, fmt.Errorf("ADAPTIVE_BATCHING_TARGET_MS must be positive")
+		}
+	}
 
-// getEnv retrieves an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	if _, invalid := parseIPPrefixes(cfg.TrustedProxies); len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES entries: %v", invalid)
+	}
+	if cfg.TrustAnyForwardedFor && (len(cfg.TrustedProxies) > 0 || cfg.StrictClientIP || cfg.CloudflareMode) {
+		return nil, fmt.Errorf("TRUST_ANY_FORWARDED_FOR cannot be combined with TRUSTED_PROXIES, STRICT_CLIENT_IP or CLOUDFLARE_MODE")
+	}
+	// Bans are keyed on the client IP, which any client could choose (or pin on a victim) in this mode
+	if cfg.TrustAnyForwardedFor && cfg.AuthBanThreshold > 0 {
+		return nil, fmt.Errorf("AUTH_BAN_THRESHOLD cannot be used with TRUST_ANY_FORWARDED_FOR, since clients choose their own X-Forwarded-For")
 	}
-	return defaultValue
-}
 
-// getEnvInt retrieves an integer environment variable or returns a default value
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		var intVal int
-		if _, err := fmt.Sscanf(value, "%d", &intVal); err == nil {
-			return intVal
-		}
+	// A SigV4 signature occupies the Authorization header that basic auth would use
+	switch cfg.LokiHTTP2 {
+	case lokiHTTP2Auto, lokiHTTP2Off, lokiHTTP2H2C:
+	default:
+		return nil, fmt.Errorf("unknown LOKI_HTTP2 %q (expected auto, off or h2c)", cfg.LokiHTTP2)
+	}
+	if cfg.LokiMaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("LOKI_MAX_CONNS_PER_HOST must not be negative")
+	}
+	if cfg.LokiMaxIdleConnsPerHost < 1 {
+		return nil, fmt.Errorf("LOKI_MAX_IDLE_CONNS_PER_HOST must be at least 1")
 	}
-	return defaultValue
-}
 
-// getEnvBool retrieves a boolean environment variable or returns a default value
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		switch value {
-		case "true", "1", "yes", "on":
-			return true
-		case "false", "0", "no", "off":
-			return false
+	if cfg.LokiSigV4 {
+		if cfg.LokiUsername != "" || cfg.LokiPassword != "" {
+			return nil, fmt.Errorf("LOKI_SIGV4 cannot be combined with LOKI_USERNAME/LOKI_PASSWORD")
+		}
+		if cfg.LokiSigV4Region == "" {
+			return nil, fmt.Errorf("LOKI_SIGV4 requires LOKI_SIGV4_REGION or AWS_REGION")
+		}
+		if cfg.LokiSigV4Service == "" {
+			return nil, fmt.Errorf("LOKI_SIGV4_SERVICE must not be empty")
 		}
 	}
-	return defaultValue
-}
 
-// getEnvSlice retrieves a comma-separated environment variable as a slice
-func getEnvSlice(key string, defaultValue []string) []string {
-	if value := os.Getenv(key); value != "" {
-		return parseCommaSeparated(value)
+	if cfg.LokiOAuth2TokenURL != "" {
+		if cfg.LokiSigV4 || cfg.LokiUsername != "" || cfg.LokiPassword != "" {
+			return nil, fmt.Errorf("LOKI_OAUTH2_TOKEN_URL cannot be combined with LOKI_SIGV4 or LOKI_USERNAME/LOKI_PASSWORD")
+		}
+		if cfg.LokiOAuth2ClientID == "" || cfg.LokiOAuth2ClientSecret == "" {
+			return nil, fmt.Errorf("LOKI_OAUTH2_TOKEN_URL requires LOKI_OAUTH2_CLIENT_ID and LOKI_OAUTH2_CLIENT_SECRET")
+		}
 	}
-	return defaultValue
-}
 
-// parseCommaSeparated parses a comma-separated string into a slice
-func parseCommaSeparated(s string) []string {
-	if s == "" {
-		return []string{}
+	// Profiles expose internals and are expensive to produce, never serve them on the public port
+	if cfg.EnablePprof && cfg.AdminAddr == "" {
+		return nil, fmt.Errorf("ENABLE_PPROF requires ADMIN_ADDR")
+	}
+	if cfg.RecentEntries < 0 {
+		return nil, fmt.Errorf("RECENT_ENTRIES must not be negative")
+	}
+	if cfg.RecentEntries > 0 && cfg.AdminAddr == "" {
+		return nil, fmt.Errorf("RECENT_ENTRIES requires ADMIN_ADDR")
 	}
 
-	parts := []string{}
-	for _, part := range splitAndTrim(s, ",") {
-		if part != "" {
-			parts = append(parts, part)
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1")
+	}
+	if cfg.RemoteWriteURL != "" {
+		if cfg.RemoteWriteInterval <= 0 {
+			return nil, fmt.Errorf("REMOTE_WRITE_INTERVAL must be positive")
+		}
+		if _, err := parseExternalLabels(cfg.RemoteWriteExternalLabels); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CanaryInterval < 0 {
+		return nil, fmt.Errorf("CANARY_INTERVAL must not be negative")
+	}
+	if cfg.CanaryInterval > 0 {
+		if cfg.CanarySLO <= 0 {
+			return nil, fmt.Errorf("CANARY_SLO must be positive")
+		}
+		// Dry-run payloads never reach Loki, so the canary could never be read back
+		if cfg.DryRun {
+			return nil, fmt.Errorf("CANARY_INTERVAL cannot be used with DRY_RUN")
 		}
 	}
-	return parts
-}
 
-// splitAndTrim splits a string and trims whitespace from each part
-func splitAndTrim(s, sep string) []string {
-	parts := []string{}
-	for _, part := range splitString(s, sep) {
-		trimmed := trimSpace(part)
-		parts = append(parts, trimmed)
+	if cfg.MaxLineSize <= 0 {
+		return nil, fmt.Errorf("MAX_LINE_SIZE must be positive")
+	}
+	sizes, err := parseLineSizes(lineSizes)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxLineSizes = sizes
+	if cfg.LokiOrgIDs, err = parseOrgIDs(orgIDs); err != nil {
+		return nil, err
+	}
+
+	if cfg.TenantQuotaLinesPerDay < 0 || cfg.TenantQuotaBytesPerDay < 0 || cfg.TenantQuotaLinesPerSec < 0 {
+		return nil, fmt.Errorf("tenant quotas must not be negative")
+	}
+	if cfg.TenantStaleMinutes < 0 {
+		return nil, fmt.Errorf("TENANT_STALE_MINUTES must not be negative")
+	}
+	if cfg.QuotasFile != "" {
+		if cfg.TenantQuotas, err = loadQuotasFile(cfg.QuotasFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.WebhooksFile != "" {
+		if cfg.Webhooks, err = LoadWebhookEndpoints(cfg.WebhooksFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AlertRulesFile != "" {
+		if cfg.AlertRules, err = LoadAlertRules(cfg.AlertRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.HooksFile != "" {
+		if cfg.Hooks, err = LoadHooks(cfg.HooksFile); err != nil {
+			return nil, err
+		}
 	}
-	return parts
-}
 
-// splitString splits a string by separator
-func splitString(s, sep string) []string {
-	if s == "" {
-		return []string{}
+	if cfg.MaxLinesPerRequest < 0 {
+		return nil, fmt.Errorf("MAX_LINES_PER_REQUEST must not be negative")
+	}
+	if cfg.MaxLinesAction != maxLinesReject && cfg.MaxLinesAction != maxLinesTruncate {
+		return nil, fmt.Errorf("unknown MAX_LINES_ACTION %q (expected reject or truncate)", cfg.MaxLinesAction)
+	}
+	if cfg.OversizedLineAction != oversizedReject && cfg.OversizedLineAction != oversizedTruncate {
+		return nil, fmt.Errorf("unknown OVERSIZED_LINE_ACTION %q (expected reject or truncate)", cfg.OversizedLineAction)
+	}
+	if cfg.ParseWorkers < 0 {
+		return nil, fmt.Errorf("PARSE_WORKERS must not be negative")
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_REQUESTS must not be negative")
+	}
+	if cfg.MaxInflightBytes < 0 {
+		return nil, fmt.Errorf("MAX_INFLIGHT_BYTES must not be negative")
+	}
+	if cfg.DiskEncryptionKey != "" && cfg.DiskEncryptionKMSCiphertext != "" {
+		return nil, fmt.Errorf("DISK_ENCRYPTION_KEY and DISK_ENCRYPTION_KMS_CIPHERTEXT are mutually exclusive")
+	}
+	if cfg.SpillDir != "" && cfg.SpillMaxBytes <= 0 {
+		return nil, fmt.Errorf("SPILL_MAX_BYTES must be positive")
+	}
+	if cfg.DLQDir != "" && cfg.DLQMaxBytes <= 0 {
+		return nil, fmt.Errorf("DLQ_MAX_BYTES must be positive")
+	}
+	if cfg.DLQReplayInterval < 0 {
+		return nil, fmt.Errorf("DLQ_REPLAY_INTERVAL must not be negative")
+	}
+	if cfg.DLQReplayInterval > 0 && cfg.DLQDir == "" {
+		return nil, fmt.Errorf("DLQ_REPLAY_INTERVAL requires DLQ_DIR")
+	}
+	if cfg.DLQExportURL != "" {
+		if cfg.DLQReplayInterval == 0 {
+			return nil, fmt.Errorf("DLQ_EXPORT_URL requires DLQ_REPLAY_INTERVAL, since batches are exported after failed automatic replays")
+		}
+		if cfg.DLQExportAfterAttempts < 1 {
+			return nil, fmt.Errorf("DLQ_EXPORT_AFTER_ATTEMPTS must be at least 1")
+		}
+	}
+	if cfg.MemoryLimitBytes < 0 {
+		return nil, fmt.Errorf("MEMORY_LIMIT_BYTES must not be negative")
+	}
+	if cfg.MemoryPressurePercent < 0 || cfg.MemoryPressurePercent > 100 {
+		return nil, fmt.Errorf("MEMORY_PRESSURE_PERCENT must be between 0 and 100")
+	}
+	if cfg.MaintenanceRetryAfter <= 0 {
+		return nil, fmt.Errorf("MAINTENANCE_RETRY_AFTER must be positive")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	switch cfg.ShutdownPolicy {
+	case shutdownDrain:
+	case shutdownPersist:
+		if cfg.SpillDir == "" {
+			return nil, fmt.Errorf("SHUTDOWN_POLICY=persist requires SPILL_DIR")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SHUTDOWN_POLICY %q (expected drain or persist)", cfg.ShutdownPolicy)
+	}
+	switch cfg.Serverless {
+	case serverlessAuto:
+		cfg.Serverless = detectServerless()
+	case serverlessOff, serverlessHTTP, serverlessLambda:
+	default:
+		return nil, fmt.Errorf("unknown SERVERLESS %q (expected auto, off, http or lambda)", cfg.Serverless)
+	}
+	if cfg.Serverless == serverlessLambda && os.Getenv("AWS_LAMBDA_RUNTIME_API") == "" {
+		return nil, fmt.Errorf("SERVERLESS=lambda requires AWS_LAMBDA_RUNTIME_API, set by the Lambda runtime")
+	}
+	// A frozen instance cannot retry a failed push, so deliveries are only acknowledged once stored
+	if cfg.Serverless != serverlessOff {
+		cfg.SyncDelivery = true
+	}
+	if err := validateRequestLabelNames("LABEL_QUERY_PARAMS", cfg.LabelQueryParams); err != nil {
+		return nil, err
+	}
+	if err := validateRequestLabelNames("LABEL_HEADER_KEYS", cfg.LabelHeaderKeys); err != nil {
+		return nil, err
+	}
+	if len(cfg.LabelHeaderKeys) > 0 && cfg.LabelHeader == "" {
+		return nil, fmt.Errorf("LABEL_HEADER is required with LABEL_HEADER_KEYS")
+	}
+	for _, name := range cfg.LabelQueryParams {
+		if name == "tenant" {
+			return nil, fmt.Errorf("LABEL_QUERY_PARAMS: tenant names the tenant and cannot be a label")
+		}
 	}
 
-	result := []string{}
-	current := ""
+	for name, pct := range map[string]float64{
+		"FAULT_REJECT_PERCENT":       cfg.FaultRejectPct,
+		"FAULT_DELAY_PERCENT":        cfg.FaultDelayPct,
+		"FAULT_CHANNEL_FULL_PERCENT": cfg.FaultChannelFullPct,
+	} {
+		if pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("%s must be between 0 and 100", name)
+		}
+	}
+	// Proxied pushes skip quotas and label enforcement, so the tenants using them must be named
+	if cfg.LokiPushProxy && len(cfg.LokiPushProxyTenants) == 0 {
+		return nil, fmt.Errorf("LOKI_PUSH_PROXY requires LOKI_PUSH_PROXY_TENANTS")
+	}
+	if cfg.SyncDelivery && cfg.SyncDeliveryTimeout <= 0 {
+		return nil, fmt.Errorf("SYNC_DELIVERY_TIMEOUT must be positive")
+	}
+	switch cfg.OutOfOrderAction {
+	case "", batch.OutOfOrderDivert:
+	case batch.OutOfOrderRestamp:
+	default:
+		return nil, fmt.Errorf("unknown OUT_OF_ORDER_ACTION %q (expected restamp or divert)", cfg.OutOfOrderAction)
+	}
+	if cfg.ExactlyOnceMode {
+		if err := validateExactlyOnce(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.SQSQueueURL != "" && cfg.SQSConcurrency <= 0 {
+		return nil, fmt.Errorf("SQS_CONCURRENCY must be positive")
+	}
+	if cfg.AzureQueueURL != "" && cfg.AzureQueueConcurrency <= 0 {
+		return nil, fmt.Errorf("AZURE_QUEUE_CONCURRENCY must be positive")
+	}
+	if cfg.KafkaRESTURL != "" && (len(cfg.KafkaTopics) == 0 || cfg.KafkaGroup == "") {
+		return nil, fmt.Errorf("KAFKA_TOPICS and KAFKA_GROUP are required with KAFKA_REST_URL")
+	}
+	if cfg.FaultDelayMs < 0 {
+		return nil, fmt.Errorf("FAULT_DELAY_MS must not be negative")
+	}
 
-	for i := 0; i < len(s); i++ {
-		if i+len(sep) <= len(s) && s[i:i+len(sep)] == sep {
-			result = append(result, current)
-			current = ""
-			i += len(sep) - 1
-		} else {
-			current += string(s[i])
+	if cfg.IPRangesMaxChangePct < 0 {
+		return nil, fmt.Errorf("IP_RANGES_MAX_CHANGE_PERCENT must not be negative")
+	}
+	if cfg.MetricsMaxSeries < 0 {
+		return nil, fmt.Errorf("METRICS_MAX_SERIES must not be negative")
+	}
+	cfg.MetricsBackend = strings.ToLower(cfg.MetricsBackend)
+	switch cfg.MetricsBackend {
+	case "prometheus":
+	case "statsd", "dogstatsd":
+		if cfg.StatsDFlushInterval <= 0 {
+			return nil, fmt.Errorf("STATSD_FLUSH_INTERVAL must be positive")
 		}
+	default:
+		return nil, fmt.Errorf("unknown METRICS_BACKEND %q (expected prometheus, statsd or dogstatsd)", cfg.MetricsBackend)
+	}
+
+	if err := validateAuth(cfg, required&requireAuth != 0); err != nil {
+		return nil, err
 	}
-	result = append(result, current)
-	return result
+
+	return cfg, nil
 }
 
-// trimSpace removes leading and trailing whitespace
-func trimSpace(s string) string {
-	start := 0
-	end := len(s)
+// validateAuth checks the authentication schemes and, when required, that each has its credentials
+func validateAuth(cfg *Config, required bool) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	for i, method := range cfg.AuthMethods {
+		switch method {
+		case authHMAC, authToken, authJWT, authMTLS:
+		default:
+			return fmt.Errorf("unknown AUTH_METHODS entry %q (expected hmac, token, jwt or mtls)", method)
+		}
+		if slices.Contains(cfg.AuthMethods[:i], method) {
+			return fmt.Errorf("AUTH_METHODS lists %s twice", method)
+		}
+	}
+	if !required {
+		return nil
+	}
 
-	for start < end && (s[start] == ' ' || s[start] == '\t' || s[start] == '\n' || s[start] == '\r') {
-		start++
+	// Either HMAC_SECRET or CUSTOM_AUTH_TOKEN must be set
+	if len(cfg.AuthMethods) == 0 && len(cfg.HMACSecrets) == 0 && len(cfg.CustomAuthTokens) == 0 {
+		return fmt.Errorf("either HMAC_SECRET or CUSTOM_AUTH_TOKEN is required")
+	}
+	for _, method := range cfg.AuthMethods {
+		switch {
+		case method == authHMAC && len(cfg.HMACSecrets) == 0:
+			return fmt.Errorf("AUTH_METHODS hmac requires HMAC_SECRET")
+		case method == authToken && len(cfg.CustomAuthTokens) == 0:
+			return fmt.Errorf("AUTH_METHODS token requires CUSTOM_AUTH_TOKEN")
+		case method == authJWT && cfg.JWTJWKSURL == "" && cfg.JWTPublicKeyFile == "":
+			return fmt.Errorf("AUTH_METHODS jwt requires JWT_JWKS_URL or JWT_PUBLIC_KEY_FILE")
+		case method == authJWT && cfg.JWTTenantClaim == "":
+			return fmt.Errorf("AUTH_METHODS jwt requires JWT_TENANT_CLAIM")
+		case method == authMTLS && cfg.TLSClientCAFile == "":
+			return fmt.Errorf("AUTH_METHODS mtls requires TLS_CLIENT_CA_FILE")
+		}
 	}
+	return nil
+}
 
-	for end > start && (s[end-1] == ' ' || s[end-1] == '\t' || s[end-1] == '\n' || s[end-1] == '\r') {
-		end--
+// validateExactlyOnce refuses every setting that gives a redelivered event a different line or
+// timestamp than its first delivery, since Loki then stores both
+func validateExactlyOnce(cfg *Config) error {
+	// Re-stamped entries get a new timestamp on every redelivery
+	if cfg.OutOfOrderAction == batch.OutOfOrderRestamp {
+		return fmt.Errorf("OUT_OF_ORDER_ACTION=restamp is incompatible with EXACTLY_ONCE_MODE")
+	}
+	// A truncated line is no longer the event as delivered, and changes with the line size limits
+	if cfg.OversizedLineAction == oversizedTruncate {
+		return fmt.Errorf("OVERSIZED_LINE_ACTION=truncate is incompatible with EXACTLY_ONCE_MODE")
+	}
+	// Events without a timestamp path are stamped with the time of receipt
+	for name, endpoint := range cfg.Webhooks {
+		if endpoint.TimestampPath == "" {
+			return fmt.Errorf("webhook %q: timestamp_path is required with EXACTLY_ONCE_MODE", name)
+		}
 	}
+	return nil
+}
 
-	return s[start:end]
+// parseLineSizes parses "source=bytes" pairs, e.g. "auth0=4194304,okta=65536"
+func parseLineSizes(entries []string) (map[string]int, error) {
+	sizes := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		source, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid MAX_LINE_SIZES entry %q (expected source=bytes)", entry)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid MAX_LINE_SIZES entry %q: size must be a positive number of bytes", entry)
+		}
+		sizes[strings.TrimSpace(source)] = size
+	}
+	return sizes, nil
 }
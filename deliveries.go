@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// Delivery states of a recently received log entry
+const (
+	deliveryQueued    = ingest.Queued   // Accepted and waiting in the batcher
+	deliveryDelivered = batch.Delivered // Pushed to Loki successfully
+	deliveryFailed    = batch.Failed    // The Loki push containing it failed
+	deliveryDropped   = ingest.Dropped  // Discarded before reaching the batcher (e.g. queue full)
+)
+
+// DeliveryTracker remembers the delivery status of the most recent log entries by log_id
+// The oldest records are evicted once capacity is reached; a nil tracker tracks nothing
+type DeliveryTracker struct {
+	capacity int
+
+	mu      sync.Mutex
+	records map[string]*DeliveryRecord
+	order   []string // Ring of log IDs in insertion order, for eviction
+	next    int
+}
+
+// NewDeliveryTracker creates a tracker holding up to capacity records
+func NewDeliveryTracker(capacity int) *DeliveryTracker {
+	return &DeliveryTracker{
+		capacity: capacity,
+		records:  make(map[string]*DeliveryRecord, capacity),
+		order:    make([]string, capacity),
+	}
+}
+
+// Track records a newly received entry with the given status
+func (t *DeliveryTracker) Track(entry LogEntry, tenant, status string) {
+	if t == nil || entry.LogID == "" {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A redelivered entry replaces the earlier record but keeps its ring slot
+	if _, exists := t.records[entry.LogID]; !exists {
+		if evicted := t.order[t.next]; evicted != "" {
+			delete(t.records, evicted)
+		}
+		t.order[t.next] = entry.LogID
+		t.next = (t.next + 1) % t.capacity
+	}
+
+	t.records[entry.LogID] = &DeliveryRecord{
+		LogID:      entry.LogID,
+		Source:     entry.Source,
+		Tenant:     tenant,
+		Status:     status,
+		Timestamp:  time.Unix(0, entry.Timestamp).UTC(),
+		ReceivedAt: now,
+		UpdatedAt:  now,
+	}
+}
+
+// Update sets the status of the given entries after a push
+func (t *DeliveryTracker) Update(entries []LogEntry, status string, err error) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range entries {
+		record, ok := t.records[entry.LogID]
+		if !ok {
+			continue
+		}
+		record.Status = status
+		record.UpdatedAt = now
+		record.Error = ""
+		if err != nil {
+			record.Error = err.Error()
+		}
+	}
+}
+
+// Lookup returns a copy of the record for a log ID
+func (t *DeliveryTracker) Lookup(logID string) (DeliveryRecord, bool) {
+	if t == nil {
+		return DeliveryRecord{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, ok := t.records[logID]
+	if !ok {
+		return DeliveryRecord{}, false
+	}
+	return *record, true
+}
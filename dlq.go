@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// errDeadLetterClosed is returned by replays requested after shutdown began
+var errDeadLetterClosed = errors.New("dead-letter queue is closed")
+
+// errDeadLetterNotFound is returned for batches that do not exist
+var errDeadLetterNotFound = errors.New("dead-lettered batch not found")
+
+// DeadLetterQueue keeps the batches Loki did not accept on disk, one file per failed push,
+// so they can be listed, replayed or purged on the admin listener instead of being lost
+// A file holds a DeadLetterBatch describing the push, then its entries as spill records
+// A nil queue drops failed batches
+type DeadLetterQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	batches map[int]DeadLetterBatch // Batches on disk by sequence number
+	bytes   int64                   // Bytes of the batches on disk
+	next    int                     // Sequence number of the next batch
+
+	// Replays and purges run one at a time, so a batch is never replayed twice
+	ops    sync.Mutex
+	closed bool // Set by Close; no replay may queue entries afterwards
+
+	ctx    context.Context // Canceled by Close, interrupting a running replay
+	cancel context.CancelFunc
+
+	export      ObjectStore // Receives batches whose automatic replays keep failing (nil keeps them)
+	exportAfter int         // Failed automatic replays after which a batch is exported
+	host        string      // Directory of this replica's batches in the object store
+
+	protection *DiskProtection // Encrypts records and deletes replayed or purged files (nil writes plaintext)
+	forwarding *Forwarding     // Automatic replays are skipped while paused (nil never pauses)
+	metrics    *Metrics
+	logger     *slog.Logger
+}
+
+// NewDeadLetterQueue opens the dead-letter directory, picking up the batches of previous runs
+func NewDeadLetterQueue(dir string, maxBytes int64, protection *DiskProtection, metrics *Metrics, logger *slog.Logger) (*DeadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter directory: %w", err)
+	}
+
+	q := &DeadLetterQueue{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		batches:    make(map[int]DeadLetterBatch),
+		next:       1,
+		protection: protection,
+		metrics:    metrics,
+		logger:     logger,
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for _, entry := range names {
+		var seq int
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".dlq-") {
+			// A batch whose write was interrupted
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if !isDeadLetterFile(entry.Name()) {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "dlq-%d.jsonl", &seq); err != nil {
+			continue
+		}
+		q.next = max(q.next, seq+1)
+		header, err := q.readHeader(seq)
+		if err != nil {
+			// Kept on disk, e.g. for a restart with the right encryption key
+			logger.Warn("Skipping unreadable dead-lettered batch", "batch", seq, "error", err)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat dead-lettered batch: %w", err)
+		}
+		header.Bytes = info.Size()
+		q.batches[seq] = header
+		q.bytes += header.Bytes
+	}
+	return q, nil
+}
+
+// SetExport uploads a batch to store, and deletes it, once afterAttempts automatic replays failed
+// It must be called before Run
+func (q *DeadLetterQueue) SetExport(store ObjectStore, afterAttempts int) {
+	q.export = store
+	q.exportAfter = afterAttempts
+	q.host, _ = os.Hostname()
+}
+
+// SetForwarding skips the automatic replays while forwarding to Loki is paused
+// It must be called before Run
+func (q *DeadLetterQueue) SetForwarding(forwarding *Forwarding) {
+	q.forwarding = forwarding
+}
+
+// batchPath returns the file of a batch
+func (q *DeadLetterQueue) batchPath(seq int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("dlq-%020d.jsonl", seq))
+}
+
+// Add writes the entries of a failed push to a new batch
+// Entries of synchronous deliveries are left out: their senders were told the push failed
+// and deliver them again
+func (q *DeadLetterQueue) Add(batches map[string]*Batch, pushErr error) {
+	if q == nil {
+		return
+	}
+	header := DeadLetterBatch{FailedAt: time.Now().UTC(), Error: pushErr.Error()}
+	var records bytes.Buffer
+	for _, key := range slices.Sorted(maps.Keys(batches)) {
+		batch := batches[key]
+		streamed := false
+		for _, entry := range batch.Entries {
+			if entry.Ack != nil {
+				continue
+			}
+			data, err := json.Marshal(newSpillRecord(entry))
+			if err == nil {
+				data, err = q.protection.Seal(data)
+			}
+			if err != nil {
+				q.logger.Error("Failed to encode dead-lettered entry, dropping it", "error", err)
+				continue
+			}
+			records.Write(data)
+			records.WriteByte('\n')
+
+			timestamp := time.Unix(0, entry.Timestamp).UTC()
+			if header.Entries == 0 || timestamp.Before(header.Oldest) {
+				header.Oldest = timestamp
+			}
+			if timestamp.After(header.Newest) {
+				header.Newest = timestamp
+			}
+			header.Entries++
+			if !streamed {
+				header.Streams++
+				streamed = true
+			}
+		}
+		header.OrgID = batch.OrgID
+	}
+	if header.Entries == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seq := q.next
+	header.ID = strconv.Itoa(seq)
+	size, err := q.write(seq, header, records.Bytes())
+	if err != nil {
+		q.metrics.deadLetterBatches.Inc("dropped")
+		q.logger.Error("Failed to dead-letter batch, dropping it",
+			"error", err,
+			"entries", header.Entries,
+			"push_error", pushErr,
+		)
+		return
+	}
+	q.next++
+	header.Bytes = size
+	q.batches[seq] = header
+	q.bytes += header.Bytes
+	q.metrics.deadLetterBatches.Inc("written")
+	q.logger.Warn("Dead-lettered batch Loki did not accept",
+		"batch", header.ID,
+		"entries", header.Entries,
+		"streams", header.Streams,
+		"dir", q.dir,
+	)
+}
+
+// write stores a batch under a temporary name first, so a crash never leaves a partial batch,
+// and returns the size of the file
+// The caller must hold q.mu
+func (q *DeadLetterQueue) write(seq int, header DeadLetterBatch, records []byte) (int64, error) {
+	data, err := json.Marshal(header)
+	if err == nil {
+		data, err = q.protection.Seal(data)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode dead-lettered batch: %w", err)
+	}
+	size := int64(len(data) + 1 + len(records))
+	if q.bytes+size > q.maxBytes {
+		return 0, fmt.Errorf("dead-letter queue is full (DLQ_MAX_BYTES=%d)", q.maxBytes)
+	}
+
+	temp := filepath.Join(q.dir, fmt.Sprintf(".dlq-%020d.jsonl.tmp", seq))
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create dead-lettered batch: %w", err)
+	}
+	_, err = file.Write(append(append(data, '\n'), records...))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, q.batchPath(seq))
+	}
+	if err != nil {
+		os.Remove(temp)
+		return 0, fmt.Errorf("failed to write dead-lettered batch: %w", err)
+	}
+	return size, nil
+}
+
+// readHeader reads the description of a batch from its first line
+func (q *DeadLetterQueue) readHeader(seq int) (DeadLetterBatch, error) {
+	var header DeadLetterBatch
+	file, err := os.Open(q.batchPath(seq))
+	if err != nil {
+		return header, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, spillWriteBuffer), spillReadBuffer)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, err
+		}
+		return header, errors.New("empty file")
+	}
+	data, err := q.protection.Open(scanner.Bytes())
+	if err != nil {
+		return header, err
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return header, fmt.Errorf("failed to parse batch description: %w", err)
+	}
+	return header, nil
+}
+
+// readRecords reads the entry records of a batch as stored, in the order they were written;
+// the position of a record is the index of its entry
+func (q *DeadLetterQueue) readRecords(seq int) ([][]byte, error) {
+	file, err := os.Open(q.batchPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, spillWriteBuffer), spillReadBuffer)
+	for line := 0; scanner.Scan(); line++ {
+		if line == 0 {
+			continue
+		}
+		records = append(records, bytes.Clone(scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead-lettered batch: %w", err)
+	}
+	return records, nil
+}
+
+// openRecord decodes a stored entry record
+func (q *DeadLetterQueue) openRecord(stored []byte) (LogEntry, error) {
+	var record spillRecord
+	data, err := q.protection.Open(stored)
+	if err == nil {
+		err = json.Unmarshal(data, &record)
+	}
+	if err != nil {
+		return LogEntry{}, err
+	}
+	return record.entry(), nil
+}
+
+// readEntries reads the entries of a batch, skipping unreadable ones
+func (q *DeadLetterQueue) readEntries(seq int) ([]LogEntry, error) {
+	records, err := q.readRecords(seq)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LogEntry, 0, len(records))
+	for _, record := range records {
+		entry, err := q.openRecord(record)
+		if err != nil {
+			q.logger.Warn("Skipping unreadable dead-lettered entry", "batch", seq, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Entries describes a batch and its entries, with the values of sensitive fields redacted as
+// on /admin/recent; the index of an entry selects it for a replay or purge
+func (q *DeadLetterQueue) Entries(id string) (DeadLetterBatchEntries, error) {
+	q.ops.Lock()
+	defer q.ops.Unlock()
+
+	seq, err := strconv.Atoi(id)
+	header, ok := q.lookup(seq)
+	if err != nil || !ok {
+		return DeadLetterBatchEntries{}, errDeadLetterNotFound
+	}
+	records, err := q.readRecords(seq)
+	if err != nil {
+		return DeadLetterBatchEntries{}, err
+	}
+
+	result := DeadLetterBatchEntries{Batch: header, Entries: make([]DeadLetterEntry, len(records))}
+	for i, record := range records {
+		entry, err := q.openRecord(record)
+		if err != nil {
+			result.Entries[i] = DeadLetterEntry{Index: int64(i), Labels: map[string]string{}, Error: err.Error()}
+			continue
+		}
+		result.Entries[i] = DeadLetterEntry{
+			Index:     int64(i),
+			Timestamp: time.Unix(0, entry.Timestamp).UTC(),
+			Source:    entry.Source,
+			LogID:     entry.LogID,
+			Labels:    entry.Labels,
+			Line:      redactSecrets(entry.Line),
+		}
+	}
+	return result, nil
+}
+
+// List describes the batches on disk, oldest first
+func (q *DeadLetterQueue) List() DeadLetterList {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := DeadLetterList{Batches: make([]DeadLetterBatch, 0, len(q.batches)), Bytes: q.bytes}
+	for _, seq := range slices.Sorted(maps.Keys(q.batches)) {
+		list.Batches = append(list.Batches, q.batches[seq])
+		list.Entries += q.batches[seq].Entries
+	}
+	return list
+}
+
+// Bytes returns the disk space the batches use
+func (q *DeadLetterQueue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Len returns the number of batches on disk
+func (q *DeadLetterQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches)
+}
+
+// selected resolves a selection to the sequence numbers of existing batches, oldest first
+func (q *DeadLetterQueue) selected(selection DeadLetterSelection) (seqs []int, notFound []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if selection.All {
+		return slices.Sorted(maps.Keys(q.batches)), nil
+	}
+	for _, id := range selection.IDs {
+		seq, err := strconv.Atoi(id)
+		if _, ok := q.batches[seq]; err != nil || !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	return slices.Compact(seqs), notFound
+}
+
+// entrySelection is the entries selected from one batch
+type entrySelection struct {
+	seq     int
+	id      string
+	indexes []int
+}
+
+// selectedEntries resolves the entry selections to existing batches, oldest first, leaving out
+// the batches selected whole; indexes are checked once the batch is read
+func (q *DeadLetterQueue) selectedEntries(selection DeadLetterSelection, whole []int) (parts []entrySelection, notFound []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	bySeq := make(map[int]*entrySelection)
+	for _, selected := range selection.Entries {
+		seq, err := strconv.Atoi(selected.ID)
+		if _, ok := q.batches[seq]; err != nil || !ok {
+			notFound = append(notFound, selected.ID)
+			continue
+		}
+		if slices.Contains(whole, seq) {
+			continue
+		}
+		part, ok := bySeq[seq]
+		if !ok {
+			part = &entrySelection{seq: seq, id: selected.ID}
+			bySeq[seq] = part
+		}
+		for _, index := range selected.Indexes {
+			part.indexes = append(part.indexes, int(index))
+		}
+	}
+	for _, seq := range slices.Sorted(maps.Keys(bySeq)) {
+		part := bySeq[seq]
+		slices.Sort(part.indexes)
+		part.indexes = slices.Compact(part.indexes)
+		parts = append(parts, *part)
+	}
+	return parts, notFound
+}
+
+// readSelected reads the records of a batch and decodes the selected entries, reporting the
+// indexes beyond the batch as <id>:<index>
+func (q *DeadLetterQueue) readSelected(part entrySelection) (records [][]byte, entries []LogEntry, indexes []int, notFound []string, err error) {
+	if records, err = q.readRecords(part.seq); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("batch %d: %w", part.seq, err)
+	}
+	for _, index := range part.indexes {
+		if index < 0 || index >= len(records) {
+			notFound = append(notFound, fmt.Sprintf("%s:%d", part.id, index))
+			continue
+		}
+		entry, err := q.openRecord(records[index])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("batch %d, entry %d: %w", part.seq, index, err)
+		}
+		entries = append(entries, entry)
+		indexes = append(indexes, index)
+	}
+	return records, entries, indexes, notFound, nil
+}
+
+// removeEntries rewrites a batch without the entries at indexes (sorted), deleting it when
+// none are left, and returns whether it was deleted
+func (q *DeadLetterQueue) removeEntries(seq int, records [][]byte, indexes []int) (bool, error) {
+	var remaining bytes.Buffer
+	var entries []LogEntry
+	kept := 0
+	for i, record := range records {
+		if _, selected := slices.BinarySearch(indexes, i); selected {
+			continue
+		}
+		remaining.Write(record)
+		remaining.WriteByte('\n')
+		kept++
+		if entry, err := q.openRecord(record); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if kept == 0 {
+		q.remove(seq)
+		return true, nil
+	}
+
+	header, ok := q.lookup(seq)
+	if !ok {
+		return false, errDeadLetterNotFound
+	}
+	header.Entries = int64(kept)
+	header.Streams = int64(len(batch.Streams(entries)))
+	header.Oldest, header.Newest = time.Time{}, time.Time{}
+	for i, entry := range entries {
+		timestamp := time.Unix(0, entry.Timestamp).UTC()
+		if i == 0 || timestamp.Before(header.Oldest) {
+			header.Oldest = timestamp
+		}
+		if timestamp.After(header.Newest) {
+			header.Newest = timestamp
+		}
+	}
+	return false, q.replace(seq, header, remaining.Bytes())
+}
+
+// remove deletes a batch
+func (q *DeadLetterQueue) remove(seq int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.protection.Remove(q.batchPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		q.logger.Error("Failed to remove dead-lettered batch", "batch", seq, "error", err)
+	}
+	q.bytes -= q.batches[seq].Bytes
+	delete(q.batches, seq)
+}
+
+// Replay queues the entries of the selected batches for delivery again, oldest first, and
+// deletes each batch once its entries are queued; then it queues the selected entries of other
+// batches, removing them from their batch
+// Sends block while the entry queue is full; an interrupted replay keeps the unfinished
+// batch, so its first entries may be delivered twice (Loki ignores exact duplicates)
+func (q *DeadLetterQueue) Replay(ctx context.Context, selection DeadLetterSelection, entryQueue *batch.EntryQueue) (DeadLetterResult, error) {
+	q.ops.Lock()
+	defer q.ops.Unlock()
+	if q.closed {
+		return DeadLetterResult{}, errDeadLetterClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(q.ctx, cancel)()
+
+	seqs, notFound := q.selected(selection)
+	result := DeadLetterResult{NotFound: notFound}
+	for _, seq := range seqs {
+		entries, err := q.readEntries(seq)
+		if err != nil {
+			return result, fmt.Errorf("batch %d: %w", seq, err)
+		}
+		for _, entry := range entries {
+			select {
+			case entryQueue.For(entry) <- entry:
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+		}
+		q.remove(seq)
+		q.metrics.deadLetterBatches.Inc("replayed")
+		result.Batches++
+		result.Entries += int64(len(entries))
+	}
+
+	parts, notFound := q.selectedEntries(selection, seqs)
+	result.NotFound = append(result.NotFound, notFound...)
+	for _, part := range parts {
+		records, entries, indexes, notFound, err := q.readSelected(part)
+		if err != nil {
+			return result, err
+		}
+		result.NotFound = append(result.NotFound, notFound...)
+		for _, entry := range entries {
+			select {
+			case entryQueue.For(entry) <- entry:
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+		}
+		deleted, err := q.removeEntries(part.seq, records, indexes)
+		if err != nil {
+			return result, fmt.Errorf("batch %d: %w", part.seq, err)
+		}
+		if deleted {
+			q.metrics.deadLetterBatches.Inc("replayed")
+			result.Batches++
+		}
+		result.Entries += int64(len(entries))
+	}
+	return result, nil
+}
+
+// Purge deletes the selected batches, then the selected entries of other batches
+func (q *DeadLetterQueue) Purge(selection DeadLetterSelection) (DeadLetterResult, error) {
+	q.ops.Lock()
+	defer q.ops.Unlock()
+
+	seqs, notFound := q.selected(selection)
+	result := DeadLetterResult{NotFound: notFound}
+	for _, seq := range seqs {
+		q.mu.Lock()
+		entries := q.batches[seq].Entries
+		q.mu.Unlock()
+		q.remove(seq)
+		q.metrics.deadLetterBatches.Inc("purged")
+		result.Batches++
+		result.Entries += entries
+	}
+
+	parts, notFound := q.selectedEntries(selection, seqs)
+	result.NotFound = append(result.NotFound, notFound...)
+	for _, part := range parts {
+		records, _, indexes, notFound, err := q.readSelected(part)
+		if err != nil {
+			return result, err
+		}
+		result.NotFound = append(result.NotFound, notFound...)
+		deleted, err := q.removeEntries(part.seq, records, indexes)
+		if err != nil {
+			return result, fmt.Errorf("batch %d: %w", part.seq, err)
+		}
+		if deleted {
+			q.metrics.deadLetterBatches.Inc("purged")
+			result.Batches++
+		}
+		result.Entries += int64(len(indexes))
+	}
+	return result, nil
+}
+
+// Run replays the batches directly to Loki every interval, oldest first, until ctx is canceled
+func (q *DeadLetterQueue) Run(ctx context.Context, lokiClient *loki.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if q.forwarding.Paused() {
+			continue
+		}
+		q.mu.Lock()
+		seqs := slices.Sorted(maps.Keys(q.batches))
+		q.mu.Unlock()
+		for _, seq := range seqs {
+			if ctx.Err() != nil {
+				return
+			}
+			q.retry(ctx, lokiClient, seq)
+		}
+	}
+}
+
+// retry pushes a batch to Loki and deletes it if Loki accepts it
+// A rejected push counts as a failed attempt; once there are enough, the batch is exported
+// The push and the upload run without holding q.ops, so the admin endpoints stay responsive;
+// a batch replayed on the admin listener meanwhile may be delivered twice (Loki ignores exact
+// duplicates)
+func (q *DeadLetterQueue) retry(ctx context.Context, lokiClient *loki.Client, seq int) {
+	q.ops.Lock()
+	header, ok := q.lookup(seq)
+	var entries []LogEntry
+	var err error
+	if ok {
+		entries, err = q.readEntries(seq)
+	}
+	q.ops.Unlock()
+	if !ok {
+		// Replayed or purged on the admin listener meanwhile
+		return
+	}
+	if err != nil {
+		q.logger.Error("Failed to read dead-lettered batch", "batch", header.ID, "error", err)
+		return
+	}
+
+	pushCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = lokiClient.Push(pushCtx, batch.Streams(entries))
+	cancel()
+	if err == nil {
+		q.ops.Lock()
+		q.remove(seq)
+		q.ops.Unlock()
+		q.metrics.deadLetterBatches.Inc("replayed")
+		q.logger.Info("Replayed dead-lettered batch", "batch", header.ID, "entries", len(entries))
+		return
+	}
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, not rejected
+		return
+	}
+
+	q.ops.Lock()
+	header, ok = q.lookup(seq)
+	if !ok {
+		q.ops.Unlock()
+		return
+	}
+	header.Attempts++
+	header.Error = err.Error()
+	if err := q.rewrite(seq, header); err != nil {
+		q.logger.Error("Failed to record replay attempt of dead-lettered batch", "batch", header.ID, "error", err)
+	}
+	var data []byte
+	var readErr error
+	export := q.export != nil && header.Attempts >= int64(q.exportAfter)
+	if export {
+		data, readErr = os.ReadFile(q.batchPath(seq))
+	}
+	q.ops.Unlock()
+
+	q.logger.Warn("Automatic replay of dead-lettered batch failed",
+		"batch", header.ID,
+		"attempts", header.Attempts,
+		"error", err,
+	)
+	switch {
+	case readErr != nil:
+		q.logger.Error("Failed to read dead-lettered batch for export", "batch", header.ID, "error", readErr)
+	case export:
+		q.exportBatch(ctx, seq, header, data)
+	}
+}
+
+// lookup returns the description of a batch
+func (q *DeadLetterQueue) lookup(seq int) (DeadLetterBatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	header, ok := q.batches[seq]
+	return header, ok
+}
+
+// rewrite replaces the description of a batch, keeping its entries
+func (q *DeadLetterQueue) rewrite(seq int, header DeadLetterBatch) error {
+	data, err := os.ReadFile(q.batchPath(seq))
+	if err != nil {
+		return err
+	}
+	_, records, _ := bytes.Cut(data, []byte{'\n'})
+	return q.replace(seq, header, records)
+}
+
+// replace writes a batch over its file, with header describing the batch as it is on disk
+func (q *DeadLetterQueue) replace(seq int, header DeadLetterBatch, records []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bytes -= header.Bytes
+	size, err := q.write(seq, header, records)
+	if err != nil {
+		q.bytes += header.Bytes
+		return err
+	}
+	header.Bytes = size
+	q.batches[seq] = header
+	q.bytes += size
+	return nil
+}
+
+// exportBatch uploads a batch to the object store as it was on disk, then deletes it
+func (q *DeadLetterQueue) exportBatch(ctx context.Context, seq int, header DeadLetterBatch, data []byte) {
+	name := path.Join(q.host, header.FailedAt.Format("20060102T150405Z")+"-"+header.ID+".jsonl")
+
+	uploadCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if err := q.export.Put(uploadCtx, name, data); err != nil {
+		q.logger.Error("Failed to export dead-lettered batch, keeping it",
+			"batch", header.ID,
+			"store", q.export.Name(),
+			"error", err,
+		)
+		return
+	}
+	q.ops.Lock()
+	q.remove(seq)
+	q.ops.Unlock()
+	q.metrics.deadLetterBatches.Inc("exported")
+	q.logger.Warn("Exported dead-lettered batch to object storage",
+		"batch", header.ID,
+		"entries", header.Entries,
+		"attempts", header.Attempts,
+		"object", q.export.Name()+"/"+name,
+	)
+}
+
+// Close interrupts a running replay and refuses new ones, so the entry queue can be closed
+// Failed batches are still written afterwards
+func (q *DeadLetterQueue) Close() {
+	if q == nil {
+		return
+	}
+	q.cancel()
+	q.ops.Lock()
+	q.closed = true
+	q.ops.Unlock()
+}
+
+// isDeadLetterFile reports whether a file name is that of a dead-lettered batch
+func isDeadLetterFile(name string) bool {
+	return strings.HasPrefix(name, "dlq-") && strings.HasSuffix(name, ".jsonl")
+}
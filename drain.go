@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// drainCheckInterval is how often a drain flushes the batchers and checks whether the queues are empty
+const drainCheckInterval = 100 * time.Millisecond
+
+// Drain states reported by /admin/drain
+const (
+	drainIdle     = "idle"
+	drainDraining = "draining"
+	drainDrained  = "drained"
+)
+
+// Drainer empties the service ahead of a deployment: deliveries are answered with 503 and
+// /ready reports not ready, then the batchers are flushed until the entry queue and the spill
+// queue are empty, so the SIGTERM that follows loses nothing and has nothing left to push
+type Drainer struct {
+	ctx         context.Context // Canceled at shutdown, ending a drain still running
+	maintenance *Maintenance
+	readiness   *ReadinessHandler
+	entryQueue  *batch.EntryQueue
+	spill       *SpillQueue // nil without a spill directory
+	forwarding  *Forwarding // nil without a spill directory
+	batchers    []*batch.Batcher
+	logger      *slog.Logger
+
+	mu        sync.Mutex
+	state     string
+	started   time.Time
+	completed time.Time
+	flushed   int                // Entries pushed by the flushes of the drain
+	cancel    context.CancelFunc // Ends the running drain
+}
+
+// NewDrainer creates a drainer for the batchers reading entryQueue and the spill queue behind it
+func NewDrainer(ctx context.Context, maintenance *Maintenance, readiness *ReadinessHandler, entryQueue *batch.EntryQueue, spill *SpillQueue, forwarding *Forwarding, batchers []*batch.Batcher, logger *slog.Logger) *Drainer {
+	return &Drainer{
+		ctx:         ctx,
+		maintenance: maintenance,
+		readiness:   readiness,
+		entryQueue:  entryQueue,
+		spill:       spill,
+		forwarding:  forwarding,
+		batchers:    batchers,
+		logger:      logger,
+		state:       drainIdle,
+	}
+}
+
+// Start begins a drain unless one is running or done
+func (d *Drainer) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != drainIdle {
+		return
+	}
+	d.state = drainDraining
+	d.started = time.Now()
+	d.flushed = 0
+
+	d.maintenance.Set(true, "drain")
+	d.readiness.SetDraining(true)
+	d.logger.Info("Draining before deployment, answering deliveries with 503")
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.cancel = cancel
+	go d.run(ctx)
+}
+
+// Abort ends a drain and accepts deliveries again
+func (d *Drainer) Abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == drainIdle {
+		return
+	}
+	d.cancel()
+	d.state = drainIdle
+	d.maintenance.Set(false, "drain")
+	d.readiness.SetDraining(false)
+	d.logger.Info("Drain aborted, accepting deliveries again")
+}
+
+// run flushes the batchers until a round finds the queues empty and nothing left to push
+func (d *Drainer) run(ctx context.Context) {
+	waitingForForwarding := false
+	for {
+		if paused := d.forwarding.Paused(); paused != waitingForForwarding {
+			waitingForForwarding = paused
+			if paused {
+				d.logger.Warn("Drain is waiting for forwarding to Loki to resume")
+			}
+		}
+
+		if !waitingForForwarding {
+			// Entries queued before the round reach a batcher and are flushed within it
+			empty := d.queuesEmpty()
+			flushed := 0
+			for _, batcher := range d.batchers {
+				flushed += batcher.Flush(ctx)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if d.finish(flushed, empty && flushed == 0 && d.queuesEmpty()) {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(drainCheckInterval):
+		}
+	}
+}
+
+// queuesEmpty reports whether no entries wait in the entry queue or on disk
+func (d *Drainer) queuesEmpty() bool {
+	return d.entryQueue.Len() == 0 && (d.spill == nil || !d.spill.Pending())
+}
+
+// finish counts the entries of a round and completes the drain once done is set
+// Returns false when the drain was aborted meanwhile, or is not done yet
+func (d *Drainer) finish(flushed int, done bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != drainDraining {
+		return true
+	}
+	d.flushed += flushed
+	if !done {
+		return false
+	}
+	d.state = drainDrained
+	d.completed = time.Now()
+	d.logger.Info("Drain complete, safe to stop",
+		"flushed_entries", d.flushed,
+		"duration_ms", d.completed.Sub(d.started).Milliseconds(),
+	)
+	return true
+}
+
+// Status returns the current state for the admin endpoint
+func (d *Drainer) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := DrainStatus{
+		State:          d.state,
+		FlushedEntries: int64(d.flushed),
+		QueuedEntries:  int64(d.entryQueue.Len()),
+	}
+	if d.spill != nil {
+		status.SpilledBytes = d.spill.Bytes()
+	}
+	if d.state != drainIdle {
+		started := d.started.UTC()
+		status.Started = &started
+	}
+	if d.state == drainDrained {
+		completed := d.completed.UTC()
+		status.Completed = &completed
+	}
+	return status
+}
+
+// ServeHTTP serves /admin/drain: GET reports progress, POST starts a drain and DELETE aborts it
+func (d *Drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		d.Start()
+	case http.MethodDelete:
+		d.Abort()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.Status())
+}
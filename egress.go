@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// egressProxyURL is the proxy used for all outbound HTTP (nil connects directly)
+// It is set once while loading the configuration, before any outbound request is made
+var egressProxyURL *url.URL
+
+// setEgressProxy validates and installs the outbound proxy
+// socks5:// resolves hostnames locally, socks5h:// lets the proxy resolve them
+func setEgressProxy(raw string) error {
+	if raw == "" {
+		egressProxyURL = nil
+		return nil
+	}
+
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid EGRESS_PROXY: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return fmt.Errorf("invalid EGRESS_PROXY %q: scheme must be socks5, socks5h, http or https", proxyURL.Redacted())
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("invalid EGRESS_PROXY %q: missing host", proxyURL.Redacted())
+	}
+
+	egressProxyURL = proxyURL
+	return nil
+}
+
+// egressProxy selects the proxy for an outbound request
+// Loopback and link-local targets (e.g. the AWS instance metadata service) are always reached directly
+func egressProxy(req *http.Request) (*url.URL, error) {
+	if egressProxyURL == nil {
+		return nil, nil
+	}
+	if addr, err := netip.ParseAddr(req.URL.Hostname()); err == nil {
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			return nil, nil
+		}
+	}
+	return egressProxyURL, nil
+}
+
+// newOutboundTransport creates a transport for outbound requests that honors EGRESS_PROXY
+func newOutboundTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: egressProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newOutboundClient creates an HTTP client for outbound requests that honors EGRESS_PROXY
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newOutboundTransport(),
+	}
+}
+
+// redactedURL hides the password of a URL for logging
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expressions of processing hooks are a subset of CEL (https://cel.dev): the same syntax,
+// operators and functions, evaluated over the JSON values of an event, so a hook written
+// today also runs on a full CEL implementation
+// Supported: literals (numbers, 'strings' and "strings", true, false, null, lists, maps),
+// field selection and indexing, ! - * / % + - == != < <= > >= in && || ?:, has(a.b),
+// size, string, int, double, and the string methods contains, startsWith, endsWith,
+// matches, lowerAscii and upperAscii
+// Numbers are JSON numbers (float64), so CEL's int and double are not told apart
+
+// errNoSuchKey is the error of selecting a field an object does not have, which has() tests for
+var errNoSuchKey = errors.New("no such key")
+
+// exprEnv holds the variables an expression is evaluated with
+type exprEnv interface {
+	lookup(name string) (any, error)
+}
+
+// Expr is a compiled expression
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+// exprNode is a node of the syntax tree
+type exprNode interface {
+	eval(env exprEnv) (any, error)
+}
+
+// CompileExpr parses source; the identifiers it references must be in vars
+func CompileExpr(source string, vars []string) (*Expr, error) {
+	p := &exprParser{source: source, vars: vars}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// Eval evaluates the expression; the result is nil, a bool, float64, string, []any or map[string]any
+func (e *Expr) Eval(env exprEnv) (any, error) {
+	return e.root.eval(env)
+}
+
+// EvalBool evaluates a condition
+func (e *Expr) EvalBool(env exprEnv) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition is %s, not bool", typeName(v))
+	}
+	return b, nil
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // Operator or identifier text, or the decoded string literal
+	num  float64
+	pos  int
+}
+
+// exprOperators are matched longest first
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}"}
+
+type exprParser struct {
+	source string
+	vars   []string
+	tokens []token
+	next   int
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...any) error {
+	return fmt.Errorf("column %d: %s", tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+// lex splits the source into tokens
+func (p *exprParser) lex() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: s[start:i], pos: start})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == 'e' || s[i] == 'E' ||
+				(s[i] == '+' || s[i] == '-') && (s[i-1] == 'e' || s[i-1] == 'E')) {
+				i++
+			}
+			n, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return fmt.Errorf("column %d: invalid number %q", start+1, s[start:i])
+			}
+			p.tokens = append(p.tokens, token{kind: tokNumber, num: n, pos: start})
+		case c == '\'' || c == '"':
+			start := i
+			text, n, err := lexString(s[i:])
+			if err != nil {
+				return fmt.Errorf("column %d: %w", start+1, err)
+			}
+			i += n
+			p.tokens = append(p.tokens, token{kind: tokString, text: text, pos: start})
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					p.tokens = append(p.tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("column %d: unexpected character %q", i+1, c)
+			}
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokEOF, pos: len(s)})
+	return nil
+}
+
+// lexString decodes the quoted string at the start of s, returning it and the length consumed
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == quote:
+			text, err := strconv.Unquote(b.String() + `"`)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string literal")
+			}
+			return text, i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			// \' is valid in CEL but not in Go's double-quoted strings
+			if s[i+1] == '\'' {
+				b.WriteByte('\'')
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(s[i+1])
+			}
+			i++
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string literal")
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.next]
+}
+
+// accept consumes the operator op if it is next
+func (p *exprParser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		if tok.kind == tokEOF {
+			return p.errorf(tok, "expected %q, found end of expression", op)
+		}
+		return p.errorf(tok, "expected %q", op)
+	}
+	return nil
+}
+
+// Grammar, by increasing precedence:
+// expr = or ["?" expr ":" expr]; or = and {"||" and}; and = rel {"&&" rel};
+// rel = add {("==" | "!=" | "<" | "<=" | ">" | ">=" | "in") add}; add = mul {("+" | "-") mul};
+// mul = unary {("*" | "/" | "%") unary}; unary = ("!" | "-") unary | member;
+// member = primary {"." ident ["(" args ")"] | "[" expr "]"}
+
+func (p *exprParser) expr() (exprNode, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &condNode{cond, then, otherwise}, nil
+}
+
+// binaryLevels lists the binary operators by increasing precedence
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if (tok.kind != tokOp && !(tok.kind == tokIdent && tok.text == "in")) || !slices.Contains(binaryLevels[level], tok.text) {
+			return left, nil
+		}
+		p.next++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			operand, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{op: op, operand: operand}, nil
+		}
+	}
+	return p.member()
+}
+
+func (p *exprParser) member() (exprNode, error) {
+	node, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.peek()
+			if tok.kind != tokIdent {
+				return nil, p.errorf(tok, "expected a field name after '.'")
+			}
+			p.next++
+			if p.accept("(") {
+				args, err := p.args(")")
+				if err != nil {
+					return nil, err
+				}
+				if node, err = newCall(tok, node, args); err != nil {
+					return nil, p.errorf(tok, "%v", err)
+				}
+				continue
+			}
+			node = &selectNode{operand: node, field: tok.text}
+		case p.accept("["):
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &indexNode{operand: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+// args parses comma-separated expressions up to the closing operator
+func (p *exprParser) args(closing string) ([]exprNode, error) {
+	var args []exprNode
+	if p.accept(closing) {
+		return nil, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(closing) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	tok := p.peek()
+	p.next++
+	switch tok.kind {
+	case tokNumber:
+		return &literalNode{tok.num}, nil
+	case tokString:
+		return &literalNode{tok.text}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.args(")")
+			if err != nil {
+				return nil, err
+			}
+			if tok.text == "has" {
+				if len(args) != 1 {
+					return nil, p.errorf(tok, "has() takes one field selection")
+				}
+				sel, ok := args[0].(*selectNode)
+				if !ok {
+					return nil, p.errorf(tok, "has() takes a field selection, e.g. has(event.data.ip)")
+				}
+				return &hasNode{sel}, nil
+			}
+			node, err := newCall(tok, nil, args)
+			if err != nil {
+				return nil, p.errorf(tok, "%v", err)
+			}
+			return node, nil
+		}
+		if !slices.Contains(p.vars, tok.text) {
+			return nil, p.errorf(tok, "undeclared reference to %q (expected one of %s)", tok.text, strings.Join(p.vars, ", "))
+		}
+		return &identNode{tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			node, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			elems, err := p.args("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{elems}, nil
+		case "{":
+			node := &mapNode{}
+			if p.accept("}") {
+				return node, nil
+			}
+			for {
+				key, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key)
+				node.values = append(node.values, value)
+				if p.accept("}") {
+					return node, nil
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case tokEOF:
+		return nil, p.errorf(tok, "unexpected end of expression")
+	}
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
+
+// Nodes
+
+type literalNode struct{ value any }
+
+func (n *literalNode) eval(exprEnv) (any, error) { return n.value, nil }
+
+type identNode struct{ name string }
+
+func (n *identNode) eval(env exprEnv) (any, error) { return env.lookup(n.name) }
+
+type selectNode struct {
+	operand exprNode
+	field   string
+}
+
+func (n *selectNode) eval(env exprEnv) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot select %q from %s", n.field, typeName(v))
+	}
+	field, ok := m[n.field]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSuchKey, n.field)
+	}
+	return exprValue(field), nil
+}
+
+type hasNode struct{ sel *selectNode }
+
+func (n *hasNode) eval(env exprEnv) (any, error) {
+	v, err := n.sel.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("has() on %s", typeName(v))
+	}
+	_, found := m[n.sel.field]
+	return found, nil
+}
+
+type indexNode struct{ operand, index exprNode }
+
+func (n *indexNode) eval(env exprEnv) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case []any:
+		i, ok := index.(float64)
+		if !ok || i != math.Trunc(i) {
+			return nil, fmt.Errorf("list index is %s, not an integer", typeName(index))
+		}
+		if i < 0 || int(i) >= len(v) {
+			return nil, fmt.Errorf("list index %v out of range", i)
+		}
+		return exprValue(v[int(i)]), nil
+	case map[string]any:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key is %s, not string", typeName(index))
+		}
+		field, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errNoSuchKey, key)
+		}
+		return exprValue(field), nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(v))
+}
+
+type listNode struct{ elems []exprNode }
+
+func (n *listNode) eval(env exprEnv) (any, error) {
+	list := make([]any, len(n.elems))
+	for i, elem := range n.elems {
+		v, err := elem.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+type mapNode struct{ keys, values []exprNode }
+
+func (n *mapNode) eval(env exprEnv) (any, error) {
+	m := make(map[string]any, len(n.keys))
+	for i := range n.keys {
+		k, err := n.keys[i].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key is %s, not string", typeName(k))
+		}
+		if m[key], err = n.values[i].eval(env); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type condNode struct{ cond, then, otherwise exprNode }
+
+func (n *condNode) eval(env exprEnv) (any, error) {
+	v, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, not bool", typeName(v))
+	}
+	if b {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env exprEnv) (any, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s%s", n.op, typeName(v))
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env exprEnv) (any, error) {
+	// Like CEL, && and || are commutative over errors: a false (true) side decides the result
+	// even when the other side fails, e.g. a missing field
+	if n.op == "&&" || n.op == "||" {
+		decisive := n.op == "||"
+		left, leftErr := evalBool(n.left, env)
+		if leftErr == nil && left == decisive {
+			return decisive, nil
+		}
+		right, rightErr := evalBool(n.right, env)
+		if rightErr == nil && right == decisive {
+			return decisive, nil
+		}
+		if leftErr != nil {
+			return nil, leftErr
+		}
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		return !decisive, nil
+	}
+
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return valuesEqual(left, right), nil
+	case "!=":
+		return !valuesEqual(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []any:
+			for _, elem := range container {
+				if valuesEqual(left, elem) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := container[key]
+			return found, nil
+		}
+	case "<", "<=", ">", ">=":
+		cmp, ok := compareValues(left, right)
+		if !ok {
+			break
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "+":
+		switch l := left.(type) {
+		case float64:
+			if r, ok := right.(float64); ok {
+				return l + r, nil
+			}
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []any:
+			if r, ok := right.([]any); ok {
+				return append(append([]any{}, l...), r...), nil
+			}
+		}
+	case "-", "*", "/", "%":
+		l, lok := left.(float64)
+		r, rok := right.(float64)
+		if !lok || !rok {
+			break
+		}
+		switch n.op {
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		default:
+			if r == 0 {
+				return nil, fmt.Errorf("modulus by zero")
+			}
+			return math.Mod(l, r), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), n.op, typeName(right))
+}
+
+// evalBool evaluates an operand of && or ||
+func evalBool(node exprNode, env exprEnv) (bool, error) {
+	v, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("no such overload: logical operator on %s", typeName(v))
+	}
+	return b, nil
+}
+
+// exprValue converts the numbers of events decoded with json.Decoder.UseNumber
+func exprValue(v any) any {
+	if n, ok := v.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// valuesEqual compares two values; values of different types are unequal
+func valuesEqual(a, b any) bool {
+	a, b = exprValue(a), exprValue(b)
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !valuesEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			if other, ok := b[key]; !ok || !valuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// compareValues orders two numbers or two strings
+func compareValues(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// typeName names the CEL type of a value in errors
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Functions
+
+// exprFunc is a function or method; methods receive their target as the first argument
+type exprFunc struct {
+	method bool // Called as target.name(args), otherwise as name(args)
+	arity  int  // Arguments, including the target of a method
+	fn     func(args []any) (any, error)
+}
+
+var exprFuncs = map[string]exprFunc{
+	"size": {arity: 1, fn: func(args []any) (any, error) { return sizeOf(args[0]) }},
+	"string": {arity: 1, fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+		return nil, fmt.Errorf("no such overload: string(%s)", typeName(args[0]))
+	}},
+	"int": {arity: 1, fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return math.Trunc(v), nil
+		case string:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("int(%q): not an integer", v)
+			}
+			return float64(n), nil
+		}
+		return nil, fmt.Errorf("no such overload: int(%s)", typeName(args[0]))
+	}},
+	"double": {arity: 1, fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case string:
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("double(%q): not a number", v)
+			}
+			return n, nil
+		}
+		return nil, fmt.Errorf("no such overload: double(%s)", typeName(args[0]))
+	}},
+	"contains":   stringMethod(2, func(s []string) any { return strings.Contains(s[0], s[1]) }),
+	"startsWith": stringMethod(2, func(s []string) any { return strings.HasPrefix(s[0], s[1]) }),
+	"endsWith":   stringMethod(2, func(s []string) any { return strings.HasSuffix(s[0], s[1]) }),
+	"lowerAscii": stringMethod(1, func(s []string) any { return asciiCase(s[0], unicode.ToLower) }),
+	"upperAscii": stringMethod(1, func(s []string) any { return asciiCase(s[0], unicode.ToUpper) }),
+	"matches": {method: true, arity: 2, fn: func(args []any) (any, error) {
+		s, ok1 := args[0].(string)
+		pattern, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("no such overload: %s.matches(%s)", typeName(args[0]), typeName(args[1]))
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	}},
+}
+
+// stringMethod wraps a method whose target and arguments are strings
+func stringMethod(arity int, fn func(s []string) any) exprFunc {
+	return exprFunc{method: true, arity: arity, fn: func(args []any) (any, error) {
+		s := make([]string, len(args))
+		for i, arg := range args {
+			var ok bool
+			if s[i], ok = arg.(string); !ok {
+				return nil, fmt.Errorf("no such overload: string method on %s", typeName(arg))
+			}
+		}
+		return fn(s), nil
+	}}
+}
+
+// asciiCase maps the ASCII letters of s, leaving other characters alone
+func asciiCase(s string, mapping func(rune) rune) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf {
+			return mapping(r)
+		}
+		return r
+	}, s)
+}
+
+// sizeOf returns the number of characters of a string or elements of a list or map
+func sizeOf(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return float64(utf8.RuneCountInString(v)), nil
+	case []any:
+		return float64(len(v)), nil
+	case map[string]any:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("no such overload: size(%s)", typeName(v))
+}
+
+type callNode struct {
+	fn   exprFunc
+	args []exprNode // The target of a method first
+}
+
+// newCall resolves a function call, or a method call on target; size may be called either way
+func newCall(name token, target exprNode, args []exprNode) (exprNode, error) {
+	fn, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name.text)
+	}
+	if target != nil {
+		if !fn.method && name.text != "size" {
+			return nil, fmt.Errorf("%s is a function, not a method", name.text)
+		}
+		args = append([]exprNode{target}, args...)
+	} else if fn.method {
+		return nil, fmt.Errorf("%s is a method, e.g. s.%s(...)", name.text, name.text)
+	}
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("%s takes %d argument(s)", name.text, fn.arity-boolToInt(target != nil))
+	}
+
+	// A literal pattern is compiled once, and checked when the hook is loaded
+	if name.text == "matches" {
+		if lit, ok := args[1].(*literalNode); ok {
+			pattern, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches takes a string pattern")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern: %w", err)
+			}
+			fn.fn = func(args []any) (any, error) {
+				s, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("no such overload: %s.matches(string)", typeName(args[0]))
+				}
+				return re.MatchString(s), nil
+			}
+		}
+	}
+	return &callNode{fn: fn, args: args}, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (n *callNode) eval(env exprEnv) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return n.fn.fn(args)
+}
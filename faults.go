@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// FaultInjector degrades /logs on purpose, for chaos testing how Auth0's retries and the
+// operators' alerting react to a struggling forwarder. A nil injector injects nothing
+type FaultInjector struct {
+	rejectPct      float64       // Requests answered with 503 before being read
+	delay          time.Duration // Added before handling a request
+	delayPct       float64       // Requests delayed
+	channelFullPct float64       // Lines dropped as if the entry channel were full
+
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// NewFaultInjector returns the injector configured in cfg, or nil if no fault is enabled
+func NewFaultInjector(cfg *Config, metrics *Metrics, logger *slog.Logger) *FaultInjector {
+	if cfg.FaultRejectPct <= 0 && (cfg.FaultDelayMs <= 0 || cfg.FaultDelayPct <= 0) && cfg.FaultChannelFullPct <= 0 {
+		return nil
+	}
+	return &FaultInjector{
+		rejectPct:      cfg.FaultRejectPct,
+		delay:          time.Duration(cfg.FaultDelayMs) * time.Millisecond,
+		delayPct:       cfg.FaultDelayPct,
+		channelFullPct: cfg.FaultChannelFullPct,
+		metrics:        metrics,
+		logger:         logger,
+	}
+}
+
+// hit draws whether a fault with the given percentage applies
+func hit(pct float64) bool {
+	return pct > 0 && rand.Float64()*100 < pct
+}
+
+// Wrap applies request rejection and delays in front of next
+func (f *FaultInjector) Wrap(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, f.logger)
+
+		if f.delay > 0 && hit(f.delayPct) {
+			f.metrics.faultsInjected.Inc("delay")
+			logger.Debug("Injecting response delay", "delay_ms", f.delay.Milliseconds())
+			timer := time.NewTimer(f.delay)
+			select {
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		if hit(f.rejectPct) {
+			f.metrics.faultsInjected.Inc("reject")
+			logger.Warn("Injecting request rejection")
+			writeJSONError(w, http.StatusServiceUnavailable, "fault_injected")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ChannelFull reports whether a line should be dropped as if the entry channel were full
+func (f *FaultInjector) ChannelFull() bool {
+	if f == nil || !hit(f.channelFullPct) {
+		return false
+	}
+	f.metrics.faultsInjected.Inc("channel_full")
+	return true
+}
+
+// Queue drops entries offered to queue as if the entry channel were full
+func (f *FaultInjector) Queue(queue ingest.Queue) ingest.Queue {
+	if f == nil || f.channelFullPct <= 0 {
+		return queue
+	}
+	return faultyQueue{queue: queue, faults: f}
+}
+
+// faultyQueue is a queue whose Offer fails at the configured channel-full percentage
+type faultyQueue struct {
+	queue  ingest.Queue
+	faults *FaultInjector
+}
+
+func (q faultyQueue) Offer(entry LogEntry) bool {
+	if q.faults.ChannelFull() {
+		q.faults.logger.Debug("Injecting entry channel full", "log_id", entry.LogID)
+		return false
+	}
+	return q.queue.Offer(entry)
+}
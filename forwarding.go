@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// forwardingCheckInterval is how often paused pushers check whether forwarding resumed
+const forwardingCheckInterval = time.Second
+
+// Forwarding pauses and resumes the pushes to Loki, so a planned Loki maintenance window
+// causes neither drops nor a retry storm from Auth0: while paused, deliveries are still
+// accepted and every entry is spilled to SPILL_DIR, to be pushed once forwarding resumes
+// A nil Forwarding is never paused
+type Forwarding struct {
+	spill  *SpillQueue // Holds the entries accepted while paused
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	paused bool
+	since  time.Time // When forwarding was paused
+
+	released    chan struct{} // Closed by Release
+	releaseOnce sync.Once
+}
+
+// NewForwarding creates a forwarding switch, initially forwarding
+func NewForwarding(spill *SpillQueue, logger *slog.Logger) *Forwarding {
+	return &Forwarding{
+		spill:    spill,
+		logger:   logger,
+		released: make(chan struct{}),
+	}
+}
+
+// Paused reports whether pushes to Loki are paused
+func (f *Forwarding) Paused() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused
+}
+
+// Set pauses or resumes pushes to Loki
+func (f *Forwarding) Set(paused bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused == paused {
+		return
+	}
+	f.paused = paused
+	if paused {
+		f.since = time.Now()
+		f.logger.Warn("Forwarding to Loki paused, spilling accepted entries to disk")
+		return
+	}
+	f.logger.Info("Forwarding to Loki resumed, draining spilled entries",
+		"paused_s", int(time.Since(f.since).Seconds()),
+		"spilled_bytes", f.spill.Bytes(),
+	)
+}
+
+// Wait blocks while forwarding is paused, or until ctx is canceled or Release is called
+func (f *Forwarding) Wait(ctx context.Context) {
+	for f.Paused() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.released:
+			return
+		case <-time.After(forwardingCheckInterval):
+		}
+	}
+}
+
+// Release ends every wait, so a shutdown pushes the batches held by a pause
+func (f *Forwarding) Release() {
+	if f == nil {
+		return
+	}
+	f.releaseOnce.Do(func() { close(f.released) })
+}
+
+// Status returns the current state for the admin endpoints
+func (f *Forwarding) Status() ForwardingStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := ForwardingStatus{Paused: f.paused, SpilledBytes: f.spill.Bytes()}
+	if f.paused {
+		since := f.since.UTC()
+		status.Since = &since
+	}
+	return status
+}
+
+// ServeStatus serves GET /admin/forwarding
+func (f *Forwarding) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.Status())
+}
+
+// Pause serves POST /admin/forwarding/pause
+func (f *Forwarding) Pause(w http.ResponseWriter, r *http.Request) {
+	f.Set(true)
+	f.ServeStatus(w, r)
+}
+
+// Resume serves POST /admin/forwarding/resume
+func (f *Forwarding) Resume(w http.ResponseWriter, r *http.Request) {
+	f.Set(false)
+	f.ServeStatus(w, r)
+}
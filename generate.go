@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/auth"
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// generatedEventType is an Auth0 event type the generator produces, with its relative frequency
+type generatedEventType struct {
+	code        string
+	description string
+	weight      int
+	user        bool // Carries user_id and user_name
+}
+
+// generatedEventTypes approximates the mix of a typical tenant's log stream
+var generatedEventTypes = []generatedEventType{
+	{"s", "Success Login", 40, true},
+	{"seacft", "Success Exchange", 20, false},
+	{"sapi", "Success API Operation", 8, false},
+	{"f", "Failed Login", 6, true},
+	{"fp", "Failed Login (Incorrect Password)", 4, true},
+	{"slo", "Success Logout", 5, true},
+	{"ss", "Success Signup", 3, true},
+	{"scp", "Success Change Password", 2, true},
+	{"fsa", "Failed Silent Auth", 4, false},
+	{"feacft", "Failed Exchange", 2, false},
+	{"sv", "Success Verification Email", 2, true},
+	{"gd_auth_succeed", "Guardian - MFA auth success", 2, true},
+	{"limit_wc", "Blocked Account", 1, true},
+	{"du", "Deleted User", 1, true},
+}
+
+// generatedClients are the applications generated events come from
+var generatedClients = []struct{ id, name, connection, strategy, strategyType string }{
+	{"aBcDeF123456", "Web App", "Username-Password-Authentication", "auth0", "database"},
+	{"gHiJkL789012", "Mobile App", "google-oauth2", "google-oauth2", "social"},
+	{"mNoPqR345678", "Admin Portal", "corp-saml", "samlp", "enterprise"},
+}
+
+// generatedUserAgents are sampled for the user_agent field
+var generatedUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+	"MyApp/2.3.1 okhttp/4.12.0",
+}
+
+// eventGenerator produces synthetic Auth0 log events
+type eventGenerator struct {
+	tenants     []string
+	environment string
+	jitter      time.Duration // Events are dated up to this long before now
+	totalWeight int
+	seq         uint64
+}
+
+// newEventGenerator creates a generator spreading events over tenants
+func newEventGenerator(tenants []string, environment string, jitter time.Duration) *eventGenerator {
+	g := &eventGenerator{tenants: tenants, environment: environment, jitter: jitter}
+	for _, t := range generatedEventTypes {
+		g.totalWeight += t.weight
+	}
+	return g
+}
+
+// Next returns one event for the given tenant as a JSON line
+func (g *eventGenerator) Next(tenant string, now time.Time) string {
+	g.seq++
+
+	// Walk the cumulative weights to a random type
+	eventType := generatedEventTypes[0]
+	pick := rand.N(g.totalWeight)
+	for _, t := range generatedEventTypes {
+		if pick < t.weight {
+			eventType = t
+			break
+		}
+		pick -= t.weight
+	}
+	client := generatedClients[rand.N(len(generatedClients))]
+
+	date := now
+	if g.jitter > 0 {
+		date = now.Add(-rand.N(g.jitter))
+	}
+
+	data := map[string]any{
+		"date":             date.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"type":             eventType.code,
+		"description":      eventType.description,
+		"client_id":        client.id,
+		"client_name":      client.name,
+		"ip":               fmt.Sprintf("203.0.113.%d", rand.N(254)+1),
+		"user_agent":       generatedUserAgents[rand.N(len(generatedUserAgents))],
+		"connection":       client.connection,
+		"strategy":         client.strategy,
+		"strategy_type":    client.strategyType,
+		"environment_name": g.environment,
+		"tenant_name":      tenant,
+		"log_id":           g.logID(date),
+	}
+	if eventType.user {
+		user := rand.N(10000)
+		data["user_id"] = fmt.Sprintf("auth0|%024x", user)
+		data["user_name"] = fmt.Sprintf("user%d@example.com", user)
+	}
+
+	line, _ := json.Marshal(map[string]any{"log_id": data["log_id"], "data": data})
+	return string(line)
+}
+
+// logID builds a unique, Auth0-shaped (56 digit) log_id
+func (g *eventGenerator) logID(date time.Time) string {
+	return fmt.Sprintf("900%s%039d", date.UTC().Format("20060102150405"), g.seq)
+}
+
+// runGenerate produces synthetic Auth0 events at a fixed rate, either straight into the
+// parsing and batching pipeline (pushing to Loki) or as Auth0 deliveries to a running instance
+func runGenerate(args []string) int {
+	rate := flag.Float64("rate", 100, "Events per second")
+	duration := flag.Duration("duration", time.Minute, "How long to generate events (0 runs until interrupted)")
+	tenants := flag.String("tenants", "acme,globex,initech", "Comma-separated tenant names to spread events over")
+	environment := flag.String("environment", "production", "environment_name of the events")
+	jitter := flag.Duration("jitter", 2*time.Second, "Date events up to this long in the past, as Auth0's delivery delay does")
+	target := flag.String("target", "", "Send events to a running instance's /logs URL (e.g. http://localhost:8080/logs) instead of into the pipeline")
+	linesPerRequest := flag.Int("lines-per-request", 100, "Events per delivery with -target (Auth0 sends up to 100)")
+	token := flag.String("token", "", "Bearer token for -target (default: HMAC of the tenant with the configured secret, or CUSTOM_AUTH_TOKEN)")
+
+	cfg, err := loadConfig(args, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate: %v\n", err)
+		return 1
+	}
+	tenantList := config.SplitList(*tenants)
+	if *rate <= 0 || *linesPerRequest <= 0 || len(tenantList) == 0 {
+		fmt.Fprintln(os.Stderr, "generate: -rate and -lines-per-request must be positive and -tenants must not be empty")
+		return 2
+	}
+	if *target == "" && cfg.LokiURL == "" && !cfg.DryRun {
+		fmt.Fprintln(os.Stderr, "generate: LOKI_URL (or -dry-run) is required unless -target is set")
+		return 2
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: parseLogLevel(cfg.LogLevel),
+	}))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	generator := newEventGenerator(tenantList, *environment, *jitter)
+	if *target != "" {
+		sender, err := newDeliverySender(*target, *token, cfg, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "generate: %v\n", err)
+			return 2
+		}
+		generateEvents(ctx, generator, *rate, *linesPerRequest, sender.Send)
+		sender.logResult()
+		if sender.failed > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	pipeline, err := startOfflinePipeline(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to start pipeline", "error", err)
+		return 1
+	}
+	generateEvents(ctx, generator, *rate, cfg.BatchSize, func(tenant string, lines []string) {
+		for _, line := range lines {
+			if entry, ok := pipeline.Parse(line); ok {
+				pipeline.Queue(entry)
+			}
+		}
+	})
+	pipeline.Close()
+	pipeline.logResult("Generation finished", "rate", *rate)
+	if pipeline.Failed() {
+		return 1
+	}
+	return 0
+}
+
+// generateEvents emits events in chunks of up to chunkSize per tenant, paced to rate events per second, until ctx ends
+func generateEvents(ctx context.Context, generator *eventGenerator, rate float64, chunkSize int, emit func(tenant string, lines []string)) {
+	// Emit every 100ms (or per chunk at low rates) to keep the pace smooth
+	interval := max(100*time.Millisecond, time.Duration(float64(time.Second)/rate))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	emitted := 0
+	next := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			due := int(now.Sub(start).Seconds()*rate) - emitted
+			for due > 0 && ctx.Err() == nil {
+				tenant := generator.tenants[next%len(generator.tenants)]
+				next++
+				lines := make([]string, min(due, chunkSize))
+				for i := range lines {
+					lines[i] = generator.Next(tenant, now)
+				}
+				emit(tenant, lines)
+				emitted += len(lines)
+				due -= len(lines)
+			}
+		}
+	}
+}
+
+// deliverySender posts generated events to a running instance the way Auth0 does
+type deliverySender struct {
+	target  *url.URL
+	token   string   // Fixed bearer token, if any
+	secrets []string // HMAC secrets; the first one signs the tenant when token is empty
+	client  *http.Client
+	logger  *slog.Logger
+
+	requests, failed, events int
+	latency                  batch.PushStats
+}
+
+// newDeliverySender resolves the target URL and how requests are authenticated
+func newDeliverySender(target, token string, cfg *Config, logger *slog.Logger) (*deliverySender, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid -target %q", target)
+	}
+	if token == "" && len(cfg.CustomAuthTokens) > 0 {
+		token = cfg.CustomAuthTokens[0]
+	}
+	if token == "" && len(cfg.HMACSecrets) == 0 {
+		return nil, fmt.Errorf("-target needs -token, CUSTOM_AUTH_TOKEN or HMAC_SECRET")
+	}
+	return &deliverySender{
+		target:  u,
+		token:   token,
+		secrets: cfg.HMACSecrets,
+		client:  newOutboundClient(30 * time.Second),
+		logger:  logger,
+	}, nil
+}
+
+// Send delivers one batch of a tenant's events
+func (s *deliverySender) Send(tenant string, lines []string) {
+	u := *s.target
+	query := u.Query()
+	query.Set("tenant", tenant)
+	u.RawQuery = query.Encode()
+
+	token := s.token
+	if token == "" {
+		token = auth.Token(s.secrets[0], tenant)
+	}
+
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader([]byte(body)))
+	if err != nil {
+		s.logger.Error("Failed to create request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	s.requests++
+	s.latency.Record(len(lines), time.Since(start), err)
+	if err != nil {
+		s.failed++
+		s.logger.Error("Failed to deliver generated events", "tenant", tenant, "events", len(lines), "error", err)
+		return
+	}
+	s.events += len(lines)
+}
+
+// logResult logs the delivery counts and latencies
+func (s *deliverySender) logResult() {
+	s.logger.Info("Generation finished",
+		"target", redactedURL(s.target.String()),
+		"requests", s.requests,
+		"failed_requests", s.failed,
+		"events_delivered", s.events,
+		"p50_ms", s.latency.Percentile(50).Milliseconds(),
+		"p99_ms", s.latency.Percentile(99).Milliseconds(),
+	)
+}
@@ -1,3 +1,3 @@
 module github.com/amba/a0-logstream2loki
 
-go 1.23
+go 1.24
@@ -1,191 +1,295 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
 )
 
 // LogsHandler handles incoming POST /logs requests
+// The ingest handler reads the deliveries; LogsHandler authorizes them and runs the service's
+// processing hooks, alerts, live tail and accounting on their entries
 type LogsHandler struct {
-	hmacSecret      string
-	customAuthToken string
-	entryChan       chan<- LogEntry
-	logger          *slog.Logger
-	serviceName     string
-	verboseLogging  bool
-	allowLocalIPs   bool
-	ipAllowlist     []string
+	*ingest.Handler
+
+	auth           *AuthChain
+	entryQueue     *batch.EntryQueue
+	logger         *slog.Logger
+	serviceName    string
+	verboseLogging bool
+	allowLocalIPs  bool
+	ipAllowlist    *IPAllowlist
+	clientIPs      *ClientIPResolver
+	canonicalJSON  bool             // Re-serialize lines with sorted keys and compact formatting
+	bans           *BanTracker      // Temporary bans after repeated auth failures (nil disables)
+	deliveries     *DeliveryTracker // Recent delivery status by log_id (nil disables)
+	tracer         *Tracer          // nil disables tracing
+	alerts         *Alerter         // Alert webhooks for matched events (nil disables)
+	hooks          *Hooks           // Processing hooks run on every entry (nil disables)
+	tail           *LiveTail        // Live tail of accepted entries on /admin/tail
+	recent         *RecentEntries   // Last accepted entries for /admin/recent (nil disables)
+	schemas        *SchemaTracker   // Schema drift detection (nil disables)
+	faults         *FaultInjector   // Chaos testing (nil disables)
+	orgIDs         *OrgIDMap        // Loki tenant of each tenant (nil sends no X-Scope-OrgID)
+	quotas         *QuotaTracker    // Per-tenant accounting and quotas
+	activity       *TenantActivity  // Last delivery of each tenant
+	memory         *MemoryGuard     // Pauses queue consumers under memory pressure (nil disables)
+	maintenance    *Maintenance     // Rejects deliveries and pauses queue consumers while enabled
+	metrics        *Metrics
+}
+
+// Handling of requests with more than MAX_LINES_PER_REQUEST lines
+const (
+	maxLinesReject   = "reject"   // Answer 413 and stop reading
+	maxLinesTruncate = "truncate" // Process the first lines, skip the rest
+)
+
+// Handling of lines longer than the maximum line size
+const (
+	oversizedReject   = "reject"   // Skip the line and count it
+	oversizedTruncate = "truncate" // Cut the line to the maximum size and mark it
+)
+
+// ingestSettings returns the settings of the ingest handler
+func (cfg *Config) ingestSettings() ingest.Settings {
+	return ingest.Settings{
+		ServiceName:       cfg.ServiceName,
+		CanonicalJSON:     cfg.CanonicalizeJSON,
+		VerboseLogging:    cfg.VerboseLogging,
+		MaxLineSize:       cfg.MaxLineSize,
+		MaxLineSizes:      cfg.MaxLineSizes,
+		MaxLines:          cfg.MaxLinesPerRequest,
+		TruncateLines:     cfg.MaxLinesAction == maxLinesTruncate,
+		TruncateOversized: cfg.OversizedLineAction == oversizedTruncate,
+		MaxEntryAge:       time.Duration(cfg.MaxEntryAgeHours) * time.Hour,
+		SyncDelivery:      cfg.SyncDelivery,
+		SyncTimeout:       time.Duration(cfg.SyncDeliveryTimeout) * time.Second,
+		ParseWorkers:      cfg.ParseWorkers,
+		QueryLabels:       cfg.LabelQueryParams,
+		LabelHeader:       cfg.LabelHeader,
+		HeaderLabels:      cfg.LabelHeaderKeys,
+	}
 }
 
 // NewLogsHandler creates a new logs handler
-func NewLogsHandler(hmacSecret, customAuthToken string, entryChan chan<- LogEntry, logger *slog.Logger, serviceName string, verboseLogging, allowLocalIPs bool, ipAllowlist []string) *LogsHandler {
-	return &LogsHandler{
-		hmacSecret:      hmacSecret,
-		customAuthToken: customAuthToken,
-		entryChan:       entryChan,
-		logger:          logger,
-		serviceName:     serviceName,
-		verboseLogging:  verboseLogging,
-		allowLocalIPs:   allowLocalIPs,
-		ipAllowlist:     ipAllowlist,
+// Scalar settings are taken from cfg; bans, deliveries, tracer and alerts may be nil to disable them
+func NewLogsHandler(cfg *Config, authChain *AuthChain, entryQueue *batch.EntryQueue, ipAllowlist *IPAllowlist, clientIPs *ClientIPResolver, bans *BanTracker, deliveries *DeliveryTracker, tracer *Tracer, alerts *Alerter, memory *MemoryGuard, metrics *Metrics, logger *slog.Logger) *LogsHandler {
+	var schemas *SchemaTracker
+	if cfg.SchemaDriftDetection {
+		schemas = NewSchemaTracker(metrics, logger)
+	}
+	var recent *RecentEntries
+	if cfg.RecentEntries > 0 {
+		recent = NewRecentEntries(cfg.RecentEntries, authChain, metrics, logger)
+	}
+
+	h := &LogsHandler{
+		auth:           authChain,
+		entryQueue:     entryQueue,
+		logger:         logger,
+		serviceName:    cfg.ServiceName,
+		verboseLogging: cfg.VerboseLogging,
+		allowLocalIPs:  cfg.AllowLocalIPs,
+		ipAllowlist:    ipAllowlist,
+		clientIPs:      clientIPs,
+		canonicalJSON:  cfg.CanonicalizeJSON,
+		bans:           bans,
+		deliveries:     deliveries,
+		tracer:         tracer,
+		alerts:         alerts,
+		hooks:          NewHooks(cfg.Hooks, metrics, logger),
+		tail:           NewLiveTail(authChain, metrics, logger),
+		recent:         recent,
+		schemas:        schemas,
+		faults:         NewFaultInjector(cfg, metrics, logger),
+		maintenance:    NewMaintenance(cfg.MaintenanceRetryAfter, metrics, logger),
+		orgIDs:         NewOrgIDMap(cfg.LokiOrgID, cfg.LokiOrgIDs),
+		quotas: NewQuotaTracker(TenantQuota{
+			LinesPerDay:    int64(cfg.TenantQuotaLinesPerDay),
+			BytesPerDay:    int64(cfg.TenantQuotaBytesPerDay),
+			LinesPerSecond: cfg.TenantQuotaLinesPerSec,
+		}, cfg.TenantQuotas, metrics),
+		activity: NewTenantActivity(time.Duration(cfg.TenantStaleMinutes)*time.Minute, metrics, logger),
+		memory:   memory,
+		metrics:  metrics,
+	}
+
+	h.Handler = ingest.NewHandler(cfg.ingestSettings(), h, h.faults.Queue(entryQueue), metrics, logger)
+	h.Handler.SetProcessor(h)
+	h.Handler.SetObserver(h)
+	h.Handler.SetQuotas(h.quotas)
+	if deliveries != nil {
+		h.Handler.SetDeliveries(deliveries)
+	}
+	if tracer != nil {
+		h.Handler.SetTracer(tracer)
+	}
+	return h
+}
+
+// SetDeadLetterQueue dead-letters the entries older than MAX_ENTRY_AGE_HOURS instead of dropping them
+func (h *LogsHandler) SetDeadLetterQueue(deadLetter *DeadLetterQueue) {
+	if deadLetter != nil {
+		h.Handler.SetDeadLetterQueue(deadLetter)
 	}
 }
 
 // ServeHTTP handles the HTTP request
 func (h *LogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Only accept POST requests
-	if r.Method != http.MethodPost {
-		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
-		return
+	// Every log line about this delivery carries its request ID
+	recordLines(r, h.ServeLogs(w, r, requestLogger(r, h.logger)))
+}
+
+// ingest authenticates a delivery, parses its lines with parse and queues the entries
+// eventKind names a valid line in the answer to a body without any
+func (h *LogsHandler) ingest(w http.ResponseWriter, r *http.Request, spanName, source, eventKind string, parse ingest.LineParser, logger *slog.Logger) {
+	recordLines(r, h.Ingest(w, r, spanName, source, eventKind, parse, logger))
+}
+
+// recordLines adds the lines of a delivery to its access log
+func recordLines(r *http.Request, lines int) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.lines = lines
+	}
+}
+
+// Authorize authorizes a delivery to the ingest handler and records the tenant's activity
+func (h *LogsHandler) Authorize(w http.ResponseWriter, r *http.Request, span ingest.Span, logger *slog.Logger) (tenant, clientIP string, ok bool) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		span.SetAttribute("request_id", info.id)
+	}
+	tenant, clientIP, ok = h.authorize(w, r, span, logger)
+	if ok {
+		h.activity.Seen(tenant)
 	}
+	return tenant, clientIP, ok
+}
 
-	// Extract client IP (supports X-Forwarded-For for Cloudflare)
-	clientIP := extractClientIP(r)
+// Process runs the processing hooks on an entry of a tenant and sets its Loki tenant
+func (h *LogsHandler) Process(tenant string, entry *LogEntry) bool {
+	if !h.hooks.Apply(tenant, entry) {
+		return false
+	}
+	entry.OrgID = h.orgIDs.For(tenant)
+	return true
+}
+
+// Observe counts an accepted entry and shows it to alerts, the live tail and schema drift detection
+func (h *LogsHandler) Observe(tenant string, entry LogEntry) {
+	h.metrics.entriesByType.Inc(tenant, entry.Labels["type"])
+	h.metrics.countSecurityEvent(tenant, entry)
+	h.alerts.Observe(tenant, entry)
+	h.tail.Publish(tenant, entry)
+	h.recent.Add(tenant, entry)
+	h.schemas.Observe(tenant, entry.Labels["type"], entry.Line)
+}
+
+// authorize applies the client IP checks, temporary bans and authentication shared by the
+// ingestion endpoints; on failure the error response is already written
+func (h *LogsHandler) authorize(w http.ResponseWriter, r *http.Request, span ingest.Span, logger *slog.Logger) (tenant, clientIP string, ok bool) {
+	// Extract client IP (X-Forwarded-For is only honored from trusted proxies when configured)
+	info := requestInfoFrom(r.Context())
+	clientIP, err := h.clientIPs.ClientIP(r)
+	span.SetAttribute("client.address", clientIP)
+	if info != nil {
+		info.clientIP = clientIP
+	}
+	if err != nil {
+		span.SetError(err)
+		logger.Error("Request rejected: spoofed client IP headers",
+			"error", err,
+			"remote_addr", r.RemoteAddr,
+			"x_forwarded_for", r.Header.Get("X-Forwarded-For"),
+		)
+		writeJSONError(w, http.StatusForbidden, "spoofed_client_ip")
+		return "", "", false
+	}
+
+	// Reject temporarily banned clients before doing any other work
+	if h.bans != nil {
+		if remaining, banned := h.bans.Banned(clientIP); banned {
+			h.metrics.bannedRequests.Inc()
+			logger.Debug("Request rejected: client IP temporarily banned",
+				"client_ip", clientIP,
+				"remaining_s", int(remaining.Seconds()),
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			writeJSONError(w, http.StatusTooManyRequests, "temporarily_banned")
+			return "", "", false
+		}
+	}
 
 	// Check IP allowlist (unless verbose logging is enabled)
 	if !h.verboseLogging {
 		isLocal := isLocalIP(clientIP)
-		isAllowed := isIPAllowed(clientIP, h.ipAllowlist)
+		isAllowed := h.ipAllowlist.Contains(clientIP)
 
 		// Allow if: in allowlist OR (local IP AND allow_local_ips enabled)
 		if !isAllowed && !(isLocal && h.allowLocalIPs) {
-			h.logger.Error("Request rejected: IP not in allowlist",
+			logger.Error("Request rejected: IP not in allowlist",
 				"client_ip", clientIP,
 				"is_local", isLocal,
 				"remote_addr", r.RemoteAddr,
 				"x_forwarded_for", r.Header.Get("X-Forwarded-For"),
 			)
 			writeJSONError(w, http.StatusForbidden, "ip_not_allowed")
-			return
+			return "", "", false
 		}
 
 		// Log if local IP was allowed due to allow_local_ips setting
 		if isLocal && h.allowLocalIPs && !isAllowed {
-			h.logger.Debug("Request allowed from local network IP",
+			logger.Debug("Request allowed from local network IP",
 				"client_ip", clientIP,
 			)
 		}
 	}
 
-	// Authenticate the request (custom token takes precedence over HMAC)
-	tenant, ok := authenticateRequest(w, r, h.hmacSecret, h.customAuthToken, h.logger)
-	if !ok {
+	// Authenticate the request with the schemes of AUTH_METHODS
+	tenant, failure := h.auth.authenticateRequest(w, r, logger)
+	if failure != "" {
 		// authenticateRequest already wrote the error response and logged the failure
-		return
-	}
-
-	if h.verboseLogging {
-		h.logger.Info("Processing log stream",
-			"tenant", tenant,
-			"client_ip", clientIP,
-			"remote_addr", r.RemoteAddr,
-			"x_forwarded_for", r.Header.Get("X-Forwarded-For"),
-		)
-	} else {
-		h.logger.Info("Processing log stream",
-			"tenant", tenant,
-			"client_ip", clientIP,
-		)
-	}
-
-	// Stream the JSONL body line by line
-	// Use bufio.Scanner for efficient line-by-line reading
-	scanner := bufio.NewScanner(r.Body)
-	defer r.Body.Close()
-
-	// Increase buffer size for potentially large log lines
-	const maxCapacity = 1024 * 1024 // 1MB per line
-	buf := make([]byte, maxCapacity)
-	scanner.Buffer(buf, maxCapacity)
-
-	lineCount := 0
-	errorCount := 0
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Skip empty lines
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-
-		lineCount++
-
-		// Parse the JSON line to extract required fields
-		entry, err := h.parseLogLine(line)
-		if err != nil {
-			errorCount++
-			h.logger.Warn("Failed to parse log line",
-				"error", err,
-				"line_number", lineCount,
-			)
-			continue
-		}
-
-		// Send to batching worker via channel
-		// This is non-blocking as long as the channel has capacity
-		select {
-		case h.entryChan <- entry:
-			// Successfully enqueued
-		default:
-			// Channel is full - this shouldn't happen with proper buffering
-			h.logger.Error("Entry channel is full, dropping log line",
-				"line_number", lineCount,
-			)
-			errorCount++
+		span.SetAttribute("auth.failure", failure)
+		h.metrics.authFailures.Inc(failure)
+		if h.bans != nil {
+			if duration, banned := h.bans.RecordFailure(clientIP); banned {
+				h.metrics.authBans.Inc()
+				logger.Warn("Temporarily banned client IP after repeated authentication failures",
+					"client_ip", clientIP,
+					"ban_duration_s", int(duration.Seconds()),
+					"last_failure", failure,
+				)
+			}
 		}
+		return "", "", false
 	}
-
-	// Check for scanner errors
-	if err := scanner.Err(); err != nil {
-		h.logger.Error("Error reading request body",
-			"error", err,
-			"tenant", tenant,
-		)
-		writeJSONError(w, http.StatusBadRequest, "error_reading_body")
-		return
+	if h.bans != nil {
+		h.bans.RecordSuccess(clientIP)
 	}
-
-	h.logger.Info("Finished processing log stream",
-		"tenant", tenant,
-		"lines_processed", lineCount,
-		"errors", errorCount,
-	)
-
-	// Return 202 Accepted (we don't wait for Loki to acknowledge)
-	w.WriteHeader(http.StatusAccepted)
-}
-
-// parseLogLine parses a single JSON line and extracts the required fields
-func (h *LogsHandler) parseLogLine(line string) (LogEntry, error) {
-	var logData Auth0LogData
-
-	// Parse the JSON to extract labels and timestamp
-	if err := json.Unmarshal([]byte(line), &logData); err != nil {
-		return LogEntry{}, err
+	span.SetAttribute("tenant", tenant)
+	h.metrics.requestsByTenant.Inc(tenant)
+	if info != nil {
+		info.tenant = tenant
 	}
+	return tenant, clientIP, true
+}
 
-	// Parse the timestamp (RFC3339 format)
-	timestamp, err := time.Parse(time.RFC3339Nano, logData.Data.Date)
+// parseQueuedLine parses a line that arrives without an authenticated tenant (queue consumers,
+// replays), so the event's tenant_name selects the Loki tenant
+func (h *LogsHandler) parseQueuedLine(raw []byte) (LogEntry, error) {
+	entry, err := h.ParseAuth0(raw)
 	if err != nil {
 		return LogEntry{}, err
 	}
-
-	// Create labels map
-	labels := map[string]string{
-		"service_name":     h.serviceName,
-		"type":             logData.Data.Type,
-		"environment_name": logData.Data.EnvironmentName,
-		"tenant_name":      logData.Data.TenantName,
+	if !h.Process(entry.Labels["tenant_name"], &entry) {
+		return LogEntry{}, errHookDropped
 	}
-
-	return LogEntry{
-		Timestamp: timestamp.UnixNano(),
-		Labels:    labels,
-		Line:      line, // Preserve the original line exactly
-	}, nil
+	h.metrics.countSecurityEvent(entry.Labels["tenant_name"], entry)
+	h.alerts.Observe(entry.Labels["tenant_name"], entry)
+	h.tail.Publish(entry.Labels["tenant_name"], entry)
+	h.recent.Add(entry.Labels["tenant_name"], entry)
+	return entry, nil
 }
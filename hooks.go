@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// hookVars are the variables hook expressions may reference
+var hookVars = []string{"event", "labels", "tenant", "source"}
+
+// errHookDropped is returned by parseQueuedLine for an entry a processing hook dropped
+var errHookDropped = errors.New("dropped by a processing hook")
+
+// Results of applying a hook, counted in hook_results_total
+const (
+	hookDropped  = "dropped"
+	hookModified = "modified"
+	hookFailed   = "failed"
+)
+
+// ProcessingHook drops, relabels or annotates the entries matching its condition
+// Its expressions are CEL (see expr.go) over the event, its labels, tenant and source
+type ProcessingHook struct {
+	Name   string            `json:"name"`   // Used in logs and metrics
+	When   string            `json:"when"`   // Condition (empty matches every entry)
+	Drop   bool              `json:"drop"`   // Drop matching entries; later hooks do not run
+	Labels map[string]string `json:"labels"` // Label names and the expressions giving their values (null or "" removes the label)
+	Set    map[string]string `json:"set"`    // Event paths and the expressions giving their values (null removes the field)
+
+	when   *Expr
+	labels []hookAssignment
+	set    []hookAssignment
+}
+
+// hookAssignment is one label or event field a hook assigns
+type hookAssignment struct {
+	target string
+	expr   *Expr
+}
+
+// hooksFile is the file configured by HOOKS_FILE
+type hooksFile struct {
+	Hooks []ProcessingHook `json:"hooks"`
+}
+
+// LoadHooks reads and compiles the hooks of a hooks file
+func LoadHooks(path string) ([]ProcessingHook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	var file hooksFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks file: %w", err)
+	}
+
+	names := make(map[string]bool, len(file.Hooks))
+	for i := range file.Hooks {
+		hook := &file.Hooks[i]
+		if err := hook.compile(); err != nil {
+			return nil, fmt.Errorf("hook %q: %w", hook.Name, err)
+		}
+		if names[hook.Name] {
+			return nil, fmt.Errorf("hook %q is defined twice", hook.Name)
+		}
+		names[hook.Name] = true
+	}
+	if len(file.Hooks) == 0 {
+		return nil, fmt.Errorf("hooks file defines no hooks")
+	}
+	return file.Hooks, nil
+}
+
+// compile validates the hook and compiles its expressions
+func (h *ProcessingHook) compile() error {
+	if h.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !h.Drop && len(h.Labels) == 0 && len(h.Set) == 0 {
+		return fmt.Errorf("one of drop, labels or set is required")
+	}
+	if h.Drop && (len(h.Labels) > 0 || len(h.Set) > 0) {
+		return fmt.Errorf("drop cannot be combined with labels or set")
+	}
+
+	var err error
+	if h.When != "" {
+		if h.when, err = CompileExpr(h.When, hookVars); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+	}
+	for name, source := range h.Labels {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		// The pipeline enforces the source label, a hook cannot change it
+		if name == "source" {
+			return fmt.Errorf("label %q cannot be set by a hook", name)
+		}
+		expr, err := CompileExpr(source, hookVars)
+		if err != nil {
+			return fmt.Errorf("label %s: %w", name, err)
+		}
+		h.labels = append(h.labels, hookAssignment{target: name, expr: expr})
+	}
+	for path, source := range h.Set {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return fmt.Errorf("invalid event path %q", path)
+		}
+		expr, err := CompileExpr(source, hookVars)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", path, err)
+		}
+		h.set = append(h.set, hookAssignment{target: path, expr: expr})
+	}
+
+	// Maps are unordered; sorting makes overlapping paths apply the same way on every run
+	byTarget := func(a, b hookAssignment) int { return strings.Compare(a.target, b.target) }
+	slices.SortFunc(h.labels, byTarget)
+	slices.SortFunc(h.set, byTarget)
+	return nil
+}
+
+// Hooks applies the processing hooks to each entry, in the order of the hooks file
+// A nil Hooks leaves entries unchanged
+type Hooks struct {
+	hooks   []ProcessingHook
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// NewHooks returns the hooks to apply, or nil when there are none
+func NewHooks(hooks []ProcessingHook, metrics *Metrics, logger *slog.Logger) *Hooks {
+	if len(hooks) == 0 {
+		return nil
+	}
+	return &Hooks{hooks: hooks, metrics: metrics, logger: logger}
+}
+
+// hookEnv is the evaluation environment of one entry; the event is decoded on first use
+type hookEnv struct {
+	entry    *LogEntry
+	tenant   string
+	event    any
+	eventErr error
+	decoded  bool
+	modified bool // The event was changed and the line must be re-serialized
+}
+
+func (e *hookEnv) lookup(name string) (any, error) {
+	switch name {
+	case "event":
+		if !e.decoded {
+			e.decoded = true
+			decoder := json.NewDecoder(strings.NewReader(e.entry.Line))
+			// Numbers keep their text when the line is re-serialized
+			decoder.UseNumber()
+			if err := decoder.Decode(&e.event); err != nil {
+				e.eventErr = fmt.Errorf("line is not a JSON event: %w", err)
+			}
+		}
+		return e.event, e.eventErr
+	case "labels":
+		labels := make(map[string]any, len(e.entry.Labels))
+		for name, value := range e.entry.Labels {
+			labels[name] = value
+		}
+		return labels, nil
+	case "tenant":
+		return e.tenant, nil
+	case "source":
+		return e.entry.Source, nil
+	}
+	return nil, fmt.Errorf("undeclared reference to %q", name)
+}
+
+// Apply runs the hooks on an entry of the tenant, changing its labels and line in place
+// It returns false when a hook dropped the entry
+// A hook whose expression fails (e.g. on a field the event lacks) is skipped and counted
+func (h *Hooks) Apply(tenant string, entry *LogEntry) bool {
+	if h == nil {
+		return true
+	}
+	env := &hookEnv{entry: entry, tenant: tenant}
+	for i := range h.hooks {
+		hook := &h.hooks[i]
+		result, err := hook.apply(env)
+		if err != nil {
+			h.metrics.hookResults.Inc(hook.Name, hookFailed)
+			h.logger.Debug("Processing hook failed",
+				"hook", hook.Name,
+				"tenant", tenant,
+				"log_id", entry.LogID,
+				"error", err,
+			)
+			continue
+		}
+		if result != "" {
+			h.metrics.hookResults.Inc(hook.Name, result)
+		}
+		if result == hookDropped {
+			return false
+		}
+	}
+
+	if env.modified {
+		line, err := marshalEvent(env.event)
+		if err != nil {
+			// Unreachable for decoded JSON, but the original line is better than none
+			h.logger.Warn("Failed to serialize the event changed by processing hooks", "error", err)
+			return true
+		}
+		entry.Line = line
+	}
+	return true
+}
+
+// apply runs one hook, returning its result ("" when its condition did not match)
+// Every expression is evaluated and every assignment made on a copy of the event before
+// anything changes, so a failing hook changes nothing
+func (h *ProcessingHook) apply(env *hookEnv) (string, error) {
+	if h.when != nil {
+		matched, err := h.when.EvalBool(env)
+		if err != nil || !matched {
+			return "", err
+		}
+	}
+	if h.Drop {
+		return hookDropped, nil
+	}
+
+	labels := make([]any, len(h.labels))
+	for i, assignment := range h.labels {
+		value, err := assignment.expr.Eval(env)
+		if err != nil {
+			return "", fmt.Errorf("label %s: %w", assignment.target, err)
+		}
+		switch value.(type) {
+		case nil, string:
+		default:
+			return "", fmt.Errorf("label %s: value is %s, not string", assignment.target, typeName(value))
+		}
+		labels[i] = value
+	}
+	values := make([]any, len(h.set))
+	for i, assignment := range h.set {
+		value, err := assignment.expr.Eval(env)
+		if err != nil {
+			return "", fmt.Errorf("set %s: %w", assignment.target, err)
+		}
+		values[i] = value
+	}
+	var event map[string]any
+	if len(h.set) > 0 {
+		decoded, err := env.lookup("event")
+		if err != nil {
+			return "", err
+		}
+		original, ok := decoded.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("event is %s, not an object", typeName(decoded))
+		}
+		// A path through a non-object fails the hook after earlier assignments were made
+		event = cloneJSON(original).(map[string]any)
+		for i, assignment := range h.set {
+			if err := setPath(event, assignment.target, cloneJSON(values[i])); err != nil {
+				return "", fmt.Errorf("set %s: %w", assignment.target, err)
+			}
+		}
+	}
+
+	for i, assignment := range h.labels {
+		if value, _ := labels[i].(string); value != "" {
+			env.entry.Labels[assignment.target] = value
+		} else {
+			delete(env.entry.Labels, assignment.target)
+		}
+	}
+	if event != nil {
+		env.event = event
+		env.modified = true
+	}
+	return hookModified, nil
+}
+
+// cloneJSON deep-copies a decoded JSON value
+func cloneJSON(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		clone := make(map[string]any, len(value))
+		for key, child := range value {
+			clone[key] = cloneJSON(child)
+		}
+		return clone
+	case []any:
+		clone := make([]any, len(value))
+		for i, child := range value {
+			clone[i] = cloneJSON(child)
+		}
+		return clone
+	}
+	return value
+}
+
+// setPath assigns value at a dot-separated path, creating the objects along it; a nil value
+// removes the field
+func setPath(event map[string]any, path string, value any) error {
+	keys := strings.Split(path, ".")
+	node := event
+	for _, key := range keys[:len(keys)-1] {
+		switch child := node[key].(type) {
+		case map[string]any:
+			node = child
+		case nil:
+			if value == nil {
+				return nil
+			}
+			created := make(map[string]any)
+			node[key] = created
+			node = created
+		default:
+			return fmt.Errorf("%s is %s, not an object", key, typeName(child))
+		}
+	}
+	last := keys[len(keys)-1]
+	if value == nil {
+		delete(node, last)
+	} else {
+		node[last] = value
+	}
+	return nil
+}
+
+// marshalEvent serializes an event changed by hooks, like ingest.CanonicalizeJSON: keys sorted,
+// compact and without HTML escaping
+func marshalEvent(event any) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
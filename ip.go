@@ -1,14 +1,119 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
+// errSpoofedClientIP is returned when a request carries Cloudflare headers without coming from Cloudflare
+var errSpoofedClientIP = errors.New("CF-Connecting-IP header from a non-Cloudflare source")
+
+// ClientIPResolver determines the real client IP of a request
+// Forwarding headers are only honored when the request comes from a trusted proxy,
+// since any client can set them to spoof an allowlisted address
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+	strict         bool         // Ignore forwarding headers entirely
+	trustAny       bool         // Trust the first X-Forwarded-For entry from any source (legacy)
+	cloudflare     *IPAllowlist // Cloudflare's published ranges (nil when Cloudflare mode is off)
+}
+
+// NewClientIPResolver creates a resolver
+// With no trusted proxies configured, the connection's address is used unless trustAny restores the
+// legacy behavior of trusting the first X-Forwarded-For entry from any source
+// When cloudflare is set, CF-Connecting-IP is used for requests arriving from Cloudflare's ranges
+func NewClientIPResolver(trustedProxies []string, strict, trustAny bool, cloudflare *IPAllowlist) *ClientIPResolver {
+	prefixes, _ := parseIPPrefixes(trustedProxies)
+	return &ClientIPResolver{
+		trustedProxies: prefixes,
+		strict:         strict,
+		trustAny:       trustAny,
+		cloudflare:     cloudflare,
+	}
+}
+
+// ClientIP extracts the real client IP from the request
+// Returns errSpoofedClientIP if the request claims to come through Cloudflare but does not
+func (c *ClientIPResolver) ClientIP(r *http.Request) (string, error) {
+	remote := remoteIP(r)
+
+	if c.strict {
+		return remote, nil
+	}
+
+	if len(c.trustedProxies) == 0 && c.cloudflare == nil {
+		if c.trustAny {
+			return extractClientIP(r), nil
+		}
+		return remote, nil
+	}
+
+	edge, hops := c.edgeIP(r, remote)
+	if c.cloudflare == nil {
+		return edge, nil
+	}
+
+	// Only Cloudflare may tell us the client address via CF-Connecting-IP
+	cfIP := strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))
+	if !c.cloudflare.Contains(edge) {
+		if cfIP != "" {
+			return "", errSpoofedClientIP
+		}
+		return edge, nil
+	}
+
+	if net.ParseIP(cfIP) != nil {
+		return cfIP, nil
+	}
+	// Cloudflare also appends the client address to X-Forwarded-For
+	if len(hops) > 0 {
+		return hops[len(hops)-1], nil
+	}
+	return edge, nil
+}
+
+// edgeIP returns the first address, walking back from the connection, that is not one of our trusted proxies,
+// along with the X-Forwarded-For hops to its left
+func (c *ClientIPResolver) edgeIP(r *http.Request, remote string) (string, []string) {
+	// Forwarding headers from untrusted peers are ignored
+	if !ipInPrefixes(remote, c.trustedProxies) {
+		return remote, nil
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxy hops;
+	// the first untrusted address is the client
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !ipInPrefixes(hops[i], c.trustedProxies) {
+			return hops[i], hops[:i]
+		}
+	}
+	// Every hop is a trusted proxy, so the leftmost one is the origin
+	if len(hops) > 0 {
+		return hops[0], nil
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		return xri, nil
+	}
+
+	return remote, nil
+}
+
 // extractClientIP extracts the real client IP from the request
 // Checks X-Forwarded-For header first (for Cloudflare and other proxies)
 // Falls back to X-Real-IP, then RemoteAddr
+// The headers are trusted from any source; ClientIPResolver restricts this to trusted proxies
 func extractClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header (Cloudflare and other proxies)
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
@@ -25,7 +130,11 @@ func extractClientIP(r *http.Request) string {
 		return xri
 	}
 
-	// Fall back to RemoteAddr
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP of the directly connected peer
+func remoteIP(r *http.Request) string {
 	// RemoteAddr is in format "IP:port", extract just the IP
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -34,10 +143,45 @@ func extractClientIP(r *http.Request) string {
 	return ip
 }
 
-// isIPAllowed checks if the given IP is in the allowlist
-func isIPAllowed(ip string, allowlist []string) bool {
-	for _, allowedIP := range allowlist {
-		if ip == allowedIP {
+// parseIPPrefixes parses a list of IPs and CIDRs into prefixes
+// Plain IPs become single-address prefixes; invalid entries are returned separately
+func parseIPPrefixes(entries []string) ([]netip.Prefix, []string) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	var invalid []string
+
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				invalid = append(invalid, entry)
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return prefixes, invalid
+}
+
+// ipInPrefixes checks if the given IP falls within any of the prefixes
+func ipInPrefixes(ipStr string, prefixes []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
 			return true
 		}
 	}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,14 +24,154 @@ type Auth0IPRanges struct {
 	} `json:"regions"`
 }
 
-// fetchAuth0IPRanges fetches the latest IP ranges from Auth0's CDN
-func fetchAuth0IPRanges(logger *slog.Logger) ([]string, error) {
-	const auth0IPRangesURL = "https://cdn.auth0.com/ip-ranges.json"
+const auth0IPRangesURL = "https://cdn.auth0.com/ip-ranges.json"
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// IPAllowlist holds the current IP allowlist, which may be replaced at runtime by refreshes
+// Entries can be single IPs or CIDR ranges
+type IPAllowlist struct {
+	current atomic.Pointer[ipSet]
+}
+
+// ipSet is an immutable, parsed snapshot of the allowlist
+type ipSet struct {
+	entries  []string
+	prefixes []netip.Prefix
+}
+
+// NewIPAllowlist creates an allowlist from a list of IPs and CIDRs
+func NewIPAllowlist(entries []string) *IPAllowlist {
+	allowlist := &IPAllowlist{}
+	allowlist.Update(entries)
+	return allowlist
+}
+
+// Update replaces the allowlist entries
+func (a *IPAllowlist) Update(entries []string) {
+	prefixes, _ := parseIPPrefixes(entries)
+	a.current.Store(&ipSet{
+		entries:  entries,
+		prefixes: prefixes,
+	})
+}
+
+// Contains checks if the given IP is covered by the allowlist
+func (a *IPAllowlist) Contains(ip string) bool {
+	return ipInPrefixes(ip, a.current.Load().prefixes)
+}
+
+// Len returns the number of allowlist entries
+func (a *IPAllowlist) Len() int {
+	return len(a.current.Load().entries)
+}
+
+// Entries returns the current allowlist entries
+func (a *IPAllowlist) Entries() []string {
+	return a.current.Load().entries
+}
+
+// allowlistChangePercent returns how much next differs from current, as the number of
+// added and removed entries relative to the size of current
+// Entries in ignore (the custom IPs) are left out, so only Auth0's ranges are compared and a
+// current list holding no Auth0 ranges (the startup fetch failed) accepts any refresh
+func allowlistChangePercent(current, next, ignore []string) float64 {
+	current = withoutEntries(current, ignore)
+	next = withoutEntries(next, ignore)
+	if len(current) == 0 {
+		return 0
+	}
+	inCurrent := make(map[string]bool, len(current))
+	for _, entry := range current {
+		inCurrent[entry] = true
+	}
+	changed := 0
+	inNext := make(map[string]bool, len(next))
+	for _, entry := range next {
+		inNext[entry] = true
+		if !inCurrent[entry] {
+			changed++
+		}
+	}
+	for _, entry := range current {
+		if !inNext[entry] {
+			changed++
+		}
+	}
+	return float64(changed) * 100 / float64(len(current))
+}
+
+// withoutEntries returns entries minus the ones in exclude
+func withoutEntries(entries, exclude []string) []string {
+	if len(exclude) == 0 {
+		return entries
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, entry := range exclude {
+		excluded[entry] = true
+	}
+	var result []string
+	for _, entry := range entries {
+		if !excluded[entry] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// fetchAuth0IPRanges returns Auth0's IP ranges, using the cache file when it is fresh enough
+// The cache file can live on a shared volume so a fleet of replicas hits the CDN only once per maxAge
+func fetchAuth0IPRanges(cacheFile string, maxAge time.Duration, logger *slog.Logger) ([]string, error) {
+	if cacheFile != "" {
+		if info, err := os.Stat(cacheFile); err == nil && time.Since(info.ModTime()) < maxAge {
+			body, err := os.ReadFile(cacheFile)
+			if err == nil {
+				ips, err := parseAuth0IPRanges(body, cacheFile, logger)
+				if err == nil {
+					return ips, nil
+				}
+			}
+			logger.Warn("Ignoring unreadable Auth0 IP ranges cache file",
+				"cache_file", cacheFile,
+				"error", err,
+			)
+		}
+	}
+
+	body, err := downloadAuth0IPRanges()
+	if err != nil {
+		// Fall back to a stale cache rather than an empty allowlist
+		if cacheFile != "" {
+			if cached, readErr := os.ReadFile(cacheFile); readErr == nil {
+				logger.Warn("Failed to fetch Auth0 IP ranges, using stale cache file",
+					"error", err,
+					"cache_file", cacheFile,
+				)
+				return parseAuth0IPRanges(cached, cacheFile, logger)
+			}
+		}
+		return nil, err
+	}
+
+	ips, err := parseAuth0IPRanges(body, auth0IPRangesURL, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheFile != "" {
+		if err := writeFileAtomic(cacheFile, body); err != nil {
+			logger.Warn("Failed to write Auth0 IP ranges cache file",
+				"cache_file", cacheFile,
+				"error", err,
+			)
+		}
 	}
 
+	return ips, nil
+}
+
+// downloadAuth0IPRanges fetches the raw IP ranges document from Auth0's CDN
+func downloadAuth0IPRanges() ([]byte, error) {
+	client := newOutboundClient(10 * time.Second)
+
 	resp, err := client.Get(auth0IPRangesURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch Auth0 IP ranges: %w", err)
@@ -41,6 +187,11 @@ func fetchAuth0IPRanges(logger *slog.Logger) ([]string, error) {
 		return nil, fmt.Errorf("failed to read Auth0 IP ranges response: %w", err)
 	}
 
+	return body, nil
+}
+
+// parseAuth0IPRanges extracts all IPv4 and IPv6 CIDRs from an IP ranges document
+func parseAuth0IPRanges(body []byte, source string, logger *slog.Logger) ([]string, error) {
 	var ipRanges Auth0IPRanges
 	if err := json.Unmarshal(body, &ipRanges); err != nil {
 		return nil, fmt.Errorf("failed to parse Auth0 IP ranges JSON: %w", err)
@@ -62,20 +213,42 @@ func fetchAuth0IPRanges(logger *slog.Logger) ([]string, error) {
 		"count", len(allIPs),
 		"regions", len(ipRanges.Regions),
 		"last_updated", ipRanges.LastUpdatedAt,
-		"source", auth0IPRangesURL,
+		"source", source,
 	)
 
 	return allIPs, nil
 }
 
+// writeFileAtomic writes data to path via a temporary file and rename,
+// so concurrent readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // buildIPAllowlist constructs the final IP allowlist based on configuration
-func buildIPAllowlist(cfg *Config, logger *slog.Logger) []string {
+// If Auth0's ranges cannot be fetched, the returned list holds only the custom IPs and the error is returned too
+func buildIPAllowlist(cfg *Config, logger *slog.Logger) ([]string, error) {
 	var allowlist []string
+	var fetchErr error
 
 	// Add Auth0's official IP ranges unless disabled
 	if !cfg.IgnoreAuth0IPs {
-		auth0IPs, err := fetchAuth0IPRanges(logger)
+		auth0IPs, err := fetchAuth0IPRanges(cfg.IPRangesCacheFile, ipRangesCacheMaxAge(cfg), logger)
 		if err != nil {
+			fetchErr = err
 			logger.Warn("Failed to fetch Auth0 IP ranges, using empty list",
 				"error", err,
 			)
@@ -100,11 +273,93 @@ func buildIPAllowlist(cfg *Config, logger *slog.Logger) []string {
 	// Remove duplicates
 	allowlist = removeDuplicates(allowlist)
 
+	// Warn about entries that can never match
+	if _, invalid := parseIPPrefixes(allowlist); len(invalid) > 0 {
+		logger.Warn("Ignoring invalid IP allowlist entries",
+			"entries", invalid,
+		)
+	}
+
 	logger.Info("Final IP allowlist built",
 		"total_count", len(allowlist),
 	)
 
-	return allowlist
+	return allowlist, fetchErr
+}
+
+// ipRangesCacheMaxAge returns how long a cached IP ranges document stays fresh
+func ipRangesCacheMaxAge(cfg *Config) time.Duration {
+	if cfg.IPRangesRefreshInterval > 0 {
+		return time.Duration(cfg.IPRangesRefreshInterval) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// sleepWithJitter waits a random duration in [0, max) so that replicas started
+// together do not hit external endpoints at the same instant
+func sleepWithJitter(ctx context.Context, max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	timer := time.NewTimer(rand.N(max))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// jitteredInterval randomizes interval by ±10% so a fleet does not act in lockstep
+func jitteredInterval(interval time.Duration) time.Duration {
+	if interval < 10 {
+		return interval
+	}
+	return interval + rand.N(interval/5) - interval/10
+}
+
+// refreshIPAllowlist periodically rebuilds the allowlist
+// Each interval is randomized by ±10% so a fleet does not refresh in lockstep
+// A list differing from the current one by more than IP_RANGES_MAX_CHANGE_PERCENT is
+// refused, since a truncated or corrupted download would otherwise lock out Auth0
+func refreshIPAllowlist(ctx context.Context, cfg *Config, allowlist *IPAllowlist, metrics *Metrics, logger *slog.Logger) {
+	interval := time.Duration(cfg.IPRangesRefreshInterval) * time.Second
+
+	for {
+		timer := time.NewTimer(jitteredInterval(interval))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		entries, err := buildIPAllowlist(cfg, logger)
+		if err != nil {
+			logger.Warn("Keeping current IP allowlist after failed refresh",
+				"error", err,
+				"current_count", allowlist.Len(),
+			)
+			continue
+		}
+
+		if change := allowlistChangePercent(allowlist.Entries(), entries, cfg.CustomIPs); cfg.IPRangesMaxChangePct > 0 && change > cfg.IPRangesMaxChangePct {
+			metrics.allowlistRejected.Inc()
+			logger.Error("Refusing IP allowlist refresh that changes too many entries, keeping current list",
+				"change_percent", change,
+				"max_change_percent", cfg.IPRangesMaxChangePct,
+				"current_count", allowlist.Len(),
+				"new_count", len(entries),
+			)
+			continue
+		}
+
+		allowlist.Update(entries)
+		logger.Info("Refreshed IP allowlist",
+			"total_count", len(entries),
+		)
+	}
 }
 
 // removeDuplicates removes duplicate IPs from the allowlist
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Hashes of RS256, PS256 and ES256
+	_ "crypto/sha512" // Hashes of the 384 and 512 variants
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew between the token issuer and the service in exp and nbf
+const jwtLeeway = time.Minute
+
+// Refresh of the key set at JWT_JWKS_URL: fetched keys are used for jwksRefreshInterval, and a
+// token signed with an unknown key ID triggers a fetch at most every jwksMinRefreshInterval
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+	jwksFetchTimeout       = 10 * time.Second
+	maxJWKSBody            = 1 << 20
+)
+
+// jwtAlgorithms maps the supported signature algorithms to their hash; HMAC algorithms are
+// not accepted, shared secrets are what HMAC_SECRET is for
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// jwtKey is a public key tokens may be signed with
+type jwtKey struct {
+	id  string // Key ID matched against the token's kid ("" matches any)
+	key crypto.PublicKey
+}
+
+// JWTAuthenticator accepts bearer tokens that are JWTs signed by a trusted key, unexpired,
+// from JWT_ISSUER for JWT_AUDIENCE when set, whose JWT_TENANT_CLAIM names the tenant
+type JWTAuthenticator struct {
+	issuer      string
+	audience    string
+	tenantClaim string
+	keys        []jwtKey // From JWT_PUBLIC_KEY_FILE
+	jwks        *JWKSet  // nil without JWT_JWKS_URL
+}
+
+// NewJWTAuthenticator loads the keys of JWT_PUBLIC_KEY_FILE and fetches JWT_JWKS_URL
+// A key set that cannot be fetched yet is fetched again on the first token
+func NewJWTAuthenticator(ctx context.Context, cfg *Config, logger *slog.Logger) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{
+		issuer:      cfg.JWTIssuer,
+		audience:    cfg.JWTAudience,
+		tenantClaim: cfg.JWTTenantClaim,
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		keys, err := loadJWTKeys(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	if cfg.JWTJWKSURL != "" {
+		a.jwks = NewJWKSet(cfg.JWTJWKSURL, logger)
+		if err := a.jwks.refresh(ctx); err != nil {
+			logger.Warn("Failed to fetch the JWT key set, retrying on the first token", "url", cfg.JWTJWKSURL, "error", err)
+		}
+	}
+	return a, nil
+}
+
+// loadJWTKeys reads the PEM public keys or certificates of path
+func loadJWTKeys(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT_PUBLIC_KEY_FILE: %w", err)
+	}
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key in JWT_PUBLIC_KEY_FILE: %w", err)
+			}
+			keys = append(keys, jwtKey{key: key})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate in JWT_PUBLIC_KEY_FILE: %w", err)
+			}
+			keys = append(keys, jwtKey{key: cert.PublicKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWT_PUBLIC_KEY_FILE holds no PEM public key or certificate")
+	}
+	return keys, nil
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate verifies a JWT bearer token; other bearer tokens are left to the other schemes
+func (a *JWTAuthenticator) Authenticate(r *http.Request, tenant string) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errNoCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return invalidToken("malformed JWT header")
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return invalidToken(fmt.Sprintf("unsupported JWT algorithm %q", header.Alg))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalidToken("malformed JWT signature")
+	}
+	if !a.verify(r.Context(), header, hash, parts[0]+"."+parts[1], signature) {
+		return invalidToken("JWT signature not verified by any trusted key")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return invalidToken("malformed JWT claims")
+	}
+	return a.checkClaims(claims, tenant)
+}
+
+// verify reports whether one of the keys matching the token's key ID signed it
+func (a *JWTAuthenticator) verify(ctx context.Context, header jwtHeader, hash crypto.Hash, signed string, signature []byte) bool {
+	keys := a.keys
+	if a.jwks != nil {
+		keys = append(slices.Clip(keys), a.jwks.Keys(ctx, header.Kid)...)
+	}
+	for _, key := range keys {
+		if key.id != "" && header.Kid != "" && key.id != header.Kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, hash, key.key, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks signature over signed with key, which must suit alg
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, signature []byte) bool {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}[alg]
+		if curve == nil || key.Curve != curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, []byte(signed), signature)
+	}
+	return false
+}
+
+// checkClaims checks the validity period, which must end, issuer, audience and tenant of a verified token
+func (a *JWTAuthenticator) checkClaims(claims map[string]any, tenant string) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return invalidToken("JWT without exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return invalidToken("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return invalidToken("JWT not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return invalidToken(fmt.Sprintf("JWT issuer %v is not JWT_ISSUER", claims["iss"]))
+	}
+	if a.audience != "" && !claimContains(claims["aud"], a.audience) {
+		return invalidToken("JWT audience does not include JWT_AUDIENCE")
+	}
+	if !claimContains(claims[a.tenantClaim], tenant) {
+		return invalidToken(fmt.Sprintf("JWT claim %q does not name the tenant", a.tenantClaim))
+	}
+	return nil
+}
+
+// claimContains reports whether a string claim is value or a string array claim holds it
+func claimContains(claim any, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []any:
+		return slices.Contains(claim, any(value))
+	}
+	return false
+}
+
+// decodeJWTPart decodes a base64url JSON part of a token into v
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// JWKSet caches the signing keys published at a JWKS URL, e.g. an identity provider's
+// /.well-known/jwks.json, and follows their rotation
+type JWKSet struct {
+	url    string
+	client *http.Client
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	keys       []jwtKey
+	fetched    time.Time     // Last successful fetch
+	attempted  time.Time     // Last fetch started by Keys, successful or not
+	refreshing chan struct{} // Closed once the fetch in flight completes; nil without one
+}
+
+// NewJWKSet creates a key set fetched from url on first use
+func NewJWKSet(url string, logger *slog.Logger) *JWKSet {
+	return &JWKSet{
+		url:    url,
+		client: newOutboundClient(jwksFetchTimeout),
+		logger: logger,
+	}
+}
+
+// Keys returns the keys of the set, fetching it again when it is stale or lacks kid
+// One fetch runs at a time, in the background so that a request ending does not abort it;
+// a token signed with a key the set lacks waits for the fetch, unless its request ends first
+func (s *JWKSet) Keys(ctx context.Context, kid string) []jwtKey {
+	s.mu.Lock()
+	known := kid == "" || slices.ContainsFunc(s.keys, func(key jwtKey) bool { return key.id == kid })
+	stale := time.Since(s.fetched) > jwksRefreshInterval
+	if (!known || stale) && s.refreshing == nil && time.Since(s.attempted) > jwksMinRefreshInterval {
+		s.attempted = time.Now()
+		s.refreshing = make(chan struct{})
+		go s.refreshInBackground(s.refreshing)
+	}
+	keys, refreshing := s.keys, s.refreshing
+	s.mu.Unlock()
+
+	if refreshing == nil || (known && len(keys) > 0) {
+		return keys
+	}
+	select {
+	case <-refreshing:
+	case <-ctx.Done():
+		return keys
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys
+}
+
+// refreshInBackground fetches the key set for Keys and closes done when it is through
+func (s *JWKSet) refreshInBackground(done chan struct{}) {
+	if err := s.refresh(context.Background()); err != nil {
+		s.logger.Warn("Failed to refresh the JWT key set, keeping the current keys", "url", s.url, "error", err)
+	}
+	s.mu.Lock()
+	s.refreshing = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+// refresh fetches the key set and swaps the fetched keys in
+func (s *JWKSet) refresh(ctx context.Context) error {
+	keys, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched.IsZero() || len(keys) != len(s.keys) {
+		s.logger.Info("Fetched the JWT key set", "url", s.url, "keys", len(keys))
+	}
+	s.keys = keys
+	s.fetched = time.Now()
+	return nil
+}
+
+// jwk is a JSON Web Key; only the members of signature keys are decoded
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch fetches and parses the key set
+func (s *JWKSet) fetch(ctx context.Context) ([]jwtKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBody)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			s.logger.Warn("Skipping unusable key of the JWT key set", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys = append(keys, jwtKey{id: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signature key")
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key of an RSA, EC or Ed25519 JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(field, value string) ([]byte, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s", field)
+		}
+		return b, nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		// Parsing the uncompressed point checks that it is on the curve
+		size := (c.curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, fmt.Errorf("invalid point")
+		}
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+		if _, err := c.ecdh.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("invalid point: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// limiterRetryAfter is the Retry-After sent with requests shed by the limiter, in seconds
+const limiterRetryAfter = 1
+
+// RequestLimiter bounds the ingestion requests handled at once and the body bytes they
+// hold, so a burst of parallel deliveries is shed with 503 instead of exhausting memory or
+// starving the batcher. A nil limiter admits everything
+type RequestLimiter struct {
+	maxRequests int   // Requests handled at once (0 = unlimited)
+	maxBytes    int64 // Body bytes of the requests handled at once (0 = unlimited)
+
+	mu       sync.Mutex
+	requests int
+	bytes    int64
+
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// NewRequestLimiter returns a limiter, or nil if neither limit is set
+func NewRequestLimiter(maxRequests int, maxBytes int64, metrics *Metrics, logger *slog.Logger) *RequestLimiter {
+	if maxRequests <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	return &RequestLimiter{
+		maxRequests: maxRequests,
+		maxBytes:    maxBytes,
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+// acquire admits a request that announced size body bytes, or returns the exceeded limit
+// A request is always admitted when nothing else is in flight, so a body larger than the
+// byte limit is not refused forever
+func (l *RequestLimiter) acquire(size int64) (exceeded string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.requests > 0 {
+		if l.maxRequests > 0 && l.requests >= l.maxRequests {
+			return "requests"
+		}
+		if l.maxBytes > 0 && l.bytes+size > l.maxBytes {
+			return "bytes"
+		}
+	}
+	l.requests++
+	l.bytes += size
+	return ""
+}
+
+// grow accounts body bytes read beyond what the request announced
+func (l *RequestLimiter) grow(n int64) {
+	l.mu.Lock()
+	l.bytes += n
+	l.mu.Unlock()
+}
+
+// release returns what a finished request held
+func (l *RequestLimiter) release(size int64) {
+	l.mu.Lock()
+	l.requests--
+	l.bytes -= size
+	l.mu.Unlock()
+}
+
+// InFlight returns the requests and body bytes currently held
+func (l *RequestLimiter) InFlight() (requests int, bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests, l.bytes
+}
+
+// Wrap sheds requests above the limits in front of next
+func (l *RequestLimiter) Wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Chunked bodies announce nothing; their bytes are accounted as they are read
+		reserved := max(r.ContentLength, 0)
+		if exceeded := l.acquire(reserved); exceeded != "" {
+			l.metrics.requestsShed.Inc(exceeded)
+			requests, bytes := l.InFlight()
+			requestLogger(r, l.logger).Warn("Shedding request above concurrency limit",
+				"limit", exceeded,
+				"requests_in_flight", requests,
+				"bytes_in_flight", bytes,
+				"content_length", r.ContentLength,
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(limiterRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, "too_many_requests_in_flight")
+			return
+		}
+
+		body := &limitedBody{ReadCloser: r.Body, limiter: l, reserved: reserved}
+		defer func() { l.release(body.held()) }()
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody accounts the bytes read beyond the request's reservation
+type limitedBody struct {
+	io.ReadCloser
+	limiter  *RequestLimiter
+	reserved int64
+	read     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		before := max(b.read, b.reserved)
+		b.read += int64(n)
+		if b.read > before {
+			b.limiter.grow(b.read - before)
+		}
+	}
+	return n, err
+}
+
+// held returns the bytes the request accounted for
+func (b *limitedBody) held() int64 {
+	return max(b.read, b.reserved)
+}
@@ -1,119 +1,86 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"strconv"
+	"os"
 	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
 )
 
-// LokiClient handles sending batches to Loki
-type LokiClient struct {
-	client   *http.Client
-	baseURL  string
-	username string // Optional: basic auth username
-	password string // Optional: basic auth password
-	logger   *slog.Logger
-}
+// HTTP/2 modes of the Loki client
+const (
+	lokiHTTP2Auto = "auto" // HTTP/2 when negotiated over TLS, HTTP/1.1 otherwise
+	lokiHTTP2Off  = "off"  // HTTP/1.1 only
+	lokiHTTP2H2C  = "h2c"  // HTTP/2 with prior knowledge for http:// URLs, negotiated over TLS
+)
 
-// NewLokiClient creates a new Loki client
-func NewLokiClient(baseURL, username, password string, logger *slog.Logger) *LokiClient {
-	return &LokiClient{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
-				DisableKeepAlives:   false,
-			},
-		},
-		baseURL:  baseURL,
-		username: username,
-		password: password,
-		logger:   logger,
-	}
+// lokiSigV4 signs requests to gateways that require AWS Signature Version 4
+type lokiSigV4 struct {
+	creds   *AWSCredentialsChain
+	region  string
+	service string
 }
 
-// Push sends a batch of log entries to Loki
-// The batches map contains entries grouped by their label set
-func (lc *LokiClient) Push(ctx context.Context, batches map[string]*Batch) error {
-	if len(batches) == 0 {
-		return nil
-	}
-
-	// Build the Loki push request payload
-	payload := lc.buildPushRequest(batches)
-
-	// Serialize to JSON
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal Loki payload: %w", err)
-	}
-
-	// Create the HTTP request
-	url := lc.baseURL + "/loki/api/v1/push"
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+// Authenticate signs req with AWS credentials from the default chain
+func (s *lokiSigV4) Authenticate(ctx context.Context, req *http.Request, body []byte) error {
+	creds, err := s.creds.Retrieve(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Add basic auth if configured
-	if lc.username != "" && lc.password != "" {
-		req.SetBasicAuth(lc.username, lc.password)
+		return fmt.Errorf("failed to get AWS credentials for Loki: %w", err)
 	}
+	signAWSRequestV4(req, body, creds, s.region, s.service, time.Now())
+	return nil
+}
 
-	// Send the request
-	resp, err := lc.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request to Loki: %w", err)
+// newLokiClientFromConfig creates the Loki client with the connection, tenant and authentication settings of cfg
+func newLokiClientFromConfig(cfg *Config, secrets *SecretStore, logger *slog.Logger) *loki.Client {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: lokiTransport(cfg.LokiHTTP2, cfg.LokiMaxConnsPerHost, cfg.LokiMaxIdleConnsPerHost),
 	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Read a snippet of the response body for logging
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
-		return fmt.Errorf("Loki returned non-2xx status %d: %s", resp.StatusCode, string(body))
+	lc := loki.NewClient(cfg.LokiURL, client, secrets, logger)
+	lc.SetOrgID(cfg.LokiOrgID)
+	lc.SetGzip(cfg.LokiGzip)
+	if cfg.LokiSigV4 {
+		lc.SetAuthenticator(&lokiSigV4{
+			creds:   NewAWSCredentialsChain(client, cfg.LokiSigV4Region),
+			region:  cfg.LokiSigV4Region,
+			service: cfg.LokiSigV4Service,
+		})
+	} else if cfg.LokiOAuth2TokenURL != "" {
+		lc.SetAuthenticator(NewOAuth2TokenSource(client, cfg.LokiOAuth2TokenURL, cfg.LokiOAuth2ClientID, cfg.LokiOAuth2Scopes, secrets))
 	}
-
-	return nil
+	return lc
 }
 
-// buildPushRequest constructs a LokiPushRequest from batches
-func (lc *LokiClient) buildPushRequest(batches map[string]*Batch) LokiPushRequest {
-	streams := make([]LokiStream, 0, len(batches))
-
-	for _, batch := range batches {
-		if len(batch.Entries) == 0 {
-			continue
-		}
-
-		// Build values array: [[timestamp_ns, line], ...]
-		values := make([][]string, 0, len(batch.Entries))
-		for _, entry := range batch.Entries {
-			values = append(values, []string{
-				strconv.FormatInt(entry.Timestamp, 10), // timestamp as string
-				entry.Line,                             // original JSON line
-			})
-		}
-
-		stream := LokiStream{
-			Stream: batch.Labels,
-			Values: values,
-		}
-
-		streams = append(streams, stream)
+// openDryRunOutput opens the file receiving dry-run payloads for appending, or stdout when path is empty
+func openDryRunOutput(path string) (*os.File, error) {
+	if path == "" {
+		return os.Stdout, nil
 	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+}
 
-	return LokiPushRequest{
-		Streams: streams,
+// lokiTransport creates the connection pool used for Loki pushes
+func lokiTransport(http2 string, maxConnsPerHost, maxIdleConnsPerHost int) *http.Transport {
+	transport := newOutboundTransport()
+	transport.MaxIdleConns = max(100, maxIdleConnsPerHost)
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.MaxConnsPerHost = maxConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	switch http2 {
+	case lokiHTTP2Off:
+		transport.ForceAttemptHTTP2 = false
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case lokiHTTP2H2C:
+		// Without HTTP1, http:// URLs use unencrypted HTTP/2 instead of HTTP/1.1
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
 	}
+	return transport
 }
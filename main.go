@@ -1,18 +1,29 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
 )
 
 func main() {
+	// Tools such as gen-token run instead of the service
+	if exitCode, ok := runSubcommand(os.Args[1:]); ok {
+		os.Exit(exitCode)
+	}
+
 	// Load configuration first (with temporary logger)
 	tempLogger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -28,67 +39,616 @@ func main() {
 	logLevel := parseLogLevel(cfg.LogLevel)
 
 	// Set up structured logging with configured level
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	// -print-config keeps stdout for the configuration
+	logOutput := os.Stdout
+	if cfg.PrintConfig {
+		logOutput = os.Stderr
+	}
+	logger := slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
 		Level: logLevel,
 	}))
 	slog.SetDefault(logger)
 
 	// Build IP allowlist from Auth0 and custom sources
-	cfg.IPAllowlist = buildIPAllowlist(cfg, logger)
+	// A random startup delay keeps a restarting fleet from hitting Auth0's CDN at once
+	sleepWithJitter(context.Background(), time.Duration(cfg.IPRangesStartupJitterMs)*time.Millisecond)
+	cfg.IPAllowlist, _ = buildIPAllowlist(cfg, logger)
+	ipAllowlist := NewIPAllowlist(cfg.IPAllowlist)
+
+	// The effective configuration includes the allowlist, so it is rendered once that is built
+	effectiveCfg, err := effectiveConfig(cfg)
+	if err != nil {
+		logger.Error("Failed to render the effective configuration", "error", err)
+		os.Exit(1)
+	}
+	if cfg.PrintConfig {
+		os.Stdout.Write(effectiveCfg)
+		os.Exit(0)
+	}
 
+	build := buildInfo()
 	logger.Info("Starting a0-logstream2loki service",
+		"version", build.Version,
+		"commit", build.Commit,
+		"build_date", build.BuildDate,
 		"loki_url", cfg.LokiURL,
+		"loki_org_id", cfg.LokiOrgID,
+		"loki_org_ids", len(cfg.LokiOrgIDs),
+		"loki_gzip", cfg.LokiGzip,
+		"loki_http2", cfg.LokiHTTP2,
+		"loki_max_conns_per_host", cfg.LokiMaxConnsPerHost,
+		"loki_max_idle_conns_per_host", cfg.LokiMaxIdleConnsPerHost,
+		"loki_sigv4", cfg.LokiSigV4,
+		"loki_sigv4_region", cfg.LokiSigV4Region,
+		"loki_sigv4_service", cfg.LokiSigV4Service,
+		"loki_oauth2_token_url", redactedURL(cfg.LokiOAuth2TokenURL),
+		"loki_oauth2_client_id", cfg.LokiOAuth2ClientID,
+		"tenant_quota_lines_per_day", cfg.TenantQuotaLinesPerDay,
+		"tenant_quota_bytes_per_day", cfg.TenantQuotaBytesPerDay,
+		"tenant_quota_lines_per_second", cfg.TenantQuotaLinesPerSec,
+		"tenant_quotas", len(cfg.TenantQuotas),
+		"tenant_stale_minutes", cfg.TenantStaleMinutes,
 		"listen_addr", cfg.ListenAddr,
 		"batch_size", cfg.BatchSize,
 		"batch_flush_ms", cfg.BatchFlush,
+		"batch_stream_max", cfg.BatchStreamMax,
+		"adaptive_batching", cfg.AdaptiveBatching,
+		"batcher_shards", cfg.BatcherShards,
+		"push_summary_interval_s", cfg.PushSummaryInterval,
 		"verbose_logging", cfg.VerboseLogging,
 		"allow_local_ips", cfg.AllowLocalIPs,
 		"ip_allowlist_size", len(cfg.IPAllowlist),
 		"ignore_auth0_ips", cfg.IgnoreAuth0IPs,
 		"custom_ips_count", len(cfg.CustomIPs),
-		"custom_auth_enabled", cfg.CustomAuthToken != "",
+		"trusted_proxies_count", len(cfg.TrustedProxies),
+		"strict_client_ip", cfg.StrictClientIP,
+		"trust_any_forwarded_for", cfg.TrustAnyForwardedFor,
+		"cloudflare_mode", cfg.CloudflareMode,
+		"proxy_protocol", cfg.ProxyProtocol,
+		"egress_proxy", redactedURL(cfg.EgressProxy),
+		"metrics_backend", cfg.MetricsBackend,
+		"metrics_max_series", cfg.MetricsMaxSeries,
+		"admin_addr", cfg.AdminAddr,
+		"admin_token", cfg.AdminToken != "",
+		"pprof_enabled", cfg.EnablePprof,
+		"tracing_enabled", cfg.OTLPEndpoint != "",
+		"ip_ranges_refresh_interval_s", cfg.IPRangesRefreshInterval,
+		"ip_ranges_max_change_percent", cfg.IPRangesMaxChangePct,
+		"custom_auth_enabled", len(cfg.CustomAuthTokens) > 0,
+		"hmac_secrets_count", len(cfg.HMACSecrets),
+		"custom_auth_tokens_count", len(cfg.CustomAuthTokens),
+		"auth_methods", cfg.authMethods(),
+		"jwt_jwks_url", cfg.JWTJWKSURL,
+		"jwt_public_key_file", cfg.JWTPublicKeyFile,
+		"tls_enabled", cfg.TLSCertFile != "",
+		"tls_client_ca_file", cfg.TLSClientCAFile,
 		"loki_auth_enabled", cfg.LokiUsername != "",
+		"secrets_watch_interval_s", cfg.SecretsWatchInterval,
+		"secrets_provider", cfg.SecretsProvider,
+		"preset", cfg.Preset,
+		"remote_config_backend", cfg.RemoteConfigBackend,
+		"remote_config_key", cfg.RemoteConfigKey,
+		"max_entry_age_hours", cfg.MaxEntryAgeHours,
+		"exactly_once_mode", cfg.ExactlyOnceMode,
+		"canonicalize_json", cfg.CanonicalizeJSON,
+		"schema_drift_detection", cfg.SchemaDriftDetection,
+		"recent_entries", cfg.RecentEntries,
+		"sync_delivery", cfg.SyncDelivery,
+		"out_of_order_action", cfg.OutOfOrderAction,
+		"loki_push_proxy", cfg.LokiPushProxy,
+		"loki_push_proxy_tenants", cfg.LokiPushProxyTenants,
+		"okta_event_hooks", cfg.OktaEventHooks,
+		"webhooks_file", cfg.WebhooksFile,
+		"alert_rules", len(cfg.AlertRules),
+		"hooks", len(cfg.Hooks),
+		"sqs_queue_url", cfg.SQSQueueURL,
+		"azure_queue", cfg.AzureQueueURL != "",
+		"kafka_topics", cfg.KafkaTopics,
+		"dry_run", cfg.DryRun,
+		"max_lines_per_request", cfg.MaxLinesPerRequest,
+		"oversized_line_action", cfg.OversizedLineAction,
+		"parse_workers", cfg.ParseWorkers,
+		"max_concurrent_requests", cfg.MaxConcurrentRequests,
+		"max_inflight_bytes", cfg.MaxInflightBytes,
+		"spill_dir", cfg.SpillDir,
+		"spill_max_bytes", cfg.SpillMaxBytes,
+		"dlq_dir", cfg.DLQDir,
+		"dlq_max_bytes", cfg.DLQMaxBytes,
+		"dlq_replay_interval", cfg.DLQReplayInterval,
+		"dlq_export_url", cfg.DLQExportURL,
+		"disk_encryption", cfg.DiskEncryptionKey != "" || cfg.DiskEncryptionKMSCiphertext != "",
+		"disk_secure_delete", cfg.DiskSecureDelete,
+		"memory_limit_bytes", memoryLimit(cfg),
+		"memory_pressure_percent", cfg.MemoryPressurePercent,
+		"maintenance_retry_after", cfg.MaintenanceRetryAfter,
+		"shutdown_timeout_s", cfg.ShutdownTimeout,
+		"shutdown_policy", cfg.ShutdownPolicy,
+		"serverless", cfg.Serverless,
+		"systemd_notify", os.Getenv("NOTIFY_SOCKET") != "",
+		"label_query_params", cfg.LabelQueryParams,
+		"label_header_keys", cfg.LabelHeaderKeys,
+		"auth_ban_threshold", cfg.AuthBanThreshold,
+		"remote_write_url", redactedURL(cfg.RemoteWriteURL),
+		"remote_write_interval", cfg.RemoteWriteInterval,
+		"canary_interval", cfg.CanaryInterval,
+		"canary_slo", cfg.CanarySLO,
 	)
 
-	// Create a buffered channel for log entries
-	// Buffer size should be large enough to handle bursts
-	entryChan := make(chan LogEntry, 10000)
+	// Create buffered channels for log entries, one per batcher shard
+	// The total buffer size should be large enough to handle bursts
+	entryQueue := batch.NewEntryQueue(cfg.BatcherShards, 10000)
+
+	// Recent delivery status by log_id, for /admin/logs lookups
+	var deliveries *DeliveryTracker
+	if cfg.LogLookupCapacity > 0 {
+		deliveries = NewDeliveryTracker(cfg.LogLookupCapacity)
+	}
+
+	// Tracing of the ingestion path, exported to an OTLP collector when configured
+	// The exporter has its own context so spans of the final flush are still exported
+	var tracer *Tracer
+	tracerCtx, tracerCancel := context.WithCancel(context.Background())
+	tracerDone := make(chan struct{})
+	if cfg.OTLPEndpoint != "" {
+		tracer = NewTracer(cfg.OTLPEndpoint, parseOTLPHeaders(cfg.OTLPHeaders), cfg.OTelServiceName, cfg.TraceSampleRatio, logger)
+		go func() {
+			defer close(tracerDone)
+			tracer.Run(tracerCtx)
+		}()
+	} else {
+		close(tracerDone)
+	}
+
+	// Metrics exposed on /metrics
+	metrics := NewMetrics(cfg.MetricsMaxSeries)
+
+	// Secrets may be swapped at runtime when loaded from watched files
+	secrets := NewSecretStore(cfg.secrets())
 
 	// Create Loki client
-	lokiClient := NewLokiClient(cfg.LokiURL, cfg.LokiUsername, cfg.LokiPassword, logger)
+	lokiClient := newLokiClientFromConfig(cfg, secrets, logger)
+
+	// Dry-run mode prints the would-be pushes instead of sending them
+	if cfg.DryRun {
+		out, err := openDryRunOutput(cfg.DryRunOutput)
+		if err != nil {
+			logger.Error("Failed to open dry-run output", "path", cfg.DryRunOutput, "error", err)
+			os.Exit(1)
+		}
+		if out != os.Stdout {
+			defer out.Close()
+		}
+		lokiClient.SetDryRun(out)
+		logger.Warn("Dry-run mode: log entries are written as Loki push payloads and not sent to Loki",
+			"output", cmp.Or(cfg.DryRunOutput, "stdout"),
+		)
+	}
+
+	// Encryption and secure deletion of the on-disk buffers
+	var protection *DiskProtection
+	if cfg.SpillDir != "" || cfg.DLQDir != "" {
+		var err error
+		protection, err = NewDiskProtection(context.Background(), cfg)
+		if err != nil {
+			logger.Error("Failed to set up disk encryption", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Entries that find the queue full spill to disk instead of being dropped
+	var spill *SpillQueue
+	if cfg.SpillDir != "" {
+		var err error
+		spill, err = NewSpillQueue(cfg.SpillDir, int64(cfg.SpillMaxBytes), protection, metrics, logger)
+		if err != nil {
+			logger.Error("Failed to open spill directory", "dir", cfg.SpillDir, "error", err)
+			os.Exit(1)
+		}
+		entryQueue.SetSpill(spill)
+		metrics.registry.NewGaugeFunc("spill_bytes", "Bytes of entries spilled to disk and not yet drained", func() float64 {
+			return float64(spill.Bytes())
+		})
+	}
+
+	// Pushes to Loki can be paused while accepted entries are spilled to disk
+	var forwarding *Forwarding
+	if spill != nil {
+		forwarding = NewForwarding(spill, logger)
+		entryQueue.SetForwarding(forwarding)
+		metrics.registry.NewGaugeFunc("forwarding_paused", "1 while pushes to Loki are paused and accepted entries are spilled to disk", func() float64 {
+			if forwarding.Paused() {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	// Entries of pushes Loki did not accept are dead-lettered to disk instead of being dropped
+	var deadLetter *DeadLetterQueue
+	if cfg.DLQDir != "" {
+		var err error
+		deadLetter, err = NewDeadLetterQueue(cfg.DLQDir, int64(cfg.DLQMaxBytes), protection, metrics, logger)
+		if err != nil {
+			logger.Error("Failed to open dead-letter directory", "dir", cfg.DLQDir, "error", err)
+			os.Exit(1)
+		}
+		if cfg.DLQExportURL != "" {
+			store, err := newObjectStore(cfg.DLQExportURL)
+			if err != nil {
+				logger.Error("Failed to configure dead-letter export", "error", err)
+				os.Exit(1)
+			}
+			deadLetter.SetExport(store, cfg.DLQExportAfterAttempts)
+		}
+		deadLetter.SetForwarding(forwarding)
+		if n := deadLetter.Len(); n > 0 {
+			logger.Warn("Dead-lettered batches are waiting to be replayed or purged", "batches", n, "dir", cfg.DLQDir)
+		}
+		metrics.registry.NewGaugeFunc("dlq_batches", "Batches in the dead-letter queue", func() float64 {
+			return float64(deadLetter.Len())
+		})
+		metrics.registry.NewGaugeFunc("dlq_bytes", "Disk space the dead-lettered batches use", func() float64 {
+			return float64(deadLetter.Bytes())
+		})
+	}
 
 	// Set up context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Watch secret files for rotation if enabled
+	if cfg.SecretsWatchInterval > 0 && cfg.hasSecretFiles() {
+		go watchSecretFiles(ctx, cfg, secrets, time.Duration(cfg.SecretsWatchInterval)*time.Second, logger)
+	}
+
+	// Periodically refresh the IP allowlist if enabled
+	if cfg.IPRangesRefreshInterval > 0 && !cfg.IgnoreAuth0IPs {
+		go refreshIPAllowlist(ctx, cfg, ipAllowlist, metrics, logger)
+	}
+
+	// Periodically refresh secrets from the external backend if configured
+	if cfg.secretsProvider != nil && cfg.SecretsRefreshInterval > 0 {
+		go refreshProviderSecrets(ctx, cfg.secretsProvider, secrets, time.Duration(cfg.SecretsRefreshInterval)*time.Second, logger)
+	}
+
+	// Watch the remote configuration for changes if configured
+	if cfg.remoteConfig != nil {
+		go cfg.remoteConfig.Watch(ctx, cfg, secrets, metrics, logger)
+	}
+
+	// Shed deliveries and push batches early when memory use nears its limit
+	if cfg.MemoryLimitBytes > 0 {
+		// The GC also works harder as memory use nears the limit, as with GOMEMLIMIT
+		debug.SetMemoryLimit(int64(cfg.MemoryLimitBytes))
+	}
+	memory := NewMemoryGuard(memoryLimit(cfg), cfg.MemoryPressurePercent, metrics, logger)
+	if memory != nil {
+		go memory.Run(ctx)
+		metrics.registry.NewGaugeFunc("memory_limit_bytes", "Memory limit watched for memory pressure (MEMORY_LIMIT_BYTES or GOMEMLIMIT)", func() float64 {
+			return float64(memory.Limit())
+		})
+		metrics.registry.NewGaugeFunc("memory_in_use_bytes", "Memory held by the Go runtime, as counted against the memory limit", func() float64 {
+			return float64(memory.Usage())
+		})
+		metrics.registry.NewGaugeFunc("memory_pressure", "1 while memory use is above MEMORY_PRESSURE_PERCENT of the limit", func() float64 {
+			if memory.UnderPressure() {
+				return 1
+			}
+			return 0
+		})
+	}
+
 	// WaitGroup to track worker goroutines
 	var wg sync.WaitGroup
 
-	// Start the batcher worker
-	batcher := NewBatcher(
-		lokiClient,
-		entryChan,
-		cfg.BatchSize,
-		time.Duration(cfg.BatchFlush)*time.Millisecond,
-		logger,
-		&wg,
-		ctx,
-	)
-	wg.Add(1)
-	go batcher.Run()
+	// Under systemd (Type=notify), readiness is reported and the watchdog fed from the batcher loops
+	systemd := NewSystemdNotifier(logger)
+
+	// Batching can be changed on /admin/batching while the batchers run
+	batchTuning := NewBatchTuning(cfg.BatchSize, time.Duration(cfg.BatchFlush)*time.Millisecond, cfg.BatchStreamMax, logger)
+
+	// Start the batcher workers, one per shard of the entry queue
+	// They are stopped on their own at shutdown, once the queue feeding them is closed
+	batcherCtx, cancelBatchers := context.WithCancel(ctx)
+	defer cancelBatchers()
+	var batcherWG sync.WaitGroup
+	batchers := make([]*batch.Batcher, cfg.BatcherShards)
+	for shard := range cfg.BatcherShards {
+		batcher := batch.NewBatcher(
+			lokiClient,
+			entryQueue.Shard(shard),
+			cfg.BatchSize,
+			time.Duration(cfg.BatchFlush)*time.Millisecond,
+			logger,
+			&batcherWG,
+			batcherCtx,
+			time.Duration(cfg.PushSummaryInterval)*time.Second,
+			metrics,
+			cfg.OutOfOrderAction,
+		)
+		if cfg.BatcherShards > 1 {
+			batcher.SetShard(shard)
+		}
+		if deliveries != nil {
+			batcher.SetDeliveries(deliveries)
+		}
+		if tracer != nil {
+			batcher.SetTracer(tracer)
+		}
+		if memory != nil {
+			batcher.SetMemoryGuard(memory)
+		}
+		if deadLetter != nil {
+			batcher.SetDeadLetterQueue(deadLetter)
+		}
+		if forwarding != nil {
+			batcher.SetForwarding(forwarding)
+		}
+		batcher.SetBatchTuning(batchTuning)
+		batcher.SetHeartbeat(systemd.Watchdog() / 4)
+		if cfg.ShutdownPolicy == shutdownPersist && spill != nil {
+			batcher.SetShutdownSpill(spill)
+		}
+		if cfg.AdaptiveBatching {
+			batcher.SetAdaptiveBatching(cfg.BatchSizeMax,
+				time.Duration(cfg.BatchFlushMax)*time.Millisecond,
+				time.Duration(cfg.AdaptiveLatencyTarget)*time.Millisecond)
+		}
+		batchers[shard] = batcher
+		batcherWG.Add(1)
+		go batcher.Run()
+	}
+
+	// Resolve client IPs, honoring forwarding headers only from trusted proxies
+	var cloudflareRanges *IPAllowlist
+	if cfg.CloudflareMode {
+		cfRanges, err := fetchCloudflareIPRanges(logger)
+		if err != nil {
+			// Fail closed: without the ranges no request can be verified as coming from Cloudflare
+			logger.Error("Failed to fetch Cloudflare IP ranges, CF-Connecting-IP will be rejected until a refresh succeeds",
+				"error", err,
+			)
+		}
+		cloudflareRanges = NewIPAllowlist(cfRanges)
+		if cfg.IPRangesRefreshInterval > 0 {
+			go refreshCloudflareIPRanges(ctx, time.Duration(cfg.IPRangesRefreshInterval)*time.Second, cloudflareRanges, logger)
+		}
+	}
+	clientIPs := NewClientIPResolver(cfg.TrustedProxies, cfg.StrictClientIP, cfg.TrustAnyForwardedFor, cloudflareRanges)
+	if cfg.TrustAnyForwardedFor {
+		logger.Warn("TRUST_ANY_FORWARDED_FOR is set: X-Forwarded-For is trusted from any source and can be spoofed to bypass the IP allowlist")
+	}
+
+	// Track authentication failures and ban brute-forcing clients if enabled
+	var bans *BanTracker
+	if cfg.AuthBanThreshold > 0 {
+		bans = NewBanTracker(
+			cfg.AuthBanThreshold,
+			time.Duration(cfg.AuthBanWindow)*time.Second,
+			time.Duration(cfg.AuthBanDuration)*time.Second,
+			time.Duration(cfg.AuthBanMaxDuration)*time.Second,
+		)
+		go bans.RunPruner(ctx, time.Minute)
+		metrics.registry.NewGaugeFunc("auth_bans_active", "Client IPs currently banned", func() float64 {
+			return float64(bans.Active())
+		})
+	}
+
+	// Push metrics to a StatsD/DogStatsD agent instead of exposing them for scraping
+	if cfg.MetricsBackend != "prometheus" {
+		emitter, err := NewStatsDEmitter(metrics.registry, cfg.StatsDAddr, cfg.StatsDPrefix, cfg.MetricsBackend == "dogstatsd", logger)
+		if err != nil {
+			logger.Error("Failed to set up metrics backend", "backend", cfg.MetricsBackend, "error", err)
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emitter.Run(ctx, time.Duration(cfg.StatsDFlushInterval)*time.Second)
+		}()
+	}
+
+	// Push the derived Auth0 metrics to Mimir/Thanos/Grafana Cloud, independent of the backend
+	if cfg.RemoteWriteURL != "" {
+		externalLabels, _ := parseExternalLabels(cfg.RemoteWriteExternalLabels)
+		writer := NewRemoteWriter(metrics.registry, cfg.RemoteWriteURL, parseOTLPHeaders(cfg.RemoteWriteHeaders), externalLabels, metrics, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer.Run(ctx, time.Duration(cfg.RemoteWriteInterval)*time.Second)
+		}()
+	}
+
+	// Notify Slack, PagerDuty or a webhook of events matching the alert rules
+	var alerts *Alerter
+	if len(cfg.AlertRules) > 0 {
+		alerts = NewAlerter(cfg.AlertRules, metrics, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alerts.Run(ctx)
+		}()
+	}
+
+	// Authenticate requests with the schemes of AUTH_METHODS
+	authChain, err := NewAuthChain(ctx, cfg, secrets, logger)
+	if err != nil {
+		logger.Error("Failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
 
 	// Create HTTP handler
-	handler := NewLogsHandler(cfg.HMACSecret, cfg.CustomAuthToken, entryChan, logger, cfg.ServiceName, cfg.VerboseLogging, cfg.AllowLocalIPs, cfg.IPAllowlist)
+	handler := NewLogsHandler(cfg, authChain, entryQueue, ipAllowlist, clientIPs, bans, deliveries, tracer, alerts, memory, metrics, logger)
+	handler.SetDeadLetterQueue(deadLetter)
+
+	// Warn about tenants whose stream went silent
+	if cfg.TenantStaleMinutes > 0 {
+		go handler.activity.RunStalenessCheck(ctx, time.Minute)
+		metrics.registry.NewGaugeFunc("tenants_stale", "Tenants silent for TENANT_STALE_MINUTES after streaming", func() float64 {
+			return float64(handler.activity.Stale())
+		})
+	}
+
+	// Queue consumers feed the entry channel and must stop before it is closed
+	consumerCtx, stopConsumers := context.WithCancel(context.Background())
+	defer stopConsumers()
+	var consumers sync.WaitGroup
+	if spill != nil {
+		// Entries still spilled at shutdown stay on disk and are drained after the restart
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			spill.Run(consumerCtx, entryQueue, forwarding)
+		}()
+	}
+	if deadLetter != nil && cfg.DLQReplayInterval > 0 {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			deadLetter.Run(consumerCtx, lokiClient, time.Duration(cfg.DLQReplayInterval)*time.Second)
+		}()
+	}
+	if cfg.CanaryInterval > 0 {
+		canary := NewCanary(entryQueue, lokiClient, cfg.ServiceName, time.Duration(cfg.CanarySLO)*time.Second, metrics, logger)
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			canary.Run(consumerCtx, time.Duration(cfg.CanaryInterval)*time.Second)
+		}()
+	}
+	if cfg.SQSQueueURL != "" {
+		consumer, err := NewSQSConsumer(cfg.SQSQueueURL, cfg.SQSConcurrency, handler, entryQueue, metrics, logger)
+		if err != nil {
+			logger.Error("Failed to configure SQS consumer", "error", err)
+			os.Exit(1)
+		}
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consumer.Run(consumerCtx)
+		}()
+	}
+	if cfg.AzureQueueURL != "" {
+		consumer, err := NewAzureQueueConsumer(cfg.AzureQueueURL, cfg.AzureQueueConcurrency, handler, entryQueue, metrics, logger)
+		if err != nil {
+			logger.Error("Failed to configure Azure queue consumer", "error", err)
+			os.Exit(1)
+		}
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consumer.Run(consumerCtx)
+		}()
+	}
+	if cfg.KafkaRESTURL != "" {
+		consumer, err := NewKafkaConsumer(cfg.KafkaRESTURL, cfg.KafkaGroup, cfg.KafkaTopics, handler, entryQueue, metrics, logger)
+		if err != nil {
+			logger.Error("Failed to configure Kafka consumer", "error", err)
+			os.Exit(1)
+		}
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consumer.Run(consumerCtx)
+		}()
+	}
 
 	// Set up HTTP server with mux
 	mux := http.NewServeMux()
-	mux.Handle("/logs", handler)
+	if handler.faults != nil {
+		logger.Warn("Fault injection enabled, /logs is degraded on purpose",
+			"reject_percent", cfg.FaultRejectPct,
+			"delay_ms", cfg.FaultDelayMs,
+			"delay_percent", cfg.FaultDelayPct,
+			"channel_full_percent", cfg.FaultChannelFullPct,
+		)
+	}
+
+	// One limiter is shared by every ingestion endpoint, as they compete for the same memory
+	limiter := NewRequestLimiter(cfg.MaxConcurrentRequests, int64(cfg.MaxInflightBytes), metrics, logger)
+	if limiter != nil {
+		metrics.registry.NewGaugeFunc("requests_in_flight", "Ingestion requests currently handled", func() float64 {
+			requests, _ := limiter.InFlight()
+			return float64(requests)
+		})
+		metrics.registry.NewGaugeFunc("request_bytes_in_flight", "Body bytes of the ingestion requests currently handled", func() float64 {
+			_, bytes := limiter.InFlight()
+			return float64(bytes)
+		})
+	}
+
+	mux.Handle("/logs", AccessLog(handler.maintenance.Wrap(memory.Wrap(limiter.Wrap(handler.faults.Wrap(handler)))), logger))
+	mux.Handle("/logs/{tenant}", AccessLog(handler.maintenance.Wrap(memory.Wrap(limiter.Wrap(handler.faults.Wrap(handler)))), logger))
+	if cfg.LokiPushProxy {
+		mux.Handle("/loki/api/v1/push", AccessLog(handler.maintenance.Wrap(memory.Wrap(limiter.Wrap(NewPushProxy(handler, lokiClient, cfg.LokiPushProxyTenants, metrics, logger)))), logger))
+	}
+	if cfg.OktaEventHooks {
+		mux.Handle("/okta/events", AccessLog(handler.maintenance.Wrap(memory.Wrap(limiter.Wrap(NewOktaHookHandler(handler, logger)))), logger))
+	}
+	if len(cfg.Webhooks) > 0 {
+		mux.Handle("/webhooks/{name}", AccessLog(handler.maintenance.Wrap(memory.Wrap(limiter.Wrap(NewWebhookHandler(handler, cfg.Webhooks, logger)))), logger))
+	}
+
+	// Operational endpoints move to a separate listener when ADMIN_ADDR is set,
+	// so the public port exposes nothing but ingestion
+	adminMux := mux
+	if cfg.AdminAddr != "" {
+		adminMux = http.NewServeMux()
+	}
+	if cfg.MetricsBackend == "prometheus" {
+		adminMux.Handle("/metrics", metrics.registry)
+	}
 
 	// Add a health check endpoint
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	adminMux.HandleFunc("/health", serveHealth)
+
+	// Per-tenant ingestion for chargeback and tenant activity list every tenant, so they are
+	// only served on the admin listener
+	if cfg.AdminAddr != "" {
+		adminMux.Handle("GET /usage", handler.quotas)
+		adminMux.Handle("GET /stats", handler.activity)
+	}
+
+	// Profiling endpoints (admin listener only, enforced by LoadConfig)
+	if cfg.EnablePprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// Readiness reflects whether Loki is accepting pushes
+	readiness := NewReadinessHandler(lokiClient)
+	adminMux.Handle("/ready", readiness)
+
+	// Admin endpoints expose log data, so they are only served on the admin listener
+	if cfg.AdminAddr != "" {
+		adminMux.Handle("GET /admin/logs/{log_id}", NewLogLookupHandler(
+			deliveries, lokiClient, cfg.ServiceName, time.Duration(cfg.LogLookupLokiHours)*time.Hour, handler.orgIDs, logger,
+		))
+		adminMux.HandleFunc("GET /admin/openapi.json", serveOpenAPISpec)
+		adminMux.HandleFunc("GET /admin/config", serveEffectiveConfig(effectiveCfg))
+		adminMux.Handle("GET /admin/tail", handler.tail)
+		adminMux.Handle("/admin/maintenance", handler.maintenance)
+		adminMux.Handle("/admin/batching", batchTuning)
+		adminMux.Handle("/admin/drain", NewDrainer(ctx, handler.maintenance, readiness, entryQueue, spill, forwarding, batchers, logger))
+		if forwarding != nil {
+			adminMux.HandleFunc("GET /admin/forwarding", forwarding.ServeStatus)
+			adminMux.HandleFunc("POST /admin/forwarding/pause", forwarding.Pause)
+			adminMux.HandleFunc("POST /admin/forwarding/resume", forwarding.Resume)
+		}
+		if handler.recent != nil {
+			adminMux.Handle("GET /admin/recent", handler.recent)
+		}
+		if deadLetter != nil {
+			dlqHandler := NewDeadLetterHandler(deadLetter, entryQueue, logger)
+			adminMux.HandleFunc("GET /admin/dlq", dlqHandler.List)
+			adminMux.HandleFunc("GET /admin/dlq/{id}", dlqHandler.Get)
+			adminMux.HandleFunc("POST /admin/dlq/replay", dlqHandler.Replay)
+			adminMux.HandleFunc("POST /admin/dlq/purge", dlqHandler.Purge)
+		}
+	}
 
 	server := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -98,26 +658,108 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// Serverless platforms freeze the instance once a request is answered, so every request
+	// pushes its entries first instead of leaving them to BATCH_FLUSH_MS
+	if cfg.Serverless != serverlessOff {
+		flusher := NewServerlessFlusher(entryQueue, batchers)
+		handler.SetSyncFlush(flusher.Flush)
+		server.Handler = flusher.Wrap(server.Handler)
+	}
+
 	// Channel to listen for interrupt signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start HTTP server in a goroutine
+	// SIGUSR2 toggles maintenance mode, like POST and DELETE /admin/maintenance
+	maintenanceSignals := make(chan os.Signal, 1)
+	signal.Notify(maintenanceSignals, syscall.SIGUSR2)
 	go func() {
-		logger.Info("HTTP server listening", "addr", cfg.ListenAddr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("HTTP server error", "error", err)
-			os.Exit(1)
+		for range maintenanceSignals {
+			handler.maintenance.Toggle("SIGUSR2")
 		}
 	}()
+	metrics.registry.NewGaugeFunc("maintenance_mode", "1 while maintenance mode answers deliveries with 503", func() float64 {
+		if handler.maintenance.Enabled() {
+			return 1
+		}
+		return 0
+	})
+
+	if cfg.Serverless == serverlessLambda {
+		// Lambda hands over requests through its runtime API instead of a listener
+		runtime := NewLambdaRuntime(os.Getenv("AWS_LAMBDA_RUNTIME_API"), server.Handler, logger)
+		go func() {
+			logger.Info("Serving AWS Lambda invocations")
+			if err := runtime.Run(ctx); err != nil {
+				logger.Error("Lambda runtime API error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	} else {
+		listener, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			logger.Error("Failed to listen", "addr", cfg.ListenAddr, "error", err)
+			os.Exit(1)
+		}
+		if cfg.ProxyProtocol {
+			// The PROXY header carries the real client address, which then feeds the IP checks
+			listener = NewProxyProtocolListener(listener, cfg.TrustedProxies, logger)
+		}
+		if cfg.TLSCertFile != "" {
+			if server.TLSConfig, err = listenerTLSConfig(cfg); err != nil {
+				logger.Error("Failed to set up TLS", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		// Start HTTP server in a goroutine
+		go func() {
+			logger.Info("HTTP server listening", "addr", cfg.ListenAddr, "proxy_protocol", cfg.ProxyProtocol, "tls", server.TLSConfig != nil)
+			serve := server.Serve
+			if server.TLSConfig != nil {
+				serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+			}
+			if err := serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error("HTTP server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminServer = &http.Server{
+			Addr:         cfg.AdminAddr,
+			Handler:      requireAdminToken(adminMux, cfg.AdminToken, logger),
+			ReadTimeout:  60 * time.Second,
+			WriteTimeout: 60 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+		// Live tails stream until closed, which would otherwise hold up the shutdown
+		adminServer.RegisterOnShutdown(handler.tail.Close)
+		go func() {
+			logger.Info("Admin server listening", "addr", cfg.AdminAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Report readiness to systemd once Loki answers, and keep its watchdog fed while the batchers make progress
+	go systemd.Ready(ctx, lokiClient.Probe)
+	go systemd.RunWatchdog(ctx, batchers, forwarding)
 
 	// Wait for interrupt signal
 	sig := <-sigChan
 	logger.Info("Received shutdown signal", "signal", sig.String())
+	readiness.SetShuttingDown()
+	systemd.Notify("STOPPING=1")
 
-	// Graceful shutdown sequence:
+	// Graceful shutdown sequence, bounded by SHUTDOWN_TIMEOUT:
 	// 1. Stop accepting new HTTP requests
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	shutdownStart := time.Now()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
 	defer shutdownCancel()
 
 	logger.Info("Shutting down HTTP server...")
@@ -125,18 +767,61 @@ func main() {
 		logger.Error("Error during HTTP server shutdown", "error", err)
 	}
 
-	// 2. Close the entry channel to signal batcher to finish
-	logger.Info("Closing entry channel...")
-	close(entryChan)
+	// Queue consumers and dead-letter replays stop too; messages not yet stored in Loki stay in their queue
+	stopConsumers()
+	consumers.Wait()
+	deadLetter.Close()
 
-	// 3. Cancel context to signal batcher to exit after flushing
-	cancel()
+	// 2. Empty the batchers per SHUTDOWN_POLICY
+	pushedBefore, failedBefore, _ := batcherTotals(batchers)
+	var persisted, lost int64
+	if cfg.ShutdownPolicy == shutdownPersist {
+		// Canceled batchers spill their pending batches; the entries still queued follow
+		logger.Info("Persisting buffered entries to the spill queue...")
+		cancelBatchers()
+		batcherWG.Wait()
+		entryQueue.Close()
+		persisted, lost = entryQueue.Persist()
+	} else {
+		// Closed channels let the batchers push every queued entry before they exit,
+		// including the batches a pause of forwarding holds
+		logger.Info("Closing entry channel, waiting for batchers to push buffered entries...")
+		forwarding.Release()
+		entryQueue.Close()
+		if !waitDone(shutdownCtx, &batcherWG) {
+			logger.Error("Shutdown timed out before the batchers pushed every buffered entry",
+				"timeout_s", cfg.ShutdownTimeout,
+				"queued_entries", entryQueue.Len(),
+			)
+			// Batchers push what they hold when canceled; entries still queued are spilled if possible
+			cancelBatchers()
+			persisted, lost = entryQueue.Persist()
+		}
+	}
+	spill.Close()
 
-	// 4. Wait for batcher to finish processing and flush remaining batches
-	logger.Info("Waiting for batcher to finish...")
+	// 3. Stop the remaining workers
+	cancel()
 	wg.Wait()
+	tracerCancel()
+	<-tracerDone
 
-	logger.Info("Shutdown complete")
+	// 4. Stop the admin server last so health and metrics stay available while draining
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Error during admin server shutdown", "error", err)
+		}
+	}
+
+	pushed, failed, persistedByBatchers := batcherTotals(batchers)
+	logger.Info("Shutdown complete",
+		"policy", cfg.ShutdownPolicy,
+		"flushed_entries", pushed-pushedBefore,
+		"failed_entries", failed-failedBefore,
+		"persisted_entries", persisted+persistedByBatchers,
+		"lost_entries", lost,
+		"duration_ms", time.Since(shutdownStart).Milliseconds(),
+	)
 }
 
 // parseLogLevel converts a string log level to slog.Level
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maintenanceCheckInterval is how often paused queue consumers check whether maintenance ended
+const maintenanceCheckInterval = time.Second
+
+// Maintenance answers deliveries with 503 and Retry-After while enabled, so Auth0 and other
+// senders queue and retry them (e.g. during a Loki migration) instead of the service dropping
+// them; queue consumers stop pulling messages, and entries already buffered are still pushed
+// A nil Maintenance is never enabled
+type Maintenance struct {
+	retryAfter int // Seconds sent in Retry-After
+	metrics    *Metrics
+	logger     *slog.Logger
+
+	mu      sync.Mutex
+	enabled bool
+	since   time.Time // When maintenance was enabled
+}
+
+// NewMaintenance creates a maintenance switch, initially disabled
+func NewMaintenance(retryAfter int, metrics *Metrics, logger *slog.Logger) *Maintenance {
+	return &Maintenance{
+		retryAfter: retryAfter,
+		metrics:    metrics,
+		logger:     logger,
+	}
+}
+
+// Enabled reports whether maintenance mode is on
+func (m *Maintenance) Enabled() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enabled
+}
+
+// Set turns maintenance mode on or off; trigger names the cause for the log
+func (m *Maintenance) Set(enabled bool, trigger string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.enabled == enabled {
+		return
+	}
+	m.enabled = enabled
+	if enabled {
+		m.since = time.Now()
+		m.logger.Warn("Maintenance mode enabled, answering deliveries with 503",
+			"trigger", trigger,
+			"retry_after_s", m.retryAfter,
+		)
+		return
+	}
+	m.logger.Info("Maintenance mode disabled, accepting deliveries again",
+		"trigger", trigger,
+		"duration_s", int(time.Since(m.since).Seconds()),
+	)
+}
+
+// Toggle flips maintenance mode, for SIGUSR2
+func (m *Maintenance) Toggle(trigger string) {
+	m.Set(!m.Enabled(), trigger)
+}
+
+// Status returns the current state for the admin endpoint
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := MaintenanceStatus{Enabled: m.enabled, RetryAfterSeconds: int64(m.retryAfter)}
+	if m.enabled {
+		since := m.since.UTC()
+		status.Since = &since
+	}
+	return status
+}
+
+// Wait blocks while maintenance mode is on, so queue consumers leave messages in their queue
+func (m *Maintenance) Wait(ctx context.Context) {
+	for m.Enabled() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(maintenanceCheckInterval):
+		}
+	}
+}
+
+// Wrap answers requests with 503 in front of next while maintenance mode is on
+func (m *Maintenance) Wrap(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Enabled() {
+			m.metrics.requestsShed.Inc("maintenance")
+			requestLogger(r, m.logger).Debug("Rejecting request in maintenance mode")
+			w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, "maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP serves /admin/maintenance: GET reports the state, POST enables and DELETE
+// disables maintenance mode
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		m.Set(true, "admin")
+	case http.MethodDelete:
+		m.Set(false, "admin")
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memoryCheckInterval is how often the memory guard reads the runtime's memory use
+	memoryCheckInterval = time.Second
+	// memoryPressureHysteresis is how many percentage points below the threshold memory use
+	// must fall before the pressure ends, so the guard does not flap around the threshold
+	memoryPressureHysteresis = 10
+	// memoryPressureRetryAfter is the Retry-After sent with requests shed under pressure, in seconds
+	memoryPressureRetryAfter = 5
+)
+
+// MemoryGuard watches the memory the Go runtime uses against its limit and reports pressure
+// once usage passes a threshold, so new deliveries are shed with 503 and batches are pushed
+// early instead of the process being OOM-killed with everything it buffered
+// A nil guard never reports pressure
+type MemoryGuard struct {
+	limit     uint64 // Bytes the process may use
+	threshold uint64 // Usage above which pressure starts
+	release   uint64 // Usage below which pressure ends
+
+	pressure atomic.Bool
+	usage    atomic.Uint64 // Usage at the last check
+
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// memoryLimit returns MEMORY_LIMIT_BYTES, or the runtime's limit (GOMEMLIMIT) when it is
+// not set; 0 means there is no limit
+func memoryLimit(cfg *Config) uint64 {
+	if cfg.MemoryLimitBytes > 0 {
+		return uint64(cfg.MemoryLimitBytes)
+	}
+	limit := debug.SetMemoryLimit(-1)
+	if limit <= 0 || limit == math.MaxInt64 {
+		return 0
+	}
+	return uint64(limit)
+}
+
+// NewMemoryGuard returns a guard for limit bytes reporting pressure above percent of it,
+// or nil if there is no limit or percent is 0
+func NewMemoryGuard(limit uint64, percent int, metrics *Metrics, logger *slog.Logger) *MemoryGuard {
+	if limit == 0 || percent <= 0 {
+		return nil
+	}
+	return &MemoryGuard{
+		limit:     limit,
+		threshold: limit / 100 * uint64(percent),
+		release:   limit / 100 * uint64(max(percent-memoryPressureHysteresis, 0)),
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// Run checks the memory use every memoryCheckInterval until ctx is canceled
+func (g *MemoryGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		g.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check reads the memory use and starts or ends the pressure
+func (g *MemoryGuard) check() {
+	usage := memoryInUse()
+	g.usage.Store(usage)
+
+	switch {
+	case !g.pressure.Load() && usage >= g.threshold:
+		g.pressure.Store(true)
+		g.metrics.memoryPressureEvents.Inc()
+		g.logger.Warn("Memory pressure, shedding new deliveries and pushing batches early",
+			"usage_bytes", usage,
+			"limit_bytes", g.limit,
+			"threshold_bytes", g.threshold,
+		)
+	case g.pressure.Load() && usage < g.release:
+		g.pressure.Store(false)
+		g.logger.Info("Memory pressure ended, accepting deliveries again",
+			"usage_bytes", usage,
+			"limit_bytes", g.limit,
+		)
+	}
+}
+
+// UnderPressure reports whether memory use is above the threshold
+func (g *MemoryGuard) UnderPressure() bool {
+	return g != nil && g.pressure.Load()
+}
+
+// Usage returns the memory use at the last check
+func (g *MemoryGuard) Usage() uint64 {
+	return g.usage.Load()
+}
+
+// Limit returns the memory limit the guard watches
+func (g *MemoryGuard) Limit() uint64 {
+	return g.limit
+}
+
+// Wait blocks while memory is under pressure, so queue consumers stop pulling messages
+func (g *MemoryGuard) Wait(ctx context.Context) {
+	for g.UnderPressure() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(memoryCheckInterval):
+		}
+	}
+}
+
+// Wrap sheds requests with 503 in front of next while memory is under pressure
+func (g *MemoryGuard) Wrap(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.UnderPressure() {
+			g.metrics.requestsShed.Inc("memory")
+			requestLogger(r, g.logger).Warn("Shedding request under memory pressure",
+				"usage_bytes", g.Usage(),
+				"limit_bytes", g.limit,
+				"content_length", r.ContentLength,
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(memoryPressureRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, "memory_pressure")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// memoryInUse returns the memory the Go runtime holds, as counted against its memory limit,
+// without stopping the world
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	for _, sample := range samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsNamespace prefixes every metric exported by the service
+const metricsNamespace = "a0_logstream2loki_"
+
+// Registry holds metrics and renders them in the Prometheus text exposition format
+// It implements just enough of the format for the metric types the service uses,
+// keeping the service free of external dependencies
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is implemented by every metric type held in a registry
+type metric interface {
+	describe() (name, help, kind string)
+	samples() []sample
+}
+
+// sample is a single value of a metric with its label values
+type sample struct {
+	suffix string // Appended to the metric name (e.g. _bucket, _sum, _count)
+	labels []labelPair
+	value  float64
+}
+
+// labelPair is a label name and value
+type labelPair struct {
+	name  string
+	value string
+}
+
+// NewRegistry creates an empty metrics registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a metric to the registry
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		a, _, _ := metrics[i].describe()
+		b, _, _ := metrics[j].describe()
+		return a < b
+	})
+
+	var b strings.Builder
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+		for _, s := range m.samples() {
+			b.WriteString(name)
+			b.WriteString(s.suffix)
+			writeLabels(&b, s.labels)
+			b.WriteByte(' ')
+			b.WriteString(formatFloat(s.value))
+			b.WriteByte('\n')
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP exposes the registry as a Prometheus scrape endpoint
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// writeLabels writes {name="value",...} with values escaped as the format requires
+func writeLabels(b *strings.Builder, labels []labelPair) {
+	if len(labels) == 0 {
+		return
+	}
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+}
+
+// escapeLabelValue escapes backslashes, quotes and newlines in a label value
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+// formatFloat renders a sample value
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// pairLabels zips label names and values
+func pairLabels(names, values []string) []labelPair {
+	pairs := make([]labelPair, len(names))
+	for i, name := range names {
+		pairs[i] = labelPair{name: name, value: values[i]}
+	}
+	return pairs
+}
+
+// vecValue is one labeled value of a counter or gauge
+type vecValue struct {
+	labels []string
+	value  float64
+}
+
+// valueVec is the shared implementation of counters and gauges
+type valueVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*vecValue
+	limit  int       // Maximum number of label combinations (0 is unlimited)
+	limitC *valueVec // Counts updates folded into the overflow series (nil when unlimited)
+}
+
+// overflowLabelValue replaces every label value once a vec reaches its series limit
+const overflowLabelValue = "other"
+
+func newValueVec(r *Registry, name, help, kind string, labelNames []string) *valueVec {
+	v := &valueVec{
+		name:       metricsNamespace + name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]*vecValue),
+	}
+	// Unlabeled metrics are exported as 0 from the start
+	if len(labelNames) == 0 {
+		v.values[""] = &vecValue{}
+	}
+	r.register(v)
+	return v
+}
+
+func (v *valueVec) describe() (string, string, string) {
+	return v.name, v.help, v.kind
+}
+
+func (v *valueVec) samples() []sample {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := make([]sample, 0, len(keys))
+	for _, key := range keys {
+		val := v.values[key]
+		samples = append(samples, sample{
+			labels: pairLabels(v.labelNames, val.labels),
+			value:  val.value,
+		})
+	}
+	return samples
+}
+
+// update applies fn to the value for the given label values, creating it if needed
+func (v *valueVec) update(labels []string, fn func(float64) float64) {
+	if len(labels) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labelNames), len(labels)))
+	}
+
+	key := labelKey(labels)
+	v.mu.Lock()
+
+	val, ok := v.values[key]
+	overflowed := false
+	if !ok && v.limit > 0 && len(v.values) >= v.limit {
+		// Fold new combinations into one series so a flood of label values cannot blow up memory
+		overflow := make([]string, len(labels))
+		for i := range overflow {
+			overflow[i] = overflowLabelValue
+		}
+		labels, key, overflowed = overflow, labelKey(overflow), true
+		val, ok = v.values[key]
+	}
+	if !ok {
+		val = &vecValue{labels: append([]string(nil), labels...)}
+		v.values[key] = val
+	}
+	val.value = fn(val.value)
+	v.mu.Unlock()
+
+	if overflowed && v.limitC != nil {
+		v.limitC.update([]string{v.name}, func(c float64) float64 { return c + 1 })
+	}
+}
+
+// CounterVec is a monotonically increasing value, partitioned by labels
+type CounterVec struct {
+	*valueVec
+}
+
+// NewCounter registers a new counter with the given label names
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newValueVec(r, name, help, "counter", labelNames)}
+}
+
+// Limit caps the number of label combinations; further combinations are counted
+// under a single series whose label values are all "other", and in overflow
+func (c *CounterVec) Limit(maxSeries int, overflow *CounterVec) *CounterVec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = maxSeries
+	c.limitC = overflow.valueVec
+	return c
+}
+
+// Inc increments the counter for the given label values by one
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increments the counter for the given label values
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	c.update(labels, func(v float64) float64 { return v + delta })
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels
+type GaugeVec struct {
+	*valueVec
+}
+
+// NewGauge registers a new gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newValueVec(r, name, help, "gauge", labelNames)}
+}
+
+// Limit caps the number of label combinations like CounterVec.Limit
+func (g *GaugeVec) Limit(maxSeries int, overflow *CounterVec) *GaugeVec {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = maxSeries
+	g.limitC = overflow.valueVec
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.update(labels, func(float64) float64 { return value })
+}
+
+// Add adds delta to the gauge for the given label values
+func (g *GaugeVec) Add(delta float64, labels ...string) {
+	g.update(labels, func(v float64) float64 { return v + delta })
+}
+
+// GaugeFunc is an unlabeled gauge whose value is read on every scrape
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge computed by fn at scrape time
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: metricsNamespace + name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *GaugeFunc) samples() []sample {
+	return []sample{{value: g.fn()}}
+}
+
+// HistogramVec counts observations into cumulative buckets, partitioned by labels
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// histogramValue holds the buckets of one labeled histogram
+type histogramValue struct {
+	labels []string
+	counts []uint64 // Per bucket (non-cumulative), plus one for +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a new histogram with the given upper bucket bounds and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:       metricsNamespace + name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	if len(labels) != len(h.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", h.name, len(h.labelNames), len(labels)))
+	}
+
+	key := labelKey(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	val, ok := h.values[key]
+	if !ok {
+		val = &histogramValue{
+			labels: append([]string(nil), labels...),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.values[key] = val
+	}
+
+	index := sort.SearchFloat64s(h.buckets, value)
+	val.counts[index]++
+	val.sum += value
+	val.count++
+}
+
+func (h *HistogramVec) describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *HistogramVec) samples() []sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var samples []sample
+	for _, key := range keys {
+		val := h.values[key]
+		labels := pairLabels(h.labelNames, val.labels)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += val.counts[i]
+			samples = append(samples, sample{
+				suffix: "_bucket",
+				labels: append(append([]labelPair(nil), labels...), labelPair{"le", formatFloat(bound)}),
+				value:  float64(cumulative),
+			})
+		}
+		samples = append(samples,
+			sample{
+				suffix: "_bucket",
+				labels: append(append([]labelPair(nil), labels...), labelPair{"le", "+Inf"}),
+				value:  float64(val.count),
+			},
+			sample{suffix: "_sum", labels: labels, value: val.sum},
+			sample{suffix: "_count", labels: labels, value: float64(val.count)},
+		)
+	}
+	return samples
+}
+
+// CounterFunc is an unlabeled counter whose value is read on every scrape
+type CounterFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewCounterFunc registers a counter computed by fn at scrape time
+// fn must return a monotonically increasing value
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{name: metricsNamespace + name, help: help, fn: fn}
+	r.register(c)
+	return c
+}
+
+func (c *CounterFunc) describe() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *CounterFunc) samples() []sample {
+	return []sample{{value: c.fn()}}
+}
+
+// Metrics holds the metrics exported by the service
+type Metrics struct {
+	registry *Registry
+
+	authFailures   *CounterVec
+	authBans       *CounterVec
+	bannedRequests *CounterVec
+
+	clientDisconnects    *CounterVec
+	lokiPushRetries      *CounterVec
+	lokiOutOfOrder       *CounterVec
+	proxyPushes          *CounterVec
+	sqsMessages          *CounterVec
+	azureQueueMessages   *CounterVec
+	kafkaRecords         *CounterVec
+	faultsInjected       *CounterVec
+	allowlistRejected    *CounterVec
+	requestsShed         *CounterVec
+	oversizedLines       *CounterVec
+	memoryPressureEvents *CounterVec
+	spillEntries         *CounterVec
+	deadLetterBatches    *CounterVec
+	canaryChecks         *CounterVec
+	remoteWrites         *CounterVec
+	alerts               *CounterVec
+	hookResults          *CounterVec
+	remoteConfigUpdates  *CounterVec
+
+	// Per-tenant and per-type breakdown, capped to maxSeries label combinations each
+	requestsByTenant *CounterVec
+	entriesByType    *CounterVec
+	securityEvents   *CounterVec
+	parseErrors      *CounterVec
+	schemaDrift      *CounterVec
+	tenantLines      *CounterVec
+	tenantBytes      *CounterVec
+	quotaRejections  *CounterVec
+	tenantLastSeen   *GaugeVec
+	tenantsGoneStale *CounterVec
+	seriesOverflow   *CounterVec
+
+	lokiPushDuration  *HistogramVec
+	batchSize         *GaugeVec
+	batchFlushSeconds *GaugeVec
+	canaryLatency     *HistogramVec
+	canaryLastSuccess *GaugeVec
+}
+
+// NewMetrics creates the service metrics in a new registry
+// maxSeries caps the label combinations of the per-tenant metrics (0 is unlimited)
+func NewMetrics(maxSeries int) *Metrics {
+	r := NewRegistry()
+	registerRuntimeMetrics(r)
+	registerBuildInfo(r)
+	seriesOverflow := r.NewCounter("metric_series_overflow_total", "Updates folded into the \"other\" series because a metric reached its series limit", "metric")
+	return &Metrics{
+		registry: r,
+
+		authFailures:   r.NewCounter("auth_failures_total", "Authentication failures by reason", "reason"),
+		authBans:       r.NewCounter("auth_bans_total", "Temporary bans issued after repeated authentication failures"),
+		bannedRequests: r.NewCounter("auth_banned_requests_total", "Requests rejected because the client IP is temporarily banned"),
+
+		clientDisconnects:    r.NewCounter("client_disconnects_total", "Log streams aborted by the client before the body was fully read"),
+		lokiPushRetries:      r.NewCounter("loki_push_retries_total", "Loki pushes retried after a 429 (rate_limited) or split after a 413 (too_large)", "reason"),
+		lokiOutOfOrder:       r.NewCounter("loki_out_of_order_rejections_total", "Pushes Loki partially rejected as out of order, by remediation (restamp, divert, none or failed)", "action"),
+		proxyPushes:          r.NewCounter("proxy_pushes_total", "Native Loki pushes forwarded by the push proxy, by tenant and Loki status code (error when Loki was unreachable)", "tenant", "status").Limit(maxSeries, seriesOverflow),
+		sqsMessages:          r.NewCounter("sqs_messages_total", "SQS messages consumed, by result (delivered, failed, invalid or filtered by processing hooks)", "result"),
+		azureQueueMessages:   r.NewCounter("azure_queue_messages_total", "Azure Storage Queue messages consumed, by result (delivered, failed, invalid or filtered by processing hooks)", "result"),
+		kafkaRecords:         r.NewCounter("kafka_records_total", "Kafka records consumed, by result (delivered, failed, invalid or filtered by processing hooks)", "result"),
+		faultsInjected:       r.NewCounter("faults_injected_total", "Faults injected for chaos testing", "fault"),
+		allowlistRejected:    r.NewCounter("ip_allowlist_refresh_rejected_total", "IP allowlist refreshes refused because they changed too many entries"),
+		oversizedLines:       r.NewCounter("oversized_lines_total", "Lines longer than the maximum line size, skipped or truncated per OVERSIZED_LINE_ACTION, by source", "source").Limit(maxSeries, seriesOverflow),
+		requestsShed:         r.NewCounter("requests_shed_total", "Ingestion requests answered 503 because MAX_CONCURRENT_REQUESTS (requests) or MAX_INFLIGHT_BYTES (bytes) was reached, memory was under pressure (memory) or maintenance mode was on (maintenance)", "limit"),
+		spillEntries:         r.NewCounter("spill_entries_total", "Entries spilled to disk while the entry queue was full, drained back from it, or rejected because the spill queue was full or failed (spilled, drained or rejected)", "result"),
+		memoryPressureEvents: r.NewCounter("memory_pressure_events_total", "Times memory use rose above MEMORY_PRESSURE_PERCENT of the limit"),
+		deadLetterBatches:    r.NewCounter("dlq_batches_total", "Failed pushes written to the dead-letter queue, dropped because it was full or failed, or replayed, purged or exported from it (written, dropped, replayed, purged or exported)", "result"),
+		remoteWrites:         r.NewCounter("remote_write_requests_total", "Remote-write pushes of the derived Auth0 metrics, by result (success or failure)", "result"),
+		alerts:               r.NewCounter("alerts_total", "Alert rule matches by rule and result (sent, failed, suppressed by the cooldown, rate_limited by max_per_hour or dropped because the alert queue was full)", "rule", "result"),
+		remoteConfigUpdates:  r.NewCounter("remote_config_updates_total", "Changes of the remote configuration by result (applied secrets, restart for settings that need one, failed to fetch or parse)", "result"),
+		hookResults:          r.NewCounter("hook_results_total", "Log entries changed by processing hooks, by hook and result (dropped, modified, or failed when an expression could not be evaluated)", "hook", "result"),
+		canaryChecks:         r.NewCounter("canary_checks_total", "End-to-end canary entries by result (ok when read back from Loki within CANARY_SLO, missing when not, dropped when the entry queue was full)", "result"),
+
+		requestsByTenant: r.NewCounter("tenant_requests_total", "Authenticated deliveries by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		entriesByType:    r.NewCounter("tenant_entries_total", "Log entries accepted by tenant and event type", "tenant", "type").Limit(maxSeries, seriesOverflow),
+		securityEvents:   r.NewCounter("security_events_total", "Auth0 events of a security class (failed_login, blocked, mfa_failure, rate_limit or breached_password), by tenant and class", "tenant", "class").Limit(maxSeries, seriesOverflow),
+		parseErrors:      r.NewCounter("tenant_parse_errors_total", "Log lines that could not be parsed, by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		schemaDrift:      r.NewCounter("schema_drift_total", "New fields and changed field types in tenant events", "tenant", "kind").Limit(maxSeries, seriesOverflow),
+		tenantLines:      r.NewCounter("tenant_lines_total", "Log lines accepted for delivery, by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		tenantBytes:      r.NewCounter("tenant_bytes_total", "Bytes of log lines accepted for delivery, by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		quotaRejections:  r.NewCounter("tenant_quota_rejections_total", "Deliveries rejected because the tenant exceeded a quota, by tenant and quota", "tenant", "quota").Limit(maxSeries, seriesOverflow),
+		tenantLastSeen:   r.NewGauge("tenant_last_seen_timestamp_seconds", "Unix time of the last authenticated delivery, by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		tenantsGoneStale: r.NewCounter("tenant_stale_total", "Times a streaming tenant went silent for TENANT_STALE_MINUTES, by tenant", "tenant").Limit(maxSeries, seriesOverflow),
+		seriesOverflow:   seriesOverflow,
+
+		lokiPushDuration: r.NewHistogram("loki_push_duration_seconds", "Duration of Loki pushes by result",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "result"),
+		batchSize:         r.NewGauge("batch_size", "Entries per batch currently used by adaptive batching, by batcher shard", "shard"),
+		batchFlushSeconds: r.NewGauge("batch_flush_seconds", "Flush timeout currently used by adaptive batching, by batcher shard", "shard"),
+		canaryLatency: r.NewHistogram("canary_latency_seconds", "Time from queuing a canary entry until Loki returned it in a query",
+			[]float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}),
+		canaryLastSuccess: r.NewGauge("canary_last_success_timestamp_seconds", "Unix time of the last canary entry read back from Loki within CANARY_SLO"),
+	}
+}
+
+// ObservePush records the duration of a Loki push by result, for the batchers
+func (m *Metrics) ObservePush(duration time.Duration, result string) {
+	m.lokiPushDuration.Observe(duration.Seconds(), result)
+}
+
+// CountPushRetry counts a Loki push retried (rate_limited) or split (too_large)
+func (m *Metrics) CountPushRetry(reason string) {
+	m.lokiPushRetries.Inc(reason)
+}
+
+// CountOutOfOrder counts a push Loki partially rejected as out of order, by remediation
+func (m *Metrics) CountOutOfOrder(action string) {
+	m.lokiOutOfOrder.Inc(action)
+}
+
+// SetBatching records the batch size and flush timeout adaptive batching uses on a shard
+func (m *Metrics) SetBatching(shard string, size int, flush time.Duration) {
+	m.batchSize.Set(float64(size), shard)
+	m.batchFlushSeconds.Set(flush.Seconds(), shard)
+}
+
+// CountParseError counts a line of a tenant that could not be parsed, for the ingest handler
+func (m *Metrics) CountParseError(tenant string) {
+	m.parseErrors.Inc(tenant)
+}
+
+// CountOversizedLine counts a line above the maximum line size of its source
+func (m *Metrics) CountOversizedLine(source string) {
+	m.oversizedLines.Inc(source)
+}
+
+// CountClientDisconnect counts a delivery the client abandoned before it was answered
+func (m *Metrics) CountClientDisconnect() {
+	m.clientDisconnects.Inc()
+}
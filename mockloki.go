@@ -0,0 +1,312 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// mockLokiEntry is one line stored by the mock Loki
+type mockLokiEntry struct {
+	labels    map[string]string
+	timestamp int64
+	line      string
+}
+
+// mockLoki is a minimal Loki: it accepts JSON pushes, records them to a file and answers
+// simple queries, so local development and integration tests do not need a real Loki
+type mockLoki struct {
+	mu       sync.Mutex
+	entries  []mockLokiEntry // Most recent entries, oldest first
+	keep     int
+	out      io.Writer // Received streams, one JSON document per line (nil disables recording)
+	username string    // Basic auth required when set
+	password string
+	status   int // Status returned for pushes (204, or a forced error status)
+	logger   *slog.Logger
+}
+
+// runMockLoki serves a Loki-compatible push endpoint until interrupted
+func runMockLoki(args []string) int {
+	fs := flag.NewFlagSet("mock-loki", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:3100", "Listen address")
+	output := fs.String("output", "mock-loki.jsonl", "File recording received streams, one JSON document per line (empty disables)")
+	keep := fs.Int("keep", 100000, "Entries kept in memory for queries")
+	username := fs.String("username", "", "Require this basic auth username")
+	password := fs.String("password", "", "Require this basic auth password")
+	status := fs.Int("status", http.StatusNoContent, "Status code returned for pushes, e.g. 429 or 500 to test failure handling")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	mock := &mockLoki{keep: *keep, username: *username, password: *password, status: *status, logger: logger}
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			logger.Error("Failed to open output file", "path", *output, "error", err)
+			return 1
+		}
+		defer f.Close()
+		mock.out = f
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /loki/api/v1/push", mock.handlePush)
+	mux.HandleFunc("GET /loki/api/v1/query_range", mock.handleQueryRange)
+	mux.HandleFunc("GET /loki/api/v1/status/buildinfo", mock.handleBuildInfo)
+	mux.HandleFunc("GET /ready", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ready\n"))
+	})
+	server := &http.Server{Addr: *listen, Handler: mock.withAuth(mux), ReadHeaderTimeout: 10 * time.Second}
+	// Accept h2c as well, for clients with LOKI_HTTP2=h2c
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Mock Loki listening", "addr", *listen, "output", *output, "push_status", *status)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Mock Loki failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// withAuth enforces basic auth when credentials are configured
+func (m *mockLoki) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.username != "" || m.password != "" {
+			username, password, ok := r.BasicAuth()
+			if !ok || username != m.username || password != m.password {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlePush accepts a JSON push request, optionally gzip-compressed
+func (m *mockLoki) handlePush(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "mock Loki only accepts application/json pushes, got "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var push LokiPushRequest
+	if err := json.NewDecoder(body).Decode(&push); err != nil {
+		http.Error(w, "invalid push body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if m.status < 200 || m.status >= 300 {
+		if m.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, "mock Loki configured to reject pushes", m.status)
+		return
+	}
+
+	entries := 0
+	for _, stream := range push.Streams {
+		for _, value := range stream.Values {
+			if len(value) < 2 {
+				http.Error(w, "invalid entry: expected [timestamp, line]", http.StatusBadRequest)
+				return
+			}
+			if _, err := strconv.ParseInt(value[0], 10, 64); err != nil {
+				http.Error(w, "invalid timestamp "+strconv.Quote(value[0]), http.StatusBadRequest)
+				return
+			}
+		}
+		entries += len(stream.Values)
+	}
+
+	m.store(push.Streams)
+	m.logger.Info("Received push", "streams", len(push.Streams), "entries", entries)
+	w.WriteHeader(m.status)
+}
+
+// store records streams to the output file and keeps their entries for queries
+func (m *mockLoki) store(streams []LokiStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	receivedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, stream := range streams {
+		if m.out != nil {
+			record, _ := json.Marshal(struct {
+				ReceivedAt string            `json:"received_at"`
+				Stream     map[string]string `json:"stream"`
+				Values     [][]string        `json:"values"`
+			}{receivedAt, stream.Stream, stream.Values})
+			if _, err := m.out.Write(append(record, '\n')); err != nil {
+				m.logger.Error("Failed to record push", "error", err)
+			}
+		}
+		for _, value := range stream.Values {
+			ns, _ := strconv.ParseInt(value[0], 10, 64)
+			m.entries = append(m.entries, mockLokiEntry{labels: stream.Stream, timestamp: ns, line: value[1]})
+		}
+	}
+	if excess := len(m.entries) - m.keep; excess > 0 {
+		m.entries = append(m.entries[:0], m.entries[excess:]...)
+	}
+}
+
+// handleQueryRange answers queries made of a stream selector with equality matchers and |= line filters
+func (m *mockLoki) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	matchers, filters, err := parseMockQuery(params.Get("query"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, _ := strconv.ParseInt(params.Get("start"), 10, 64)
+	end, err := strconv.ParseInt(params.Get("end"), 10, 64)
+	if err != nil {
+		end = time.Now().UnixNano()
+	}
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	backward := params.Get("direction") != "forward"
+
+	m.mu.Lock()
+	var matched []mockLokiEntry
+	for _, entry := range m.entries {
+		if entry.timestamp >= start && entry.timestamp <= end && matchesMockQuery(entry, matchers, filters) {
+			matched = append(matched, entry)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if backward {
+			return matched[i].timestamp > matched[j].timestamp
+		}
+		return matched[i].timestamp < matched[j].timestamp
+	})
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+
+	// Group the matches back into streams
+	var result []LokiStream
+	index := make(map[string]int)
+	for _, entry := range matched {
+		key := batch.LabelKey(entry.labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(result)
+			index[key] = i
+			result = append(result, LokiStream{Stream: entry.labels})
+		}
+		result[i].Values = append(result[i].Values, []string{strconv.FormatInt(entry.timestamp, 10), entry.line})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   map[string]any{"resultType": "streams", "result": result},
+	})
+}
+
+// handleBuildInfo identifies the server as a mock
+func (m *mockLoki) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"version": "mock", "revision": version})
+}
+
+// parseMockQuery parses `{name="value", ...} |= "text" ...`, the subset of LogQL the mock supports
+func parseMockQuery(query string) (matchers map[string]string, filters []string, err error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(query, "{") {
+		return nil, nil, fmt.Errorf("unsupported query %q: expected a stream selector", query)
+	}
+	selectorEnd := strings.Index(query, "}")
+	if selectorEnd < 0 {
+		return nil, nil, fmt.Errorf("unsupported query %q: unterminated stream selector", query)
+	}
+
+	matchers = make(map[string]string)
+	for _, matcher := range config.SplitList(query[1:selectorEnd]) {
+		if matcher == "" {
+			continue
+		}
+		name, quoted, ok := strings.Cut(matcher, "=")
+		value, err := strconv.Unquote(strings.TrimSpace(quoted))
+		if !ok || strings.HasSuffix(name, "!") || strings.HasPrefix(quoted, "~") || err != nil {
+			return nil, nil, fmt.Errorf("unsupported matcher %q: only name=\"value\" is supported", matcher)
+		}
+		matchers[strings.TrimSpace(name)] = value
+	}
+
+	rest := strings.TrimSpace(query[selectorEnd+1:])
+	for rest != "" {
+		if !strings.HasPrefix(rest, "|=") {
+			return nil, nil, fmt.Errorf("unsupported pipeline %q: only |= \"text\" filters are supported", rest)
+		}
+		rest = strings.TrimSpace(rest[2:])
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid line filter %q", rest)
+		}
+		text, _ := strconv.Unquote(quoted)
+		filters = append(filters, text)
+		rest = strings.TrimSpace(rest[len(quoted):])
+	}
+	return matchers, filters, nil
+}
+
+// matchesMockQuery reports whether an entry has all matcher labels and contains every filter text
+func matchesMockQuery(entry mockLokiEntry, matchers map[string]string, filters []string) bool {
+	for name, value := range matchers {
+		if entry.labels[name] != value {
+			return false
+		}
+	}
+	for _, text := range filters {
+		if !strings.Contains(entry.line, text) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2DefaultLifetime is how long a token without expires_in is reused
+const oauth2DefaultLifetime = 5 * time.Minute
+
+// OAuth2TokenSource fetches access tokens with the OAuth2 client credentials grant
+// Tokens are cached and fetched again shortly before they expire
+type OAuth2TokenSource struct {
+	client   *http.Client
+	tokenURL string
+	clientID string
+	scopes   []string
+	secrets  *SecretStore // Holds the client secret, so rotated secrets are picked up
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewOAuth2TokenSource creates a token source for the client credentials grant
+func NewOAuth2TokenSource(client *http.Client, tokenURL, clientID string, scopes []string, secrets *SecretStore) *OAuth2TokenSource {
+	return &OAuth2TokenSource{
+		client:   client,
+		tokenURL: tokenURL,
+		clientID: clientID,
+		scopes:   scopes,
+		secrets:  secrets,
+	}
+}
+
+// Token returns a valid access token, fetching a new one when needed
+func (s *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+
+	token, lifetime, err := s.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Refresh a minute early, or halfway through short-lived tokens
+	s.token = token
+	s.expires = time.Now().Add(lifetime - min(time.Minute, lifetime/2))
+	return token, nil
+}
+
+// Authenticate adds a bearer token to a Loki request
+func (s *OAuth2TokenSource) Authenticate(ctx context.Context, req *http.Request, _ []byte) error {
+	token, err := s.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get OAuth2 token for Loki: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Invalidate drops the cached token after the gateway rejected it
+func (s *OAuth2TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// fetch requests a new token from the token endpoint
+// The client credentials are sent in the form body (client_secret_post)
+func (s *OAuth2TokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", s.clientID)
+	form.Set("client_secret", s.secrets.Load().LokiOAuth2ClientSecret)
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to reach OAuth2 token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("OAuth2 token endpoint returned status %d: %s", resp.StatusCode, truncate(string(body), 500))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", 0, fmt.Errorf("failed to parse OAuth2 token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("OAuth2 token response has no access_token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported OAuth2 token type %q", result.TokenType)
+	}
+
+	lifetime := oauth2DefaultLifetime
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	return result.AccessToken, lifetime, nil
+}
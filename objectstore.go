@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectStore uploads files to a bucket of a cloud object store
+type ObjectStore interface {
+	Name() string
+	Put(ctx context.Context, name string, body []byte) error
+}
+
+// newObjectStore creates the object store of an s3://bucket/prefix or gs://bucket/prefix URL
+func newObjectStore(rawURL string) (ObjectStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid object store URL %q (expected s3://bucket/prefix or gs://bucket/prefix)", rawURL)
+	}
+	client := newOutboundClient(60 * time.Second)
+	prefix := strings.Trim(u.Path, "/")
+
+	switch u.Scheme {
+	case "s3":
+		region := awsRegion()
+		if region == "" {
+			return nil, fmt.Errorf("AWS_REGION is required for s3:// URLs")
+		}
+		return &S3ObjectStore{
+			client: client,
+			creds:  NewAWSCredentialsChain(client, region),
+			region: region,
+			bucket: u.Host,
+			prefix: prefix,
+		}, nil
+	case "gs":
+		return &GCSObjectStore{
+			client: client,
+			bucket: u.Host,
+			prefix: prefix,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported object store URL scheme %q (expected s3 or gs)", u.Scheme)
+	}
+}
+
+// S3ObjectStore uploads to an S3 bucket with the credentials of the default AWS chain,
+// addressing it path-style
+type S3ObjectStore struct {
+	client *http.Client
+	creds  *AWSCredentialsChain
+	region string
+	bucket string
+	prefix string
+}
+
+// Name returns the bucket and prefix for logging
+func (s *S3ObjectStore) Name() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// Put uploads a file with PutObject
+func (s *S3ObjectStore) Put(ctx context.Context, name string, body []byte) error {
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Path-style, since TLS certificates of virtual-hosted URLs do not cover bucket names with dots
+	endpoint := &url.URL{
+		Scheme: "https",
+		Host:   "s3." + s.region + ".amazonaws.com",
+		Path:   "/" + path.Join(s.bucket, s.prefix, name),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	signAWSRequestV4(req, body, creds, s.region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("S3 PutObject returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// gcsMetadataTokenURL is where GCE, GKE (Workload Identity) and Cloud Run hand out access
+// tokens of the attached service account
+const gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCSObjectStore uploads to a Google Cloud Storage bucket with the service account of the
+// metadata server
+type GCSObjectStore struct {
+	client *http.Client
+	bucket string
+	prefix string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Name returns the bucket and prefix for logging
+func (s *GCSObjectStore) Name() string {
+	return "gs://" + path.Join(s.bucket, s.prefix)
+}
+
+// Put uploads a file with a simple media upload
+func (s *GCSObjectStore) Put(ctx context.Context, name string, body []byte) error {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"uploadType": {"media"}, "name": {path.Join(s.prefix, name)}}
+	endpoint := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to GCS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("GCS upload returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// accessToken returns a cached access token, fetching a new one shortly before it expires
+func (s *GCSObjectStore) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GCP metadata server unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GCP metadata server returned status %d for an access token", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %w", err)
+	}
+	s.token = result.AccessToken
+	s.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// maxOktaHookBytes bounds the body of an event hook delivery
+const maxOktaHookBytes = 16 << 20
+
+// oktaChallengeHeader carries the one-time verification challenge of a new event hook
+const oktaChallengeHeader = "X-Okta-Verification-Challenge"
+
+// oktaHookDelivery is the envelope of an Okta event hook request
+type oktaHookDelivery struct {
+	Data struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"data"`
+}
+
+// oktaLogEvent holds the System Log fields mapped to labels
+type oktaLogEvent struct {
+	UUID      string `json:"uuid"`
+	Published string `json:"published"`
+	EventType string `json:"eventType"`
+	Severity  string `json:"severity"`
+}
+
+// OktaHookHandler receives Okta event hooks, so Okta System Log events reach Loki through
+// the same batching, authentication and delivery tracking as Auth0 log streams
+type OktaHookHandler struct {
+	logs   *LogsHandler
+	logger *slog.Logger
+}
+
+// NewOktaHookHandler creates the event hook handler
+func NewOktaHookHandler(logs *LogsHandler, logger *slog.Logger) *OktaHookHandler {
+	return &OktaHookHandler{logs: logs, logger: logger}
+}
+
+// ServeHTTP answers verification challenges and queues the events of deliveries
+func (o *OktaHookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r, o.logger)
+	h := o.logs
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+
+	span := h.tracer.StartFromRequest(r.Method+" /okta/events", r)
+	defer span.End()
+
+	// Okta sends the configured Authorization header with the challenge as well
+	tenant, _, ok := h.authorize(w, r, span, logger)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		challenge := r.Header.Get(oktaChallengeHeader)
+		if challenge == "" {
+			writeJSONErrorDetail(w, http.StatusBadRequest, "missing_verification_challenge",
+				fmt.Sprintf("Okta verification requests carry the %s header", oktaChallengeHeader))
+			return
+		}
+		logger.Info("Answered Okta event hook verification", "tenant", tenant)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(OktaVerificationResponse{Verification: challenge})
+		return
+	}
+	h.activity.Seen(tenant)
+
+	if exceeded, retryAfter := h.quotas.Admit(tenant); exceeded != "" {
+		ingest.RejectOverQuota(w, tenant, exceeded, retryAfter, logger)
+		return
+	}
+
+	defer r.Body.Close()
+	var delivery oktaHookDelivery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOktaHookBytes)).Decode(&delivery); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large")
+			return
+		}
+		logger.Warn("Failed to parse Okta event hook delivery", "tenant", tenant, "error", err)
+		writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_event_hook", err.Error())
+		return
+	}
+
+	// Okta waits 3 seconds for the answer, so events are only queued, as in asynchronous mode
+	maxLineSize := h.LineBuffers().MaxLineSize(sourceOkta)
+	summary := ingest.Summary{LinesReceived: int64(len(delivery.Data.Events))}
+	var tooOldEntries []LogEntry
+	for i, raw := range delivery.Data.Events {
+		if len(raw) > maxLineSize {
+			summary.Oversized++
+			h.metrics.CountOversizedLine(sourceOkta)
+			logger.Warn("Okta event larger than the maximum line size", "event_index", i, "bytes", len(raw))
+			continue
+		}
+		entry, err := h.parseOktaEvent(raw, tenant)
+		if err != nil {
+			summary.ParseErrors++
+			h.metrics.CountParseError(tenant)
+			logger.Warn("Failed to parse Okta event", "event_index", i, "error", err)
+			continue
+		}
+		tooOld := h.TooOld(entry)
+		if tooOld && !h.DeadLettering() {
+			summary.Filtered++
+			continue
+		}
+		if !tooOld {
+			h.quotas.Charge(tenant, len(raw))
+		}
+		if !h.Process(tenant, &entry) {
+			summary.Filtered++
+			continue
+		}
+		if tooOld {
+			summary.Filtered++
+			tooOldEntries = append(tooOldEntries, entry)
+			continue
+		}
+		entry.Trace = span.Context()
+		h.metrics.entriesByType.Inc(tenant, entry.Labels["type"])
+		if h.entryQueue.Offer(entry) {
+			summary.LinesEnqueued++
+			h.deliveries.Track(entry, tenant, deliveryQueued)
+		} else {
+			logger.Error("Entry channel is full, dropping Okta event", "event_index", i)
+			h.deliveries.Track(entry, tenant, deliveryDropped)
+			summary.Dropped++
+		}
+	}
+
+	h.DeadLetterOld(tooOldEntries)
+
+	span.SetAttribute("lines_processed", len(delivery.Data.Events))
+	logger.Info("Finished processing Okta event hook",
+		"tenant", tenant,
+		"events", summary.LinesReceived,
+		"enqueued", summary.LinesEnqueued,
+		"errors", summary.ParseErrors+summary.Oversized+summary.Dropped,
+	)
+	ingest.WriteSummary(w, http.StatusOK, summary)
+}
+
+// parseOktaEvent maps an Okta System Log event to an entry
+// Okta events carry no tenant, so the authenticated tenant becomes tenant_name
+func (h *LogsHandler) parseOktaEvent(raw json.RawMessage, tenant string) (LogEntry, error) {
+	var event oktaLogEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return LogEntry{}, err
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, event.Published)
+	if err != nil {
+		return LogEntry{}, err
+	}
+
+	var line bytes.Buffer
+	if err := json.Compact(&line, raw); err != nil {
+		return LogEntry{}, err
+	}
+	text := line.String()
+	if h.canonicalJSON {
+		if text, err = ingest.CanonicalizeJSON(text); err != nil {
+			return LogEntry{}, err
+		}
+	}
+
+	return LogEntry{
+		Timestamp: timestamp.UnixNano(),
+		Labels: map[string]string{
+			"service_name": h.serviceName,
+			"type":         event.EventType,
+			"severity":     event.Severity,
+			"tenant_name":  tenant,
+		},
+		Line:   text,
+		Source: sourceOkta,
+		LogID:  event.UUID,
+	}, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The HTTP API is defined in openapi.json; request and response types are generated from it
+//go:generate go run ./tools/openapigen -in openapi.json -out api_types_gen.go
+
+// openAPISpec is the OpenAPI document of the service's HTTP API, shipped in the binary
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// serveOpenAPISpec serves the embedded OpenAPI document
+func serveOpenAPISpec(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
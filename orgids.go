@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OrgIDMap assigns each tenant the Loki tenant (X-Scope-OrgID) its streams are pushed to
+// so tenants are isolated in a multi-tenant Loki; a nil map sends no X-Scope-OrgID
+type OrgIDMap struct {
+	defaultID string            // For unmapped tenants ("" sends no X-Scope-OrgID)
+	byTenant  map[string]string // Tenant to org ID
+}
+
+// NewOrgIDMap creates the mapping, or returns nil when no org ID is configured
+func NewOrgIDMap(defaultID string, byTenant map[string]string) *OrgIDMap {
+	if defaultID == "" && len(byTenant) == 0 {
+		return nil
+	}
+	return &OrgIDMap{defaultID: defaultID, byTenant: byTenant}
+}
+
+// For returns the org ID of a tenant
+func (m *OrgIDMap) For(tenant string) string {
+	if m == nil {
+		return ""
+	}
+	if orgID, ok := m.byTenant[tenant]; ok {
+		return orgID
+	}
+	return m.defaultID
+}
+
+// parseOrgIDs parses tenant=org_id pairs
+func parseOrgIDs(entries []string) (map[string]string, error) {
+	orgIDs := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		tenant, orgID, ok := strings.Cut(entry, "=")
+		tenant, orgID = strings.TrimSpace(tenant), strings.TrimSpace(orgID)
+		if !ok || tenant == "" || orgID == "" {
+			return nil, fmt.Errorf("invalid LOKI_ORG_IDS entry %q (expected tenant=org_id)", entry)
+		}
+		orgIDs[tenant] = orgID
+	}
+	return orgIDs, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// offlinePipeline runs the service's parsing and batching outside of an HTTP request,
+// for subcommands that feed log lines from elsewhere (replay, generate)
+type offlinePipeline struct {
+	parser    *LogsHandler
+	entryChan chan LogEntry
+	batcher   *batch.Batcher
+	wg        sync.WaitGroup
+	dryRunOut *os.File // Closed by Close unless it is stdout
+	logger    *slog.Logger
+
+	lines       int
+	parseErrors int
+	tooOld      int
+	filtered    int // Dropped by processing hooks
+}
+
+// startOfflinePipeline starts a batcher pushing to the configured Loki (or the dry-run output)
+// Push results are logged per push since there is no summary interval
+func startOfflinePipeline(cfg *Config, logger *slog.Logger) (*offlinePipeline, error) {
+	p := &offlinePipeline{logger: logger}
+
+	lokiClient := newLokiClientFromConfig(cfg, NewSecretStore(cfg.secrets()), logger)
+	if cfg.DryRun {
+		out, err := openDryRunOutput(cfg.DryRunOutput)
+		if err != nil {
+			return nil, err
+		}
+		p.dryRunOut = out
+		lokiClient.SetDryRun(out)
+	}
+
+	metrics := NewMetrics(cfg.MetricsMaxSeries)
+	p.entryChan = make(chan LogEntry, cfg.BatchSize)
+	p.batcher = batch.NewBatcher(
+		lokiClient,
+		p.entryChan,
+		cfg.BatchSize,
+		time.Duration(cfg.BatchFlush)*time.Millisecond,
+		logger,
+		&p.wg,
+		context.Background(),
+		0,
+		metrics,
+		cfg.OutOfOrderAction,
+	)
+	p.wg.Add(1)
+	go p.batcher.Run()
+
+	// Lines are parsed exactly as the /logs handler parses them
+	p.parser = NewLogsHandler(cfg, nil, nil, nil, nil, nil, nil, nil, nil, nil, metrics, logger)
+	return p, nil
+}
+
+// Parse parses one line, counting it; ok is false for lines that must not be queued
+func (p *offlinePipeline) Parse(line string) (entry LogEntry, ok bool) {
+	p.lines++
+
+	entry, err := p.parser.parseQueuedLine([]byte(line))
+	if errors.Is(err, errHookDropped) {
+		p.filtered++
+		return LogEntry{}, false
+	}
+	if err != nil {
+		p.parseErrors++
+		p.logger.Warn("Failed to parse log line",
+			"error", err,
+			"line_number", p.lines,
+		)
+		return LogEntry{}, false
+	}
+
+	// Loki would reject the whole push for entries older than its max age
+	if p.parser.TooOld(entry) {
+		p.tooOld++
+		return LogEntry{}, false
+	}
+	return entry, true
+}
+
+// Queue hands an entry to the batcher, waiting while it is busy pushing
+func (p *offlinePipeline) Queue(entry LogEntry) {
+	p.entryChan <- entry
+}
+
+// Close flushes the pending entries and waits for the last push
+func (p *offlinePipeline) Close() {
+	close(p.entryChan)
+	p.wg.Wait()
+	if p.dryRunOut != nil && p.dryRunOut != os.Stdout {
+		p.dryRunOut.Close()
+	}
+}
+
+// Failed reports whether a line could not be parsed or a push failed
+func (p *offlinePipeline) Failed() bool {
+	return p.parseErrors > 0 || p.batcher.Stats().Failures > 0
+}
+
+// logResult logs the counts of a finished run, with the given message and extra attributes
+func (p *offlinePipeline) logResult(msg string, args ...any) {
+	stats := p.batcher.Stats()
+	p.logger.Info(msg, append(args,
+		"lines", p.lines,
+		"parse_errors", p.parseErrors,
+		"too_old", p.tooOld,
+		"filtered", p.filtered,
+		"pushes", stats.Pushes,
+		"failed_pushes", stats.Failures,
+		"entries_pushed", stats.Entries,
+	)...)
+}
@@ -0,0 +1,60 @@
+// Package auth implements the bearer tokens accepted on the ingestion endpoints: the hex
+// HMAC-SHA256 of the tenant under a shared secret, or static tokens matched exactly
+// Several secrets or tokens may be active at once, so credentials can be rotated without downtime
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Reasons VerifyHMAC rejects a token
+var (
+	ErrMalformedToken = errors.New("token is not valid hex")
+	ErrTokenMismatch  = errors.New("HMAC mismatch")
+)
+
+// Sum returns the HMAC-SHA256 of the tenant under secret
+func Sum(secret, tenant string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tenant))
+	return mac.Sum(nil)
+}
+
+// Token returns the bearer token of tenant under secret, as sent by the log stream
+func Token(secret, tenant string) string {
+	return hex.EncodeToString(Sum(secret, tenant))
+}
+
+// VerifyHMAC checks that token is the hex HMAC of tenant under one of the secrets
+// All secrets are compared so the timing does not reveal which one matched
+func VerifyHMAC(tenant, token string, secrets []string) error {
+	provided, err := hex.DecodeString(token)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	matched := false
+	for _, secret := range secrets {
+		if hmac.Equal(Sum(secret, tenant), provided) {
+			matched = true
+		}
+	}
+	if !matched {
+		return ErrTokenMismatch
+	}
+	return nil
+}
+
+// MatchToken reports whether token equals one of the static tokens
+// All tokens are compared so the timing does not reveal which one matched
+func MatchToken(token string, tokens []string) bool {
+	matched := false
+	for _, candidate := range tokens {
+		if hmac.Equal([]byte(token), []byte(candidate)) {
+			matched = true
+		}
+	}
+	return matched
+}
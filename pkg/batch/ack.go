@@ -0,0 +1,65 @@
+package batch
+
+import (
+	"context"
+	"sync"
+)
+
+// DeliveryAck collects the push results of all entries of one request, so a synchronous
+// delivery can be answered only once Loki has acknowledged every entry
+// A nil ack tracks nothing
+type DeliveryAck struct {
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err error // First push error of any entry
+}
+
+// NewDeliveryAck creates an ack with no pending entries
+func NewDeliveryAck() *DeliveryAck {
+	return &DeliveryAck{}
+}
+
+// Add registers one more entry whose push result is awaited
+func (a *DeliveryAck) Add() {
+	if a == nil {
+		return
+	}
+	a.wg.Add(1)
+}
+
+// Done records the push result of one entry
+func (a *DeliveryAck) Done(err error) {
+	if a == nil {
+		return
+	}
+	if err != nil {
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = err
+		}
+		a.mu.Unlock()
+	}
+	a.wg.Done()
+}
+
+// Wait blocks until every entry has been pushed, returning the first push error,
+// or ctx's error if it ends first
+func (a *DeliveryAck) Wait(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
@@ -0,0 +1,841 @@
+package batch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pusher sends batches of one Loki tenant to Loki, such as the Client of pkg/sink/loki
+// A rejected push returns a *StatusError, which the batcher recovers from where it can
+type Pusher interface {
+	Push(ctx context.Context, batches map[string]*Batch) error
+}
+
+// Metrics records the pushes and the batching of a batcher
+type Metrics interface {
+	// ObservePush records the duration of a push by result (success or failure)
+	ObservePush(duration time.Duration, result string)
+	// CountPushRetry counts a push retried after a 429 (rate_limited) or split after a 413 (too_large)
+	CountPushRetry(reason string)
+	// CountOutOfOrder counts a push Loki partially rejected as out of order, by remediation
+	// (restamp, divert, none or failed)
+	CountOutOfOrder(action string)
+	// SetBatching records the batch size and flush timeout adaptive batching uses on a shard
+	SetBatching(shard string, size int, flush time.Duration)
+}
+
+// Delivery statuses passed to Deliveries.Update
+const (
+	Delivered = "delivered" // Pushed to Loki successfully
+	Failed    = "failed"    // The Loki push containing it failed
+)
+
+// Deliveries tracks the delivery status of entries by log ID
+type Deliveries interface {
+	Update(entries []Entry, status string, err error)
+}
+
+// Tracer traces pushes
+type Tracer interface {
+	// StartPush starts the span of a push as a child of parent and linked to the other spans
+	// whose entries it carries, returning a context carrying the span for the Pusher
+	StartPush(ctx context.Context, parent SpanContext, links []SpanContext) (context.Context, Span)
+}
+
+// Span is the span of one push
+type Span interface {
+	SetAttribute(key string, value any)
+	SetError(err error)
+	End()
+}
+
+// MemoryGuard reports whether memory use is high enough to push batches early
+type MemoryGuard interface {
+	UnderPressure() bool
+}
+
+// DeadLetter keeps the entries of failed pushes, such as the service's dead-letter queue
+type DeadLetter interface {
+	Add(batches map[string]*Batch, err error)
+}
+
+// Tuning supplies batching settings changed while running, such as /admin/batching
+type Tuning interface {
+	// Load returns the current settings and a channel closed when they change
+	Load() (size int, flush time.Duration, streamMax int, changed <-chan struct{})
+}
+
+// pressureBatchDivisor shrinks the batch size under memory pressure, so buffered entries
+// leave memory sooner
+const pressureBatchDivisor = 10
+
+// Batcher accumulates log entries and sends them to Loki in batches
+type Batcher struct {
+	pusher       Pusher
+	entryChan    <-chan Entry
+	batchSize    int
+	flushTimeout time.Duration
+	logger       *slog.Logger
+	wg           *sync.WaitGroup
+	ctx          context.Context
+
+	// Push results are summarized at INFO once per summaryInterval (0 logs every push at INFO)
+	summaryInterval time.Duration
+	stats           PushStats
+
+	metrics    Metrics
+	deliveries Deliveries // Recent delivery status by log_id (nil disables)
+	tracer     Tracer     // nil disables tracing
+
+	// Entries Loki rejects as out of order are re-stamped or diverted ("" fails the push)
+	outOfOrderAction string
+	highWater        map[string]int64 // Newest timestamp pushed per stream, by label key
+
+	tuner *batchTuner // Adapts batchSize and flushTimeout to push latency (nil keeps them fixed)
+	shard string      // Shard of the entry queue the batcher reads, in metrics and logs
+
+	memory MemoryGuard // Under memory pressure batches are pushed at a fraction of batchSize (nil disables)
+
+	deadLetter DeadLetter // Receives the entries of failed pushes (nil drops them)
+
+	forwarding Forwarding // Holds pushes while paused (nil never pauses)
+
+	streamMax int             // Entries of one stream that trigger a push (0 = no limit)
+	tuning    Tuning          // Batching changed at runtime (nil keeps it fixed)
+	tuned     <-chan struct{} // Closed when tuning changes (nil never fires)
+
+	flushes chan chan int // Flush requests, answered with the entries pushed
+
+	shutdownSpill Spill // Receives the pending entries when canceled, instead of a push (nil pushes them)
+
+	// Entries of successful and failed pushes and entries persisted when canceled, for the shutdown log
+	pushed, failed, persisted atomic.Int64
+
+	heartbeat time.Duration // Longest time the loop may idle without a heartbeat (0 only beats on activity)
+	beat      atomic.Int64  // Unix nanoseconds of the last loop iteration (0 while not running)
+}
+
+// Remediations for entries Loki rejects as out of order or too far behind
+const (
+	OutOfOrderRestamp = "restamp" // Re-push at the stream's newest timestamp
+	OutOfOrderDivert  = "divert"  // Re-push unchanged into a side stream
+)
+
+// outOfOrderLabel marks the side stream receiving diverted entries
+const outOfOrderLabel = "out_of_order"
+
+// maxHighWaterStreams bounds the streams whose newest timestamp is remembered
+const maxHighWaterStreams = 10000
+
+// NewBatcher creates a new batcher instance
+// It pushes through pusher the entries read from entryChan, usually a shard of an EntryQueue,
+// until entryChan is closed or ctx is canceled; metrics may be nil
+func NewBatcher(
+	pusher Pusher,
+	entryChan <-chan Entry,
+	batchSize int,
+	flushTimeout time.Duration,
+	logger *slog.Logger,
+	wg *sync.WaitGroup,
+	ctx context.Context,
+	summaryInterval time.Duration,
+	metrics Metrics,
+	outOfOrderAction string,
+) *Batcher {
+	if metrics == nil {
+		metrics = noMetrics{}
+	}
+	return &Batcher{
+		pusher:       pusher,
+		entryChan:    entryChan,
+		batchSize:    batchSize,
+		flushTimeout: flushTimeout,
+		logger:       logger,
+		wg:           wg,
+		ctx:          ctx,
+
+		summaryInterval: summaryInterval,
+		metrics:         metrics,
+
+		outOfOrderAction: outOfOrderAction,
+		highWater:        make(map[string]int64),
+		shard:            "0",
+		flushes:          make(chan chan int),
+	}
+}
+
+// SetShard names the shard of a sharded entry queue the batcher reads
+// It must be called before Run
+func (b *Batcher) SetShard(shard int) {
+	b.shard = strconv.Itoa(shard)
+	b.logger = b.logger.With("shard", shard)
+}
+
+// SetDeliveries reports the status of every pushed entry to deliveries
+// It must be called before Run
+func (b *Batcher) SetDeliveries(deliveries Deliveries) {
+	b.deliveries = deliveries
+}
+
+// SetTracer traces every push
+// It must be called before Run
+func (b *Batcher) SetTracer(tracer Tracer) {
+	b.tracer = tracer
+}
+
+// SetMemoryGuard pushes batches early while memory is under pressure
+// It must be called before Run
+func (b *Batcher) SetMemoryGuard(memory MemoryGuard) {
+	b.memory = memory
+}
+
+// SetDeadLetterQueue keeps the entries of failed pushes in a dead-letter queue
+// It must be called before Run
+func (b *Batcher) SetDeadLetterQueue(deadLetter DeadLetter) {
+	b.deadLetter = deadLetter
+}
+
+// SetForwarding holds pushes while forwarding to Loki is paused
+// It must be called before Run
+func (b *Batcher) SetForwarding(forwarding Forwarding) {
+	b.forwarding = forwarding
+}
+
+// SetBatchTuning applies batching changed while running, e.g. on /admin/batching
+// It must be called before Run and before SetAdaptiveBatching
+func (b *Batcher) SetBatchTuning(tuning Tuning) {
+	b.tuning = tuning
+	b.batchSize, b.flushTimeout, b.streamMax, b.tuned = tuning.Load()
+}
+
+// retune applies the current runtime batching; with adaptive batching it becomes the lower bound
+func (b *Batcher) retune() {
+	b.batchSize, b.flushTimeout, b.streamMax, b.tuned = b.tuning.Load()
+	if b.tuner != nil {
+		b.tuner.rebase(b.batchSize, b.flushTimeout)
+		b.metrics.SetBatching(b.shard, b.batchSize, b.flushTimeout)
+	}
+}
+
+// SetShutdownSpill spills the pending entries to spill when the batcher is canceled, instead of
+// pushing them, for SHUTDOWN_POLICY=persist
+// It must be called before Run
+func (b *Batcher) SetShutdownSpill(spill Spill) {
+	b.shutdownSpill = spill
+}
+
+// SetHeartbeat makes the idle loop record a heartbeat at least every interval, for the systemd watchdog
+// It must be called before Run
+func (b *Batcher) SetHeartbeat(interval time.Duration) {
+	b.heartbeat = interval
+}
+
+// Stats returns the pushes since the last summary, or since the start without summaries
+// It must not be called while Run is running
+func (b *Batcher) Stats() PushStats {
+	return b.stats
+}
+
+// Totals returns the entries of successful and failed pushes and the entries persisted when canceled
+func (b *Batcher) Totals() (pushed, failed, persisted int64) {
+	return b.pushed.Load(), b.failed.Load(), b.persisted.Load()
+}
+
+// LastBeat returns when the loop last ran (zero while the batcher is not running)
+func (b *Batcher) LastBeat() time.Time {
+	beat := b.beat.Load()
+	if beat == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, beat)
+}
+
+// Flush makes the running batcher push its pending entries now and returns how many it pushed
+// Returns 0 when ctx is canceled first
+func (b *Batcher) Flush(ctx context.Context) int {
+	done := make(chan int, 1)
+	select {
+	case b.flushes <- done:
+	case <-ctx.Done():
+		return 0
+	}
+	select {
+	case n := <-done:
+		return n
+	case <-ctx.Done():
+		return 0
+	}
+}
+
+// flushSize returns the number of entries that triggers a flush
+func (b *Batcher) flushSize() int {
+	if b.memory != nil && b.memory.UnderPressure() {
+		return max(1, b.batchSize/pressureBatchDivisor)
+	}
+	return b.batchSize
+}
+
+// SetAdaptiveBatching lets the batch size and flush timeout grow up to maxSize and maxFlush
+// while the smoothed push latency is above target; the configured values are the lower bounds
+// It must be called before Run
+func (b *Batcher) SetAdaptiveBatching(maxSize int, maxFlush, target time.Duration) {
+	b.tuner = newBatchTuner(b.batchSize, maxSize, b.flushTimeout, maxFlush, target)
+	b.metrics.SetBatching(b.shard, b.batchSize, b.flushTimeout)
+}
+
+// adapt feeds the latency of a successful push to the tuner and applies its batching
+func (b *Batcher) adapt(latency time.Duration) {
+	if b.tuner == nil || !b.tuner.observe(latency) {
+		return
+	}
+	b.batchSize, b.flushTimeout = b.tuner.size, b.tuner.flush
+	b.metrics.SetBatching(b.shard, b.batchSize, b.flushTimeout)
+	b.logger.Info("Adjusted batching to Loki push latency",
+		"batch_size", b.batchSize,
+		"flush_ms", b.flushTimeout.Milliseconds(),
+		"latency_ms", b.tuner.latency.Milliseconds(),
+	)
+}
+
+// Run starts the batching worker
+// It reads from entryChan, accumulates entries into batches grouped by label set,
+// and flushes when either the batch size or timeout is reached
+func (b *Batcher) Run() {
+	defer b.wg.Done()
+
+	// Map of label key -> Batch
+	// Label key is computed from the label set to group entries
+	batches := make(map[string]*Batch)
+
+	// Timer for flush timeout
+	flushTimer := time.NewTimer(b.flushTimeout)
+	defer flushTimer.Stop()
+
+	// Ticker for periodic push summaries; a nil channel never fires when disabled
+	var summaryC <-chan time.Time
+	if b.summaryInterval > 0 {
+		summaryTicker := time.NewTicker(b.summaryInterval)
+		defer summaryTicker.Stop()
+		summaryC = summaryTicker.C
+	}
+
+	// Ticker for heartbeats while idle; a nil channel never fires when disabled
+	var heartbeatC <-chan time.Time
+	if b.heartbeat > 0 {
+		heartbeatTicker := time.NewTicker(b.heartbeat)
+		defer heartbeatTicker.Stop()
+		heartbeatC = heartbeatTicker.C
+	}
+	defer b.beat.Store(0)
+
+	totalEntries := 0
+	firstEntryTime := time.Time{}
+
+	for {
+		b.beat.Store(time.Now().UnixNano())
+
+		select {
+		case <-heartbeatC:
+			// The iteration itself is the heartbeat
+
+		case <-summaryC:
+			b.logSummary()
+
+		case <-b.tuned:
+			b.retune()
+			// The pending entries' timeout restarts with the new flush timeout, counted from the first of them
+			wait := b.flushTimeout
+			if totalEntries > 0 {
+				wait = max(0, b.flushTimeout-time.Since(firstEntryTime))
+			}
+			if !flushTimer.Stop() {
+				select {
+				case <-flushTimer.C:
+				default:
+				}
+			}
+			flushTimer.Reset(wait)
+
+		case <-b.ctx.Done():
+			if b.shutdownSpill != nil {
+				b.logger.Info("Batcher shutting down, persisting remaining batches",
+					"pending_entries", totalEntries,
+				)
+				b.persist(batches)
+				return
+			}
+			// Context cancelled, flush remaining batches and exit
+			b.logger.Info("Batcher shutting down, flushing remaining batches",
+				"pending_entries", totalEntries,
+			)
+			b.flush(batches)
+			b.logSummary()
+			return
+
+		case entry, ok := <-b.entryChan:
+			if !ok {
+				// Channel closed, flush and exit
+				b.logger.Info("Entry channel closed, flushing remaining batches",
+					"pending_entries", totalEntries,
+				)
+				b.flush(batches)
+				b.logSummary()
+				return
+			}
+
+			// Track first entry time for the current batch set
+			if totalEntries == 0 {
+				firstEntryTime = time.Now()
+				// Reset and start the flush timer
+				if !flushTimer.Stop() {
+					select {
+					case <-flushTimer.C:
+					default:
+					}
+				}
+				flushTimer.Reset(b.flushTimeout)
+			}
+
+			// The source label always reflects the entry's source, so one
+			// source can never write into another source's streams
+			entry.Labels[SourceLabel] = entry.Source
+
+			// Compute label key for grouping; equal label sets of different Loki tenants stay apart
+			labelKey := LabelKey(entry.Labels)
+			if entry.OrgID != "" {
+				labelKey = entry.OrgID + "/" + labelKey
+			}
+
+			// Get or create batch for this label set
+			batch, exists := batches[labelKey]
+			if !exists {
+				batch = &Batch{
+					Labels:     entry.Labels,
+					Entries:    make([]Entry, 0, b.batchSize),
+					FirstEntry: time.Now(),
+					OrgID:      entry.OrgID,
+				}
+				batches[labelKey] = batch
+			}
+
+			// Add entry to batch
+			batch.Entries = append(batch.Entries, entry)
+			totalEntries++
+
+			// Check if we should flush based on size, overall or of this stream
+			streamFull := b.streamMax > 0 && len(batch.Entries) >= b.streamMax
+			if totalEntries >= b.flushSize() || streamFull {
+				b.logger.Debug("Flushing batch (size limit reached)",
+					"total_entries", totalEntries,
+					"streams", len(batches),
+					"stream_limit", streamFull,
+				)
+				b.flush(batches)
+				batches = make(map[string]*Batch)
+				totalEntries = 0
+				firstEntryTime = time.Time{}
+			}
+
+		case done := <-b.flushes:
+			if totalEntries > 0 {
+				b.logger.Debug("Flushing batch (requested)",
+					"total_entries", totalEntries,
+					"streams", len(batches),
+				)
+				b.flush(batches)
+				batches = make(map[string]*Batch)
+			}
+			done <- totalEntries
+			totalEntries = 0
+			firstEntryTime = time.Time{}
+
+		case <-flushTimer.C:
+			// Timeout elapsed, flush if we have any entries
+			if totalEntries > 0 {
+				elapsed := time.Since(firstEntryTime)
+				b.logger.Debug("Flushing batch (timeout reached)",
+					"total_entries", totalEntries,
+					"streams", len(batches),
+					"elapsed_ms", elapsed.Milliseconds(),
+				)
+				b.flush(batches)
+				batches = make(map[string]*Batch)
+				totalEntries = 0
+				firstEntryTime = time.Time{}
+			}
+			// Reset timer for next interval
+			flushTimer.Reset(b.flushTimeout)
+		}
+	}
+}
+
+// flush sends the accumulated batches to Loki, one push per Loki tenant
+func (b *Batcher) flush(batches map[string]*Batch) {
+	byOrg := make(map[string]map[string]*Batch)
+	for key, batch := range batches {
+		if byOrg[batch.OrgID] == nil {
+			byOrg[batch.OrgID] = make(map[string]*Batch)
+		}
+		byOrg[batch.OrgID][key] = batch
+	}
+	for _, orgID := range slices.Sorted(maps.Keys(byOrg)) {
+		b.flushOrg(byOrg[orgID])
+	}
+}
+
+// flushOrg pushes batches of a single Loki tenant
+func (b *Batcher) flushOrg(batches map[string]*Batch) {
+	if len(batches) == 0 {
+		return
+	}
+
+	// A pause holds the batch; at shutdown it is pushed regardless
+	if b.forwarding != nil {
+		b.forwarding.Wait(b.ctx)
+	}
+
+	// Count total entries across all streams
+	totalEntries := 0
+	for _, batch := range batches {
+		totalEntries += len(batch.Entries)
+	}
+
+	// Create a context with timeout for the Loki push
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The push span joins the trace of the first traced request it carries and links the others
+	ctx, span := b.startPushSpan(ctx, batches)
+	span.SetAttribute("entries", totalEntries)
+	span.SetAttribute("streams", len(batches))
+	defer span.End()
+
+	// Send to Loki
+	start := time.Now()
+	cyclesBefore := gcCycles()
+	err := b.push(ctx, batches, totalEntries, true)
+	elapsed := time.Since(start)
+	b.stats.Record(totalEntries, elapsed, err)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		span.SetError(err)
+	}
+	b.metrics.ObservePush(elapsed, result)
+
+	// Annotate pushes that overlapped a GC cycle, to correlate latency spikes with GC pauses
+	if gcCycles() != cyclesBefore {
+		pauses, pauseTotal := gcPausesSince(start)
+		b.logger.Debug("GC ran during Loki push",
+			"duration_ms", elapsed.Milliseconds(),
+			"gc_pauses", pauses,
+			"gc_pause_us", pauseTotal.Microseconds(),
+			"total_entries", totalEntries,
+			"result", result,
+		)
+	}
+
+	status := Delivered
+	if err != nil {
+		status = Failed
+		b.failed.Add(int64(totalEntries))
+	} else {
+		b.pushed.Add(int64(totalEntries))
+	}
+	for _, batch := range batches {
+		if b.deliveries != nil {
+			b.deliveries.Update(batch.Entries, status, err)
+		}
+		for _, entry := range batch.Entries {
+			entry.Ack.Done(err)
+		}
+	}
+
+	if err != nil {
+		b.logger.Error("Failed to push batch to Loki",
+			"error", err,
+			"total_entries", totalEntries,
+			"streams", len(batches),
+		)
+		if b.deadLetter != nil {
+			b.deadLetter.Add(batches, err)
+		}
+		return
+	}
+
+	b.adapt(elapsed)
+
+	// Per-push detail is DEBUG when summaries are enabled
+	level := slog.LevelInfo
+	if b.summaryInterval > 0 {
+		level = slog.LevelDebug
+	}
+	b.logger.Log(context.Background(), level, "Successfully pushed batch to Loki",
+		"total_entries", totalEntries,
+		"streams", len(batches),
+		"duration_ms", elapsed.Milliseconds(),
+	)
+}
+
+// persist spills pending batches to the shutdown spill queue instead of pushing them
+func (b *Batcher) persist(batches map[string]*Batch) {
+	lost := 0
+	for _, batch := range batches {
+		for _, entry := range batch.Entries {
+			if err := b.shutdownSpill.Persist(entry); err != nil {
+				lost++
+				continue
+			}
+			b.persisted.Add(1)
+		}
+	}
+	if lost > 0 {
+		b.logger.Error("Failed to persist pending entries, dropping them", "entries", lost)
+	}
+}
+
+// Recovery from Loki rejecting a push as rate limited (429) or too large (413)
+const (
+	maxRateLimitRetries   = 3
+	defaultRateLimitDelay = time.Second // When Loki sends no Retry-After
+)
+
+// push sends batches to Loki, waiting out 429 responses for the advertised Retry-After
+// and splitting batches in half, recursively, on 413 responses
+// With remediate set, entries rejected as out of order are handled per outOfOrderAction
+func (b *Batcher) push(ctx context.Context, batches map[string]*Batch, totalEntries int, remediate bool) error {
+	for attempt := 0; ; attempt++ {
+		err := b.pusher.Push(ctx, batches)
+		if err == nil {
+			b.recordHighWater(batches)
+		}
+
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			return err
+		}
+
+		switch statusErr.StatusCode {
+		case http.StatusBadRequest:
+			rejection := parseOutOfOrderRejection(statusErr.Body)
+			if rejection == nil || !remediate {
+				return err
+			}
+			if b.outOfOrderAction == "" {
+				b.metrics.CountOutOfOrder("none")
+				return err
+			}
+			return b.remediateOutOfOrder(ctx, batches, rejection, err)
+
+		case http.StatusTooManyRequests:
+			if attempt >= maxRateLimitRetries {
+				return err
+			}
+			delay := cmp.Or(statusErr.RetryAfter, defaultRateLimitDelay)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				return err
+			}
+			b.metrics.CountPushRetry("rate_limited")
+			b.logger.Warn("Loki rate limited the push, retrying",
+				"retry_after_ms", delay.Milliseconds(),
+				"attempt", attempt+1,
+				"total_entries", totalEntries,
+			)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+
+		case http.StatusRequestEntityTooLarge:
+			if totalEntries < 2 {
+				return err
+			}
+			first, second := splitBatches(batches, totalEntries/2)
+			b.metrics.CountPushRetry("too_large")
+			b.logger.Warn("Loki rejected the push as too large, splitting it",
+				"total_entries", totalEntries,
+			)
+			firstErr := b.push(ctx, first, totalEntries/2, remediate)
+			secondErr := b.push(ctx, second, totalEntries-totalEntries/2, remediate)
+			return cmp.Or(firstErr, secondErr)
+
+		default:
+			return err
+		}
+	}
+}
+
+// remediateOutOfOrder re-pushes the entries Loki rejected as out of order, re-stamped
+// to their stream's newest timestamp or diverted into a side stream
+// Loki stored the other entries of the push, so success means the whole push is delivered
+func (b *Batcher) remediateOutOfOrder(ctx context.Context, batches map[string]*Batch, rejection *outOfOrderRejection, pushErr error) error {
+	retry := make(map[string]*Batch)
+	rejected := 0
+	for key, batch := range batches {
+		newest := b.highWater[key]
+		var entries []Entry
+		for _, entry := range batch.Entries {
+			if rejection.rejects(entry.Timestamp) {
+				entries = append(entries, entry)
+			} else {
+				newest = max(newest, entry.Timestamp)
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		rejected += len(entries)
+
+		labels := batch.Labels
+		switch b.outOfOrderAction {
+		case OutOfOrderRestamp:
+			// The line keeps its original date, only the Loki timestamp moves
+			if newest == 0 {
+				newest = time.Now().UnixNano()
+			}
+			newest = max(newest, rejection.oldestAcceptable)
+			for i := range entries {
+				entries[i].Timestamp = newest + int64(i) + 1
+			}
+		case OutOfOrderDivert:
+			labels = maps.Clone(batch.Labels)
+			labels[outOfOrderLabel] = "true"
+			key = batch.OrgID + "/" + LabelKey(labels)
+		}
+		retry[key] = &Batch{Labels: labels, Entries: entries, FirstEntry: batch.FirstEntry, OrgID: batch.OrgID}
+	}
+
+	// Loki reported rejections that match none of the pushed entries
+	if rejected == 0 {
+		b.metrics.CountOutOfOrder("failed")
+		return pushErr
+	}
+
+	b.logger.Warn("Loki rejected out-of-order entries, re-pushing them",
+		"action", b.outOfOrderAction,
+		"rejected_entries", rejected,
+		"error", pushErr,
+	)
+	if err := b.push(ctx, retry, rejected, false); err != nil {
+		b.metrics.CountOutOfOrder("failed")
+		return fmt.Errorf("failed to re-push out-of-order entries: %w", err)
+	}
+	b.metrics.CountOutOfOrder(b.outOfOrderAction)
+	return nil
+}
+
+// recordHighWater remembers the newest timestamp pushed to each stream
+func (b *Batcher) recordHighWater(batches map[string]*Batch) {
+	if b.outOfOrderAction != OutOfOrderRestamp {
+		return
+	}
+	if len(b.highWater) > maxHighWaterStreams {
+		clear(b.highWater)
+	}
+	for key, batch := range batches {
+		for _, entry := range batch.Entries {
+			b.highWater[key] = max(b.highWater[key], entry.Timestamp)
+		}
+	}
+}
+
+// splitBatches splits batches into two sets, the first holding n entries
+// Streams are walked in label key order so the split is deterministic
+func splitBatches(batches map[string]*Batch, n int) (map[string]*Batch, map[string]*Batch) {
+	keys := make([]string, 0, len(batches))
+	for key := range batches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	first := make(map[string]*Batch)
+	second := make(map[string]*Batch)
+	for _, key := range keys {
+		batch := batches[key]
+		take := min(n, len(batch.Entries))
+		if take > 0 {
+			first[key] = &Batch{Labels: batch.Labels, Entries: batch.Entries[:take], FirstEntry: batch.FirstEntry, OrgID: batch.OrgID}
+			n -= take
+		}
+		if take < len(batch.Entries) {
+			second[key] = &Batch{Labels: batch.Labels, Entries: batch.Entries[take:], FirstEntry: batch.FirstEntry, OrgID: batch.OrgID}
+		}
+	}
+	return first, second
+}
+
+// startPushSpan starts the span of a Loki push
+func (b *Batcher) startPushSpan(ctx context.Context, batches map[string]*Batch) (context.Context, Span) {
+	if b.tracer == nil {
+		return ctx, noSpan{}
+	}
+
+	var parent SpanContext
+	linked := make(map[SpanContext]bool)
+	for _, batch := range batches {
+		for _, entry := range batch.Entries {
+			if entry.Trace.IsValid() && !linked[entry.Trace] {
+				if !parent.IsValid() {
+					parent = entry.Trace
+				}
+				linked[entry.Trace] = true
+			}
+		}
+	}
+
+	var links []SpanContext
+	for sc := range linked {
+		if sc != parent {
+			links = append(links, sc)
+		}
+	}
+	return b.tracer.StartPush(ctx, parent, links)
+}
+
+// noSpan is the span of pushes without a tracer
+type noSpan struct{}
+
+func (noSpan) SetAttribute(string, any) {}
+func (noSpan) SetError(error)           {}
+func (noSpan) End()                     {}
+
+// noMetrics records nothing, for batchers created without metrics
+type noMetrics struct{}
+
+func (noMetrics) ObservePush(time.Duration, string)      {}
+func (noMetrics) CountPushRetry(string)                  {}
+func (noMetrics) CountOutOfOrder(string)                 {}
+func (noMetrics) SetBatching(string, int, time.Duration) {}
+
+// logSummary emits one INFO line summarizing the pushes since the last summary
+func (b *Batcher) logSummary() {
+	if b.summaryInterval <= 0 || b.stats.Pushes == 0 {
+		return
+	}
+
+	b.logger.Info("Loki push summary",
+		"interval_s", int(b.summaryInterval.Seconds()),
+		"pushes", b.stats.Pushes,
+		"failures", b.stats.Failures,
+		"entries", b.stats.Entries,
+		"p50_ms", b.stats.Percentile(50).Milliseconds(),
+		"p99_ms", b.stats.Percentile(99).Milliseconds(),
+		"max_ms", b.stats.Percentile(100).Milliseconds(),
+	)
+	b.stats.Reset()
+}
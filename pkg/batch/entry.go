@@ -0,0 +1,109 @@
+// Package batch groups log entries into Loki streams and pushes them in batches
+// An EntryQueue shards entries by stream across Batchers, which push through a Pusher
+// such as the Loki client of pkg/sink/loki; the service's spill and dead-letter queues,
+// metrics and tracing plug in through the small interfaces of this package
+package batch
+
+import (
+	"context"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SourceLabel is the stream label the pipeline sets from Entry.Source
+// It keeps streams from different sources apart even when their other labels collide
+const SourceLabel = "source"
+
+// Entry represents a single log line to be sent to Loki
+type Entry struct {
+	Timestamp int64             // Unix nanoseconds
+	Labels    map[string]string // Stream labels (type, environment_name, tenant_name)
+	Line      string            // Original JSON line
+	Source    string            // Ingestion source (e.g. auth0), enforced as the "source" label
+	LogID     string            // Source event ID (Auth0 log_id), used for delivery lookups
+	Trace     SpanContext       // Span of the request that received the entry (zero when not traced)
+	Ack       *DeliveryAck      // Receives the push result (nil unless delivery is synchronous)
+	OrgID     string            // Loki tenant (X-Scope-OrgID) the entry is pushed to ("" uses the client's default)
+}
+
+// Batch accumulates log entries for a single label set
+type Batch struct {
+	Labels     map[string]string
+	Entries    []Entry
+	FirstEntry time.Time // Track when first entry was added for timeout
+	OrgID      string    // X-Scope-OrgID of the push ("" uses the client's default)
+}
+
+// SpanContext identifies a span across process and goroutine boundaries
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the span context refers to a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent renders the W3C Trace Context header for a sampled span
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-01"
+}
+
+// traceKey carries the span of a push in a context
+type traceKey struct{}
+
+// ContextWithTrace returns a context carrying the span of a push, which a Pusher propagates
+// to Loki in the traceparent header
+func ContextWithTrace(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, sc)
+}
+
+// TraceFromContext returns the span carried by ctx, if any
+func TraceFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(traceKey{}).(SpanContext)
+	return sc, ok
+}
+
+// LabelKey creates a unique key from a label set for grouping
+// Label names are sorted so the key is deterministic regardless of which labels a source sets
+func LabelKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(labels[name])
+		key.WriteByte('|')
+	}
+	return key.String()
+}
+
+// Streams groups entries into the batches of their Loki streams, as the batcher does
+func Streams(entries []Entry) map[string]*Batch {
+	batches := make(map[string]*Batch)
+	for _, entry := range entries {
+		entry.Labels[SourceLabel] = entry.Source
+		key := LabelKey(entry.Labels)
+		if entry.OrgID != "" {
+			key = entry.OrgID + "/" + key
+		}
+		b, ok := batches[key]
+		if !ok {
+			b = &Batch{Labels: entry.Labels, OrgID: entry.OrgID}
+			batches[key] = b
+		}
+		b.Entries = append(b.Entries, entry)
+	}
+	return batches
+}
@@ -0,0 +1,33 @@
+package batch
+
+import (
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+// gcCycles returns the number of completed GC cycles without stopping the world
+func gcCycles() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// gcPausesSince sums the GC pauses that ended after start, to annotate slow operations
+func gcPausesSince(start time.Time) (count int, total time.Duration) {
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+
+	// PauseEnd is ordered from the most recent pause
+	for i, end := range stats.PauseEnd {
+		if end.Before(start) || i >= len(stats.Pause) {
+			break
+		}
+		count++
+		total += stats.Pause[i]
+	}
+	return count, total
+}
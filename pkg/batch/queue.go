@@ -0,0 +1,141 @@
+package batch
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// EntryQueue hands entries to the batcher shards
+// Each shard has its own channel and batcher goroutine and owns the streams whose label set
+// hashes to it, so batching, encoding and pushing scale across cores while every stream
+// (and its out-of-order high-water mark) stays with a single batcher
+type EntryQueue struct {
+	shards     []chan Entry
+	spill      Spill      // Takes entries while their shard is full (nil drops them)
+	forwarding Forwarding // While paused, every entry that may be spilled is spilled (nil never pauses)
+}
+
+// Spill keeps entries on disk while the queue cannot take them, such as the service's spill queue
+type Spill interface {
+	// Append stores an entry to be queued again later
+	Append(entry Entry) error
+	// Pending reports whether stored entries are waiting
+	Pending() bool
+	// Persist stores an entry at shutdown, telling the sender of a synchronous delivery it was not delivered
+	Persist(entry Entry) error
+}
+
+// Forwarding pauses pushes to Loki, such as the service's /admin/forwarding switch
+type Forwarding interface {
+	// Paused reports whether pushes are paused
+	Paused() bool
+	// Wait blocks while pushes are paused, or until ctx is canceled
+	Wait(ctx context.Context)
+}
+
+// NewEntryQueue creates shards channels sharing a total capacity
+func NewEntryQueue(shards, capacity int) *EntryQueue {
+	q := &EntryQueue{shards: make([]chan Entry, shards)}
+	for i := range q.shards {
+		q.shards[i] = make(chan Entry, (capacity+shards-1)/shards)
+	}
+	return q
+}
+
+// Shard returns the channel read by the i-th batcher
+func (q *EntryQueue) Shard(i int) <-chan Entry {
+	return q.shards[i]
+}
+
+// For returns the channel of the shard owning the entry's stream
+func (q *EntryQueue) For(entry Entry) chan<- Entry {
+	if len(q.shards) == 1 {
+		return q.shards[0]
+	}
+	return q.shards[streamHash(entry)%uint64(len(q.shards))]
+}
+
+// SetSpill spills entries that find their shard full to disk instead of dropping them
+func (q *EntryQueue) SetSpill(spill Spill) {
+	q.spill = spill
+}
+
+// SetForwarding spills every entry while forwarding to Loki is paused
+func (q *EntryQueue) SetForwarding(forwarding Forwarding) {
+	q.forwarding = forwarding
+}
+
+// Offer queues an entry without blocking and reports whether it was accepted
+// With a spill queue, an entry whose shard is full is spilled to disk, as is every entry while
+// earlier ones wait there or forwarding is paused; entries of synchronous deliveries are never spilled
+func (q *EntryQueue) Offer(entry Entry) bool {
+	spill := q.spill != nil && entry.Ack == nil
+	if spill && (q.spill.Pending() || q.forwarding != nil && q.forwarding.Paused()) {
+		return q.spill.Append(entry) == nil
+	}
+	select {
+	case q.For(entry) <- entry:
+		return true
+	default:
+	}
+	return spill && q.spill.Append(entry) == nil
+}
+
+// Len returns the entries waiting in the shards
+func (q *EntryQueue) Len() int {
+	n := 0
+	for _, shard := range q.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// Close closes every shard, telling the batchers to flush and exit
+func (q *EntryQueue) Close() {
+	for _, shard := range q.shards {
+		close(shard)
+	}
+}
+
+// Persist spills the entries left in the closed shards at shutdown and returns how many were
+// persisted and how many were lost, which without a spill queue is all of them
+func (q *EntryQueue) Persist() (persisted, lost int64) {
+	for _, shard := range q.shards {
+		for entry := range shard {
+			if q.spill != nil && q.spill.Persist(entry) == nil {
+				persisted++
+			} else {
+				lost++
+			}
+		}
+	}
+	return persisted, lost
+}
+
+// streamHash hashes the Loki stream of an entry, its tenant and label set with the source
+// label the batcher enforces, with FNV-1a
+func streamHash(entry Entry) uint64 {
+	h := hashString(fnvOffset64, entry.OrgID)
+	for _, name := range slices.Sorted(maps.Keys(entry.Labels)) {
+		if name == SourceLabel {
+			continue
+		}
+		h = hashString(hashString(hashString(h, "\x00"), name), "="+entry.Labels[name])
+	}
+	return hashString(hashString(h, "\x00"), entry.Source)
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hashString adds s to an FNV-1a hash
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
@@ -0,0 +1,46 @@
+package batch
+
+import (
+	"slices"
+	"time"
+)
+
+// PushStats aggregates push results between two summary log lines
+type PushStats struct {
+	Pushes    int
+	Failures  int
+	Entries   int // Entries of the successful pushes
+	durations []time.Duration
+}
+
+// maxSummarySamples bounds the latency samples kept per summary interval
+const maxSummarySamples = 10000
+
+// Record adds the result of one push
+func (s *PushStats) Record(entries int, duration time.Duration, err error) {
+	s.Pushes++
+	if err != nil {
+		s.Failures++
+		return
+	}
+	s.Entries += entries
+	if len(s.durations) < maxSummarySamples {
+		s.durations = append(s.durations, duration)
+	}
+}
+
+// Percentile returns the p-th percentile (0-100) of the recorded push durations
+func (s *PushStats) Percentile(p float64) time.Duration {
+	if len(s.durations) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(s.durations)
+	slices.Sort(sorted)
+	index := int(float64(len(sorted)-1) * p / 100)
+	return sorted[index]
+}
+
+// Reset clears the stats for the next interval
+func (s *PushStats) Reset() {
+	*s = PushStats{durations: s.durations[:0]}
+}
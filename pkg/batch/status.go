@@ -0,0 +1,65 @@
+package batch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// StatusError is returned when Loki answers with a non-2xx status
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // From the Retry-After header (0 when absent)
+	Body       string        // Start of the response body
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("Loki returned non-2xx status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Loki returned non-2xx status %d: %s", e.StatusCode, e.Body[:min(len(e.Body), 500)])
+}
+
+// outOfOrderRejection lists the entries Loki refused for arriving out of order or too late
+type outOfOrderRejection struct {
+	timestamps       map[int64]bool // Timestamps of the entries Loki listed (it lists only the first few)
+	oldestAcceptable int64          // Entries older than this were too far behind (0 when not reported)
+}
+
+var (
+	rejectedEntryPattern    = regexp.MustCompile(`entry with timestamp (.+?) ignored, reason: '([^']*)'`)
+	oldestAcceptablePattern = regexp.MustCompile(`oldest acceptable timestamp is: ([^',\s]+)`)
+)
+
+// parseOutOfOrderRejection extracts out-of-order rejections from the body of a Loki 400
+// It returns nil when Loki reported no such rejection or rejected entries for other reasons too
+func parseOutOfOrderRejection(body string) *outOfOrderRejection {
+	matches := rejectedEntryPattern.FindAllStringSubmatch(body, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	rejection := &outOfOrderRejection{timestamps: make(map[int64]bool, len(matches))}
+	for _, match := range matches {
+		reason := match[2]
+		if !strings.Contains(reason, "out of order") && !strings.Contains(reason, "too far behind") {
+			return nil
+		}
+		// Loki formats the timestamp with time.Time.String
+		if ts, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", match[1]); err == nil {
+			rejection.timestamps[ts.UnixNano()] = true
+		}
+		if oldest := oldestAcceptablePattern.FindStringSubmatch(reason); oldest != nil {
+			if ts, err := time.Parse(time.RFC3339Nano, oldest[1]); err == nil {
+				rejection.oldestAcceptable = max(rejection.oldestAcceptable, ts.UnixNano())
+			}
+		}
+	}
+	return rejection
+}
+
+// rejects reports whether Loki refused an entry with the given timestamp
+func (r *outOfOrderRejection) rejects(timestamp int64) bool {
+	return r.timestamps[timestamp] || timestamp < r.oldestAcceptable
+}
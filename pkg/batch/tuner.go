@@ -0,0 +1,66 @@
+package batch
+
+import (
+	"time"
+)
+
+// Adaptive batching reacts to the smoothed push latency: above the target batches grow,
+// below half of it they shrink back, so Loki under load gets fewer, larger pushes
+const (
+	adaptiveLatencyWeight = 0.2 // Weight of the newest push in the smoothed latency
+	adaptiveGrowFactor    = 1.5
+	adaptiveShrinkFactor  = 0.8
+)
+
+// batchTuner adjusts the batch size and flush timeout of a batcher to Loki's push latency
+// It is used by the batcher goroutine only
+type batchTuner struct {
+	minSize, maxSize   int
+	minFlush, maxFlush time.Duration
+	target             time.Duration // Smoothed latency above which batches grow
+
+	latency time.Duration // Smoothed push latency (0 before the first push)
+	size    int
+	flush   time.Duration
+}
+
+// newBatchTuner starts at the lower bounds, which are the configured batch size and flush timeout
+func newBatchTuner(minSize, maxSize int, minFlush, maxFlush, target time.Duration) *batchTuner {
+	return &batchTuner{
+		minSize:  minSize,
+		maxSize:  maxSize,
+		minFlush: minFlush,
+		maxFlush: maxFlush,
+		target:   target,
+		size:     minSize,
+		flush:    minFlush,
+	}
+}
+
+// observe adds the latency of a successful push and reports whether the batching changed
+func (t *batchTuner) observe(latency time.Duration) bool {
+	if t.latency == 0 {
+		t.latency = latency
+	} else {
+		t.latency += time.Duration(adaptiveLatencyWeight * float64(latency-t.latency))
+	}
+
+	size, flush := t.size, t.flush
+	switch {
+	case t.latency > t.target:
+		t.size = min(t.maxSize, int(float64(t.size)*adaptiveGrowFactor)+1)
+		t.flush = min(t.maxFlush, time.Duration(float64(t.flush)*adaptiveGrowFactor))
+	case t.latency < t.target/2:
+		t.size = max(t.minSize, int(float64(t.size)*adaptiveShrinkFactor))
+		t.flush = max(t.minFlush, time.Duration(float64(t.flush)*adaptiveShrinkFactor))
+	}
+	return t.size != size || t.flush != flush
+}
+
+// rebase moves the lower bounds to a batch size and flush timeout set at runtime and starts over
+// from them; upper bounds below the new values are raised to them
+func (t *batchTuner) rebase(minSize int, minFlush time.Duration) {
+	t.minSize, t.minFlush = minSize, minFlush
+	t.maxSize, t.maxFlush = max(t.maxSize, minSize), max(t.maxFlush, minFlush)
+	t.size, t.flush = minSize, minFlush
+}
@@ -0,0 +1,123 @@
+// Package config reads settings from the environment: typed lookups with defaults,
+// comma-separated lists and .env files, shared by the service and programs embedding
+// the pipeline
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Getenv retrieves an environment variable or returns a default value
+func Getenv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// GetenvInt retrieves an integer environment variable or returns a default value
+func GetenvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		var intVal int
+		if _, err := fmt.Sscanf(value, "%d", &intVal); err == nil {
+			return intVal
+		}
+	}
+	return defaultValue
+}
+
+// GetenvFloat retrieves a float environment variable or returns a default value
+func GetenvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+// GetenvBool retrieves a boolean environment variable or returns a default value
+func GetenvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		switch value {
+		case "true", "1", "yes", "on":
+			return true
+		case "false", "0", "no", "off":
+			return false
+		}
+	}
+	return defaultValue
+}
+
+// GetenvList retrieves a comma-separated environment variable as a slice
+func GetenvList(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		return SplitList(value)
+	}
+	return defaultValue
+}
+
+// SplitList parses a comma-separated string into a slice, without empty elements
+func SplitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+
+	parts := []string{}
+	for _, part := range splitAndTrim(s, ",") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// splitAndTrim splits a string and trims whitespace from each part
+func splitAndTrim(s, sep string) []string {
+	parts := []string{}
+	for _, part := range splitString(s, sep) {
+		trimmed := trimSpace(part)
+		parts = append(parts, trimmed)
+	}
+	return parts
+}
+
+// splitString splits a string by separator
+func splitString(s, sep string) []string {
+	if s == "" {
+		return []string{}
+	}
+
+	result := []string{}
+	current := ""
+
+	for i := 0; i < len(s); i++ {
+		if i+len(sep) <= len(s) && s[i:i+len(sep)] == sep {
+			result = append(result, current)
+			current = ""
+			i += len(sep) - 1
+		} else {
+			current += string(s[i])
+		}
+	}
+	result = append(result, current)
+	return result
+}
+
+// trimSpace removes leading and trailing whitespace
+func trimSpace(s string) string {
+	start := 0
+	end := len(s)
+
+	for start < end && (s[start] == ' ' || s[start] == '\t' || s[start] == '\n' || s[start] == '\r') {
+		start++
+	}
+
+	for end > start && (s[end-1] == ' ' || s[end-1] == '\t' || s[end-1] == '\n' || s[end-1] == '\r') {
+		end--
+	}
+
+	return s[start:end]
+}
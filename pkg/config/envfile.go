@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// envKeyPattern matches the variable names accepted in an env file
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadEnvFile sets the KEY=VALUE pairs of a .env file as environment variables, before the
+// configuration is read from the environment; variables already set in the environment win
+// It returns the variables it set
+// Blank lines and # comments are skipped, an "export " prefix is allowed, and values may be
+// single-quoted (literal) or double-quoted (with \n, \t, \" and \\ escapes)
+func LoadEnvFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file: %w", err)
+	}
+	defer file.Close()
+
+	set := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := ParseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("env file %s, line %d: %w", path, lineNumber, err)
+		}
+		if _, inEnv := os.LookupEnv(key); inEnv && !set[key] {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, fmt.Errorf("env file %s, line %d: %w", path, lineNumber, err)
+		}
+		set[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file: %w", err)
+	}
+	return set, nil
+}
+
+// ValidKey reports whether key is a variable name accepted in an env file
+func ValidKey(key string) bool {
+	return envKeyPattern.MatchString(key)
+}
+
+// ParseEnvLine parses one KEY=VALUE line of an env file
+func ParseEnvLine(line string) (string, string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", "", fmt.Errorf("expected KEY=VALUE")
+	}
+	key = strings.TrimSpace(key)
+	if !envKeyPattern.MatchString(key) {
+		return "", "", fmt.Errorf("invalid variable name %q", key)
+	}
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quote in %s", key)
+		}
+		return key, value[1 : end+1], nil
+	case strings.HasPrefix(value, `"`):
+		// The closing quote is the first one not escaped
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '\\':
+				i++
+			case '"':
+				unquoted, err := strconv.Unquote(value[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid quoted value of %s", key)
+				}
+				return key, unquoted, nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated quote in %s", key)
+	}
+
+	// A # after whitespace starts a comment in unquoted values
+	for i := 1; i < len(value); i++ {
+		if value[i] == '#' && (value[i-1] == ' ' || value[i-1] == '\t') {
+			value = strings.TrimSpace(value[:i])
+			break
+		}
+	}
+	return key, value, nil
+}
@@ -0,0 +1,99 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// SourceAuth0 is the source of Auth0 log events, the deliveries of /logs
+const SourceAuth0 = "auth0"
+
+// auth0Fields are the fields of an Auth0 log event that become the labels and timestamp of its entry
+type auth0Fields struct {
+	LogID string `json:"log_id"`
+	Data  struct {
+		Date            string `json:"date"`
+		Type            string `json:"type"`
+		EnvironmentName string `json:"environment_name"`
+		TenantName      string `json:"tenant_name"`
+		LogID           string `json:"log_id"`
+	} `json:"data"`
+}
+
+// ParseAuth0 parses a single JSON line and extracts the required fields
+// The entry has no OrgID, callers set it from the tenant they trust
+func (h *Handler) ParseAuth0(raw []byte) (batch.Entry, error) {
+	// Extract only the fields needed for labels and the timestamp; a line cut to the maximum
+	// line size keeps the fields before the cut
+	body, truncated := cutTruncationMarker(raw)
+	logData, err := extractAuth0Fields(body, truncated)
+	if err != nil {
+		return batch.Entry{}, err
+	}
+
+	// Parse the timestamp (RFC3339 format)
+	timestamp, err := time.Parse(time.RFC3339Nano, logData.Data.Date)
+	if err != nil {
+		return batch.Entry{}, err
+	}
+
+	// The entry outlives the caller's buffer, so this is the one copy of the line
+	line := string(raw)
+
+	// Canonicalize the forwarded line so retries with a different key order are identical
+	// A truncated line is no longer valid JSON and is forwarded as it is
+	if h.settings.CanonicalJSON && !truncated {
+		canonical, err := CanonicalizeJSON(line)
+		if err != nil {
+			return batch.Entry{}, err
+		}
+		line = canonical
+	}
+
+	// Create labels map
+	labels := map[string]string{
+		"service_name":     h.settings.ServiceName,
+		"type":             logData.Data.Type,
+		"environment_name": logData.Data.EnvironmentName,
+		"tenant_name":      logData.Data.TenantName,
+	}
+
+	logID := logData.LogID
+	if logID == "" {
+		logID = logData.Data.LogID
+	}
+
+	return batch.Entry{
+		Timestamp: timestamp.UnixNano(),
+		Labels:    labels,
+		Line:      line, // Preserve the original line exactly (unless canonicalized)
+		Source:    SourceAuth0,
+		LogID:     logID,
+	}, nil
+}
+
+// CanonicalizeJSON re-serializes a JSON document with object keys sorted and no insignificant whitespace
+// Numbers keep their original text and HTML characters are not escaped, so only key order and formatting change
+func CanonicalizeJSON(line string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	// encoding/json writes map keys in sorted order
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,255 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Body formats of a delivery, selected from its Content-Type
+const (
+	formatJSONLines = "jsonl" // One event per line
+	formatJSON      = "json"  // A JSON array of events, one event, or a sequence of events
+)
+
+// supportedContentTypes is listed to clients that send something else
+const supportedContentTypes = "application/x-ndjson or text/plain (JSON Lines), application/json (array or objects)"
+
+// bodyFormat selects the parser for a Content-Type; a missing type means JSON Lines
+func bodyFormat(contentType string) (string, error) {
+	if contentType == "" {
+		return formatJSONLines, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid Content-Type %q: %w", contentType, err)
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines", "application/jsonlines", "text/plain":
+		return formatJSONLines, nil
+	case "application/json":
+		return formatJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported Content-Type %q", mediaType)
+	}
+}
+
+// lineReader yields the events of a delivery one line at a time
+// jsonLinesReader reads JSON Lines; jsonValueReader reads JSON documents
+// Bytes returns the current line without copying; it is only valid until the next Scan
+// Lines above the maximum size are cut to it rather than ending the delivery, and Truncated
+// returns how many bytes were cut off the current line (0 when it is complete)
+type lineReader interface {
+	Scan() bool
+	Bytes() []byte
+	Truncated() int
+	Err() error
+}
+
+// newLineReader returns the reader for a body format
+// buf holds the current line and bounds its size
+func newLineReader(format string, body io.Reader, buf []byte) lineReader {
+	if format == formatJSON {
+		return &jsonValueReader{reader: bufio.NewReader(body), maxSize: len(buf)}
+	}
+	return &jsonLinesReader{reader: bufio.NewReader(body), buf: buf[:0:len(buf)]}
+}
+
+// jsonLinesReader reads newline-delimited lines, like bufio.Scanner with ScanLines, but
+// discards what does not fit into buf instead of failing with bufio.ErrTooLong
+type jsonLinesReader struct {
+	reader *bufio.Reader
+	buf    []byte // The current line, at most cap(buf) bytes
+	cut    int    // Bytes discarded from the current line
+	err    error
+}
+
+func (r *jsonLinesReader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	r.buf = r.buf[:0]
+	r.cut = 0
+	endsWithCR := false // Whether the previous chunk of the line ended with a CR
+	empty := true       // Whether nothing was read for the line
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		empty = empty && len(chunk) == 0
+		chunk, terminated := bytes.CutSuffix(chunk, []byte{'\n'})
+
+		// A CR before the newline (or the end of the body) is not part of the line, as with
+		// bufio.ScanLines
+		if terminated || errors.Is(err, io.EOF) {
+			if trimmed, ok := bytes.CutSuffix(chunk, []byte{'\r'}); ok {
+				chunk = trimmed
+			} else if len(chunk) == 0 && endsWithCR {
+				// The CR ended the previous chunk; it went to the line or, past the limit, was cut
+				if r.cut > 0 {
+					r.cut--
+				} else {
+					r.buf = r.buf[:len(r.buf)-1]
+				}
+			}
+		}
+		endsWithCR = len(chunk) > 0 && chunk[len(chunk)-1] == '\r'
+
+		fits := min(len(chunk), cap(r.buf)-len(r.buf))
+		r.buf = append(r.buf, chunk[:fits]...)
+		r.cut += len(chunk) - fits
+
+		switch {
+		case terminated:
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			// The last line may lack its newline
+			if empty {
+				return false
+			}
+			r.err = io.EOF
+		default:
+			r.err = err
+			return false
+		}
+		return true
+	}
+}
+
+func (r *jsonLinesReader) Bytes() []byte {
+	return r.buf
+}
+
+func (r *jsonLinesReader) Truncated() int {
+	return r.cut
+}
+
+func (r *jsonLinesReader) Err() error {
+	if errors.Is(r.err, io.EOF) {
+		return nil
+	}
+	return r.err
+}
+
+// truncationMarker ends a line cut to the maximum line size (OVERSIZED_LINE_ACTION=truncate)
+const truncationMarker = "...[truncated %d bytes]"
+
+// markTruncated appends the truncation marker to a line that lost cut bytes, first backing
+// off to a rune boundary so the line stays valid UTF-8
+func markTruncated(line []byte, cut int) []byte {
+	for i := len(line) - 1; i >= 0 && i >= len(line)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(line[i]) {
+			if !utf8.FullRune(line[i:]) {
+				cut += len(line) - i
+				line = line[:i]
+			}
+			break
+		}
+	}
+	return fmt.Appendf(line, truncationMarker, cut)
+}
+
+// cutTruncationMarker returns a line without its truncation marker, and whether it had one
+func cutTruncationMarker(line []byte) ([]byte, bool) {
+	if !bytes.HasSuffix(line, []byte(" bytes]")) {
+		return line, false
+	}
+	i := bytes.LastIndex(line, []byte("...[truncated "))
+	if i < 0 {
+		return line, false
+	}
+	if _, err := strconv.Atoi(string(line[i+len("...[truncated ") : len(line)-len(" bytes]")])); err != nil {
+		return line, false
+	}
+	return line[:i], true
+}
+
+// jsonValueReader reads an array of events, a single event or a sequence of events
+// Each event is yielded as one compact line, so pretty-printed events become valid entries
+type jsonValueReader struct {
+	reader  *bufio.Reader
+	decoder *json.Decoder
+	maxSize int
+	inArray bool
+	line    bytes.Buffer // Reused for every event
+	cut     int          // Bytes cut off the current event
+	err     error
+}
+
+func (r *jsonValueReader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.decoder == nil && !r.start() {
+		return false
+	}
+
+	if r.inArray && !r.decoder.More() {
+		// Consume the closing bracket so a truncated array is reported
+		if _, err := r.decoder.Token(); err != nil && !errors.Is(err, io.EOF) {
+			r.err = err
+		}
+		return false
+	}
+
+	var raw json.RawMessage
+	if err := r.decoder.Decode(&raw); err != nil {
+		if !errors.Is(err, io.EOF) || r.inArray {
+			r.err = err
+		}
+		return false
+	}
+
+	r.line.Reset()
+	if err := json.Compact(&r.line, raw); err != nil {
+		r.err = err
+		return false
+	}
+	r.cut = max(r.line.Len()-r.maxSize, 0)
+	r.line.Truncate(r.line.Len() - r.cut)
+	return true
+}
+
+// start detects whether the body is an array and sets up the decoder
+func (r *jsonValueReader) start() bool {
+	r.decoder = json.NewDecoder(r.reader)
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			// An empty body holds no events
+			if !errors.Is(err, io.EOF) {
+				r.err = err
+			}
+			return false
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		r.reader.UnreadByte()
+		if b == '[' {
+			r.inArray = true
+			if _, err := r.decoder.Token(); err != nil {
+				r.err = err
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (r *jsonValueReader) Bytes() []byte {
+	return r.line.Bytes()
+}
+
+func (r *jsonValueReader) Truncated() int {
+	return r.cut
+}
+
+func (r *jsonValueReader) Err() error {
+	return r.err
+}
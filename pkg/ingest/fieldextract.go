@@ -0,0 +1,227 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errUnexpectedEnd reports a JSON document that ends before it is complete
+var errUnexpectedEnd = errors.New("unexpected end of JSON input")
+
+// extractAuth0Fields reads the fields ParseAuth0 needs from an Auth0 log event
+// Unlike json.Unmarshal it stops as soon as they were found and never decodes the rest of
+// the event (details, user agent, ...), so the remainder of the line is not validated
+// For an event cut to the maximum line size (truncated), the fields found before the cut are
+// returned without error
+func extractAuth0Fields(raw []byte, truncated bool) (auth0Fields, error) {
+	var fields auth0Fields
+	s := jsonScanner{data: raw}
+	haveLogID, haveData := false, false
+
+	err := s.object(func(key []byte) (bool, error) {
+		var err error
+		switch string(key) {
+		case "log_id":
+			fields.LogID, err = s.stringValue()
+			haveLogID = true
+		case "data":
+			haveData = true
+			if s.peek() == 'n' {
+				return false, s.skipValue()
+			}
+			found := 0
+			err = s.object(func(key []byte) (bool, error) {
+				var err error
+				switch string(key) {
+				case "date":
+					fields.Data.Date, err = s.stringValue()
+				case "type":
+					fields.Data.Type, err = s.stringValue()
+				case "environment_name":
+					fields.Data.EnvironmentName, err = s.stringValue()
+				case "tenant_name":
+					fields.Data.TenantName, err = s.stringValue()
+				case "log_id":
+					fields.Data.LogID, err = s.stringValue()
+					return false, err
+				default:
+					return false, s.skipValue()
+				}
+				found++
+				// data.log_id is only the fallback for a missing top-level log_id
+				return err == nil && found == 4 && haveLogID, err
+			})
+		default:
+			err = s.skipValue()
+		}
+		return err == nil && haveLogID && haveData, err
+	})
+	if truncated && errors.Is(err, errUnexpectedEnd) {
+		err = nil
+	}
+	return fields, err
+}
+
+// jsonScanner walks a JSON document without decoding the values it skips
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *jsonScanner) errorf(format string, args ...any) error {
+	if s.pos >= len(s.data) {
+		return fmt.Errorf("%w (%s)", errUnexpectedEnd, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("invalid JSON at offset %d: %s", s.pos, fmt.Sprintf(format, args...))
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end of the document
+func (s *jsonScanner) peek() byte {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+// object walks the members of the object at the current position
+// member is called positioned at each value, must consume it and returns true to stop early,
+// which leaves the scanner inside the object
+func (s *jsonScanner) object(member func(key []byte) (bool, error)) error {
+	if s.peek() != '{' {
+		return s.errorf("expected object")
+	}
+	s.pos++
+	if s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		if s.peek() != '"' {
+			return s.errorf("expected object key")
+		}
+		key, _, err := s.rawString()
+		if err != nil {
+			return err
+		}
+		if s.peek() != ':' {
+			return s.errorf("expected colon after object key")
+		}
+		s.pos++
+		s.skipSpace()
+
+		stop, err := member(key)
+		if err != nil || stop {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected comma or end of object")
+		}
+	}
+}
+
+// rawString consumes the string at the current position and returns its undecoded contents
+func (s *jsonScanner) rawString() (contents []byte, escaped bool, err error) {
+	start := s.pos + 1
+	for i := start; i < len(s.data); i++ {
+		switch s.data[i] {
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			s.pos = i + 1
+			return s.data[start:i], escaped, nil
+		}
+	}
+	s.pos = len(s.data)
+	return nil, false, s.errorf("unterminated string")
+}
+
+// stringValue consumes a string (or null, which reads as "") and decodes it
+func (s *jsonScanner) stringValue() (string, error) {
+	switch s.peek() {
+	case '"':
+		start := s.pos
+		contents, escaped, err := s.rawString()
+		if err != nil {
+			return "", err
+		}
+		if !escaped {
+			return string(contents), nil
+		}
+		var value string
+		if err := json.Unmarshal(s.data[start:s.pos], &value); err != nil {
+			return "", err
+		}
+		return value, nil
+	case 'n':
+		return "", s.skipValue()
+	default:
+		return "", s.errorf("expected string")
+	}
+}
+
+// skipValue consumes the value at the current position
+func (s *jsonScanner) skipValue() error {
+	switch s.peek() {
+	case '"':
+		_, _, err := s.rawString()
+		return err
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"':
+				if _, _, err := s.rawString(); err != nil {
+					return err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					s.pos++
+					return nil
+				}
+			}
+			s.pos++
+		}
+		return s.errorf("unterminated value")
+	case 0:
+		return s.errorf("expected value")
+	default:
+		// Number or literal
+		start := s.pos
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				if s.pos == start {
+					return s.errorf("unexpected character %q", s.data[s.pos])
+				}
+				return nil
+			}
+			s.pos++
+		}
+		return nil
+	}
+}
@@ -0,0 +1,692 @@
+// Package ingest receives deliveries of log events over HTTP and queues them as entries
+// A Handler reads a body in the format its Content-Type names, one event at a time, parses
+// the events and offers the entries to a Queue such as the EntryQueue of pkg/batch; the
+// service's authentication, processing hooks, quotas, delivery tracking and tracing plug in
+// through the small interfaces of this package
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// errEntryDropped is the delivery error of an entry that never reached the batcher
+var errEntryDropped = errors.New("entry channel is full")
+
+// Queue receives the entries of deliveries, such as a batch.EntryQueue
+type Queue interface {
+	// Offer queues an entry without blocking, reporting false when it was dropped
+	Offer(entry batch.Entry) bool
+}
+
+// Authorizer authenticates deliveries
+type Authorizer interface {
+	// Authorize returns the tenant a request is authenticated as and the client's IP
+	// On failure the error response is already written
+	Authorize(w http.ResponseWriter, r *http.Request, span Span, logger *slog.Logger) (tenant, clientIP string, ok bool)
+}
+
+// Processor prepares the entries of a tenant before they are queued, such as processing hooks
+type Processor interface {
+	// Process changes an entry in place and sets its OrgID; false drops the entry
+	Process(tenant string, entry *batch.Entry) bool
+}
+
+// Observer sees every accepted entry before it is queued, for metrics, alerts and live tails
+type Observer interface {
+	Observe(tenant string, entry batch.Entry)
+}
+
+// Quotas accounts for the lines of each tenant
+type Quotas interface {
+	// Admit returns the quota a tenant exceeded and when it may retry, or "" to accept its delivery
+	Admit(tenant string) (exceeded string, retryAfter time.Duration)
+	// Charge accounts for one line of size bytes
+	Charge(tenant string, size int)
+}
+
+// Delivery statuses passed to Deliveries.Track
+const (
+	Queued  = "queued"  // Accepted and waiting in the batcher
+	Dropped = "dropped" // Discarded before reaching the batcher (e.g. queue full)
+)
+
+// Deliveries tracks the delivery status of entries by log ID
+type Deliveries interface {
+	Track(entry batch.Entry, tenant, status string)
+}
+
+// Tracer traces deliveries
+type Tracer interface {
+	// StartRequest starts the server span of a request, continuing the caller's trace if any
+	StartRequest(name string, r *http.Request) Span
+}
+
+// Span is the span of one delivery, carried by its entries to the Loki push
+type Span interface {
+	Context() batch.SpanContext
+	SetAttribute(key string, value any)
+	SetError(err error)
+	End()
+}
+
+// Metrics counts the lines of deliveries that are not queued
+type Metrics interface {
+	// CountParseError counts a line of a tenant that failed to parse
+	CountParseError(tenant string)
+	// CountOversizedLine counts a line of a source above its maximum line size
+	CountOversizedLine(source string)
+	// CountClientDisconnect counts a delivery the client abandoned before it was answered
+	CountClientDisconnect()
+}
+
+// Settings configure a Handler
+type Settings struct {
+	ServiceName    string // service_name label of Auth0 entries
+	CanonicalJSON  bool   // Re-serialize lines with sorted keys and compact formatting
+	VerboseLogging bool   // Log the forwarding headers of every delivery
+
+	MaxLineSize       int            // Longest line accepted
+	MaxLineSizes      map[string]int // Longest line accepted per source, overriding MaxLineSize
+	MaxLines          int            // Lines accepted per request (0 = unlimited)
+	TruncateLines     bool           // Skip lines beyond MaxLines instead of rejecting the request
+	TruncateOversized bool           // Cut lines above the maximum line size instead of skipping them
+	MaxEntryAge       time.Duration  // Entries older than this are dead-lettered, or dropped (0 disables)
+
+	SyncDelivery bool          // Answer only after Loki acknowledged the entries
+	SyncTimeout  time.Duration // Longest wait for that acknowledgement
+
+	ParseWorkers int // Workers parsing large deliveries in parallel (0 parses on the request goroutine)
+
+	QueryLabels  []string // Query parameters added as labels
+	LabelHeader  string   // Header carrying key=value labels
+	HeaderLabels []string // Labels accepted from LabelHeader (empty ignores the header)
+}
+
+// Handler handles deliveries of log events, POST /logs for Auth0 log streams
+type Handler struct {
+	settings    Settings
+	authorizer  Authorizer
+	queue       Queue
+	lineBuffers *LineBufferPools
+	parsers     *ParsePool // Parallel parsing of large deliveries (nil parses inline)
+	metrics     Metrics
+	logger      *slog.Logger
+
+	tracer     Tracer                // nil disables tracing
+	processor  Processor             // nil queues entries as parsed
+	observer   Observer              // nil disables
+	quotas     Quotas                // nil accepts every delivery
+	deliveries Deliveries            // Recent delivery status by log_id (nil disables)
+	deadLetter batch.DeadLetter      // Keeps entries older than MaxEntryAge recoverable (nil drops them)
+	syncFlush  func(context.Context) // Pushes the queued entries before waiting for the acknowledgement (nil waits for the batchers)
+}
+
+// NewHandler creates a handler queueing the entries of the deliveries authorizer accepts
+// metrics may be nil
+func NewHandler(settings Settings, authorizer Authorizer, queue Queue, metrics Metrics, logger *slog.Logger) *Handler {
+	if metrics == nil {
+		metrics = noMetrics{}
+	}
+	return &Handler{
+		settings:    settings,
+		authorizer:  authorizer,
+		queue:       queue,
+		lineBuffers: NewLineBufferPools(settings.MaxLineSize, settings.MaxLineSizes),
+		parsers:     NewParsePool(settings.ParseWorkers),
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+// SetTracer traces deliveries, and the pushes of their entries
+// It must be called before the handler serves requests
+func (h *Handler) SetTracer(tracer Tracer) {
+	h.tracer = tracer
+}
+
+// SetProcessor runs processor on every entry before it is queued
+// It must be called before the handler serves requests
+func (h *Handler) SetProcessor(processor Processor) {
+	h.processor = processor
+}
+
+// SetObserver shows observer every entry before it is queued
+// It must be called before the handler serves requests
+func (h *Handler) SetObserver(observer Observer) {
+	h.observer = observer
+}
+
+// SetQuotas rejects the deliveries of tenants over their quotas and charges them for their lines
+// It must be called before the handler serves requests
+func (h *Handler) SetQuotas(quotas Quotas) {
+	h.quotas = quotas
+}
+
+// SetDeliveries tracks the delivery status of the entries queued
+// It must be called before the handler serves requests
+func (h *Handler) SetDeliveries(deliveries Deliveries) {
+	h.deliveries = deliveries
+}
+
+// SetDeadLetterQueue dead-letters the entries older than MaxEntryAge instead of dropping them
+// It must be called before the handler serves requests
+func (h *Handler) SetDeadLetterQueue(deadLetter batch.DeadLetter) {
+	h.deadLetter = deadLetter
+}
+
+// SetSyncFlush makes synchronous deliveries push their entries right away instead of waiting
+// for the batch to fill or time out, for serverless runtimes answering one request at a time
+// It must be called before the handler serves requests
+func (h *Handler) SetSyncFlush(flush func(context.Context)) {
+	h.syncFlush = flush
+}
+
+// LineBuffers returns the buffer pools holding the lines of deliveries, one maximum line size per source
+func (h *Handler) LineBuffers() *LineBufferPools {
+	return h.lineBuffers
+}
+
+// TooOld reports whether Loki would reject an entry as older than reject_old_samples_max_age
+func (h *Handler) TooOld(entry batch.Entry) bool {
+	return h.settings.MaxEntryAge > 0 && time.Since(time.Unix(0, entry.Timestamp)) > h.settings.MaxEntryAge
+}
+
+// DeadLetterOld writes the entries older than MaxEntryAge to the dead-letter queue as one batch,
+// where they can be replayed once Loki accepts them or exported with the failed pushes
+func (h *Handler) DeadLetterOld(entries []batch.Entry) {
+	if len(entries) == 0 || h.deadLetter == nil {
+		return
+	}
+	h.deadLetter.Add(batch.Streams(entries), fmt.Errorf("entries older than MAX_ENTRY_AGE_HOURS (%s), which Loki rejects", h.settings.MaxEntryAge))
+}
+
+// DeadLettering reports whether entries older than MaxEntryAge are dead-lettered rather than dropped
+func (h *Handler) DeadLettering() bool {
+	return h.deadLetter != nil
+}
+
+// ServeHTTP handles the HTTP request
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.ServeLogs(w, r, h.logger)
+}
+
+// ServeLogs handles a request of an Auth0 log stream, logging with logger
+// It returns the lines read, like Ingest
+func (h *Handler) ServeLogs(w http.ResponseWriter, r *http.Request, logger *slog.Logger) int {
+	// Auth0 probes a custom webhook when the stream is created; answer probes
+	// so the setup succeeds, but only accept log events through POST
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		logger.Info("Answered log stream validation probe", "method", r.Method)
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS, POST")
+		writeStreamCheck(w, "Ready to receive Auth0 log streams; deliver events with POST")
+		return 0
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return 0
+	}
+
+	return h.Ingest(w, r, "POST /logs", SourceAuth0, "Auth0 log event", func(line []byte, _ string) (batch.Entry, error) {
+		return h.ParseAuth0(line)
+	}, logger)
+}
+
+// LineParser turns one line of a delivery into an entry; tenant is the authenticated tenant
+// line is only valid during the call, so the entry must hold a copy
+type LineParser func(line []byte, tenant string) (batch.Entry, error)
+
+// Ingest authenticates a delivery, parses its lines with parse and queues the entries
+// eventKind names a valid line in the answer to a body without any
+// It returns the number of lines of a body read to the end, for the access log
+func (h *Handler) Ingest(w http.ResponseWriter, r *http.Request, spanName, source, eventKind string, parse LineParser, logger *slog.Logger) int {
+	// The request span continues the caller's trace and is carried by every entry to the Loki push
+	var span Span = noSpan{}
+	if h.tracer != nil {
+		span = h.tracer.StartRequest(spanName, r)
+	}
+	defer span.End()
+
+	tenant, clientIP, ok := h.authorizer.Authorize(w, r, span, logger)
+	if !ok {
+		return 0
+	}
+
+	if h.settings.VerboseLogging {
+		logger.Info("Processing log stream",
+			"tenant", tenant,
+			"client_ip", clientIP,
+			"remote_addr", r.RemoteAddr,
+			"x_forwarded_for", r.Header.Get("X-Forwarded-For"),
+		)
+	} else {
+		logger.Info("Processing log stream",
+			"tenant", tenant,
+			"client_ip", clientIP,
+		)
+	}
+
+	// Allowlisted query parameters and header labels become labels of every entry of the delivery
+	extraLabels, err := h.requestLabels(r)
+	if err != nil {
+		logger.Warn("Rejecting log stream with invalid request labels",
+			"tenant", tenant,
+			"error", err,
+		)
+		writeErrorDetail(w, http.StatusBadRequest, "invalid_label", err.Error())
+		return 0
+	}
+
+	// Quotas are checked once per delivery, before any line is queued
+	if h.quotas != nil {
+		if exceeded, retryAfter := h.quotas.Admit(tenant); exceeded != "" {
+			RejectOverQuota(w, tenant, exceeded, retryAfter, logger)
+			return 0
+		}
+	}
+
+	// The Content-Type selects the parser; anything that cannot hold log events is refused
+	defer r.Body.Close()
+	format, err := bodyFormat(r.Header.Get("Content-Type"))
+	if err != nil {
+		logger.Warn("Rejecting log stream with unsupported content type",
+			"tenant", tenant,
+			"error", err,
+		)
+		writeErrorDetail(w, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			fmt.Sprintf("%v; send %s", err, supportedContentTypes))
+		return 0
+	}
+
+	// Stream the body one event at a time instead of loading it into memory
+	// The buffer holds the largest line accepted for the source and is reused across requests
+	buf := h.lineBuffers.Get(source)
+	defer h.lineBuffers.Put(buf)
+	scanner := newLineReader(format, r.Body, *buf)
+
+	// In synchronous mode the response waits for Loki to acknowledge every queued entry
+	var ack *batch.DeliveryAck
+	if h.settings.SyncDelivery {
+		ack = batch.NewDeliveryAck()
+	}
+
+	// The request context is canceled when the client goes away (e.g. Auth0 timing out
+	// the delivery on its side), so stop reading the dead connection as soon as it is
+	ctx := r.Context()
+
+	lineCount := 0
+	errorCount := 0
+	parseErrorCount := 0
+	var firstParseErr error
+	tooOldCount := 0
+	var tooOldEntries []batch.Entry // Dead-lettered once the request is handled
+	hookDroppedCount := 0
+	droppedCount := 0
+	enqueuedCount := 0
+	truncatedCount := 0
+	oversizedCount := 0
+
+	// handle applies everything after parsing to one line, in line order; it returns false
+	// when the delivery was rejected and the response is already written
+	handle := func(lineNumber, size int, entry batch.Entry, err error) bool {
+		if err != nil {
+			errorCount++
+			parseErrorCount++
+			if firstParseErr == nil {
+				firstParseErr = fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			h.metrics.CountParseError(tenant)
+			logger.Warn("Failed to parse log line",
+				"error", err,
+				"line_number", lineNumber,
+			)
+			return true
+		}
+
+		// Loki rejects samples older than reject_old_samples_max_age with a 400 that
+		// fails the whole push, so such entries are not pushed; with a dead-letter queue
+		// they are labeled like the others and kept there, otherwise dropped here
+		tooOld := h.TooOld(entry)
+		if tooOld {
+			logger.Debug("Not pushing log line older than max entry age",
+				"line_number", lineNumber,
+				"timestamp", time.Unix(0, entry.Timestamp).UTC().Format(time.RFC3339Nano),
+				"max_entry_age", h.settings.MaxEntryAge.String(),
+			)
+			if h.deadLetter == nil {
+				tooOldCount++
+				return true
+			}
+		} else if h.quotas != nil {
+			h.quotas.Charge(tenant, size)
+		}
+
+		for name, value := range extraLabels {
+			entry.Labels[name] = value
+		}
+		// Processing sees the request labels and may override them; the authenticated tenant,
+		// not the event's tenant_name, selects the Loki tenant
+		if h.processor != nil && !h.processor.Process(tenant, &entry) {
+			hookDroppedCount++
+			return true
+		}
+		if tooOld {
+			tooOldCount++
+			tooOldEntries = append(tooOldEntries, entry)
+			return true
+		}
+		entry.Trace = span.Context()
+		entry.Ack = ack
+		if h.observer != nil {
+			h.observer.Observe(tenant, entry)
+		}
+
+		// Send to batching worker via channel
+		// This is non-blocking as long as the channel has capacity
+		ack.Add()
+		if h.queue.Offer(entry) {
+			enqueuedCount++
+			h.track(entry, tenant, Queued)
+		} else {
+			// Channel (and spill queue, if any) is full - this shouldn't happen with proper buffering
+			logger.Error("Entry channel is full, dropping log line",
+				"line_number", lineNumber,
+			)
+			h.track(entry, tenant, Dropped)
+			ack.Done(errEntryDropped)
+			errorCount++
+			droppedCount++
+		}
+		return true
+	}
+
+	// Rejecting a delivery above the line limit must leave nothing of it queued, or a retry
+	// would duplicate its first lines; parsed lines are thus held until the body was read
+	type heldLine struct {
+		lineNumber, size int
+		entry            batch.Entry
+		err              error
+	}
+	var held []heldLine
+	accept := handle
+	if h.settings.MaxLines > 0 && !h.settings.TruncateLines {
+		accept = func(lineNumber, size int, entry batch.Entry, err error) bool {
+			held = append(held, heldLine{lineNumber, size, entry, err})
+			return true
+		}
+	}
+
+	// With a parse pool, lines are collected into chunks that are parsed in parallel and
+	// then handled in order, so the outcome is the same as parsing them one by one
+	var chunk *lineChunk
+	var results []parseResult
+	if h.parsers != nil {
+		chunk = &lineChunk{}
+	}
+	flush := func() bool {
+		results = h.parsers.Parse(chunk, tenant, parse, results)
+		for i, result := range results {
+			if !accept(chunk.first+i, len(chunk.Line(i)), result.entry, result.err) {
+				return false
+			}
+		}
+		chunk.Reset()
+		return true
+	}
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// The line stays in the reader's buffer; only lines that parse are copied into an entry
+		line := scanner.Bytes()
+
+		// Skip empty lines
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		lineCount++
+
+		// Pathological payloads must not flood the queue; when rejected, none of the held lines are queued
+		if h.settings.MaxLines > 0 && lineCount > h.settings.MaxLines {
+			if h.settings.TruncateLines {
+				truncatedCount++
+				continue
+			}
+			h.rejectTooManyLines(w, tenant, logger)
+			return 0
+		}
+
+		// Lines above the maximum line size are skipped or cut instead of failing the delivery
+		if cut := scanner.Truncated(); cut > 0 {
+			oversizedCount++
+			h.metrics.CountOversizedLine(source)
+			if !h.settings.TruncateOversized {
+				errorCount++
+				logger.Warn("Skipping log line above max line size",
+					"line_number", lineCount,
+					"bytes", len(line)+cut,
+					"max_line_size", len(line),
+				)
+				continue
+			}
+			logger.Warn("Truncating log line above max line size",
+				"line_number", lineCount,
+				"bytes", len(line)+cut,
+				"max_line_size", len(line),
+			)
+			line = markTruncated(line, cut)
+		}
+
+		if chunk != nil {
+			chunk.Add(lineCount, line)
+			if chunk.Len() == parseChunkLines && !flush() {
+				return 0
+			}
+			continue
+		}
+
+		// Parse the JSON line to extract required fields
+		entry, err := parse(line, tenant)
+		if !accept(lineCount, len(line), entry, err) {
+			return 0
+		}
+	}
+
+	// Lines read before the client went away are delivered, as without a parse pool
+	if chunk != nil && chunk.Len() > 0 && !flush() {
+		return 0
+	}
+	for _, line := range held {
+		if !handle(line.lineNumber, line.size, line.entry, line.err) {
+			return 0
+		}
+	}
+
+	// A client that aborted the delivery gets no response; it will redeliver the batch
+	if err := scanner.Err(); ctx.Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		h.metrics.CountClientDisconnect()
+		logger.Warn("Client disconnected before the log stream was fully read",
+			"tenant", tenant,
+			"client_ip", clientIP,
+			"lines_processed", lineCount,
+			"errors", errorCount,
+		)
+		return lineCount
+	}
+
+	// Check for scanner errors
+	if err := scanner.Err(); err != nil {
+		logger.Error("Error reading request body",
+			"error", err,
+			"tenant", tenant,
+		)
+		writeError(w, http.StatusBadRequest, "error_reading_body")
+		return 0
+	}
+
+	span.SetAttribute("lines_processed", lineCount)
+	span.SetAttribute("errors", errorCount)
+	span.SetAttribute("too_old", tooOldCount)
+
+	logger.Info("Finished processing log stream",
+		"tenant", tenant,
+		"lines_processed", lineCount,
+		"errors", errorCount,
+		"too_old", tooOldCount,
+		"dropped_by_hooks", hookDroppedCount,
+	)
+
+	if tooOldCount > 0 {
+		h.DeadLetterOld(tooOldEntries)
+		logger.Warn("Did not push log lines older than max entry age",
+			"tenant", tenant,
+			"count", tooOldCount,
+			"max_entry_age", h.settings.MaxEntryAge.String(),
+			"dead_lettered", h.deadLetter != nil,
+		)
+	}
+
+	// An empty delivery is a validation ping; it passed authentication, so confirm the setup
+	if lineCount == 0 {
+		logger.Info("Answered log stream validation ping", "tenant", tenant)
+		writeStreamCheck(w, fmt.Sprintf("Authenticated as tenant %q, ready to receive log events", tenant))
+		return lineCount
+	}
+
+	if truncatedCount > 0 {
+		logger.Warn("Truncated log stream above max lines per request",
+			"tenant", tenant,
+			"max_lines", h.settings.MaxLines,
+			"truncated", truncatedCount,
+		)
+	}
+
+	// A body without a single valid event is a misconfigured upstream (wrong content type,
+	// an HTML error page, ...); failing it surfaces the problem in Auth0's stream health
+	if lineCount > truncatedCount && parseErrorCount == lineCount-truncatedCount {
+		logger.Warn("Rejecting log stream without any valid log line",
+			"tenant", tenant,
+			"lines", lineCount,
+			"content_type", r.Header.Get("Content-Type"),
+			"error", firstParseErr,
+		)
+		writeErrorDetail(w, http.StatusBadRequest, "no_valid_lines",
+			fmt.Sprintf("none of the %d lines is a valid %s; first error: %v", lineCount, eventKind, firstParseErr))
+		return lineCount
+	}
+
+	// The summary shows the operator of the Auth0 stream whether lines are being skipped
+	summary := Summary{
+		LinesReceived: int64(lineCount),
+		LinesEnqueued: int64(enqueuedCount),
+		ParseErrors:   int64(parseErrorCount),
+		Filtered:      int64(tooOldCount + hookDroppedCount),
+		Dropped:       int64(droppedCount),
+		Truncated:     int64(truncatedCount),
+		Oversized:     int64(oversizedCount),
+	}
+
+	if h.settings.SyncDelivery {
+		h.respondWhenDelivered(w, r, ack, summary, logger)
+		return lineCount
+	}
+
+	// Return 202 Accepted (we don't wait for Loki to acknowledge)
+	WriteSummary(w, http.StatusAccepted, summary)
+	return lineCount
+}
+
+// track records the delivery status of an entry
+func (h *Handler) track(entry batch.Entry, tenant, status string) {
+	if h.deliveries != nil {
+		h.deliveries.Track(entry, tenant, status)
+	}
+}
+
+// rejectTooManyLines answers a request that exceeds the max lines per request
+func (h *Handler) rejectTooManyLines(w http.ResponseWriter, tenant string, logger *slog.Logger) {
+	logger.Warn("Rejecting log stream above max lines per request",
+		"tenant", tenant,
+		"max_lines", h.settings.MaxLines,
+	)
+	writeErrorDetail(w, http.StatusRequestEntityTooLarge, "too_many_lines",
+		fmt.Sprintf("at most %d lines are accepted per request", h.settings.MaxLines))
+}
+
+// RejectOverQuota answers a request of a tenant that exceeded one of its quotas
+func RejectOverQuota(w http.ResponseWriter, tenant, quota string, retryAfter time.Duration, logger *slog.Logger) {
+	logger.Warn("Rejecting log stream above tenant quota",
+		"tenant", tenant,
+		"quota", quota,
+		"retry_after", retryAfter.String(),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	writeErrorDetail(w, http.StatusTooManyRequests, "quota_exceeded",
+		fmt.Sprintf("tenant %q exceeded its %s quota", tenant, quota))
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for the Retry-After header
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// respondWhenDelivered answers a synchronous delivery once Loki has acknowledged its entries
+// Any entry that was dropped or failed to push fails the whole request so that Auth0 redelivers it
+func (h *Handler) respondWhenDelivered(w http.ResponseWriter, r *http.Request, ack *batch.DeliveryAck, summary Summary, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.settings.SyncTimeout)
+	defer cancel()
+
+	if h.syncFlush != nil {
+		h.syncFlush(ctx)
+	}
+	err := ack.Wait(ctx)
+	switch {
+	case r.Context().Err() != nil:
+		// The client gave up waiting; it will redeliver the batch
+		h.metrics.CountClientDisconnect()
+		logger.Warn("Client disconnected while waiting for Loki to acknowledge the log stream")
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Error("Timed out waiting for Loki to acknowledge the log stream",
+			"timeout", h.settings.SyncTimeout.String(),
+		)
+		writeError(w, http.StatusGatewayTimeout, "delivery_timeout")
+	case err != nil || summary.Dropped > 0:
+		logger.Error("Log stream not delivered to Loki, asking the client to retry",
+			"error", err,
+			"dropped", summary.Dropped,
+		)
+		writeError(w, http.StatusServiceUnavailable, "delivery_failed")
+	default:
+		// Every entry is stored in Loki
+		WriteSummary(w, http.StatusOK, summary)
+	}
+}
+
+// noSpan is the span of deliveries without a tracer
+type noSpan struct{}
+
+func (noSpan) Context() batch.SpanContext { return batch.SpanContext{} }
+func (noSpan) SetAttribute(string, any)   {}
+func (noSpan) SetError(error)             {}
+func (noSpan) End()                       {}
+
+// noMetrics counts nothing, for handlers created without metrics
+type noMetrics struct{}
+
+func (noMetrics) CountParseError(string)    {}
+func (noMetrics) CountOversizedLine(string) {}
+func (noMetrics) CountClientDisconnect()    {}
@@ -0,0 +1,73 @@
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRequestLabelValue bounds label values taken from a request
+const maxRequestLabelValue = 256
+
+// requestLabels returns the labels a delivery adds to all of its entries
+// Only allowlisted query parameters are used; other parameters (tenant, ...) are ignored
+// Labels from the label header are set last, so a proxy's tags win over the client's query
+func (h *Handler) requestLabels(r *http.Request) (map[string]string, error) {
+	queryLabels, labelHeader, headerLabels := h.settings.QueryLabels, h.settings.LabelHeader, h.settings.HeaderLabels
+	if len(queryLabels) == 0 && len(headerLabels) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string)
+	query := r.URL.Query()
+	for _, name := range queryLabels {
+		if !query.Has(name) {
+			continue
+		}
+		value := query.Get(name)
+		if err := validateRequestLabelValue(value); err != nil {
+			return nil, fmt.Errorf("query parameter %q: %w", name, err)
+		}
+		labels[name] = value
+	}
+
+	if len(headerLabels) > 0 {
+		for _, header := range r.Header.Values(labelHeader) {
+			for _, pair := range strings.Split(header, ",") {
+				pair = strings.TrimSpace(pair)
+				if pair == "" {
+					continue
+				}
+				name, value, ok := strings.Cut(pair, "=")
+				name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+				if !ok {
+					return nil, fmt.Errorf("%s: %q is not key=value", labelHeader, pair)
+				}
+				if !slices.Contains(headerLabels, name) {
+					return nil, fmt.Errorf("%s: label %q is not allowed", labelHeader, name)
+				}
+				if err := validateRequestLabelValue(value); err != nil {
+					return nil, fmt.Errorf("%s: label %q: %w", labelHeader, name, err)
+				}
+				labels[name] = value
+			}
+		}
+	}
+	return labels, nil
+}
+
+// validateRequestLabelValue rejects values that would create unusable streams
+func validateRequestLabelValue(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty label value")
+	}
+	if len(value) > maxRequestLabelValue {
+		return fmt.Errorf("label value longer than %d bytes", maxRequestLabelValue)
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("label value is not valid UTF-8")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package ingest
+
+import "sync"
+
+// LineBufferPools hands out scanner buffers sized for each ingestion source
+// Buffers are reused across requests instead of allocating the maximum line size every time
+type LineBufferPools struct {
+	defaultSize int
+	sizes       map[string]int
+
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+// NewLineBufferPools creates buffer pools with per-source maximum line sizes
+func NewLineBufferPools(defaultSize int, sizes map[string]int) *LineBufferPools {
+	return &LineBufferPools{
+		defaultSize: defaultSize,
+		sizes:       sizes,
+		pools:       make(map[int]*sync.Pool),
+	}
+}
+
+// MaxLineSize returns the maximum line size for a source
+func (p *LineBufferPools) MaxLineSize(source string) int {
+	if size, ok := p.sizes[source]; ok {
+		return size
+	}
+	return p.defaultSize
+}
+
+// Get returns a buffer whose capacity is the maximum line size for the source
+// The buffer must be returned with Put once the scanner using it is done
+func (p *LineBufferPools) Get(source string) *[]byte {
+	return p.pool(p.MaxLineSize(source)).Get().(*[]byte)
+}
+
+// Put returns a buffer obtained from Get
+func (p *LineBufferPools) Put(buf *[]byte) {
+	p.pool(cap(*buf)).Put(buf)
+}
+
+// pool returns the pool for buffers of the given size
+func (p *LineBufferPools) pool(size int) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool, ok := p.pools[size]
+	if !ok {
+		pool = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		p.pools[size] = pool
+	}
+	return pool
+}
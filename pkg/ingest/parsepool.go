@@ -0,0 +1,115 @@
+package ingest
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+const (
+	// parseChunkLines is how many lines of a delivery are collected before they are parsed together
+	parseChunkLines = 512
+	// minLinesPerParseWorker keeps small deliveries (and small chunk tails) from being split
+	// into jobs that cost more to hand over than to parse
+	minLinesPerParseWorker = 64
+)
+
+// ParsePool parses the lines of large deliveries on several cores
+// The workers are shared by all requests, so the CPU used for parsing stays bounded
+type ParsePool struct {
+	workers int
+	jobs    chan func()
+}
+
+// NewParsePool starts workers that live as long as the process; workers <= 0 returns nil,
+// which keeps parsing on the request goroutine
+func NewParsePool(workers int) *ParsePool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &ParsePool{workers: workers, jobs: make(chan func())}
+	for range workers {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// parseResult is the outcome of parsing one line of a chunk
+type parseResult struct {
+	entry batch.Entry
+	err   error
+}
+
+// Parse parses the lines of a chunk in parallel and returns the results in line order
+// results is reused for the returned slice when it is large enough
+func (p *ParsePool) Parse(chunk *lineChunk, tenant string, parse LineParser, results []parseResult) []parseResult {
+	n := chunk.Len()
+	results = slices.Grow(results[:0], n)[:n]
+
+	parseRange := func(start, end int) {
+		for i := start; i < end; i++ {
+			results[i].entry, results[i].err = parse(chunk.Line(i), tenant)
+		}
+	}
+
+	parts := min(p.workers, n/minLinesPerParseWorker)
+	if parts <= 1 {
+		parseRange(0, n)
+		return results
+	}
+
+	var wg sync.WaitGroup
+	size := (n + parts - 1) / parts
+	for start := 0; start < n; start += size {
+		end := min(start+size, n)
+		wg.Add(1)
+		p.jobs <- func() {
+			defer wg.Done()
+			parseRange(start, end)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// lineChunk holds copies of consecutive lines of a delivery, taken out of the reader's
+// buffer so they stay valid while the reader moves on
+type lineChunk struct {
+	data  []byte
+	ends  []int // End offset of each line in data
+	first int   // Line number of the first line
+}
+
+// Add copies a line into the chunk
+func (c *lineChunk) Add(lineNumber int, line []byte) {
+	if len(c.ends) == 0 {
+		c.first = lineNumber
+	}
+	c.data = append(c.data, line...)
+	c.ends = append(c.ends, len(c.data))
+}
+
+// Len returns the number of lines in the chunk
+func (c *lineChunk) Len() int {
+	return len(c.ends)
+}
+
+// Line returns the i-th line of the chunk
+func (c *lineChunk) Line(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = c.ends[i-1]
+	}
+	return c.data[start:c.ends[i]]
+}
+
+// Reset empties the chunk, keeping its memory for the next lines
+func (c *lineChunk) Reset() {
+	c.data = c.data[:0]
+	c.ends = c.ends[:0]
+}
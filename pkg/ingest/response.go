@@ -0,0 +1,59 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Summary accounts for every line of a delivery, the IngestSummary of the OpenAPI document
+type Summary struct {
+	LinesReceived int64 `json:"lines_received"` // Non-empty lines in the body
+	LinesEnqueued int64 `json:"lines_enqueued"` // Lines queued for delivery to Loki
+	ParseErrors   int64 `json:"parse_errors"`   // Lines that are not valid events
+	Filtered      int64 `json:"filtered"`       // Lines skipped on purpose, e.g. older than MAX_ENTRY_AGE_HOURS
+	Dropped       int64 `json:"dropped"`        // Lines lost because the entry channel was full
+	Truncated     int64 `json:"truncated"`      // Lines beyond MAX_LINES_PER_REQUEST (MAX_LINES_ACTION=truncate)
+	Oversized     int64 `json:"oversized"`      // Lines above the maximum line size, skipped or cut per OVERSIZED_LINE_ACTION
+}
+
+// WriteSummary writes the per-request ingestion summary
+func WriteSummary(w http.ResponseWriter, statusCode int, summary Summary) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// streamCheck answers Auth0's log stream validation requests, the StreamCheckResponse of the OpenAPI document
+type streamCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// writeStreamCheck answers a validation request of the stream setup
+func writeStreamCheck(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(streamCheck{Status: "ok", Message: message})
+}
+
+// errorResponse is the body of an error, the ErrorResponse of the OpenAPI document
+type errorResponse struct {
+	Error  string `json:"error"`            // Error code, e.g. too_many_lines
+	Detail string `json:"detail,omitempty"` // Human-readable explanation, when available
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, statusCode int, errorMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorMsg})
+}
+
+// writeErrorDetail writes a JSON error response explaining the error
+func writeErrorDetail(w http.ResponseWriter, statusCode int, errorMsg, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false) // Details often quote the offending input, e.g. '<'
+	encoder.Encode(errorResponse{Error: errorMsg, Detail: detail})
+}
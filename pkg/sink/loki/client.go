@@ -0,0 +1,389 @@
+package loki
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// Client handles sending batches to Loki
+// It implements batch.Pusher
+type Client struct {
+	client      *http.Client
+	baseURL     string
+	credentials Credentials   // Optional basic auth credentials
+	auth        Authenticator // Authenticates requests instead of basic auth (nil disables)
+	orgID       string        // X-Scope-OrgID of requests not bound to a tenant (empty sends none)
+	gzip        bool          // gzip-compress push bodies
+	logger      *slog.Logger
+
+	lastPush atomic.Pointer[PushResult] // Result of the most recent push, for readiness
+
+	// Dry-run mode: push payloads are written here, one JSON document per line, instead of being sent
+	dryRunMu  sync.Mutex
+	dryRunOut io.Writer
+}
+
+// Credentials supplies the basic auth credentials of a client, which may change at runtime
+type Credentials interface {
+	// BasicAuth returns the current username and password ("" sends no basic auth)
+	BasicAuth() (username, password string)
+}
+
+// Authenticator authenticates requests in place of basic auth, e.g. with a signature or token
+type Authenticator interface {
+	// Authenticate adds the credentials to req; body is the exact request body, which a signature covers
+	Authenticate(ctx context.Context, req *http.Request, body []byte) error
+}
+
+// Invalidator is implemented by authenticators caching credentials that Loki may reject before
+// they expire; a push Loki answers with 401 invalidates them and is retried once
+type Invalidator interface {
+	Invalidate()
+}
+
+// PushResult is the outcome of one push
+type PushResult struct {
+	At  time.Time
+	Err error
+}
+
+// NewClient creates a new Loki client sending requests through httpClient
+// credentials may be nil when Loki requires no basic auth
+func NewClient(baseURL string, httpClient *http.Client, credentials Credentials, logger *slog.Logger) *Client {
+	return &Client{
+		client:      httpClient,
+		baseURL:     baseURL,
+		credentials: credentials,
+		logger:      logger,
+	}
+}
+
+// SetAuthenticator authenticates every request with auth instead of basic auth
+func (lc *Client) SetAuthenticator(auth Authenticator) {
+	lc.auth = auth
+}
+
+// SetOrgID sets the X-Scope-OrgID of batches without their own and of probes and queries
+func (lc *Client) SetOrgID(orgID string) {
+	lc.orgID = orgID
+}
+
+// SetGzip gzip-compresses push bodies
+func (lc *Client) SetGzip(enabled bool) {
+	lc.gzip = enabled
+}
+
+// SetDryRun makes Push write each payload to w instead of sending it to Loki
+func (lc *Client) SetDryRun(w io.Writer) {
+	lc.dryRunMu.Lock()
+	defer lc.dryRunMu.Unlock()
+	lc.dryRunOut = w
+}
+
+// dryRun reports whether dry-run mode is on
+func (lc *Client) dryRun() bool {
+	lc.dryRunMu.Lock()
+	defer lc.dryRunMu.Unlock()
+	return lc.dryRunOut != nil
+}
+
+// writeDryRun writes a push payload to the dry-run output, reporting whether dry-run mode is on
+func (lc *Client) writeDryRun(payload []byte) (bool, error) {
+	lc.dryRunMu.Lock()
+	defer lc.dryRunMu.Unlock()
+	if lc.dryRunOut == nil {
+		return false, nil
+	}
+	if _, err := lc.dryRunOut.Write(append(payload, '\n')); err != nil {
+		return true, fmt.Errorf("failed to write dry-run output: %w", err)
+	}
+	return true, nil
+}
+
+// Push sends a batch of log entries to Loki
+// The batches map contains entries grouped by their label set
+func (lc *Client) Push(ctx context.Context, batches map[string]*batch.Batch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+
+	err := lc.push(ctx, batches)
+	// A token revoked before it expired has been dropped; retry once with a new one
+	var statusErr *batch.StatusError
+	if _, ok := lc.auth.(Invalidator); ok && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+		err = lc.push(ctx, batches)
+	}
+	lc.lastPush.Store(&PushResult{At: time.Now(), Err: err})
+	return err
+}
+
+// push builds and sends the push request
+func (lc *Client) push(ctx context.Context, batches map[string]*batch.Batch) error {
+	// Encode the payload into a pooled buffer, which the request body returns when closed
+	body := getPushBuffer()
+	encodePushRequest(body, batches)
+
+	if dryRun, err := lc.writeDryRun(body.Bytes()); dryRun {
+		putPushBuffer(body)
+		return err
+	}
+
+	// Auth0 events repeat the same keys and values, so they compress very well
+	if lc.gzip {
+		compressed := getPushBuffer()
+		err := gzipPayload(compressed, body.Bytes())
+		putPushBuffer(body)
+		if err != nil {
+			putPushBuffer(compressed)
+			return err
+		}
+		body = compressed
+	}
+
+	// Create the HTTP request
+	url := lc.baseURL + "/loki/api/v1/push"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, newPooledBody(body))
+	if err != nil {
+		putPushBuffer(body)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(body.Len())
+
+	// All batches of a push belong to one Loki tenant
+	var orgID string
+	for _, b := range batches {
+		orgID = b.OrgID
+		break
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if lc.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if err := lc.setAuth(ctx, req, body.Bytes(), orgID); err != nil {
+		req.Body.Close()
+		return err
+	}
+	if sc, ok := batch.TraceFromContext(ctx); ok {
+		req.Header.Set("traceparent", sc.Traceparent())
+	}
+
+	// Send the request
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to Loki: %w", err)
+	}
+	defer resp.Body.Close()
+	lc.observeStatus(resp.StatusCode)
+
+	// Check response status
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Keep enough of the body to parse rejections
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 8192))
+		return &batch.StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Body:       string(body),
+		}
+	}
+
+	return nil
+}
+
+// ForwardResult is Loki's answer to a forwarded push
+type ForwardResult struct {
+	Status     int
+	RetryAfter string // Retry-After header
+	Body       []byte // Start of the response body
+}
+
+// Forward sends a native push payload unchanged to Loki with the client's credentials
+// and the X-Scope-OrgID orgID; unlike Push, any answer from Loki is a result rather than an error
+func (lc *Client) Forward(ctx context.Context, payload []byte, contentType, contentEncoding, orgID string) (*ForwardResult, error) {
+	// Only JSON payloads are readable in the dry-run output, protobuf ones are dropped
+	if contentEncoding == "" && strings.HasPrefix(contentType, "application/json") {
+		if dryRun, err := lc.writeDryRun(payload); dryRun {
+			return &ForwardResult{Status: http.StatusNoContent}, err
+		}
+	} else if lc.dryRun() {
+		return &ForwardResult{Status: http.StatusNoContent}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lc.baseURL+"/loki/api/v1/push", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if err := lc.setAuth(ctx, req, payload, orgID); err != nil {
+		return nil, err
+	}
+	if sc, ok := batch.TraceFromContext(ctx); ok {
+		req.Header.Set("traceparent", sc.Traceparent())
+	}
+
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to Loki: %w", err)
+	}
+	defer resp.Body.Close()
+	lc.observeStatus(resp.StatusCode)
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 8192))
+	return &ForwardResult{
+		Status:     resp.StatusCode,
+		RetryAfter: resp.Header.Get("Retry-After"),
+		Body:       body,
+	}, nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// setAuth adds the authenticator's credentials or basic auth if configured, and the X-Scope-OrgID orgID or the client's default
+// body is the exact request body, which a signature may cover
+func (lc *Client) setAuth(ctx context.Context, req *http.Request, body []byte, orgID string) error {
+	if orgID = cmp.Or(orgID, lc.orgID); orgID != "" {
+		req.Header.Set("X-Scope-OrgID", orgID)
+	}
+	if lc.auth != nil {
+		return lc.auth.Authenticate(ctx, req, body)
+	}
+	if lc.credentials == nil {
+		return nil
+	}
+	if username, password := lc.credentials.BasicAuth(); username != "" && password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	return nil
+}
+
+// observeStatus drops cached credentials that Loki rejected, so the next request fetches new ones
+func (lc *Client) observeStatus(status int) {
+	if invalidator, ok := lc.auth.(Invalidator); ok && status == http.StatusUnauthorized {
+		invalidator.Invalidate()
+	}
+}
+
+// LastPush returns the result of the most recent push, or nil if nothing was pushed yet
+func (lc *Client) LastPush() *PushResult {
+	return lc.lastPush.Load()
+}
+
+// Probe checks that Loki is reachable and accepts the configured credentials
+// It calls the lightweight build info endpoint instead of pushing data
+func (lc *Client) Probe(ctx context.Context) error {
+	// Nothing is sent in dry-run mode, so Loki's state does not matter
+	if lc.dryRun() {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lc.baseURL+"/loki/api/v1/status/buildinfo", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := lc.setAuth(ctx, req, nil, ""); err != nil {
+		return err
+	}
+
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Loki: %w", err)
+	}
+	defer resp.Body.Close()
+	lc.observeStatus(resp.StatusCode)
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &batch.StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// LogMatch is a log line found by a Loki query
+type LogMatch struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// FindLine searches Loki for the most recent line in the selected streams containing needle
+// Returns nil when no line matches in the time range
+// orgID selects the Loki tenant searched ("" uses the client's default)
+func (lc *Client) FindLine(ctx context.Context, orgID, selector, needle string, start, end time.Time) (*LogMatch, error) {
+	query := url.Values{}
+	query.Set("query", selector+" |= "+strconv.Quote(needle))
+	query.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	query.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	query.Set("limit", "1")
+	query.Set("direction", "backward")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lc.baseURL+"/loki/api/v1/query_range?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := lc.setAuth(ctx, req, nil, orgID); err != nil {
+		return nil, err
+	}
+
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send query to Loki: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("Loki returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Data struct {
+			Result []Stream `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse Loki query response: %w", err)
+	}
+
+	for _, stream := range result.Data.Result {
+		if len(stream.Values) == 0 || len(stream.Values[0]) == 0 {
+			continue
+		}
+		ns, err := strconv.ParseInt(stream.Values[0][0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp in Loki query response: %w", err)
+		}
+		return &LogMatch{Timestamp: time.Unix(0, ns).UTC(), Labels: stream.Stream}, nil
+	}
+	return nil, nil
+}
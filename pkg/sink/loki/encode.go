@@ -0,0 +1,112 @@
+package loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// maxPooledPushBuffer bounds the buffers kept for reuse, so one huge push does not pin its memory
+const maxPooledPushBuffer = 16 * 1024 * 1024
+
+// pushBuffers reuses the buffers push payloads are encoded and compressed into
+var pushBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getPushBuffer returns an empty buffer from the pool
+func getPushBuffer() *bytes.Buffer {
+	buf := pushBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putPushBuffer returns a buffer to the pool; its contents must no longer be used
+func putPushBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledPushBuffer {
+		pushBuffers.Put(buf)
+	}
+}
+
+// pooledBody is a request body that returns its buffer to the pool when closed
+// The transport may read the body after Do returned, but always closes it when done
+type pooledBody struct {
+	*bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putPushBuffer(b.buf) })
+	return nil
+}
+
+// gzipWriters reuses compressors, which allocate large internal tables
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// gzipPayload writes the gzip-compressed payload to dst
+func gzipPayload(dst *bytes.Buffer, payload []byte) error {
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(dst)
+	if _, err := gz.Write(payload); err != nil {
+		return fmt.Errorf("failed to compress Loki payload: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress Loki payload: %w", err)
+	}
+	return nil
+}
+
+// encodePushRequest writes the JSON push payload of batches to buf
+// The output matches json.Marshal of a PushRequest (except that HTML characters are
+// not escaped) without building the intermediate streams and value arrays
+func encodePushRequest(buf *bytes.Buffer, batches map[string]*batch.Batch) {
+	buf.WriteString(`{"streams":[`)
+	first := true
+	for _, batch := range batches {
+		if len(batch.Entries) == 0 {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+
+		buf.WriteString(`{"stream":{`)
+		for i, name := range slices.Sorted(maps.Keys(batch.Labels)) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(AppendJSONString(buf.AvailableBuffer(), name))
+			buf.WriteByte(':')
+			buf.Write(AppendJSONString(buf.AvailableBuffer(), batch.Labels[name]))
+		}
+
+		buf.WriteString(`},"values":[`)
+		for i, entry := range batch.Entries {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(`["`)
+			buf.Write(strconv.AppendInt(buf.AvailableBuffer(), entry.Timestamp, 10))
+			buf.WriteString(`",`)
+			buf.Write(AppendJSONString(buf.AvailableBuffer(), entry.Line))
+			buf.WriteByte(']')
+		}
+		buf.WriteString(`]}`)
+	}
+	buf.WriteString(`]}`)
+}
@@ -0,0 +1,73 @@
+// Package loki is the Loki sink of the pipeline: a Client pushing batches to Loki's push API
+// (/loki/api/v1/push) and the wire format of that API, shared by the service, its mock Loki
+// and programs embedding the pipeline
+package loki
+
+import "unicode/utf8"
+
+// Stream is one stream of a push request: its labels and its entries
+type Stream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]string        `json:"values"` // [timestamp_ns, line]
+}
+
+// PushRequest is the JSON payload of a push
+type PushRequest struct {
+	Streams []Stream `json:"streams"`
+}
+
+const hexDigits = "0123456789abcdef"
+
+// AppendJSONString appends s as a JSON string, escaping like encoding/json
+// apart from HTML characters; invalid UTF-8 becomes U+FFFD
+func AppendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			dst = append(dst, s[start:i]...)
+			dst = utf8.AppendRune(dst, utf8.RuneError)
+		case r == '\u2028' || r == '\u2029':
+			// Valid JSON, but escaped by encoding/json for JavaScript consumers
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
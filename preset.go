@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Presets of PRESET
+const presetGrafanaCloud = "grafana-cloud"
+
+// grafanaCloudZonePattern matches Grafana Cloud zones, e.g. prod-eu-west-0 or prod-us-central-0
+var grafanaCloudZonePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// grafanaCloudMaxLineSize is the longest log line Grafana Cloud Logs accepts
+const grafanaCloudMaxLineSize = 256 * 1024
+
+// applyPreset sets the variables a preset derives in the environment, before the configuration
+// is read from it; variables set in the environment, or set through their _FILE variant, win
+func applyPreset(preset, zone, apiKey string) error {
+	var values map[string]string
+	switch preset {
+	case "":
+		return nil
+	case presetGrafanaCloud:
+		var err error
+		if values, err = grafanaCloudPreset(zone, apiKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown PRESET %q (expected %s)", preset, presetGrafanaCloud)
+	}
+
+	for key, value := range values {
+		if _, inEnv := os.LookupEnv(key); inEnv {
+			continue
+		}
+		if _, inEnv := os.LookupEnv(key + "_FILE"); inEnv {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grafanaCloudPreset derives the settings of a Grafana Cloud Logs stack from its zone and an
+// API key of the form <user>:<token>, the User and a token of the stack's Loki details page
+// The user, Loki's tenant in Grafana Cloud, is both the basic auth username and the org ID;
+// pushes are gzip-compressed and batched for a remote endpoint
+func grafanaCloudPreset(zone, apiKey string) (map[string]string, error) {
+	zone = strings.TrimPrefix(strings.ToLower(zone), "logs-")
+	if zone == "" || apiKey == "" {
+		return nil, fmt.Errorf("PRESET=%s requires GRAFANA_CLOUD_ZONE and GRAFANA_CLOUD_API_KEY", presetGrafanaCloud)
+	}
+	if !grafanaCloudZonePattern.MatchString(zone) {
+		return nil, fmt.Errorf("invalid GRAFANA_CLOUD_ZONE %q (e.g. prod-eu-west-0)", zone)
+	}
+	user, token, ok := strings.Cut(apiKey, ":")
+	if _, err := strconv.ParseUint(user, 10, 64); !ok || err != nil || token == "" {
+		return nil, fmt.Errorf("GRAFANA_CLOUD_API_KEY must be <user>:<token>, with the numeric User of the stack's Loki details page")
+	}
+
+	return map[string]string{
+		"LOKI_URL":       "https://logs-" + zone + ".grafana.net",
+		"LOKI_USERNAME":  user,
+		"LOKI_PASSWORD":  token,
+		"LOKI_ORG_ID":    user,
+		"LOKI_GZIP":      "true",
+		"BATCH_SIZE":     "1000",
+		"BATCH_FLUSH_MS": "1000",
+		"MAX_LINE_SIZE":  strconv.Itoa(grafanaCloudMaxLineSize),
+	}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// secretConfigFields are the Config fields holding credentials, shown as [REDACTED] when set
+var secretConfigFields = []string{
+	"LokiPassword",
+	"LokiOAuth2ClientSecret",
+	"HMACSecrets",
+	"CustomAuthTokens",
+	"DiskEncryptionKey",
+	"VaultToken",
+	"RemoteConfigToken",
+	"GrafanaCloudAPIKey",
+	"AdminToken",
+}
+
+// headerConfigFields are the Config fields of name=value headers, whose values may be credentials
+var headerConfigFields = []string{"OTLPHeaders", "RemoteWriteHeaders"}
+
+// effectiveConfig returns the configuration as indented JSON, fields in declaration order,
+// with credentials redacted: secrets, header values, passwords and query strings of URLs
+// (SAS tokens), and the URLs and routing keys of alert targets
+func effectiveConfig(cfg *Config) ([]byte, error) {
+	v := reflect.ValueOf(cfg).Elem()
+	var buf bytes.Buffer
+	// URLs read better with & and < > left as they are
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case slices.Contains(secretConfigFields, field.Name):
+			value = redactSecretValue(value)
+		case slices.Contains(headerConfigFields, field.Name):
+			value = redactHeaderValues(value.([]string))
+		case field.Name == "AlertRules":
+			value = redactAlertTargets(cfg.AlertRules)
+		case field.Type.Kind() == reflect.String:
+			value = redactURLCredentials(value.(string))
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + field.Name + `":`)
+		// Encode appends a newline, which Indent drops
+		if err := encoder.Encode(value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+// serveEffectiveConfig serves GET /admin/config, the redacted configuration rendered at
+// startup; settings changed at runtime (e.g. PUT /admin/batching) are not reflected
+func serveEffectiveConfig(body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// redactSecretValue replaces a set secret, or each secret of a list, keeping whether and how many are set
+func redactSecretValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return redactedValue
+		}
+	case []string:
+		redacted := make([]string, len(v))
+		for i := range v {
+			redacted[i] = redactedValue
+		}
+		return redacted
+	}
+	return value
+}
+
+// redactHeaderValues keeps the names of name=value headers and replaces their values
+func redactHeaderValues(headers []string) []string {
+	redacted := make([]string, len(headers))
+	for i, header := range headers {
+		name, _, _ := strings.Cut(header, "=")
+		redacted[i] = name + "=" + redactedValue
+	}
+	return redacted
+}
+
+// redactURLCredentials replaces the password and query values of a URL; other strings are returned unchanged
+func redactURLCredentials(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			params[i] = name + "=" + redactedValue
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	// Unescape the placeholder url.URL.String escaped in the password
+	return strings.ReplaceAll(u.String(), url.PathEscape(redactedValue), redactedValue)
+}
+
+// redactAlertTargets hides the webhook URLs of alert targets past their host, since a Slack
+// incoming webhook URL is a credential, and their PagerDuty routing keys
+func redactAlertTargets(rules []AlertRule) []AlertRule {
+	redacted := slices.Clone(rules)
+	for i := range redacted {
+		target := &redacted[i].Target
+		if u, err := url.Parse(target.URL); err == nil && u.Host != "" {
+			target.URL = u.Scheme + "://" + u.Host + "/" + redactedValue
+		}
+		target.RoutingKey = redactSecretValue(target.RoutingKey).(string)
+	}
+	return redacted
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY header
+const proxyHeaderTimeout = 10 * time.Second
+
+// ProxyProtocolListener wraps a listener and parses PROXY protocol v1/v2 headers,
+// so the client address seen behind a TCP load balancer (HAProxy, AWS NLB) feeds the IP checks
+// Headers are required from connections whose peer is in trustedProxies (or from every
+// connection when trustedProxies is empty); other connections are served unchanged
+type ProxyProtocolListener struct {
+	net.Listener
+	trustedProxies []netip.Prefix
+	logger         *slog.Logger
+}
+
+// NewProxyProtocolListener wraps ln with PROXY protocol parsing
+func NewProxyProtocolListener(ln net.Listener, trustedProxies []string, logger *slog.Logger) *ProxyProtocolListener {
+	prefixes, _ := parseIPPrefixes(trustedProxies)
+	return &ProxyProtocolListener{
+		Listener:       ln,
+		trustedProxies: prefixes,
+		logger:         logger,
+	}
+}
+
+// Accept waits for the next connection
+// The header is parsed lazily by the connection so a slow client cannot block the accept loop
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(l.trustedProxies) > 0 {
+		peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !ipInPrefixes(peer, l.trustedProxies) {
+			return conn, nil
+		}
+	}
+
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		logger: l.logger,
+	}, nil
+}
+
+// proxyProtocolConn is a connection whose first bytes are a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	logger *slog.Logger
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// init reads the PROXY header once, on first use of the connection
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			c.err = err
+			c.logger.Warn("Rejected connection with invalid PROXY protocol header",
+				"peer", c.Conn.RemoteAddr().String(),
+				"error", err,
+			)
+			c.Conn.Close()
+			return
+		}
+		c.remoteAddr = addr
+	})
+}
+
+// Read reads from the connection after the PROXY header
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address announced in the PROXY header
+// LOCAL connections (health checks from the proxy itself) keep the peer address
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader parses a v1 or v2 PROXY header
+// Returns a nil address for LOCAL/UNKNOWN connections
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	prefix, err := r.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if string(prefix) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, errors.New("connection did not start with a PROXY protocol header")
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The v1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", string(line))
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source port: %w", err)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyHeaderV2 parses the binary v2 header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	// LOCAL: the proxy's own connection (e.g. a health check), keep the peer address
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	// Any trailing TLVs after the addresses are ignored
+	switch family {
+	case 0x1: // AF_INET: src(4) dst(4) sport(2) dport(2)
+		if len(payload) < 12 {
+			return nil, errors.New("truncated PROXY v2 IPv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport(2) dport(2)
+		if len(payload) < 36 {
+			return nil, errors.New("truncated PROXY v2 IPv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16]))
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	default:
+		// AF_UNSPEC or AF_UNIX carry no usable client IP
+		return nil, nil
+	}
+}
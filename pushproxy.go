@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// maxProxyPushBytes bounds the body of a proxied push
+const maxProxyPushBytes = 16 << 20
+
+// PushProxy forwards native Loki push payloads from other agents (promtail, Alloy) to Loki
+// Clients authenticate like /logs deliveries; the push is sent with the service's Loki credentials
+// Payloads are forwarded unchanged, bypassing tenant quotas and label enforcement, so only the
+// trusted tenants given to NewPushProxy may use it
+type PushProxy struct {
+	logs    *LogsHandler // Client IP checks, bans and authentication
+	loki    *loki.Client
+	tenants map[string]bool
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// NewPushProxy creates the push proxy for the given trusted tenants
+func NewPushProxy(logs *LogsHandler, loki *loki.Client, tenants []string, metrics *Metrics, logger *slog.Logger) *PushProxy {
+	allowed := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		allowed[tenant] = true
+	}
+	return &PushProxy{logs: logs, loki: loki, tenants: allowed, metrics: metrics, logger: logger}
+}
+
+// ServeHTTP forwards one push and relays Loki's answer
+func (p *PushProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r, p.logger)
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+
+	span := p.logs.tracer.StartFromRequest("POST /loki/api/v1/push", r)
+	defer span.End()
+
+	tenant, _, ok := p.logs.authorize(w, r, span, logger)
+	if !ok {
+		return
+	}
+	if !p.tenants[tenant] {
+		logger.Warn("Rejected push from a tenant not allowed to use the push proxy", "tenant", tenant)
+		writeJSONError(w, http.StatusForbidden, "proxy_not_allowed")
+		return
+	}
+
+	// The payload is forwarded untouched, so it is read whole (promtail sends snappy-compressed protobuf)
+	defer r.Body.Close()
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProxyPushBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large")
+			return
+		}
+		logger.Warn("Failed to read proxied push", "tenant", tenant, "error", err)
+		writeJSONError(w, http.StatusBadRequest, "error_reading_body")
+		return
+	}
+
+	// The agent's own X-Scope-OrgID is ignored so a tenant can only write to its mapped Loki tenant
+	orgID := p.logs.orgIDs.For(tenant)
+	result, err := p.loki.Forward(batch.ContextWithTrace(r.Context(), span.Context()), payload, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), orgID)
+	if err != nil {
+		span.SetError(err)
+		p.metrics.proxyPushes.Inc(tenant, "error")
+		logger.Error("Failed to forward push to Loki",
+			"tenant", tenant,
+			"bytes", len(payload),
+			"error", err,
+		)
+		writeJSONError(w, http.StatusBadGateway, "loki_unreachable")
+		return
+	}
+
+	p.metrics.proxyPushes.Inc(tenant, strconv.Itoa(result.Status))
+	logger.Debug("Forwarded push to Loki",
+		"tenant", tenant,
+		"bytes", len(payload),
+		"status", result.Status,
+	)
+
+	// Relay Loki's answer so agents apply their own retry and backoff
+	if result.RetryAfter != "" {
+		w.Header().Set("Retry-After", result.RetryAfter)
+	}
+	if len(result.Body) > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(result.Status)
+	w.Write(result.Body)
+}
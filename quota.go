@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantQuota limits a tenant's ingestion; zero values are unlimited
+type TenantQuota struct {
+	LinesPerDay    int64   `json:"lines_per_day"`
+	BytesPerDay    int64   `json:"bytes_per_day"`
+	LinesPerSecond float64 `json:"lines_per_second"`
+}
+
+// Quotas a tenant can exceed, reported in errors and metrics
+const (
+	quotaLinesPerDay    = "lines_per_day"
+	quotaBytesPerDay    = "bytes_per_day"
+	quotaLinesPerSecond = "lines_per_second"
+)
+
+// quotasFile is the file configured by QUOTAS_FILE
+type quotasFile struct {
+	Tenants map[string]TenantQuota `json:"tenants"`
+}
+
+// loadQuotasFile reads per-tenant quotas, which replace the default quota of those tenants
+func loadQuotasFile(path string) (map[string]TenantQuota, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quotas file: %w", err)
+	}
+	var file quotasFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse quotas file: %w", err)
+	}
+	for tenant, quota := range file.Tenants {
+		if quota.LinesPerDay < 0 || quota.BytesPerDay < 0 || quota.LinesPerSecond < 0 {
+			return nil, fmt.Errorf("quotas file: tenant %q has a negative quota", tenant)
+		}
+	}
+	return file.Tenants, nil
+}
+
+// tenantUsage is the ingestion of one tenant
+type tenantUsage struct {
+	day        string // UTC day the daily counters belong to
+	linesToday int64
+	bytesToday int64
+	linesTotal int64
+	bytesTotal int64
+	rejected   int64 // Deliveries rejected
+
+	tokens     float64 // Lines-per-second bucket; negative after a delivery larger than the bucket
+	refilledAt time.Time
+}
+
+// QuotaTracker accounts the lines and bytes each tenant sends and enforces their quotas
+// Counters are kept in memory per replica and start over when the service restarts
+type QuotaTracker struct {
+	defaultQuota TenantQuota
+	quotas       map[string]TenantQuota // Per-tenant quotas replacing the default
+	metrics      *Metrics
+	now          func() time.Time
+
+	mu      sync.Mutex
+	usage   map[string]*tenantUsage
+	started time.Time
+}
+
+// NewQuotaTracker creates a tracker with a default quota and per-tenant quotas
+func NewQuotaTracker(defaultQuota TenantQuota, quotas map[string]TenantQuota, metrics *Metrics) *QuotaTracker {
+	return &QuotaTracker{
+		defaultQuota: defaultQuota,
+		quotas:       quotas,
+		metrics:      metrics,
+		now:          time.Now,
+		usage:        make(map[string]*tenantUsage),
+		started:      time.Now(),
+	}
+}
+
+// quota returns the quota of a tenant
+func (q *QuotaTracker) quota(tenant string) TenantQuota {
+	if quota, ok := q.quotas[tenant]; ok {
+		return quota
+	}
+	return q.defaultQuota
+}
+
+// tenantUsage returns the usage of a tenant, starting new daily counters at UTC midnight
+// The caller holds q.mu
+func (q *QuotaTracker) tenantUsage(tenant string, now time.Time) *tenantUsage {
+	usage, ok := q.usage[tenant]
+	if !ok {
+		usage = &tenantUsage{refilledAt: now, tokens: q.quota(tenant).LinesPerSecond}
+		q.usage[tenant] = usage
+	}
+	if day := now.UTC().Format(time.DateOnly); usage.day != day {
+		usage.day = day
+		usage.linesToday = 0
+		usage.bytesToday = 0
+	}
+	return usage
+}
+
+// Admit checks a delivery of a tenant against its quotas before any of its lines is queued,
+// and returns the exceeded quota and when to retry
+// An admitted delivery is accepted whole: its lines are charged with Charge and may overshoot
+// the quotas, which then hold back the next deliveries. Splitting a delivery instead would
+// queue part of it and have Auth0 redeliver all of it, cut at the same line every time
+func (q *QuotaTracker) Admit(tenant string) (exceeded string, retryAfter time.Duration) {
+	if q == nil {
+		return "", 0
+	}
+	now := q.now()
+	quota := q.quota(tenant)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.tenantUsage(tenant, now)
+	q.refill(usage, quota, now)
+
+	switch {
+	case quota.LinesPerDay > 0 && usage.linesToday >= quota.LinesPerDay:
+		exceeded = quotaLinesPerDay
+	case quota.BytesPerDay > 0 && usage.bytesToday >= quota.BytesPerDay:
+		exceeded = quotaBytesPerDay
+	case quota.LinesPerSecond > 0 && usage.tokens < 1:
+		usage.rejected++
+		q.metrics.quotaRejections.Inc(tenant, quotaLinesPerSecond)
+		wait := time.Duration((1 - usage.tokens) / quota.LinesPerSecond * float64(time.Second))
+		return quotaLinesPerSecond, max(wait, time.Second)
+	default:
+		return "", 0
+	}
+	usage.rejected++
+	q.metrics.quotaRejections.Inc(tenant, exceeded)
+	midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return exceeded, midnight.Sub(now)
+}
+
+// Charge accounts one line of an admitted delivery
+func (q *QuotaTracker) Charge(tenant string, size int) {
+	if q == nil {
+		return
+	}
+	now := q.now()
+	quota := q.quota(tenant)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.tenantUsage(tenant, now)
+	if quota.LinesPerSecond > 0 {
+		q.refill(usage, quota, now)
+		usage.tokens--
+	}
+	usage.linesToday++
+	usage.bytesToday += int64(size)
+	usage.linesTotal++
+	usage.bytesTotal += int64(size)
+	q.metrics.tenantLines.Inc(tenant)
+	q.metrics.tenantBytes.Add(float64(size), tenant)
+}
+
+// refill adds the lines-per-second tokens earned since the last refill, up to one second's worth
+// The caller holds q.mu
+func (q *QuotaTracker) refill(usage *tenantUsage, quota TenantQuota, now time.Time) {
+	if quota.LinesPerSecond <= 0 {
+		return
+	}
+	elapsed := now.Sub(usage.refilledAt).Seconds()
+	usage.tokens = min(quota.LinesPerSecond, usage.tokens+elapsed*quota.LinesPerSecond)
+	usage.refilledAt = now
+}
+
+// ServeHTTP serves GET /usage, the ingestion of every tenant for chargeback
+func (q *QuotaTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := q.now()
+
+	q.mu.Lock()
+	tenants := make([]TenantUsage, 0, len(q.usage))
+	for tenant := range q.usage {
+		usage := q.tenantUsage(tenant, now)
+		quota := q.quota(tenant)
+		tenants = append(tenants, TenantUsage{
+			Tenant:              tenant,
+			LinesToday:          usage.linesToday,
+			BytesToday:          usage.bytesToday,
+			LinesTotal:          usage.linesTotal,
+			BytesTotal:          usage.bytesTotal,
+			Rejected:            usage.rejected,
+			QuotaLinesPerDay:    quota.LinesPerDay,
+			QuotaBytesPerDay:    quota.BytesPerDay,
+			QuotaLinesPerSecond: quota.LinesPerSecond,
+		})
+	}
+	q.mu.Unlock()
+	slices.SortFunc(tenants, func(a, b TenantUsage) int {
+		return strings.Compare(a.Tenant, b.Tenant)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UsageResponse{
+		Day:     now.UTC().Format(time.DateOnly),
+		Since:   q.started.UTC(),
+		Tenants: tenants,
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+)
+
+// Readiness windows: a push this recent decides readiness on its own,
+// otherwise Loki is probed and the probe result reused for a while
+const (
+	readinessPushWindow   = 30 * time.Second
+	readinessProbeTTL     = 10 * time.Second
+	readinessProbeTimeout = 5 * time.Second
+)
+
+// ReadinessHandler serves /ready, reporting whether logs can currently be delivered to Loki
+type ReadinessHandler struct {
+	lokiClient   *loki.Client
+	shuttingDown atomic.Bool
+	draining     atomic.Bool
+
+	mu         sync.Mutex
+	probedAt   time.Time
+	probeError error
+}
+
+// NewReadinessHandler creates a readiness handler backed by the Loki client
+func NewReadinessHandler(lokiClient *loki.Client) *ReadinessHandler {
+	return &ReadinessHandler{lokiClient: lokiClient}
+}
+
+// SetShuttingDown makes the service report not ready so orchestrators stop routing traffic to it
+func (h *ReadinessHandler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// SetDraining reports not ready while /admin/drain empties the service
+func (h *ReadinessHandler) SetDraining(draining bool) {
+	h.draining.Store(draining)
+}
+
+// ServeHTTP responds 200 when ready and 503 otherwise
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reason := h.check()
+
+	w.Header().Set("Content-Type", "application/json")
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ReadinessResponse{Status: "not_ready", Reason: reason})
+		return
+	}
+	json.NewEncoder(w).Encode(ReadinessResponse{Status: "ready"})
+}
+
+// check returns why the service is not ready, or "" if it is
+func (h *ReadinessHandler) check() string {
+	if h.shuttingDown.Load() {
+		return "shutting_down"
+	}
+	if h.draining.Load() {
+		return "draining"
+	}
+
+	// A recent push tells us more than a probe would
+	if last := h.lokiClient.LastPush(); last != nil && time.Since(last.At) < readinessPushWindow {
+		if last.Err != nil {
+			return "loki_push_failed: " + last.Err.Error()
+		}
+		return ""
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.probedAt) > readinessProbeTTL {
+		// Not tied to the request, so a client hanging up never gets cached as a Loki failure
+		probeCtx, cancel := context.WithTimeout(context.Background(), readinessProbeTimeout)
+		h.probeError = h.lokiClient.Probe(probeCtx)
+		cancel()
+		h.probedAt = time.Now()
+	}
+	if h.probeError != nil {
+		return "loki_unreachable: " + h.probeError.Error()
+	}
+	return ""
+}
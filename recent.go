@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedValue replaces the values of sensitive fields in /admin/recent
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeyParts are the parts of field names whose values are redacted, matched case-insensitively
+var sensitiveKeyParts = []string{"password", "passwd", "secret", "token", "authorization", "cookie", "credential", "apikey", "api_key", "private_key"}
+
+// RecentEntries keeps the last accepted entries in a ring buffer for GET /admin/recent,
+// answering "is anything arriving at all?" without access to Loki
+// A nil buffer keeps nothing
+type RecentEntries struct {
+	auth    *AuthChain
+	metrics *Metrics
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	entries []TailEntry // Ring in arrival order
+	next    int
+	full    bool
+}
+
+// NewRecentEntries creates a ring buffer of the last capacity entries, served to requests
+// authenticated by authChain
+func NewRecentEntries(capacity int, authChain *AuthChain, metrics *Metrics, logger *slog.Logger) *RecentEntries {
+	return &RecentEntries{
+		auth:    authChain,
+		metrics: metrics,
+		logger:  logger,
+		entries: make([]TailEntry, capacity),
+	}
+}
+
+// Add records an accepted entry, evicting the oldest once the buffer is full
+// Lines are stored as received and redacted when they are served
+func (b *RecentEntries) Add(tenant string, entry LogEntry) {
+	if b == nil {
+		return
+	}
+
+	recent := TailEntry{
+		Tenant:    tenant,
+		Source:    entry.Source,
+		Timestamp: time.Unix(0, entry.Timestamp).UTC(),
+		Labels:    maps.Clone(entry.Labels),
+		Line:      entry.Line,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = recent
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Recent returns up to limit of the tenant's entries, newest first
+func (b *RecentEntries) Recent(tenant string, limit int) []TailEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored := b.next
+	if b.full {
+		stored = len(b.entries)
+	}
+	result := []TailEntry{}
+	for i := 1; i <= stored && len(result) < limit; i++ {
+		entry := b.entries[(b.next-i+len(b.entries))%len(b.entries)]
+		if entry.Tenant == tenant {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// ServeHTTP authenticates the tenant like /logs and lists its recent entries with the values
+// of sensitive fields redacted
+func (b *RecentEntries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r, b.logger)
+
+	tenant, failure := b.auth.authenticateRequest(w, r, logger)
+	if failure != "" {
+		// authenticateRequest already wrote the error response and logged the failure
+		b.metrics.authFailures.Inc(failure)
+		return
+	}
+
+	limit := len(b.entries)
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			writeJSONErrorDetail(w, http.StatusBadRequest, "invalid_limit", "limit must be a positive integer")
+			return
+		}
+		limit = min(n, limit)
+	}
+
+	entries := b.Recent(tenant, limit)
+	for i := range entries {
+		entries[i].Line = redactSecrets(entries[i].Line)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecentEntriesResponse{
+		Tenant:   tenant,
+		Capacity: int64(len(b.entries)),
+		Entries:  entries,
+	})
+}
+
+// redactSecrets replaces the values of sensitive fields of a JSON line, at any depth
+// Lines that are not JSON are returned unchanged
+func redactSecrets(line string) string {
+	var event any
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return line
+	}
+	if !redactValue(event) {
+		return line
+	}
+	redacted, err := json.Marshal(event)
+	if err != nil {
+		return line
+	}
+	return string(redacted)
+}
+
+// redactValue redacts the sensitive fields of a decoded JSON value in place
+// Returns whether anything was redacted
+func redactValue(value any) bool {
+	redacted := false
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if sensitiveKey(key) {
+				v[key] = redactedValue
+				redacted = true
+			} else if redactValue(field) {
+				redacted = true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if redactValue(item) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// sensitiveKey reports whether a field name looks like it holds a secret
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
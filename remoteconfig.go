@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// Remote configuration backends of REMOTE_CONFIG_BACKEND
+const (
+	remoteConfigConsul = "consul"
+	remoteConfigEtcd   = "etcd"
+)
+
+// remoteConfigWait bounds one blocking query or watch, after which it is renewed
+const remoteConfigWait = 5 * time.Minute
+
+// remoteConfigRetry is the pause after a failed watch before it is retried
+const remoteConfigRetry = 10 * time.Second
+
+// remoteSecretVars are the variables applied without a restart when they change; their
+// lowercase names are the keys of the secrets providers
+var remoteSecretVars = []string{"HMAC_SECRET", "CUSTOM_AUTH_TOKEN", "LOKI_USERNAME", "LOKI_PASSWORD", "LOKI_OAUTH2_CLIENT_SECRET"}
+
+// RemoteConfigSource reads the configuration document stored at a key of a KV store
+// Get returns the document and its version; given the version of an earlier call, it waits
+// until the key changes or the wait expires, returning that version again when unchanged
+type RemoteConfigSource interface {
+	Name() string
+	Get(ctx context.Context, after uint64) ([]byte, uint64, error)
+}
+
+// newRemoteConfigSource creates the source selected by REMOTE_CONFIG_BACKEND, or nil when none is
+func newRemoteConfigSource(backend, addr, key, token string) (RemoteConfigSource, error) {
+	if backend == "" {
+		return nil, nil
+	}
+	if addr == "" || key == "" {
+		return nil, fmt.Errorf("REMOTE_CONFIG_ADDR and REMOTE_CONFIG_KEY are required for the %s remote configuration", backend)
+	}
+	// Blocking queries and watches outlast any client timeout; requests are bound by their context
+	client := &http.Client{}
+	addr = strings.TrimRight(addr, "/")
+
+	switch strings.ToLower(backend) {
+	case remoteConfigConsul:
+		return &ConsulConfigSource{client: client, addr: addr, key: strings.Trim(key, "/"), token: token}, nil
+	case remoteConfigEtcd:
+		if token != "" {
+			return nil, fmt.Errorf("REMOTE_CONFIG_TOKEN is not supported for etcd")
+		}
+		return &EtcdConfigSource{client: client, addr: addr, key: key}, nil
+	default:
+		return nil, fmt.Errorf("unknown REMOTE_CONFIG_BACKEND %q (expected consul or etcd)", backend)
+	}
+}
+
+// RemoteConfig is the configuration loaded from a remote source at startup, watched for changes
+type RemoteConfig struct {
+	source  RemoteConfigSource
+	version uint64
+	applied map[string]string // Variables the document set, i.e. not overridden by the environment
+	restart bool              // Restart gracefully when a setting that needs it changes
+}
+
+// loadRemoteConfig fetches the document and sets its variables in the environment, before the
+// configuration is read from it; variables set in the environment win, those from the env file do not
+func loadRemoteConfig(ctx context.Context, source RemoteConfigSource, fromEnvFile map[string]bool, restart bool) (*RemoteConfig, error) {
+	document, version, err := source.Get(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch remote configuration from %s: %w", source.Name(), err)
+	}
+	values, err := parseRemoteConfig(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote configuration from %s: %w", source.Name(), err)
+	}
+
+	remote := &RemoteConfig{source: source, version: version, applied: make(map[string]string), restart: restart}
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set && !fromEnvFile[key] {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, fmt.Errorf("invalid remote configuration from %s: %w", source.Name(), err)
+		}
+		remote.applied[key] = value
+	}
+	return remote, nil
+}
+
+// parseRemoteConfig parses a document of KEY=VALUE lines, as in an env file, or a JSON object
+// of variables and their string values
+func parseRemoteConfig(document []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	if trimmed := bytes.TrimSpace(document); bytes.HasPrefix(trimmed, []byte("{")) {
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, err
+		}
+		for key := range values {
+			if !config.ValidKey(key) {
+				return nil, fmt.Errorf("invalid variable name %q", key)
+			}
+		}
+		return values, nil
+	}
+
+	for i, line := range strings.Split(string(document), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := config.ParseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Watch applies changes of the document until ctx is canceled: changed secrets are swapped into
+// store, other changed settings are logged and, with REMOTE_CONFIG_RESTART, restart the service
+// gracefully so it starts again with them (the process supervisor must restart it)
+// Secrets are swapped only when no secret files or secrets backend manage them
+func (r *RemoteConfig) Watch(ctx context.Context, cfg *Config, store *SecretStore, metrics *Metrics, logger *slog.Logger) {
+	hotSecrets := !cfg.hasSecretFiles() && cfg.secretsProvider == nil
+	for {
+		document, version, err := r.source.Get(ctx, r.version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && version != r.version {
+			err = r.apply(document, hotSecrets, store, metrics, logger)
+			r.version = version
+		}
+		if err != nil {
+			metrics.remoteConfigUpdates.Inc("failed")
+			logger.Warn("Failed to watch remote configuration, keeping current settings",
+				"backend", r.source.Name(),
+				"error", err,
+			)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(remoteConfigRetry):
+			}
+		}
+	}
+}
+
+// apply compares a changed document with the variables applied so far and acts on the changes
+func (r *RemoteConfig) apply(document []byte, hotSecrets bool, store *SecretStore, metrics *Metrics, logger *slog.Logger) error {
+	values, err := parseRemoteConfig(document)
+	if err != nil {
+		return fmt.Errorf("invalid remote configuration: %w", err)
+	}
+
+	// Only variables the document owns are compared; those set in the environment stay as they are
+	secretValues := make(map[string]string)
+	var restartVars []string
+	keys := slices.Sorted(maps.Keys(values))
+	for key := range r.applied {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key) // Removed from the document
+		}
+	}
+	for _, key := range keys {
+		value, ok := values[key]
+		previous, owned := r.applied[key]
+		if _, set := os.LookupEnv(key); set && !owned {
+			continue
+		}
+		if owned && ok && value == previous {
+			continue
+		}
+		if hotSecrets && slices.Contains(remoteSecretVars, key) {
+			secretValues[strings.ToLower(key)] = value
+		} else {
+			restartVars = append(restartVars, key)
+		}
+		if ok {
+			r.applied[key] = value
+		} else {
+			delete(r.applied, key)
+		}
+	}
+
+	if len(secretValues) > 0 {
+		current := store.Load()
+		updated := applyProviderSecrets(current, secretValues)
+		// Never swap in a configuration that would reject every request
+		if len(updated.HMACSecrets) == 0 && len(updated.CustomAuthTokens) == 0 && len(current.HMACSecrets)+len(current.CustomAuthTokens) > 0 {
+			logger.Error("Remote configuration contains no HMAC secret or custom token, keeping current secrets",
+				"backend", r.source.Name(),
+			)
+		} else if !secretsEqual(current, updated) {
+			store.Store(updated)
+			metrics.remoteConfigUpdates.Inc("applied")
+			logger.Info("Applied secrets from remote configuration",
+				"backend", r.source.Name(),
+				"hmac_secrets_count", len(updated.HMACSecrets),
+				"custom_auth_tokens_count", len(updated.CustomAuthTokens),
+				"loki_auth_enabled", updated.LokiUsername != "",
+			)
+		}
+	}
+
+	if len(restartVars) > 0 {
+		metrics.remoteConfigUpdates.Inc("restart")
+		if !r.restart {
+			logger.Warn("Remote configuration changed settings that take effect on the next restart",
+				"backend", r.source.Name(),
+				"variables", restartVars,
+			)
+			return nil
+		}
+		logger.Warn("Remote configuration changed settings that need a restart, shutting down gracefully",
+			"backend", r.source.Name(),
+			"variables", restartVars,
+		)
+		// Goes through the same graceful shutdown as a SIGTERM from the supervisor
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}
+	return nil
+}
+
+// ConsulConfigSource reads the configuration from a Consul KV key, watched with blocking queries
+type ConsulConfigSource struct {
+	client *http.Client
+	addr   string
+	key    string
+	token  string // ACL token (optional)
+}
+
+// Name returns the backend name for logging
+func (c *ConsulConfigSource) Name() string {
+	return remoteConfigConsul
+}
+
+// Get reads the key; with a previous index it is a blocking query returning once the key changes
+func (c *ConsulConfigSource) Get(ctx context.Context, after uint64) ([]byte, uint64, error) {
+	url := c.addr + "/v1/kv/" + c.key + "?raw"
+	if after > 0 {
+		url += fmt.Sprintf("&index=%d&wait=%ds", after, int(remoteConfigWait.Seconds()))
+	}
+	// The server may answer up to 1/16 later than the wait, for jitter
+	ctx, cancel := context.WithTimeout(ctx, remoteConfigWait+remoteConfigWait/16+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, fmt.Errorf("key %q not found", c.key)
+	default:
+		return nil, 0, fmt.Errorf("Consul returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Consul response without X-Consul-Index")
+	}
+	// An index going backwards (e.g. after a snapshot restore) restarts the blocking queries
+	if index < after {
+		index = 0
+	}
+	return body, index, nil
+}
+
+// EtcdConfigSource reads the configuration from an etcd v3 key through the JSON gateway,
+// watched with a watch stream
+type EtcdConfigSource struct {
+	client *http.Client
+	addr   string
+	key    string
+}
+
+// etcdKeyValue is a key of the etcd gateway; 64-bit integers are JSON strings
+type etcdKeyValue struct {
+	Value       string `json:"value"` // base64
+	ModRevision string `json:"mod_revision"`
+}
+
+// Name returns the backend name for logging
+func (e *EtcdConfigSource) Name() string {
+	return remoteConfigEtcd
+}
+
+// Get reads the key; with a previous revision it watches the key for the next change
+func (e *EtcdConfigSource) Get(ctx context.Context, after uint64) ([]byte, uint64, error) {
+	if after == 0 {
+		return e.get(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteConfigWait)
+	defer cancel()
+	resp, err := e.post(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.key)),
+			"start_revision": strconv.FormatUint(after+1, 10),
+		},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	// The gateway streams one JSON object per watch response
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Canceled        bool   `json:"canceled"`
+				CompactRevision string `json:"compact_revision"`
+				Events          []struct {
+					Type string       `json:"type"`
+					KV   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// The wait expired without a change
+				return nil, after, nil
+			}
+			return nil, 0, fmt.Errorf("etcd watch: %w", err)
+		}
+		if message.Result.Canceled {
+			// The revision was compacted away; read the key as it is now
+			return e.get(ctx)
+		}
+		if len(message.Result.Events) == 0 {
+			continue
+		}
+		event := message.Result.Events[len(message.Result.Events)-1]
+		if event.Type == "DELETE" {
+			return nil, 0, fmt.Errorf("key %q was deleted", e.key)
+		}
+		return decodeEtcdKeyValue(event.KV)
+	}
+}
+
+// get reads the current value of the key
+func (e *EtcdConfigSource) get(ctx context.Context) ([]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := e.post(ctx, "/v3/kv/range", map[string]any{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.key)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse etcd response: %w", err)
+	}
+	if len(result.KVs) == 0 {
+		return nil, 0, fmt.Errorf("key %q not found", e.key)
+	}
+	return decodeEtcdKeyValue(result.KVs[0])
+}
+
+// post sends a request to the JSON gateway, returning an error for non-2xx answers
+func (e *EtcdConfigSource) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.addr+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// decodeEtcdKeyValue returns the value of a key and the revision it was last modified at
+func decodeEtcdKeyValue(kv etcdKeyValue) ([]byte, uint64, error) {
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid etcd value: %w", err)
+	}
+	revision, err := strconv.ParseUint(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid etcd mod_revision %q", kv.ModRevision)
+	}
+	return value, revision, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// remoteWriteTimeout bounds one remote-write request, including the final one at shutdown
+const remoteWriteTimeout = 10 * time.Second
+
+// RemoteWriter periodically pushes the derived Auth0 metrics (tenant_* and security_events_total)
+// to a Prometheus remote-write endpoint such as Mimir, Thanos Receive or Grafana Cloud
+// Counters are sent as their cumulative values, so a failed push only loses resolution
+type RemoteWriter struct {
+	registry       *Registry
+	client         *http.Client
+	url            string // Basic auth credentials may be given as the URL's user info
+	headers        map[string]string
+	externalLabels []labelPair
+	metrics        *Metrics
+	logger         *slog.Logger
+}
+
+// NewRemoteWriter creates a remote writer for the registry's derived metrics
+func NewRemoteWriter(registry *Registry, url string, headers map[string]string, externalLabels []labelPair, metrics *Metrics, logger *slog.Logger) *RemoteWriter {
+	return &RemoteWriter{
+		registry:       registry,
+		client:         newOutboundClient(remoteWriteTimeout),
+		url:            url,
+		headers:        headers,
+		externalLabels: externalLabels,
+		metrics:        metrics,
+		logger:         logger,
+	}
+}
+
+// Run pushes the metrics every interval until ctx is canceled, then pushes once more
+func (w *RemoteWriter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The final values would otherwise be lost with the process
+			finalCtx, cancel := context.WithTimeout(context.Background(), remoteWriteTimeout)
+			w.push(finalCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			w.push(ctx)
+		}
+	}
+}
+
+// push sends the current values and logs a failure
+func (w *RemoteWriter) push(ctx context.Context) {
+	if err := w.Write(ctx, time.Now()); err != nil {
+		w.metrics.remoteWrites.Inc("failure")
+		w.logger.Warn("Failed to push metrics to remote-write endpoint",
+			"url", redactedURL(w.url),
+			"error", err,
+		)
+		return
+	}
+	w.metrics.remoteWrites.Inc("success")
+}
+
+// Write sends one remote-write request holding every derived series, stamped with now
+func (w *RemoteWriter) Write(ctx context.Context, now time.Time) error {
+	payload := w.encode(now.UnixMilli())
+	if len(payload) == 0 {
+		return nil
+	}
+	body := snappyEncodeLiteral(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("remote-write endpoint returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// remoteWriteMetric reports whether a metric is one of the derived Auth0 metrics
+func remoteWriteMetric(name string) bool {
+	name = strings.TrimPrefix(name, metricsNamespace)
+	return strings.HasPrefix(name, "tenant_") || name == "security_events_total"
+}
+
+// encode renders the derived series as a protobuf WriteRequest
+// Returns nil when there is no series to send
+func (w *RemoteWriter) encode(timestamp int64) []byte {
+	w.registry.mu.Lock()
+	metrics := append([]metric(nil), w.registry.metrics...)
+	w.registry.mu.Unlock()
+
+	var request []byte
+	for _, m := range metrics {
+		name, _, _ := m.describe()
+		if !remoteWriteMetric(name) {
+			continue
+		}
+		for _, s := range m.samples() {
+			labels := make([]labelPair, 0, len(s.labels)+len(w.externalLabels)+1)
+			labels = append(labels, labelPair{name: "__name__", value: name + s.suffix})
+			labels = append(labels, s.labels...)
+			for _, external := range w.externalLabels {
+				if !slices.ContainsFunc(labels, func(l labelPair) bool { return l.name == external.name }) {
+					labels = append(labels, external)
+				}
+			}
+			// Remote write requires the labels of a series sorted by name
+			slices.SortFunc(labels, func(a, b labelPair) int { return strings.Compare(a.name, b.name) })
+
+			var series []byte
+			for _, l := range labels {
+				// An empty value means the label is absent in Prometheus
+				if l.value == "" {
+					continue
+				}
+				var label []byte
+				label = protoAppendString(label, 1, l.name)
+				label = protoAppendString(label, 2, l.value)
+				series = protoAppendBytes(series, 1, label)
+			}
+			var sample []byte
+			sample = protoAppendTag(sample, 1, protoFixed64)
+			sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.value))
+			sample = protoAppendTag(sample, 2, protoVarint)
+			sample = binary.AppendUvarint(sample, uint64(timestamp))
+			series = protoAppendBytes(series, 2, sample)
+
+			request = protoAppendBytes(request, 1, series)
+		}
+	}
+	return request
+}
+
+// parseExternalLabels parses REMOTE_WRITE_EXTERNAL_LABELS (name=value pairs)
+func parseExternalLabels(entries []string) ([]labelPair, error) {
+	labels := make([]labelPair, 0, len(entries))
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid REMOTE_WRITE_EXTERNAL_LABELS entry %q (expected name=value)", entry)
+		}
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("REMOTE_WRITE_EXTERNAL_LABELS: invalid label name %q", name)
+		}
+		labels = append(labels, labelPair{name: name, value: strings.TrimSpace(value)})
+	}
+	return labels, nil
+}
+
+// Protobuf wire types used by the remote-write encoding
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// protoAppendTag appends a field tag
+func protoAppendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// protoAppendBytes appends a length-delimited field
+func protoAppendBytes(b []byte, field int, value []byte) []byte {
+	b = protoAppendTag(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// protoAppendString appends a string field
+func protoAppendString(b []byte, field int, value string) []byte {
+	b = protoAppendTag(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// snappyEncodeLiteral wraps src in the snappy block format as uncompressed literals
+// Remote write requires snappy; the derived series are small, so skipping the
+// compression keeps the service free of a compression library
+func snappyEncodeLiteral(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)+len(src)/65536*3+16), uint64(len(src)))
+	for len(src) > 0 {
+		chunk := src[:min(len(src), 65536)]
+		src = src[len(chunk):]
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n<<2))
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runReplay pushes an exported Auth0 log file (JSONL) to Loki through the normal parsing and batching pipeline
+// Service flags and environment variables configure Loki, labels and batching as they would for the service
+func runReplay(args []string) int {
+	file := flag.String("file", "", "JSONL file of Auth0 log events to replay (required)")
+	speed := flag.String("speed", "", "Replay at the pace of the event timestamps, sped up by this factor (e.g. 10x); as fast as possible when empty")
+
+	cfg, err := loadConfig(args, requireLoki)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "replay: -file is required")
+		return 2
+	}
+	factor, err := parseReplaySpeed(*speed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: parseLogLevel(cfg.LogLevel),
+	}))
+
+	f, err := os.Open(*file)
+	if err != nil {
+		logger.Error("Failed to open replay file", "error", err)
+		return 1
+	}
+	defer f.Close()
+
+	pipeline, err := startOfflinePipeline(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to start pipeline", "error", err)
+		return 1
+	}
+	replayLines(f, pipeline, factor, logger)
+	pipeline.Close()
+
+	pipeline.logResult("Replay finished", "file", *file)
+	if pipeline.Failed() {
+		return 1
+	}
+	return 0
+}
+
+// replayLines queues every line of f, pacing them by their timestamps when factor > 0
+func replayLines(f *os.File, pipeline *offlinePipeline, factor float64, logger *slog.Logger) {
+	scanner := bufio.NewScanner(f)
+	buf := pipeline.parser.LineBuffers().Get(sourceAuth0)
+	defer pipeline.parser.LineBuffers().Put(buf)
+	scanner.Buffer(*buf, len(*buf))
+
+	var started time.Time
+	var firstTimestamp int64
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, ok := pipeline.Parse(line)
+		if !ok {
+			continue
+		}
+
+		if factor > 0 {
+			if started.IsZero() {
+				started, firstTimestamp = time.Now(), entry.Timestamp
+			}
+			offset := time.Duration(float64(entry.Timestamp-firstTimestamp) / factor)
+			if wait := time.Until(started.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		pipeline.Queue(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("Failed to read replay file", "error", err, "line_number", pipeline.lines)
+		pipeline.parseErrors++
+	}
+}
+
+// parseReplaySpeed parses a speed factor such as "10x" or "0.5"; empty means no pacing
+func parseReplaySpeed(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "x"), 64)
+	if err != nil || factor <= 0 {
+		return 0, fmt.Errorf("invalid -speed %q (expected a positive factor such as 10x)", s)
+	}
+	return factor, nil
+}
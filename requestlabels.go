@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// reservedLabels are set from the events themselves and cannot be overridden per request
+var reservedLabels = map[string]bool{
+	batch.SourceLabel:  true,
+	"service_name":     true,
+	"tenant_name":      true,
+	"type":             true,
+	"environment_name": true,
+}
+
+// validateRequestLabelNames checks label names an operator allows clients to set
+func validateRequestLabelNames(setting string, names []string) error {
+	for _, name := range names {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("%s: invalid label name %q", setting, name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("%s: label %q is set by the service", setting, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memStatsMaxAge bounds how often a scrape reads the memory statistics,
+// since runtime.ReadMemStats briefly stops the world
+const memStatsMaxAge = time.Second
+
+// memStatsCache shares one runtime.ReadMemStats call between the metrics of a scrape
+type memStatsCache struct {
+	mu    sync.Mutex
+	stats runtime.MemStats
+	read  time.Time
+}
+
+// get returns memory statistics no older than memStatsMaxAge
+func (c *memStatsCache) get() *runtime.MemStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.read) > memStatsMaxAge {
+		runtime.ReadMemStats(&c.stats)
+		c.read = time.Now()
+	}
+	return &c.stats
+}
+
+// registerRuntimeMetrics adds Go runtime metrics (goroutines, heap, GC) to the registry
+func registerRuntimeMetrics(r *Registry) {
+	cache := &memStatsCache{}
+
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.NewGaugeFunc("go_heap_alloc_bytes", "Bytes of allocated heap objects", func() float64 {
+		return float64(cache.get().HeapAlloc)
+	})
+	r.NewGaugeFunc("go_heap_inuse_bytes", "Bytes in in-use heap spans", func() float64 {
+		return float64(cache.get().HeapInuse)
+	})
+	r.NewGaugeFunc("go_heap_objects", "Number of allocated heap objects", func() float64 {
+		return float64(cache.get().HeapObjects)
+	})
+	r.NewGaugeFunc("go_sys_bytes", "Bytes of memory obtained from the OS", func() float64 {
+		return float64(cache.get().Sys)
+	})
+	r.NewGaugeFunc("go_next_gc_bytes", "Heap size target of the next GC cycle", func() float64 {
+		return float64(cache.get().NextGC)
+	})
+	r.NewCounterFunc("go_gc_cycles_total", "Completed GC cycles", func() float64 {
+		return float64(cache.get().NumGC)
+	})
+	r.NewCounterFunc("go_gc_pause_seconds_total", "Cumulative stop-the-world GC pause time", func() float64 {
+		return float64(cache.get().PauseTotalNs) / 1e9
+	})
+	r.NewGaugeFunc("go_gc_last_pause_seconds", "Duration of the most recent GC pause", func() float64 {
+		stats := cache.get()
+		if stats.NumGC == 0 {
+			return 0
+		}
+		return float64(stats.PauseNs[(stats.NumGC+255)%256]) / 1e9
+	})
+}
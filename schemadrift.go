@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+// maxTrackedSchemas bounds the tenant/type pairs whose schema is remembered
+const maxTrackedSchemas = 10000
+
+// maxSchemaFields bounds the fields remembered per schema, in case events carry arbitrary keys
+const maxSchemaFields = 500
+
+// Schema drift kinds, used as the "kind" metric label
+const (
+	driftNewField   = "new_field"
+	driftTypeChange = "type_change"
+)
+
+// SchemaTracker learns the fields of each tenant's events, per Auth0 event type, and reports drift
+// The first event of a type establishes its schema; later events report fields that were never
+// seen before and fields whose JSON type changed
+type SchemaTracker struct {
+	mu      sync.Mutex
+	schemas map[schemaKey]map[string]string // field path -> JSON type
+
+	metrics *Metrics
+	logger  *slog.Logger
+}
+
+// schemaKey identifies the schema of one event type of one tenant
+type schemaKey struct {
+	tenant    string
+	eventType string
+}
+
+// NewSchemaTracker creates an empty schema tracker
+func NewSchemaTracker(metrics *Metrics, logger *slog.Logger) *SchemaTracker {
+	return &SchemaTracker{
+		schemas: make(map[schemaKey]map[string]string),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Observe compares the top-level and data fields of line with the learned schema
+// It is safe to call on a nil tracker
+func (s *SchemaTracker) Observe(tenant, eventType, line string) {
+	if s == nil {
+		return
+	}
+	fields := schemaFields(line)
+	if fields == nil {
+		return
+	}
+
+	key := schemaKey{tenant: tenant, eventType: eventType}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known, ok := s.schemas[key]
+	if !ok {
+		if len(s.schemas) < maxTrackedSchemas {
+			s.schemas[key] = fields
+		}
+		return
+	}
+
+	for field, jsonType := range fields {
+		previous, seen := known[field]
+		switch {
+		case !seen:
+			if len(known) >= maxSchemaFields {
+				continue
+			}
+			known[field] = jsonType
+			s.report(key, driftNewField, field, "", jsonType)
+		case jsonType == "null" || previous == jsonType:
+		case previous == "null":
+			known[field] = jsonType
+		default:
+			known[field] = jsonType
+			s.report(key, driftTypeChange, field, previous, jsonType)
+		}
+	}
+}
+
+// report logs and counts one schema change
+func (s *SchemaTracker) report(key schemaKey, kind, field, oldType, newType string) {
+	s.metrics.schemaDrift.Inc(key.tenant, kind)
+	s.logger.Warn("Log schema drift detected",
+		"tenant", key.tenant,
+		"type", key.eventType,
+		"change", kind,
+		"field", field,
+		"old_type", oldType,
+		"new_type", newType,
+	)
+}
+
+// schemaFields returns the JSON type of every top-level field and every field of "data", keyed by path
+func schemaFields(line string) map[string]string {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &top); err != nil {
+		return nil
+	}
+
+	fields := make(map[string]string, len(top))
+	for name, value := range top {
+		fields[name] = jsonType(value)
+	}
+
+	var data map[string]json.RawMessage
+	if raw, ok := top["data"]; ok && json.Unmarshal(raw, &data) == nil {
+		for name, value := range data {
+			fields["data."+name] = jsonType(value)
+		}
+	}
+	return fields
+}
+
+// jsonType names the JSON type of a raw value from its first byte
+func jsonType(value json.RawMessage) string {
+	if len(value) == 0 {
+		return "null"
+	}
+	switch value[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
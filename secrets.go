@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// Secrets holds the credentials that may change while the service is running
+type Secrets struct {
+	HMACSecrets            []string
+	CustomAuthTokens       []string
+	LokiUsername           string
+	LokiPassword           string
+	LokiOAuth2ClientSecret string
+}
+
+// SecretStore provides concurrency-safe access to the current secrets
+// Readers always see a complete snapshot; updates replace the snapshot atomically
+type SecretStore struct {
+	current atomic.Pointer[Secrets]
+}
+
+// NewSecretStore creates a secret store initialized with the given secrets
+func NewSecretStore(secrets *Secrets) *SecretStore {
+	store := &SecretStore{}
+	store.current.Store(secrets)
+	return store
+}
+
+// Load returns the current secrets snapshot (must not be modified)
+func (s *SecretStore) Load() *Secrets {
+	return s.current.Load()
+}
+
+// BasicAuth returns the current Loki basic auth credentials
+func (s *SecretStore) BasicAuth() (username, password string) {
+	secrets := s.Load()
+	return secrets.LokiUsername, secrets.LokiPassword
+}
+
+// Store replaces the current secrets snapshot
+func (s *SecretStore) Store(secrets *Secrets) {
+	s.current.Store(secrets)
+}
+
+// secretsEqual reports whether two secrets snapshots hold the same values
+func secretsEqual(a, b *Secrets) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// secrets returns the secrets currently held in the configuration
+func (cfg *Config) secrets() *Secrets {
+	return &Secrets{
+		HMACSecrets:            cfg.HMACSecrets,
+		CustomAuthTokens:       cfg.CustomAuthTokens,
+		LokiUsername:           cfg.LokiUsername,
+		LokiPassword:           cfg.LokiPassword,
+		LokiOAuth2ClientSecret: cfg.LokiOAuth2ClientSecret,
+	}
+}
+
+// hasSecretFiles reports whether any secret is loaded from a file
+func (cfg *Config) hasSecretFiles() bool {
+	return cfg.HMACSecretFile != "" || cfg.CustomAuthTokenFile != "" ||
+		cfg.LokiUsernameFile != "" || cfg.LokiPasswordFile != "" || cfg.LokiOAuth2ClientSecretFile != ""
+}
+
+// loadSecretFiles resolves the *_FILE settings into the configuration
+// A secret may be given either directly or via a file, not both
+func (cfg *Config) loadSecretFiles() error {
+	conflicts := []struct {
+		name   string
+		direct bool
+		file   string
+	}{
+		{"HMAC_SECRET", len(cfg.HMACSecrets) > 0, cfg.HMACSecretFile},
+		{"CUSTOM_AUTH_TOKEN", len(cfg.CustomAuthTokens) > 0, cfg.CustomAuthTokenFile},
+		{"LOKI_USERNAME", cfg.LokiUsername != "", cfg.LokiUsernameFile},
+		{"LOKI_PASSWORD", cfg.LokiPassword != "", cfg.LokiPasswordFile},
+		{"LOKI_OAUTH2_CLIENT_SECRET", cfg.LokiOAuth2ClientSecret != "", cfg.LokiOAuth2ClientSecretFile},
+		{"DISK_ENCRYPTION_KEY", cfg.DiskEncryptionKey != "", cfg.DiskEncryptionKeyFile},
+	}
+	for _, c := range conflicts {
+		if c.direct && c.file != "" {
+			return fmt.Errorf("%s and %s_FILE are mutually exclusive", c.name, c.name)
+		}
+	}
+
+	secrets, err := readSecretFiles(cfg, cfg.secrets())
+	if err != nil {
+		return err
+	}
+
+	// The disk encryption key is read once; files written with it must stay readable
+	if cfg.DiskEncryptionKeyFile != "" {
+		if cfg.DiskEncryptionKey, err = readSecretFile(cfg.DiskEncryptionKeyFile); err != nil {
+			return err
+		}
+	}
+
+	cfg.HMACSecrets = secrets.HMACSecrets
+	cfg.CustomAuthTokens = secrets.CustomAuthTokens
+	cfg.LokiUsername = secrets.LokiUsername
+	cfg.LokiPassword = secrets.LokiPassword
+	cfg.LokiOAuth2ClientSecret = secrets.LokiOAuth2ClientSecret
+	return nil
+}
+
+// readSecretFiles returns a copy of base with every file-backed secret re-read from disk
+func readSecretFiles(cfg *Config, base *Secrets) (*Secrets, error) {
+	secrets := *base
+
+	if cfg.HMACSecretFile != "" {
+		value, err := readSecretFile(cfg.HMACSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets.HMACSecrets = config.SplitList(value)
+	}
+	if cfg.CustomAuthTokenFile != "" {
+		value, err := readSecretFile(cfg.CustomAuthTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets.CustomAuthTokens = config.SplitList(value)
+	}
+	if cfg.LokiUsernameFile != "" {
+		value, err := readSecretFile(cfg.LokiUsernameFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets.LokiUsername = value
+	}
+	if cfg.LokiPasswordFile != "" {
+		value, err := readSecretFile(cfg.LokiPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets.LokiPassword = value
+	}
+	if cfg.LokiOAuth2ClientSecretFile != "" {
+		value, err := readSecretFile(cfg.LokiOAuth2ClientSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets.LokiOAuth2ClientSecret = value
+	}
+
+	return &secrets, nil
+}
+
+// readSecretFile reads a secret from a file, dropping the trailing newline most editors add
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// watchSecretFiles periodically re-reads the secret files and swaps in changed values
+// Mounted Kubernetes/Docker secrets are updated in place, so polling picks up rotations
+func watchSecretFiles(ctx context.Context, cfg *Config, store *SecretStore, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := store.Load()
+			updated, err := readSecretFiles(cfg, current)
+			if err != nil {
+				logger.Warn("Failed to reload secret files, keeping current secrets",
+					"error", err,
+				)
+				continue
+			}
+
+			if secretsEqual(current, updated) {
+				continue
+			}
+
+			// Never swap in a configuration that would reject every request
+			if len(updated.HMACSecrets) == 0 && len(updated.CustomAuthTokens) == 0 {
+				logger.Error("Reloaded secret files contain no HMAC secret or custom token, keeping current secrets")
+				continue
+			}
+
+			store.Store(updated)
+			logger.Info("Reloaded secrets from files",
+				"hmac_secrets_count", len(updated.HMACSecrets),
+				"custom_auth_tokens_count", len(updated.CustomAuthTokens),
+				"loki_auth_enabled", updated.LokiUsername != "",
+			)
+		}
+	}
+}
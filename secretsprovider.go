@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// Keys looked up in a secrets backend; each maps to the matching environment variable
+const (
+	secretKeyHMACSecret             = "hmac_secret"
+	secretKeyCustomAuthToken        = "custom_auth_token"
+	secretKeyLokiUsername           = "loki_username"
+	secretKeyLokiPassword           = "loki_password"
+	secretKeyLokiOAuth2ClientSecret = "loki_oauth2_client_secret"
+)
+
+// SecretsProvider fetches secrets from an external backend
+// Fetch returns the key/value pairs stored in the backend; unknown keys are ignored
+type SecretsProvider interface {
+	Name() string
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// newSecretsProvider creates the secrets provider selected by the configuration
+// Returns nil when no provider is configured
+func newSecretsProvider(cfg *Config) (SecretsProvider, error) {
+	client := newOutboundClient(10 * time.Second)
+
+	switch strings.ToLower(cfg.SecretsProvider) {
+	case "":
+		return nil, nil
+	case "vault":
+		if cfg.VaultAddr == "" || cfg.VaultSecretPath == "" {
+			return nil, fmt.Errorf("VAULT_ADDR and VAULT_SECRET_PATH are required for the vault secrets provider")
+		}
+		return &VaultSecretsProvider{
+			client:    client,
+			addr:      strings.TrimRight(cfg.VaultAddr, "/"),
+			token:     cfg.VaultToken,
+			namespace: cfg.VaultNamespace,
+			path:      strings.Trim(cfg.VaultSecretPath, "/"),
+		}, nil
+	case "aws":
+		if cfg.AWSSecretID == "" {
+			return nil, fmt.Errorf("AWS_SECRET_ID is required for the aws secrets provider")
+		}
+		region := awsRegion()
+		if region == "" {
+			return nil, fmt.Errorf("AWS_REGION is required for the aws secrets provider")
+		}
+		return &AWSSecretsManagerProvider{
+			client:   client,
+			creds:    NewAWSCredentialsChain(client, region),
+			region:   region,
+			secretID: cfg.AWSSecretID,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown SECRETS_PROVIDER %q (expected vault or aws)", cfg.SecretsProvider)
+	}
+}
+
+// applyProviderSecrets returns a copy of base with the values found in the backend applied
+// Keys absent from the backend leave the corresponding secret untouched
+func applyProviderSecrets(base *Secrets, values map[string]string) *Secrets {
+	secrets := *base
+	if value, ok := values[secretKeyHMACSecret]; ok {
+		secrets.HMACSecrets = config.SplitList(value)
+	}
+	if value, ok := values[secretKeyCustomAuthToken]; ok {
+		secrets.CustomAuthTokens = config.SplitList(value)
+	}
+	if value, ok := values[secretKeyLokiUsername]; ok {
+		secrets.LokiUsername = value
+	}
+	if value, ok := values[secretKeyLokiPassword]; ok {
+		secrets.LokiPassword = value
+	}
+	if value, ok := values[secretKeyLokiOAuth2ClientSecret]; ok {
+		secrets.LokiOAuth2ClientSecret = value
+	}
+	return &secrets
+}
+
+// loadProviderSecrets fetches secrets from the configured provider into the configuration
+func (cfg *Config) loadProviderSecrets(ctx context.Context, provider SecretsProvider) error {
+	values, err := provider.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch secrets from %s: %w", provider.Name(), err)
+	}
+
+	secrets := applyProviderSecrets(cfg.secrets(), values)
+	cfg.HMACSecrets = secrets.HMACSecrets
+	cfg.CustomAuthTokens = secrets.CustomAuthTokens
+	cfg.LokiUsername = secrets.LokiUsername
+	cfg.LokiPassword = secrets.LokiPassword
+	cfg.LokiOAuth2ClientSecret = secrets.LokiOAuth2ClientSecret
+	return nil
+}
+
+// refreshProviderSecrets periodically re-fetches secrets from the provider and swaps in changes
+func refreshProviderSecrets(ctx context.Context, provider SecretsProvider, store *SecretStore, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			values, err := provider.Fetch(fetchCtx)
+			cancel()
+			if err != nil {
+				logger.Warn("Failed to refresh secrets, keeping current secrets",
+					"provider", provider.Name(),
+					"error", err,
+				)
+				continue
+			}
+
+			current := store.Load()
+			updated := applyProviderSecrets(current, values)
+			if secretsEqual(current, updated) {
+				continue
+			}
+
+			// Never swap in a configuration that would reject every request
+			if len(updated.HMACSecrets) == 0 && len(updated.CustomAuthTokens) == 0 {
+				logger.Error("Refreshed secrets contain no HMAC secret or custom token, keeping current secrets",
+					"provider", provider.Name(),
+				)
+				continue
+			}
+
+			store.Store(updated)
+			logger.Info("Refreshed secrets from provider",
+				"provider", provider.Name(),
+				"hmac_secrets_count", len(updated.HMACSecrets),
+				"custom_auth_tokens_count", len(updated.CustomAuthTokens),
+				"loki_auth_enabled", updated.LokiUsername != "",
+			)
+		}
+	}
+}
+
+// VaultSecretsProvider reads secrets from a HashiCorp Vault KV secrets engine (v1 or v2)
+type VaultSecretsProvider struct {
+	client    *http.Client
+	addr      string
+	token     string
+	namespace string
+	path      string // e.g. secret/data/a0-logstream2loki for KV v2
+}
+
+// Name returns the provider name for logging
+func (p *VaultSecretsProvider) Name() string {
+	return "vault"
+}
+
+// Fetch reads the secret at the configured path
+func (p *VaultSecretsProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.addr+"/v1/"+p.path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("Vault returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// KV v2 nests the secret under data.data, KV v1 returns it directly under data
+	var result struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse Vault response: %w", err)
+	}
+
+	data := result.Data
+	if nested, ok := result.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return nil, fmt.Errorf("failed to parse Vault KV v2 data: %w", err)
+		}
+	}
+
+	return stringValues(data), nil
+}
+
+// AWSSecretsManagerProvider reads a JSON secret from AWS Secrets Manager
+type AWSSecretsManagerProvider struct {
+	client   *http.Client
+	creds    *AWSCredentialsChain
+	region   string
+	secretID string
+}
+
+// Name returns the provider name for logging
+func (p *AWSSecretsManagerProvider) Name() string {
+	return "aws-secretsmanager"
+}
+
+// Fetch calls GetSecretValue and decodes the secret string as a JSON object
+func (p *AWSSecretsManagerProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	creds, err := p.creds.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": p.secretID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	endpoint := "https://secretsmanager." + p.region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequestV4(req, body, creds, p.region, "secretsmanager", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to Secrets Manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, fmt.Errorf("Secrets Manager returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse Secrets Manager response: %w", err)
+	}
+
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(result.SecretString), &data); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object: %w", p.secretID, err)
+	}
+
+	return stringValues(data), nil
+}
+
+// stringValues keeps the string-valued entries of a JSON object
+func stringValues(data map[string]json.RawMessage) map[string]string {
+	values := make(map[string]string, len(data))
+	for key, raw := range data {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			values[key] = value
+		}
+	}
+	return values
+}
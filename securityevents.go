@@ -0,0 +1,47 @@
+package main
+
+// Security event classes counted by security_events_total
+const (
+	securityFailedLogin      = "failed_login"
+	securityBlocked          = "blocked"
+	securityMFAFailure       = "mfa_failure"
+	securityRateLimit        = "rate_limit"
+	securityBreachedPassword = "breached_password"
+)
+
+// securityEventClasses maps Auth0 log event types to their security event class
+// See https://auth0.com/docs/deploy-monitor/logs/log-event-type-codes
+var securityEventClasses = map[string]string{
+	"f":    securityFailedLogin, // Failed login
+	"fp":   securityFailedLogin, // Incorrect password
+	"fu":   securityFailedLogin, // Invalid email or username
+	"fc":   securityFailedLogin, // Failed by connector
+	"fco":  securityFailedLogin, // Origin not allowed
+	"fcoa": securityFailedLogin, // Failed cross-origin authentication
+
+	"limit_wc":  securityBlocked, // IP blocked after too many failed logins to one account
+	"limit_mu":  securityBlocked, // IP blocked after failed logins to multiple accounts
+	"limit_sul": securityBlocked, // Account blocked after too many logins from one IP
+
+	"gd_auth_failed":     securityMFAFailure, // MFA code verification failed
+	"gd_auth_rejected":   securityMFAFailure, // MFA push notification rejected
+	"gd_recovery_failed": securityMFAFailure, // MFA recovery code verification failed
+
+	"api_limit":                     securityRateLimit, // Authentication or Management API rate limit hit
+	"gd_otp_rate_limit_exceed":      securityRateLimit, // Too many MFA code attempts
+	"gd_recovery_rate_limit_exceed": securityRateLimit, // Too many MFA recovery code attempts
+
+	"pwd_leak":        securityBreachedPassword, // Login with a breached password
+	"signup_pwd_leak": securityBreachedPassword, // Signup with a breached password
+	"reset_pwd_leak":  securityBreachedPassword, // Password reset to a breached password
+}
+
+// countSecurityEvent counts an Auth0 entry in security_events_total if its type is in a class
+func (m *Metrics) countSecurityEvent(tenant string, entry LogEntry) {
+	if entry.Source != sourceAuth0 {
+		return
+	}
+	if class, ok := securityEventClasses[entry.Labels["type"]]; ok {
+		m.securityEvents.Inc(tenant, class)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// Serverless modes of SERVERLESS
+const (
+	serverlessAuto   = "auto"   // Detect the platform from the environment its runtime sets
+	serverlessOff    = "off"    // Long-running server, entries are pushed by the batchers on their own schedule
+	serverlessHTTP   = "http"   // Flush per request behind an HTTP frontend that freezes idle instances (Cloud Run, Cloud Functions)
+	serverlessLambda = "lambda" // Serve AWS Lambda invocations from API Gateway or a function URL
+)
+
+// lambdaRuntimePath prefixes the paths of the AWS Lambda runtime API
+const lambdaRuntimePath = "/2018-06-01/runtime"
+
+// detectServerless returns the serverless mode matching the environment of the process
+func detectServerless() string {
+	switch {
+	case os.Getenv("AWS_LAMBDA_RUNTIME_API") != "":
+		return serverlessLambda
+	case os.Getenv("K_SERVICE") != "":
+		// Set by Cloud Run and Cloud Functions (2nd gen)
+		return serverlessHTTP
+	}
+	return serverlessOff
+}
+
+// ServerlessFlusher pushes the entries of each request before it is answered, since a
+// serverless platform freezes the instance once the response is sent and a batch left
+// waiting for BATCH_FLUSH_MS would only be pushed on a later invocation, if ever
+type ServerlessFlusher struct {
+	entryQueue *batch.EntryQueue
+	batchers   []*batch.Batcher
+}
+
+// NewServerlessFlusher creates a flusher for the batchers reading entryQueue
+func NewServerlessFlusher(entryQueue *batch.EntryQueue, batchers []*batch.Batcher) *ServerlessFlusher {
+	return &ServerlessFlusher{entryQueue: entryQueue, batchers: batchers}
+}
+
+// Flush flushes the batchers until a round starts with the entry queue empty, so every entry
+// queued before the call has been pushed to Loki, or has failed to be
+func (f *ServerlessFlusher) Flush(ctx context.Context) {
+	for {
+		// Entries queued before the round reach a batcher and are flushed within it
+		empty := f.entryQueue.Len() == 0
+		for _, batcher := range f.batchers {
+			batcher.Flush(ctx)
+		}
+		if empty || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Wrap buffers the responses of next and flushes the batchers before sending them, covering
+// the sources acknowledged once queued (webhooks, Okta, pushes)
+func (f *ServerlessFlusher) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		next.ServeHTTP(recorder, r)
+		f.Flush(r.Context())
+
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	})
+}
+
+// lambdaHTTPEvent is an API Gateway proxy event: payload format 2.0 (HTTP APIs and function
+// URLs) sets rawPath, format 1.0 (REST APIs) sets path
+type lambdaHTTPEvent struct {
+	Version               string              `json:"version"`
+	RawPath               string              `json:"rawPath"`
+	RawQueryString        string              `json:"rawQueryString"`
+	Cookies               []string            `json:"cookies"`
+	Path                  string              `json:"path"`
+	HTTPMethod            string              `json:"httpMethod"`
+	Headers               map[string]string   `json:"headers"`
+	MultiValueHeaders     map[string][]string `json:"multiValueHeaders"`
+	QueryStringParameters map[string]string   `json:"queryStringParameters"`
+	MultiValueQuery       map[string][]string `json:"multiValueQueryStringParameters"`
+	Body                  string              `json:"body"`
+	IsBase64Encoded       bool                `json:"isBase64Encoded"`
+	RequestContext        struct {
+		RequestID string `json:"requestId"`
+		HTTP      struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// lambdaHTTPResponse is the proxy response returned to API Gateway or the function URL
+type lambdaHTTPResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// lambdaError reports a failed invocation to the runtime API
+type lambdaError struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// request converts the event into the HTTP request it proxies
+func (e *lambdaHTTPEvent) request(ctx context.Context) (*http.Request, error) {
+	method, path, sourceIP := e.RequestContext.HTTP.Method, e.RawPath, e.RequestContext.HTTP.SourceIP
+	query := e.RawQueryString
+	if e.Version != "2.0" {
+		method, path, sourceIP = e.HTTPMethod, e.Path, e.RequestContext.Identity.SourceIP
+		values := url.Values{}
+		for name, value := range e.QueryStringParameters {
+			values.Set(name, value)
+		}
+		for name, list := range e.MultiValueQuery {
+			values[name] = list
+		}
+		query = values.Encode()
+	}
+	if method == "" || path == "" {
+		return nil, fmt.Errorf("not an API Gateway or function URL event")
+	}
+
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %w", err)
+		}
+		body = decoded
+	}
+
+	target := path
+	if query != "" {
+		target += "?" + query
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range e.Headers {
+		r.Header.Set(name, value)
+	}
+	for name, list := range e.MultiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(name)] = list
+	}
+	if len(e.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(e.Cookies, "; "))
+	}
+	r.Host = r.Header.Get("Host")
+	r.ContentLength = int64(len(body))
+	// The source IP is the client as seen by API Gateway, which feeds the IP checks
+	r.RemoteAddr = net.JoinHostPort(sourceIP, "0")
+	if e.RequestContext.RequestID != "" && r.Header.Get(requestIDHeader) == "" {
+		r.Header.Set(requestIDHeader, e.RequestContext.RequestID)
+	}
+	return r, nil
+}
+
+// LambdaRuntime serves AWS Lambda invocations through the runtime API, so the service runs
+// behind API Gateway or a function URL without a server kept running; each invocation is one
+// HTTP request, answered after its entries reached Loki
+type LambdaRuntime struct {
+	base    string // URL of the runtime API
+	handler http.Handler
+	client  *http.Client
+	logger  *slog.Logger
+}
+
+// NewLambdaRuntime creates a runtime loop against the runtime API at api (AWS_LAMBDA_RUNTIME_API)
+func NewLambdaRuntime(api string, handler http.Handler, logger *slog.Logger) *LambdaRuntime {
+	return &LambdaRuntime{
+		base:    "http://" + api + lambdaRuntimePath,
+		handler: handler,
+		// Fetching the next invocation blocks until there is one, so there is no timeout
+		client: &http.Client{},
+		logger: logger,
+	}
+}
+
+// Run serves invocations until ctx is canceled or the runtime API fails
+func (l *LambdaRuntime) Run(ctx context.Context) error {
+	for {
+		if err := l.invoke(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// invoke fetches the next invocation, serves it and posts its response
+func (l *LambdaRuntime) invoke(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.base+"/invocation/next", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching the next invocation: %w", err)
+	}
+	payload, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading the next invocation: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching the next invocation: status %d: %s", resp.StatusCode, payload)
+	}
+	requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+
+	// The request may run until the function times out
+	invocationCtx := ctx
+	if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		var cancel context.CancelFunc
+		invocationCtx, cancel = context.WithDeadline(ctx, time.UnixMilli(ms))
+		defer cancel()
+	}
+
+	var event lambdaHTTPEvent
+	err = json.Unmarshal(payload, &event)
+	var r *http.Request
+	if err == nil {
+		r, err = event.request(invocationCtx)
+	}
+	if err != nil {
+		l.logger.Error("Invalid Lambda invocation", "request_id", requestID, "error", err)
+		return l.post(ctx, "/invocation/"+requestID+"/error", lambdaError{
+			ErrorMessage: err.Error(),
+			ErrorType:    "InvalidEvent",
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	l.handler.ServeHTTP(recorder, r)
+	return l.post(ctx, "/invocation/"+requestID+"/response", lambdaResponse(recorder, event.Version == "2.0"))
+}
+
+// lambdaResponse converts a recorded response into a proxy response; bodies that are not
+// UTF-8 text are base64 encoded
+func lambdaResponse(recorder *httptest.ResponseRecorder, v2 bool) lambdaHTTPResponse {
+	response := lambdaHTTPResponse{StatusCode: recorder.Code}
+	if v2 {
+		response.Headers = make(map[string]string, len(recorder.Header()))
+		for name, values := range recorder.Header() {
+			response.Headers[name] = strings.Join(values, ", ")
+		}
+	} else {
+		response.MultiValueHeaders = recorder.Header()
+	}
+	body := recorder.Body.Bytes()
+	if utf8.Valid(body) {
+		response.Body = string(body)
+	} else {
+		response.Body = base64.StdEncoding.EncodeToString(body)
+		response.IsBase64Encoded = true
+	}
+	return response
+}
+
+// post sends a JSON document to the runtime API
+func (l *LambdaRuntime) post(ctx context.Context, path string, document any) error {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting %s: %w", path, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("posting %s: status %d", path, resp.StatusCode)
+	}
+	return nil
+}
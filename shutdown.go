@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// Shutdown policies for the entries still buffered when the service stops
+const (
+	shutdownDrain   = "drain"   // Push them to Loki within SHUTDOWN_TIMEOUT
+	shutdownPersist = "persist" // Spill them to SPILL_DIR without pushing, for the next start
+)
+
+// waitDone waits for wg until ctx ends and reports whether wg finished
+func waitDone(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// batcherTotals sums the entries the batchers pushed, failed to push and persisted
+func batcherTotals(batchers []*batch.Batcher) (pushed, failed, persisted int64) {
+	for _, b := range batchers {
+		bPushed, bFailed, bPersisted := b.Totals()
+		pushed += bPushed
+		failed += bFailed
+		persisted += bPersisted
+	}
+	return pushed, failed, persisted
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+const (
+	// spillSegmentBytes is the size at which a spill segment is closed and a new one started,
+	// so drained entries leave the disk segment by segment
+	spillSegmentBytes = 4 << 20
+	// spillWriteBuffer buffers appends to the current segment
+	spillWriteBuffer = 64 << 10
+	// spillReadBuffer is the longest spilled entry a segment can be read back with
+	spillReadBuffer = 64 << 20
+)
+
+// errSpillFull is returned when the spill queue reached SPILL_MAX_BYTES
+var errSpillFull = errors.New("spill queue is full")
+
+// errShutdownPersisted is the delivery error of an entry spilled at shutdown instead of pushed
+var errShutdownPersisted = errors.New("service shut down before the entry was pushed")
+
+// SpillQueue holds entries on disk while the entry queue is full and hands them back to it
+// once the batchers catch up. Entries are appended to numbered segment files in a directory;
+// segments left by a previous run are drained after a restart
+// While entries are spilled new ones are spilled too, so a stream's entries stay in order
+type SpillQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []spillSegment // Segments on disk, oldest first
+	bytes    int64          // Bytes in the segments on disk
+	file     *os.File       // Last segment, while it receives appends (nil until the next append)
+	writer   *bufio.Writer  // Buffers appends to file
+
+	notify     chan struct{}   // Wakes the drainer after an append
+	protection *DiskProtection // Encrypts records and deletes drained segments (nil writes plaintext)
+	metrics    *Metrics
+	logger     *slog.Logger
+}
+
+// spillSegment is one segment file
+type spillSegment struct {
+	seq  int   // Sequence number in the file name
+	size int64 // Bytes appended
+}
+
+// spillRecord is a spilled entry, one JSON document per line of a segment
+// Acknowledgements and trace context are not kept; entries of synchronous deliveries only spill at shutdown
+type spillRecord struct {
+	Timestamp int64             `json:"ts"`
+	Labels    map[string]string `json:"labels"`
+	Line      string            `json:"line"`
+	Source    string            `json:"source"`
+	LogID     string            `json:"log_id,omitempty"`
+	OrgID     string            `json:"org_id,omitempty"`
+}
+
+// newSpillRecord returns the record of an entry
+func newSpillRecord(entry LogEntry) spillRecord {
+	return spillRecord{
+		Timestamp: entry.Timestamp,
+		Labels:    entry.Labels,
+		Line:      entry.Line,
+		Source:    entry.Source,
+		LogID:     entry.LogID,
+		OrgID:     entry.OrgID,
+	}
+}
+
+// entry returns the entry a record was written for
+func (r spillRecord) entry() LogEntry {
+	return LogEntry{
+		Timestamp: r.Timestamp,
+		Labels:    r.Labels,
+		Line:      r.Line,
+		Source:    r.Source,
+		LogID:     r.LogID,
+		OrgID:     r.OrgID,
+	}
+}
+
+// NewSpillQueue opens the spill directory, picking up the segments of a previous run
+func NewSpillQueue(dir string, maxBytes int64, protection *DiskProtection, metrics *Metrics, logger *slog.Logger) (*SpillQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spill directory: %w", err)
+	}
+
+	q := &SpillQueue{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		notify:     make(chan struct{}, 1),
+		protection: protection,
+		metrics:    metrics,
+		logger:     logger,
+	}
+	for _, entry := range names {
+		var seq int
+		if entry.IsDir() || !isSpillSegment(entry.Name()) {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "spill-%d.jsonl", &seq); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spill segment: %w", err)
+		}
+		q.segments = append(q.segments, spillSegment{seq: seq, size: info.Size()})
+		q.bytes += info.Size()
+	}
+	slices.SortFunc(q.segments, func(a, b spillSegment) int { return a.seq - b.seq })
+	return q, nil
+}
+
+// segmentPath returns the file of a segment
+func (q *SpillQueue) segmentPath(seq int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("spill-%020d.jsonl", seq))
+}
+
+// Pending reports whether entries are waiting on disk
+func (q *SpillQueue) Pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.segments) > 0
+}
+
+// Bytes returns the bytes spilled to disk
+func (q *SpillQueue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Persist spills an entry at shutdown, including one of a synchronous delivery, whose sender is
+// told it was not delivered
+func (q *SpillQueue) Persist(entry LogEntry) error {
+	err := q.Append(entry)
+	entry.Ack.Done(errShutdownPersisted)
+	return err
+}
+
+// Close flushes and closes the segment receiving appends, once nothing appends anymore
+func (q *SpillQueue) Close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeSegment()
+}
+
+// Append writes an entry to the current segment
+func (q *SpillQueue) Append(entry LogEntry) error {
+	data, err := json.Marshal(newSpillRecord(entry))
+	if err != nil {
+		return fmt.Errorf("failed to encode spilled entry: %w", err)
+	}
+	if data, err = q.protection.Seal(data); err != nil {
+		return fmt.Errorf("failed to encrypt spilled entry: %w", err)
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.bytes+int64(len(data)) > q.maxBytes {
+		q.metrics.spillEntries.Inc("rejected")
+		return errSpillFull
+	}
+	if q.file == nil {
+		seq := 1
+		if len(q.segments) > 0 {
+			seq = q.segments[len(q.segments)-1].seq + 1
+		}
+		file, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+		if err != nil {
+			q.metrics.spillEntries.Inc("rejected")
+			return fmt.Errorf("failed to create spill segment: %w", err)
+		}
+		q.file, q.writer = file, bufio.NewWriterSize(file, spillWriteBuffer)
+		q.segments = append(q.segments, spillSegment{seq: seq})
+	}
+	if _, err := q.writer.Write(data); err != nil {
+		q.metrics.spillEntries.Inc("rejected")
+		return fmt.Errorf("failed to write spill segment: %w", err)
+	}
+	q.bytes += int64(len(data))
+	last := &q.segments[len(q.segments)-1]
+	last.size += int64(len(data))
+	if last.size >= spillSegmentBytes {
+		q.closeSegment()
+	}
+	q.metrics.spillEntries.Inc("spilled")
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// closeSegment flushes and closes the segment receiving appends; the next append starts a new one
+// The caller must hold q.mu
+func (q *SpillQueue) closeSegment() {
+	if q.file == nil {
+		return
+	}
+	if err := q.writer.Flush(); err != nil {
+		q.logger.Error("Failed to flush spill segment", "path", q.file.Name(), "error", err)
+	}
+	if err := q.file.Close(); err != nil {
+		q.logger.Error("Failed to close spill segment", "path", q.file.Name(), "error", err)
+	}
+	q.file, q.writer = nil, nil
+}
+
+// oldest returns the oldest segment for draining, closing it first if it receives appends
+func (q *SpillQueue) oldest() (seq int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.segments) == 0 {
+		return 0, false
+	}
+	if q.file != nil && len(q.segments) == 1 {
+		q.closeSegment()
+	}
+	return q.segments[0].seq, true
+}
+
+// remove deletes a drained segment
+func (q *SpillQueue) remove(seq int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.protection.Remove(q.segmentPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		q.logger.Error("Failed to remove drained spill segment", "segment", seq, "error", err)
+	}
+	q.segments = slices.DeleteFunc(q.segments, func(s spillSegment) bool {
+		if s.seq == seq {
+			q.bytes -= s.size
+			return true
+		}
+		return false
+	})
+}
+
+// Run hands spilled entries back to the entry queue, oldest first, until ctx is canceled
+// Sends block while the entry queue is full, which is what paces the drain, and none are
+// sent while forwarding is paused
+func (q *SpillQueue) Run(ctx context.Context, entryQueue *batch.EntryQueue, forwarding *Forwarding) {
+	if q.Pending() {
+		q.logger.Info("Draining entries spilled to disk before the restart", "bytes", q.Bytes(), "dir", q.dir)
+	}
+	defer func() {
+		q.mu.Lock()
+		q.closeSegment()
+		q.mu.Unlock()
+	}()
+
+	for {
+		seq, ok := q.oldest()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+				continue
+			}
+		}
+		// Spilled entries stay on disk while forwarding is paused
+		forwarding.Wait(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err := q.drain(ctx, seq, entryQueue); err != nil {
+			if ctx.Err() != nil {
+				// The segment stays on disk and is drained again after a restart
+				return
+			}
+			q.logger.Error("Failed to drain spill segment, discarding it", "segment", seq, "error", err)
+		}
+	}
+}
+
+// drain queues the entries of one segment, then deletes it
+// An interrupted drain leaves the segment, so its first entries may be delivered twice;
+// Loki ignores exact duplicates
+func (q *SpillQueue) drain(ctx context.Context, seq int, entryQueue *batch.EntryQueue) error {
+	file, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		q.remove(seq)
+		return fmt.Errorf("failed to open spill segment: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, spillWriteBuffer), spillReadBuffer)
+	for scanner.Scan() {
+		var record spillRecord
+		data, err := q.protection.Open(scanner.Bytes())
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil {
+			// A crash can leave the last line of a segment incomplete
+			q.logger.Warn("Skipping unreadable spilled entry", "segment", seq, "error", err)
+			continue
+		}
+		entry := record.entry()
+		select {
+		case entryQueue.For(entry) <- entry:
+			q.metrics.spillEntries.Inc("drained")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err = scanner.Err()
+	q.remove(seq)
+	if err != nil {
+		return fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	return nil
+}
+
+// isSpillSegment reports whether a file name is that of a spill segment
+func isSpillSegment(name string) bool {
+	return strings.HasPrefix(name, "spill-") && strings.HasSuffix(name, ".jsonl")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// SQS long polling: each receive waits up to sqsWaitSeconds for up to sqsMaxMessages messages
+const (
+	sqsWaitSeconds = 20
+	sqsMaxMessages = 10
+)
+
+// sqsMessage is a message returned by ReceiveMessage
+type sqsMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// SQSConsumer polls an SQS queue bound to the EventBridge rule of an Auth0 partner event source
+// Messages are deleted only once Loki stored their entries, so delivery is at-least-once
+type SQSConsumer struct {
+	client      *http.Client
+	creds       *AWSCredentialsChain
+	region      string
+	endpoint    string // Service endpoint derived from the queue URL
+	queueURL    string
+	concurrency int
+
+	parser     *LogsHandler // Turns Auth0 events into entries with the configured labels
+	entryQueue *batch.EntryQueue
+	metrics    *Metrics
+	logger     *slog.Logger
+}
+
+// NewSQSConsumer creates a consumer for the queue
+// The region comes from the queue URL (sqs.<region>.amazonaws.com) or AWS_REGION
+func NewSQSConsumer(queueURL string, concurrency int, parser *LogsHandler, entryQueue *batch.EntryQueue, metrics *Metrics, logger *slog.Logger) (*SQSConsumer, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS_QUEUE_URL %q", queueURL)
+	}
+
+	region := awsRegion()
+	if parts := strings.Split(u.Hostname(), "."); len(parts) >= 4 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("cannot determine the AWS region of SQS_QUEUE_URL, set AWS_REGION")
+	}
+
+	client := newOutboundClient((sqsWaitSeconds + 10) * time.Second)
+	return &SQSConsumer{
+		client:      client,
+		creds:       NewAWSCredentialsChain(client, region),
+		region:      region,
+		endpoint:    u.Scheme + "://" + u.Host + "/",
+		queueURL:    queueURL,
+		concurrency: concurrency,
+		parser:      parser,
+		entryQueue:  entryQueue,
+		metrics:     metrics,
+		logger:      logger.With("queue_url", queueURL),
+	}, nil
+}
+
+// Run polls the queue with concurrency pollers until ctx is canceled
+func (c *SQSConsumer) Run(ctx context.Context) {
+	c.logger.Info("Consuming Auth0 events from SQS", "concurrency", c.concurrency, "region", c.region)
+
+	var wg sync.WaitGroup
+	for range c.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.poll(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// poll receives and processes messages, backing off after errors
+func (c *SQSConsumer) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		c.parser.memory.Wait(ctx)
+		c.parser.maintenance.Wait(ctx)
+		messages, err := c.receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.logger.Error("Failed to receive SQS messages", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if len(messages) > 0 {
+			c.process(ctx, messages)
+		}
+	}
+}
+
+// process queues the events of the messages and deletes the messages once Loki stored them
+func (c *SQSConsumer) process(ctx context.Context, messages []sqsMessage) {
+	var entries []LogEntry
+	var queued, filtered []sqsMessage
+	for _, message := range messages {
+		entry, err := c.parseMessage(message.Body)
+		if errors.Is(err, errHookDropped) {
+			filtered = append(filtered, message)
+			continue
+		}
+		if err != nil {
+			// Left in the queue; its redrive policy moves it to a dead-letter queue
+			c.metrics.sqsMessages.Inc("invalid")
+			c.logger.Warn("Failed to parse SQS message",
+				"message_id", message.MessageID,
+				"error", err,
+			)
+			continue
+		}
+		entries = append(entries, entry)
+		queued = append(queued, message)
+	}
+
+	// Messages dropped by processing hooks are done with and deleted right away
+	if len(filtered) > 0 {
+		c.metrics.sqsMessages.Add(float64(len(filtered)), "filtered")
+		if err := c.deleteMessages(ctx, filtered); err != nil {
+			c.logger.Error("Failed to delete filtered SQS messages, they will be delivered again",
+				"messages", len(filtered),
+				"error", err,
+			)
+		}
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	if err := deliverAndWait(ctx, c.entryQueue, c.parser.deliveries, entries, queueAckTimeout); err != nil {
+		c.metrics.sqsMessages.Add(float64(len(queued)), "failed")
+		c.logger.Warn("SQS messages not delivered to Loki, leaving them for redelivery",
+			"messages", len(queued),
+			"error", err,
+		)
+		return
+	}
+
+	c.metrics.sqsMessages.Add(float64(len(queued)), "delivered")
+	if err := c.deleteMessages(ctx, queued); err != nil {
+		c.logger.Error("Failed to delete delivered SQS messages, they will be delivered again",
+			"messages", len(queued),
+			"error", err,
+		)
+	}
+}
+
+// parseMessage extracts the Auth0 event from the EventBridge envelope of a message
+func (c *SQSConsumer) parseMessage(body string) (LogEntry, error) {
+	var event struct {
+		Detail json.RawMessage `json:"detail"`
+	}
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return LogEntry{}, err
+	}
+	if len(event.Detail) == 0 {
+		return LogEntry{}, fmt.Errorf("not an EventBridge event (no detail)")
+	}
+
+	// The detail is the event Auth0 would deliver to a webhook
+	var line bytes.Buffer
+	if err := json.Compact(&line, event.Detail); err != nil {
+		return LogEntry{}, err
+	}
+	return c.parser.parseQueuedLine(line.Bytes())
+}
+
+// receive long-polls the queue for messages
+func (c *SQSConsumer) receive(ctx context.Context) ([]sqsMessage, error) {
+	var result struct {
+		Messages []sqsMessage `json:"Messages"`
+	}
+	err := c.call(ctx, "ReceiveMessage", map[string]any{
+		"QueueUrl":            c.queueURL,
+		"MaxNumberOfMessages": sqsMaxMessages,
+		"WaitTimeSeconds":     sqsWaitSeconds,
+	}, &result)
+	return result.Messages, err
+}
+
+// deleteMessages deletes processed messages in one batch
+func (c *SQSConsumer) deleteMessages(ctx context.Context, messages []sqsMessage) error {
+	entries := make([]map[string]string, len(messages))
+	for i, message := range messages {
+		entries[i] = map[string]string{"Id": strconv.Itoa(i), "ReceiptHandle": message.ReceiptHandle}
+	}
+
+	var result struct {
+		Failed []struct {
+			ID      string `json:"Id"`
+			Message string `json:"Message"`
+		} `json:"Failed"`
+	}
+	if err := c.call(ctx, "DeleteMessageBatch", map[string]any{
+		"QueueUrl": c.queueURL,
+		"Entries":  entries,
+	}, &result); err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d deletions failed: %s", len(result.Failed), len(messages), result.Failed[0].Message)
+	}
+	return nil
+}
+
+// call invokes an SQS action with the AWS JSON protocol
+func (c *SQSConsumer) call(ctx context.Context, action string, input any, output any) error {
+	creds, err := c.creds.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	signAWSRequestV4(req, body, creds, c.region, "sqs", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to SQS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("SQS %s returned status %d: %s", action, resp.StatusCode, string(respBody))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse SQS %s response: %w", action, err)
+	}
+	return nil
+}
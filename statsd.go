@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacketSize keeps datagrams below the typical Ethernet MTU
+const statsdMaxPacketSize = 1432
+
+// StatsDEmitter periodically sends the registry's metrics to a StatsD or DogStatsD agent
+// Counters are sent as the increase since the previous flush, gauges as their current value
+type StatsDEmitter struct {
+	registry  *Registry
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool // Send labels as DogStatsD tags instead of name segments
+	logger    *slog.Logger
+
+	previous map[string]float64 // Counter values at the previous flush
+}
+
+// NewStatsDEmitter creates an emitter sending to addr over UDP
+func NewStatsDEmitter(registry *Registry, addr, prefix string, dogstatsd bool, logger *slog.Logger) (*StatsDEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD agent at %s: %w", addr, err)
+	}
+	return &StatsDEmitter{
+		registry:  registry,
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: dogstatsd,
+		logger:    logger,
+		previous:  make(map[string]float64),
+	}, nil
+}
+
+// Run flushes metrics every interval until ctx is canceled, then flushes once more
+func (e *StatsDEmitter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer e.conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.Flush()
+			return
+		case <-ticker.C:
+			e.Flush()
+		}
+	}
+}
+
+// Flush sends the current metric values
+func (e *StatsDEmitter) Flush() {
+	var packet strings.Builder
+	for _, line := range e.lines() {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacketSize {
+			e.send(packet.String())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		e.send(packet.String())
+	}
+}
+
+// send writes one datagram; UDP delivery is best effort
+func (e *StatsDEmitter) send(packet string) {
+	if _, err := e.conn.Write([]byte(packet)); err != nil {
+		e.logger.Debug("Failed to send metrics to StatsD agent", "error", err)
+	}
+}
+
+// lines renders the registry as StatsD lines
+func (e *StatsDEmitter) lines() []string {
+	e.registry.mu.Lock()
+	metrics := append([]metric(nil), e.registry.metrics...)
+	e.registry.mu.Unlock()
+
+	var lines []string
+	for _, m := range metrics {
+		fullName, _, kind := m.describe()
+		name := e.prefix + strings.TrimPrefix(fullName, metricsNamespace)
+
+		for _, s := range m.samples() {
+			key := name + s.suffix + "\xff" + labelKey(labelValues(s.labels))
+
+			var value float64
+			var statType string
+			switch kind {
+			case "counter":
+				value = s.value - e.previous[key]
+				e.previous[key] = s.value
+				if value == 0 {
+					continue
+				}
+				statType = "c"
+			case "gauge":
+				value = s.value
+				statType = "g"
+			case "histogram":
+				// Buckets have no StatsD equivalent; _sum and _count are sent as counters
+				if s.suffix == "_bucket" {
+					continue
+				}
+				value = s.value - e.previous[key]
+				e.previous[key] = s.value
+				if value == 0 {
+					continue
+				}
+				statType = "c"
+			default:
+				continue
+			}
+
+			lines = append(lines, e.format(name+s.suffix, s.labels, value, statType))
+		}
+	}
+	return lines
+}
+
+// format renders a single stat, as DogStatsD tags or with label values appended to the name
+func (e *StatsDEmitter) format(name string, labels []labelPair, value float64, statType string) string {
+	if e.dogstatsd {
+		line := name + ":" + formatFloat(value) + "|" + statType
+		if len(labels) > 0 {
+			tags := make([]string, len(labels))
+			for i, l := range labels {
+				tags[i] = l.name + ":" + statsdSanitize(l.value)
+			}
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return line
+	}
+
+	for _, l := range labels {
+		name += "." + statsdSanitize(l.value)
+	}
+	return name + ":" + formatFloat(value) + "|" + statType
+}
+
+// labelValues returns the values of label pairs
+func labelValues(labels []labelPair) []string {
+	values := make([]string, len(labels))
+	for i, l := range labels {
+		values[i] = l.value
+	}
+	return values
+}
+
+// statsdSanitize replaces characters that have a meaning in the StatsD line format
+func statsdSanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, v)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// systemdProbeInterval is how often Loki is probed until the service reports ready
+const systemdProbeInterval = 5 * time.Second
+
+// SystemdNotifier reports readiness and feeds the watchdog of a Type=notify systemd unit,
+// sending sd_notify messages to the datagram socket in NOTIFY_SOCKET
+// A nil notifier, outside systemd, sends nothing
+type SystemdNotifier struct {
+	addr     *net.UnixAddr
+	watchdog time.Duration // WatchdogSec of the unit (0 when the watchdog is off)
+	logger   *slog.Logger
+}
+
+// NewSystemdNotifier returns a notifier when the service runs under systemd with NOTIFY_SOCKET set
+func NewSystemdNotifier(logger *slog.Logger) *SystemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Names starting with @ are in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	n := &SystemdNotifier{
+		addr:   &net.UnixAddr{Name: socket, Net: "unixgram"},
+		logger: logger,
+	}
+
+	// The watchdog applies to this process only when WATCHDOG_PID is unset or names it
+	if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+		if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// Watchdog returns the watchdog timeout of the unit (0 when it is off or outside systemd)
+func (n *SystemdNotifier) Watchdog() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog
+}
+
+// Notify sends one sd_notify message, e.g. READY=1
+func (n *SystemdNotifier) Notify(state string) {
+	if n == nil {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err == nil {
+		_, err = conn.Write([]byte(state))
+		conn.Close()
+	}
+	if err != nil {
+		n.logger.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// Ready reports readiness once probe succeeds, retrying until ctx is canceled
+// It is called once the listeners are up and the IP allowlist is built
+func (n *SystemdNotifier) Ready(ctx context.Context, probe func(context.Context) error) {
+	if n == nil {
+		return
+	}
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+		err := probe(probeCtx)
+		cancel()
+		if err == nil {
+			n.Notify("READY=1\nSTATUS=Forwarding logs to Loki")
+			n.logger.Info("Notified systemd of readiness", "watchdog_s", n.watchdog.Seconds())
+			return
+		}
+		n.Notify("STATUS=Waiting for Loki: " + err.Error())
+		n.logger.Warn("Loki is not reachable yet, delaying readiness", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(systemdProbeInterval):
+		}
+	}
+}
+
+// RunWatchdog feeds the watchdog twice per timeout while every running batcher loop has made
+// progress within the timeout, so systemd restarts a wedged pipeline; batches held by a pause
+// of forwarding do not count as wedged
+func (n *SystemdNotifier) RunWatchdog(ctx context.Context, batchers []*batch.Batcher, forwarding *Forwarding) {
+	if n.Watchdog() == 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := n.checkBatchers(batchers, forwarding)
+		if err != nil {
+			if !stalled {
+				n.logger.Error("Pipeline is stalled, no longer feeding the systemd watchdog", "error", err)
+			}
+			stalled = true
+			continue
+		}
+		if stalled {
+			n.logger.Info("Pipeline recovered, feeding the systemd watchdog again")
+			stalled = false
+		}
+		n.Notify("WATCHDOG=1")
+	}
+}
+
+// checkBatchers returns an error naming the first batcher whose loop has not run within the watchdog timeout
+func (n *SystemdNotifier) checkBatchers(batchers []*batch.Batcher, forwarding *Forwarding) error {
+	if forwarding.Paused() {
+		return nil
+	}
+	for i, b := range batchers {
+		last := b.LastBeat()
+		if !last.IsZero() && time.Since(last) > n.watchdog {
+			return fmt.Errorf("batcher %d made no progress for %s", i, time.Since(last).Round(time.Second))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/config"
+)
+
+// Limits of the live tail
+const (
+	maxTailSubscribers = 8                // Open tails at once
+	tailBufferSize     = 256              // Entries waiting to be written to one tail
+	tailKeepalive      = 15 * time.Second // Comment sent to idle tails so proxies keep them open
+)
+
+// LiveTail streams accepted entries to operators watching GET /admin/tail with server-sent
+// events, so a new stream can be debugged without waiting for Loki to index it
+// Subscribers only see the tenant their token authenticates
+type LiveTail struct {
+	auth    *AuthChain
+	metrics *Metrics
+	logger  *slog.Logger
+
+	active      atomic.Int32 // Subscribers, read by Publish without the lock
+	mu          sync.Mutex
+	subscribers map[*tailSubscriber]struct{}
+	done        chan struct{} // Closed by Close
+	closeOnce   sync.Once
+}
+
+// tailSubscriber is one open tail
+type tailSubscriber struct {
+	tenant  string
+	types   []string // Event types streamed (empty streams all)
+	entries chan TailEntry
+	dropped atomic.Int64 // Entries skipped since the last dropped event
+}
+
+// NewLiveTail creates a live tail authenticating subscribers with authChain
+func NewLiveTail(authChain *AuthChain, metrics *Metrics, logger *slog.Logger) *LiveTail {
+	return &LiveTail{
+		auth:        authChain,
+		metrics:     metrics,
+		logger:      logger,
+		subscribers: make(map[*tailSubscriber]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Publish hands an accepted entry to the tails watching its tenant and type
+// It never blocks; a tail that falls behind skips entries and is told how many
+func (t *LiveTail) Publish(tenant string, entry LogEntry) {
+	if t == nil || t.active.Load() == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subscribers {
+		if sub.tenant != tenant || (len(sub.types) > 0 && !slices.Contains(sub.types, entry.Labels["type"])) {
+			continue
+		}
+		select {
+		case sub.entries <- TailEntry{
+			Tenant:    tenant,
+			Source:    entry.Source,
+			Timestamp: time.Unix(0, entry.Timestamp).UTC(),
+			Labels:    maps.Clone(entry.Labels),
+			Line:      entry.Line,
+		}:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Close ends every open tail, letting the admin server shut down
+func (t *LiveTail) Close() {
+	t.closeOnce.Do(func() { close(t.done) })
+}
+
+// subscribe registers a tail, failing when maxTailSubscribers are already open
+func (t *LiveTail) subscribe(sub *tailSubscriber) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subscribers) >= maxTailSubscribers {
+		return false
+	}
+	t.subscribers[sub] = struct{}{}
+	t.active.Store(int32(len(t.subscribers)))
+	return true
+}
+
+// unsubscribe removes a tail
+func (t *LiveTail) unsubscribe(sub *tailSubscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, sub)
+	t.active.Store(int32(len(t.subscribers)))
+}
+
+// ServeHTTP authenticates the tenant like /logs and streams its entries until the client
+// disconnects or the service shuts down
+func (t *LiveTail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r, t.logger)
+
+	tenant, failure := t.auth.authenticateRequest(w, r, logger)
+	if failure != "" {
+		// authenticateRequest already wrote the error response and logged the failure
+		t.metrics.authFailures.Inc(failure)
+		return
+	}
+
+	sub := &tailSubscriber{
+		tenant:  tenant,
+		types:   config.SplitList(r.URL.Query().Get("type")),
+		entries: make(chan TailEntry, tailBufferSize),
+	}
+	if !t.subscribe(sub) {
+		writeJSONErrorDetail(w, http.StatusServiceUnavailable, "too_many_tails",
+			fmt.Sprintf("at most %d tails may be open at once", maxTailSubscribers))
+		return
+	}
+	defer t.unsubscribe(sub)
+
+	// The stream outlives the admin server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("Failed to clear the write deadline of a live tail", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	logger.Info("Live tail opened", "tenant", tenant, "types", strings.Join(sub.types, ","))
+	defer logger.Info("Live tail closed", "tenant", tenant)
+
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.done:
+			return
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case entry := <-sub.entries:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			if err == nil {
+				data, _ := json.Marshal(entry)
+				_, err = fmt.Fprintf(w, "event: entry\ndata: %s\n\n", data)
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+)
+
+// runTestLoki checks the configured Loki URL and credentials before Auth0 traffic arrives
+// It calls the build info endpoint and, with -push, pushes one line to a test stream
+func runTestLoki(args []string) int {
+	push := flag.Bool("push", false, "Also push one test line (stream {service_name=SERVICE_NAME, type=\"test_loki\"})")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout of each check")
+
+	cfg, err := loadConfig(args, requireLoki)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "test-loki: %v\n", err)
+		return 1
+	}
+
+	// Client errors are reported below, keep the client's own logging quiet
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	secrets := cfg.secrets()
+	lokiClient := newLokiClientFromConfig(cfg, NewSecretStore(secrets), logger)
+
+	fmt.Printf("Loki URL:   %s\n", redactedURL(cfg.LokiURL))
+	switch {
+	case cfg.LokiSigV4:
+		fmt.Printf("Auth:       AWS SigV4 (region %s, service %s)\n", cfg.LokiSigV4Region, cfg.LokiSigV4Service)
+	case cfg.LokiOAuth2TokenURL != "":
+		fmt.Printf("Auth:       OAuth2 client credentials (client %s, token URL %s)\n", cfg.LokiOAuth2ClientID, redactedURL(cfg.LokiOAuth2TokenURL))
+	case secrets.LokiUsername != "" && secrets.LokiPassword != "":
+		fmt.Printf("Auth:       basic (user %s)\n", secrets.LokiUsername)
+	default:
+		fmt.Println("Auth:       none")
+	}
+	if cfg.EgressProxy != "" {
+		fmt.Printf("Proxy:      %s\n", redactedURL(cfg.EgressProxy))
+	}
+
+	ok := reportLokiCheck("Build info", *timeout, lokiClient.Probe)
+	if *push {
+		ok = reportLokiCheck("Test push", *timeout, func(ctx context.Context) error {
+			return lokiClient.Push(ctx, testLokiBatch(cfg.ServiceName))
+		}) && ok
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// reportLokiCheck runs one check and prints its result, latency and a hint for common failures
+func reportLokiCheck(name string, timeout time.Duration, check func(ctx context.Context) error) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	if err == nil {
+		fmt.Printf("%-11s OK (%s)\n", name+":", elapsed)
+		return true
+	}
+	fmt.Printf("%-11s FAILED (%s): %v\n", name+":", elapsed, err)
+	if hint := lokiErrorHint(err); hint != "" {
+		fmt.Printf("%-11s %s\n", "", hint)
+	}
+	return false
+}
+
+// lokiErrorHint explains the likely cause of a failed Loki request
+func lokiErrorHint(err error) string {
+	var statusErr *batch.StatusError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return "Authentication rejected: check LOKI_USERNAME and LOKI_PASSWORD, or the LOKI_SIGV4/LOKI_OAUTH2 settings"
+		case http.StatusNotFound:
+			return "Endpoint not found: LOKI_URL should be the base URL, without /loki/api/v1/push"
+		case http.StatusBadRequest:
+			return "Push rejected by Loki: check its limits and the error message"
+		}
+		return ""
+	case errors.As(err, &hostnameErr):
+		return "TLS certificate does not match the host in LOKI_URL"
+	case errors.As(err, &unknownAuthority), errors.As(err, &certErr):
+		return "TLS certificate not trusted: add the CA to the system trust store"
+	case errors.As(err, &recordErr):
+		return "Loki did not answer TLS: use http:// instead of https://"
+	case errors.As(err, &dnsErr):
+		return "Host name could not be resolved"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Timed out: check network access to Loki (and EGRESS_PROXY)"
+	case errors.As(err, &opErr):
+		return "Connection failed: check the host and port in LOKI_URL"
+	}
+	return ""
+}
+
+// testLokiBatch builds the single-line batch pushed by test-loki
+func testLokiBatch(serviceName string) map[string]*Batch {
+	now := time.Now()
+	labels := map[string]string{
+		"service_name": serviceName,
+		"type":         "test_loki",
+	}
+	entry := LogEntry{
+		Timestamp: now.UnixNano(),
+		Labels:    labels,
+		Line:      fmt.Sprintf(`{"message":"a0-logstream2loki connectivity test","date":%q}`, now.UTC().Format(time.RFC3339Nano)),
+	}
+	return map[string]*Batch{
+		batch.LabelKey(labels): {Labels: labels, Entries: []LogEntry{entry}, FirstEntry: now},
+	}
+}
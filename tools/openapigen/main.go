@@ -0,0 +1,213 @@
+// Command openapigen generates Go types from the schemas of an OpenAPI document
+// It supports the subset of JSON Schema the service's API uses: objects, strings
+// (including date-time), integers, numbers, booleans, arrays, string maps and $ref
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// schema is the supported subset of an OpenAPI schema object
+type schema struct {
+	Ref                  string            `json:"$ref"`
+	Type                 string            `json:"type"`
+	Format               string            `json:"format"`
+	Description          string            `json:"description"`
+	Required             []string          `json:"required"`
+	Properties           orderedProperties `json:"properties"`
+	Items                *schema           `json:"items"`
+	AdditionalProperties *schema           `json:"additionalProperties"`
+}
+
+// property is a named schema, kept in document order
+type property struct {
+	Name   string
+	Schema schema
+}
+
+// orderedProperties decodes an object's properties preserving their order
+type orderedProperties []property
+
+func (p *orderedProperties) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var s schema
+		if err := decoder.Decode(&s); err != nil {
+			return err
+		}
+		*p = append(*p, property{Name: token.(string), Schema: s})
+	}
+	return nil
+}
+
+func main() {
+	in := flag.String("in", "openapi.json", "OpenAPI document")
+	out := flag.String("out", "api_types_gen.go", "Generated Go file")
+	pkg := flag.String("package", "main", "Package of the generated file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *in, err)
+	}
+
+	var doc struct {
+		Components struct {
+			Schemas map[string]schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("failed to parse %s: %v", *in, err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by tools/openapigen from %s; DO NOT EDIT.\n\n", *in)
+	fmt.Fprintf(&b, "package %s\n\n", *pkg)
+
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usesTime := false
+	var body bytes.Buffer
+	for _, name := range names {
+		s := doc.Components.Schemas[name]
+		if s.Type != "object" {
+			log.Fatalf("schema %s: only object schemas can be generated", name)
+		}
+		if s.Description != "" {
+			fmt.Fprintf(&body, "// %s\n", s.Description)
+		}
+		fmt.Fprintf(&body, "type %s struct {\n", name)
+
+		required := make(map[string]bool, len(s.Required))
+		for _, r := range s.Required {
+			required[r] = true
+		}
+		for _, prop := range s.Properties {
+			goType, err := goTypeOf(prop.Schema, required[prop.Name])
+			if err != nil {
+				log.Fatalf("schema %s, property %s: %v", name, prop.Name, err)
+			}
+			if strings.Contains(goType, "time.Time") {
+				usesTime = true
+			}
+			tag := prop.Name
+			if !required[prop.Name] {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&body, "\t%s %s `json:\"%s\"`", goName(prop.Name), goType, tag)
+			if prop.Schema.Description != "" {
+				fmt.Fprintf(&body, " // %s", prop.Schema.Description)
+			}
+			body.WriteString("\n")
+		}
+		body.WriteString("}\n\n")
+	}
+
+	if usesTime {
+		b.WriteString("import \"time\"\n\n")
+	}
+	b.Write(body.Bytes())
+
+	formatted, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatalf("failed to format generated code: %v\n%s", err, b.String())
+	}
+	if err := os.WriteFile(*out, formatted, 0o644); err != nil {
+		log.Fatalf("failed to write %s: %v", *out, err)
+	}
+}
+
+// goTypeOf maps a schema to a Go type
+// Optional references and timestamps become pointers so they can be omitted
+func goTypeOf(s schema, required bool) (string, error) {
+	if s.Ref != "" {
+		name := s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+		if required {
+			return name, nil
+		}
+		return "*" + name, nil
+	}
+
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			if required {
+				return "time.Time", nil
+			}
+			return "*time.Time", nil
+		}
+		return "string", nil
+	case "integer":
+		if s.Format == "int32" {
+			return "int32", nil
+		}
+		return "int64", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := goTypeOf(*s.Items, true)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + item, nil
+	case "object":
+		if s.AdditionalProperties == nil || len(s.Properties) > 0 {
+			return "", fmt.Errorf("inline objects are not supported, use a $ref")
+		}
+		value, err := goTypeOf(*s.AdditionalProperties, true)
+		if err != nil {
+			return "", err
+		}
+		return "map[string]" + value, nil
+	default:
+		return "", fmt.Errorf("unsupported type %q", s.Type)
+	}
+}
+
+// initialisms are written in upper case in Go names
+var initialisms = map[string]bool{"id": true, "ip": true, "url": true, "http": true, "json": true, "api": true}
+
+// goName converts a snake_case JSON name to an exported Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		if initialisms[part] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		// Plurals of initialisms, e.g. ids -> IDs
+		if singular, ok := strings.CutSuffix(part, "s"); ok && initialisms[singular] {
+			b.WriteString(strings.ToUpper(singular) + "s")
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// Span kinds and status codes as defined by OTLP
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// Export limits: spans are sent in batches, and dropped when the queue is full
+const (
+	traceQueueSize      = 4096
+	traceExportBatch    = 512
+	traceExportInterval = 5 * time.Second
+	maxSpanLinks        = 128
+)
+
+// SpanContext identifies a span across process and goroutine boundaries
+type SpanContext = batch.SpanContext
+
+// parseTraceparent parses a W3C Trace Context header
+// Returns the remote span context and whether the caller sampled it
+func parseTraceparent(header string) (sc SpanContext, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, false, false
+	}
+	return sc, flags&0x01 == 1, true
+}
+
+// Span is a timed operation exported to an OTLP collector
+// All methods are no-ops on a nil span, which is what an unsampled or disabled tracer returns
+type Span struct {
+	tracer  *Tracer
+	name    string
+	kind    int
+	context SpanContext
+	parent  [8]byte
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]any
+	links      []SpanContext
+	status     int
+	message    string
+}
+
+// Context returns the span's identity for propagation
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, bool, integer or float attribute
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// AddLink links the span to another span, e.g. the requests whose entries a push carries
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.links) < maxSpanLinks {
+		s.links = append(s.links, sc)
+	}
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = spanStatusError
+	s.message = err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// Tracer creates spans and exports them to an OTLP/HTTP endpoint using the JSON encoding
+// A nil tracer creates no spans, so tracing costs nothing when disabled
+type Tracer struct {
+	client      *http.Client
+	endpoint    string // Full traces URL, e.g. http://collector:4318/v1/traces
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	logger      *slog.Logger
+
+	queue chan *Span
+}
+
+// NewTracer creates a tracer exporting to the OTLP/HTTP collector at endpoint
+func NewTracer(endpoint string, headers map[string]string, serviceName string, sampleRatio float64, logger *slog.Logger) *Tracer {
+	return &Tracer{
+		client:      newOutboundClient(10 * time.Second),
+		endpoint:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		headers:     headers,
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		logger:      logger,
+		queue:       make(chan *Span, traceQueueSize),
+	}
+}
+
+// Start starts a span; the parent may be a zero SpanContext to start a new trace
+// Root spans are sampled by ratio, child spans follow their parent
+func (t *Tracer) Start(name string, kind int, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]any),
+	}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		if !t.sampled(span.context.TraceID) {
+			return nil
+		}
+	}
+	rand.Read(span.context.SpanID[:])
+	return span
+}
+
+// StartFromRequest starts a server span continuing the caller's W3C trace context, if any
+func (t *Tracer) StartFromRequest(name string, r *http.Request) *Span {
+	if t == nil {
+		return nil
+	}
+	parent, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if ok && !sampled {
+		return nil
+	}
+	return t.Start(name, spanKindServer, parent)
+}
+
+// StartRequest is StartFromRequest for the ingest handler
+func (t *Tracer) StartRequest(name string, r *http.Request) ingest.Span {
+	return t.StartFromRequest(name, r)
+}
+
+// StartPush starts the client span of a Loki push, for the batchers
+// It is a child of parent, linked to the other spans whose entries the push carries
+func (t *Tracer) StartPush(ctx context.Context, parent SpanContext, links []SpanContext) (context.Context, batch.Span) {
+	span := t.Start("loki.push", spanKindClient, parent)
+	for _, sc := range links {
+		span.AddLink(sc)
+	}
+	return batch.ContextWithTrace(ctx, span.Context()), span
+}
+
+// sampled decides from the trace ID whether a new trace is recorded
+func (t *Tracer) sampled(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/float64(1<<53) < t.sampleRatio
+}
+
+// enqueue hands a finished span to the exporter without blocking
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		t.logger.Debug("Trace export queue full, dropping span", "span", span.name)
+	}
+}
+
+// Run exports queued spans until ctx is canceled, then exports what is left
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var pending []*Span
+	for {
+		select {
+		case span := <-t.queue:
+			pending = append(pending, span)
+			if len(pending) >= traceExportBatch {
+				t.export(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				t.export(pending)
+				pending = nil
+			}
+		case <-ctx.Done():
+			for len(t.queue) > 0 {
+				pending = append(pending, <-t.queue)
+			}
+			if len(pending) > 0 {
+				t.export(pending)
+			}
+			return
+		}
+	}
+}
+
+// export sends one batch of spans to the collector
+func (t *Tracer) export(spans []*Span) {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		t.logger.Warn("Failed to encode trace spans", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.logger.Warn("Failed to create trace export request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.logger.Warn("Failed to export trace spans", "spans", len(spans), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		t.logger.Warn("Trace collector rejected spans",
+			"spans", len(spans),
+			"status", resp.StatusCode,
+			"body", string(respBody),
+		)
+	}
+}
+
+// OTLP/HTTP JSON payload types (opentelemetry-proto, JSON mapping)
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// encode converts spans to an OTLP export request
+func (t *Tracer) encode(spans []*Span) otlpTraceRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, link := range s.links {
+			span.Links = append(span.Links, otlpLink{
+				TraceID: hex.EncodeToString(link.TraceID[:]),
+				SpanID:  hex.EncodeToString(link.SpanID[:]),
+			})
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]any{"service.name": t.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "a0-logstream2loki"}, Spans: encoded}},
+	}}}
+}
+
+// otlpAttributes converts attributes to OTLP key/values
+func otlpAttributes(attributes map[string]any) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		var v otlpAnyValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: v})
+	}
+	return kvs
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS (comma-separated key=value pairs)
+func parseOTLPHeaders(entries []string) map[string]string {
+	headers := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return headers
+}
@@ -1,38 +1,29 @@
 package main
 
-import "time"
+import (
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/sink/loki"
+
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// Ingestion sources; each becomes the value of the "source" stream label
+const (
+	sourceAuth0 = ingest.SourceAuth0
+	sourceOkta  = "okta"
+
+	// sourceCanary marks the synthetic entries of the end-to-end canary
+	sourceCanary = "canary"
+)
 
 // LogEntry represents a single log line to be sent to Loki
-type LogEntry struct {
-	Timestamp int64             // Unix nanoseconds
-	Labels    map[string]string // Stream labels (type, environment_name, tenant_name)
-	Line      string            // Original JSON line
-}
-
-// Auth0LogData represents the structure of incoming Auth0 log events
-type Auth0LogData struct {
-	Data struct {
-		Date            string `json:"date"`
-		Type            string `json:"type"`
-		EnvironmentName string `json:"environment_name"`
-		TenantName      string `json:"tenant_name"`
-	} `json:"data"`
-}
+type LogEntry = batch.Entry
 
 // LokiStream represents a single stream in the Loki push request
-type LokiStream struct {
-	Stream map[string]string `json:"stream"`
-	Values [][]string        `json:"values"` // [timestamp_ns, line]
-}
+type LokiStream = loki.Stream
 
 // LokiPushRequest represents the Loki /loki/api/v1/push request payload
-type LokiPushRequest struct {
-	Streams []LokiStream `json:"streams"`
-}
+type LokiPushRequest = loki.PushRequest
 
 // Batch accumulates log entries for a single label set
-type Batch struct {
-	Labels     map[string]string
-	Entries    []LogEntry
-	FirstEntry time.Time // Track when first entry was added for timeout
-}
+type Batch = batch.Batch
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.buildDate=2025-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo returns the build information, falling back to the VCS stamp Go embeds
+// when the binary was built from a git checkout without ldflags
+func buildInfo() HealthResponse {
+	info := HealthResponse{
+		Status:    "ok",
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// runVersion prints the build information
+func runVersion(args []string) int {
+	info := buildInfo()
+	fmt.Printf("a0-logstream2loki %s (commit %s, built %s, %s)\n", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+	return 0
+}
+
+// registerBuildInfo exposes the build information as a constant gauge
+func registerBuildInfo(r *Registry) {
+	info := buildInfo()
+	r.NewGauge("build_info", "Build information of the running binary, always 1", "version", "commit", "build_date", "go_version").
+		Set(1, info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
+
+// serveHealth reports liveness along with the build information
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
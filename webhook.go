@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amba/a0-logstream2loki/pkg/batch"
+	"github.com/amba/a0-logstream2loki/pkg/ingest"
+)
+
+// Timestamp formats of a webhook endpoint; any other value is a Go time layout
+const (
+	timestampRFC3339 = "rfc3339"
+	timestampUnix    = "unix"
+	timestampUnixMs  = "unix_ms"
+	timestampUnixNs  = "unix_ns"
+)
+
+// webhookNamePattern restricts endpoint names, which become URL paths and source labels
+var webhookNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// labelNamePattern is Loki's label name syntax
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// WebhookEndpoint maps the JSON events of one webhook source to Loki entries
+// Paths are dot-separated keys into the event; array elements are addressed by index
+type WebhookEndpoint struct {
+	Name            string            `json:"name"`             // Served on /webhooks/{name} and set as the source label
+	TimestampPath   string            `json:"timestamp_path"`   // Event time (empty uses the time of receipt)
+	TimestampFormat string            `json:"timestamp_format"` // rfc3339 (default), unix, unix_ms, unix_ns or a Go layout
+	Labels          map[string]string `json:"labels"`           // Label name to path
+	TenantPath      string            `json:"tenant_path"`      // tenant_name label (empty uses the authenticated tenant)
+	LogIDPath       string            `json:"log_id_path"`      // Event ID for delivery lookups (optional)
+}
+
+// WebhookEndpoints maps endpoint names to their mappings
+type WebhookEndpoints map[string]*WebhookEndpoint
+
+// webhookConfig is the file configured by WEBHOOKS_FILE
+type webhookConfig struct {
+	Endpoints []WebhookEndpoint `json:"endpoints"`
+}
+
+// LoadWebhookEndpoints reads and validates the endpoint mappings of a webhooks file
+func LoadWebhookEndpoints(path string) (WebhookEndpoints, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks file: %w", err)
+	}
+	var cfg webhookConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks file: %w", err)
+	}
+
+	endpoints := make(WebhookEndpoints, len(cfg.Endpoints))
+	for i := range cfg.Endpoints {
+		endpoint := &cfg.Endpoints[i]
+		if err := endpoint.validate(); err != nil {
+			return nil, fmt.Errorf("webhook %q: %w", endpoint.Name, err)
+		}
+		if _, exists := endpoints[endpoint.Name]; exists {
+			return nil, fmt.Errorf("webhook %q is defined twice", endpoint.Name)
+		}
+		endpoints[endpoint.Name] = endpoint
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("webhooks file defines no endpoints")
+	}
+	return endpoints, nil
+}
+
+// validate checks the endpoint's name, labels and timestamp format
+func (e *WebhookEndpoint) validate() error {
+	if !webhookNamePattern.MatchString(e.Name) {
+		return fmt.Errorf("name must be lowercase letters, digits, '-' or '_'")
+	}
+	if e.Name == sourceAuth0 || e.Name == sourceOkta || e.Name == sourceCanary {
+		return fmt.Errorf("name is reserved for a built-in source")
+	}
+	for label, path := range e.Labels {
+		if !labelNamePattern.MatchString(label) {
+			return fmt.Errorf("invalid label name %q", label)
+		}
+		if label == batch.SourceLabel || label == "service_name" || label == "tenant_name" {
+			return fmt.Errorf("label %q is set by the service", label)
+		}
+		if path == "" {
+			return fmt.Errorf("label %q has no path", label)
+		}
+	}
+	if e.TimestampFormat == "" {
+		e.TimestampFormat = timestampRFC3339
+	}
+	return nil
+}
+
+// parse maps one event to an entry
+func (e *WebhookEndpoint) parse(raw []byte, tenant, serviceName string, canonical bool) (LogEntry, error) {
+	var event any
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return LogEntry{}, err
+	}
+	if _, ok := event.(map[string]any); !ok {
+		return LogEntry{}, fmt.Errorf("event is not a JSON object")
+	}
+
+	timestamp := time.Now()
+	if e.TimestampPath != "" {
+		value, ok := lookupPath(event, e.TimestampPath)
+		if !ok {
+			return LogEntry{}, fmt.Errorf("no timestamp at %q", e.TimestampPath)
+		}
+		var err error
+		if timestamp, err = parseTimestamp(value, e.TimestampFormat); err != nil {
+			return LogEntry{}, fmt.Errorf("invalid timestamp at %q: %w", e.TimestampPath, err)
+		}
+	}
+
+	labels := map[string]string{
+		"service_name": serviceName,
+		"tenant_name":  tenant,
+	}
+	for label, path := range e.Labels {
+		if value, ok := lookupPath(event, path); ok {
+			labels[label] = value
+		}
+	}
+	if e.TenantPath != "" {
+		value, ok := lookupPath(event, e.TenantPath)
+		if !ok || value == "" {
+			return LogEntry{}, fmt.Errorf("no tenant at %q", e.TenantPath)
+		}
+		labels["tenant_name"] = value
+	}
+
+	var logID string
+	if e.LogIDPath != "" {
+		logID, _ = lookupPath(event, e.LogIDPath)
+	}
+
+	line := string(raw)
+	if canonical {
+		var err error
+		if line, err = ingest.CanonicalizeJSON(line); err != nil {
+			return LogEntry{}, err
+		}
+	}
+
+	return LogEntry{
+		Timestamp: timestamp.UnixNano(),
+		Labels:    labels,
+		Line:      line,
+		Source:    e.Name,
+		LogID:     logID,
+	}, nil
+}
+
+// lookupPath returns the value at a dot-separated path as a string
+// Numbers and booleans are returned as their JSON text; objects, arrays and null are not found
+func lookupPath(event any, path string) (string, bool) {
+	value := event
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = node[key]; !ok {
+				return "", false
+			}
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			value = node[index]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// parseTimestamp parses an event time in the endpoint's format
+func parseTimestamp(value, format string) (time.Time, error) {
+	switch format {
+	case timestampRFC3339:
+		return time.Parse(time.RFC3339Nano, value)
+	case timestampUnixNs:
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, nanos), nil
+	case timestampUnix, timestampUnixMs:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		unit := time.Second
+		if format == timestampUnixMs {
+			unit = time.Millisecond
+		}
+		return time.Unix(0, int64(number*float64(unit))), nil
+	default:
+		return time.Parse(format, value)
+	}
+}
+
+// WebhookHandler receives events from generic JSON webhook sources on /webhooks/{name}
+// Deliveries are authenticated and read like /logs; each endpoint's mapping builds the entries
+type WebhookHandler struct {
+	logs      *LogsHandler
+	endpoints map[string]*WebhookEndpoint
+	logger    *slog.Logger
+}
+
+// NewWebhookHandler creates the handler for the configured endpoints
+func NewWebhookHandler(logs *LogsHandler, endpoints map[string]*WebhookEndpoint, logger *slog.Logger) *WebhookHandler {
+	return &WebhookHandler{logs: logs, endpoints: endpoints, logger: logger}
+}
+
+// ServeHTTP ingests a delivery to one endpoint
+func (wh *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r, wh.logger)
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	endpoint, ok := wh.endpoints[r.PathValue("name")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown_webhook")
+		return
+	}
+
+	logger = logger.With("webhook", endpoint.Name)
+	canonical := wh.logs.canonicalJSON
+	serviceName := wh.logs.serviceName
+	wh.logs.ingest(w, r, "POST /webhooks/"+endpoint.Name, endpoint.Name, endpoint.Name+" event",
+		func(line []byte, tenant string) (LogEntry, error) {
+			return endpoint.parse(line, tenant, serviceName, canonical)
+		}, logger)
+}